@@ -0,0 +1,185 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the max number of the recent build failures of the admin dashboard
+const recentFailuresSize = 50
+
+// recentFailure is a build failure that is listed in the admin dashboard.
+type recentFailure struct {
+	ID       string    `json:"id"`
+	Pkg      string    `json:"pkg"`
+	Target   string    `json:"target"`
+	Error    string    `json:"error"`
+	Log      []string  `json:"log,omitempty"`
+	Limit    string    `json:"limit,omitempty"`
+	Duration int64     `json:"duration"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// the recent build failures of this server, newest last
+var recentFailures struct {
+	lock sync.Mutex
+	list []recentFailure
+}
+
+// recordRecentFailure keeps the failure of the build task for the admin dashboard.
+func recordRecentFailure(t *queueTask, err error) {
+	f := recentFailure{
+		ID:       t.ID(),
+		Pkg:      t.Pkg.String(),
+		Target:   t.Target,
+		Error:    redact(err.Error()),
+		Log:      redactLines(getBuildLog(err)),
+		Limit:    getBuildLimit(err),
+		Duration: time.Since(t.startedAt).Milliseconds(),
+		FailedAt: time.Now(),
+	}
+	recentFailures.lock.Lock()
+	defer recentFailures.lock.Unlock()
+	if len(recentFailures.list) >= recentFailuresSize {
+		recentFailures.list = append(recentFailures.list[:0], recentFailures.list[1:]...)
+	}
+	recentFailures.list = append(recentFailures.list, f)
+}
+
+func getRecentFailures() []recentFailure {
+	recentFailures.lock.Lock()
+	defer recentFailures.lock.Unlock()
+	list := make([]recentFailure, len(recentFailures.list))
+	for i, f := range recentFailures.list {
+		list[len(list)-1-i] = f
+	}
+	return list
+}
+
+// the max number of the packages that are counted by the `hotPackages`
+const hotPackagesSize = 10000
+
+// hotPackages counts the module requests by the package name, the counts are halved hourly so
+// the recent requests weigh more.
+var hotPackages = &packageCounter{counts: map[string]uint64{}, decayedAt: time.Now()}
+
+type packageCounter struct {
+	lock      sync.Mutex
+	counts    map[string]uint64
+	decayedAt time.Time
+}
+
+// Inc counts a request of the package.
+func (c *packageCounter) Inc(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.decayedAt) > time.Hour || len(c.counts) >= hotPackagesSize {
+		c.decay()
+	}
+	c.counts[name]++
+}
+
+// decay halves the counts and drops the packages that are not requested recently.
+func (c *packageCounter) decay() {
+	for name, n := range c.counts {
+		if n /= 2; n == 0 {
+			delete(c.counts, name)
+		} else {
+			c.counts[name] = n
+		}
+	}
+	c.decayedAt = time.Now()
+}
+
+// Top returns the `n` most requested packages.
+func (c *packageCounter) Top(n int) []map[string]interface{} {
+	type entry struct {
+		name  string
+		count uint64
+	}
+	c.lock.Lock()
+	entries := make([]entry, 0, len(c.counts))
+	for name, count := range c.counts {
+		entries = append(entries, entry{name, count})
+	}
+	c.lock.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].count == entries[j].count {
+			return entries[i].name < entries[j].name
+		}
+		return entries[i].count > entries[j].count
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	list := make([]map[string]interface{}, len(entries))
+	for i, e := range entries {
+		list[i] = map[string]interface{}{"name": e.name, "requests": e.count}
+	}
+	return list
+}
+
+// getAdminStatus returns the status of the admin dashboard: the running and the queued builds,
+// the recent failures, the storage usage, the cache stats and the hot packages.
+func getAdminStatus(startTime time.Time) map[string]interface{} {
+	running := []map[string]interface{}{}
+	queued := []map[string]interface{}{}
+	buildQueue.lock.RLock()
+	for el := buildQueue.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if !ok {
+			continue
+		}
+		m := map[string]interface{}{
+			"id":        t.ID(),
+			"pkg":       t.Pkg.String(),
+			"target":    t.Target,
+			"stage":     t.stage,
+			"consumers": len(t.consumers),
+			"createdAt": t.createdAt.Format(http.TimeFormat),
+		}
+		if t.inProcess {
+			m["startedAt"] = t.startedAt.Format(http.TimeFormat)
+			m["elapsed"] = time.Since(t.startedAt).Milliseconds()
+			running = append(running, m)
+		} else {
+			m["waiting"] = time.Since(t.createdAt).Milliseconds()
+			queued = append(queued, m)
+		}
+	}
+	buildQueue.lock.RUnlock()
+
+	caches := map[string]interface{}{
+		"ua":           uaTargetCache.Stats(),
+		"client-hints": clientHintsTargetCache.Stats(),
+	}
+	for _, tier := range []string{"builds", "npm", "npm-packument"} {
+		caches[tier] = map[string]interface{}{
+			"hits":   cacheRequests.Get(tier, "hit"),
+			"misses": cacheRequests.Get(tier, "miss"),
+		}
+	}
+	storageUsage := map[string]interface{}{}
+	if storageQuota != nil {
+		storageUsage["quota"] = storageQuota.Stats()
+	}
+	if hotCache != nil {
+		size, hits, misses := hotCache.Stats()
+		storageUsage["hotCache"] = map[string]interface{}{"size": size, "maxSize": cfg.HotCacheSize}
+		caches["hot"] = map[string]interface{}{"hits": hits, "misses": misses}
+	}
+
+	return map[string]interface{}{
+		"version":        VERSION,
+		"uptime":         time.Since(startTime).String(),
+		"maxProcesses":   buildQueue.maxProcesses,
+		"running":        running,
+		"queued":         queued,
+		"recentFailures": getRecentFailures(),
+		"storage":        storageUsage,
+		"caches":         caches,
+		"hotPackages":    hotPackages.Top(20),
+	}
+}
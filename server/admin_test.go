@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPackageCounter(t *testing.T) {
+	c := &packageCounter{counts: map[string]uint64{}, decayedAt: time.Now()}
+	for i := 0; i < 3; i++ {
+		c.Inc("react")
+	}
+	c.Inc("vue")
+	c.Inc("preact")
+	top := c.Top(2)
+	if len(top) != 2 || top[0]["name"] != "react" || top[0]["requests"] != uint64(3) || top[1]["name"] != "preact" {
+		t.Fatalf("unexpected top packages: %v", top)
+	}
+
+	// the counts are halved hourly
+	c.decayedAt = time.Now().Add(-2 * time.Hour)
+	c.Inc("svelte")
+	top = c.Top(10)
+	if len(top) != 2 || top[0]["name"] != "react" || top[0]["requests"] != uint64(1) || top[1]["name"] != "svelte" {
+		t.Fatalf("unexpected top packages: %v", top)
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	defer func(prev *BuildQueue) {
+		buildQueue = prev
+		recentFailures.list = nil
+	}(buildQueue)
+	buildQueue = newBuildQueue(1)
+
+	running := &queueTask{BuildTask: &BuildTask{id: "v135/react@18.3.1/es2022/react.mjs", Pkg: Pkg{Name: "react", Version: "18.3.1"}, Target: "es2022"}, inProcess: true, startedAt: time.Now(), createdAt: time.Now()}
+	queued := &queueTask{BuildTask: &BuildTask{id: "v135/vue@3.4.0/es2022/vue.mjs", Pkg: Pkg{Name: "vue", Version: "3.4.0"}, Target: "es2022"}, createdAt: time.Now()}
+	for _, task := range []*queueTask{running, queued} {
+		task.el = buildQueue.list.PushBack(task)
+		buildQueue.tasks[task.ID()] = task
+	}
+
+	for i := 0; i < recentFailuresSize+1; i++ {
+		recordRecentFailure(queued, errors.New("build failed"))
+	}
+	recordRecentFailure(running, errors.New("install failed"))
+
+	status := getAdminStatus(time.Now())
+	if list := status["running"].([]map[string]interface{}); len(list) != 1 || list[0]["id"] != running.ID() {
+		t.Fatalf("unexpected running builds: %v", list)
+	}
+	if list := status["queued"].([]map[string]interface{}); len(list) != 1 || list[0]["id"] != queued.ID() {
+		t.Fatalf("unexpected queued builds: %v", list)
+	}
+	failures := status["recentFailures"].([]recentFailure)
+	if len(failures) != recentFailuresSize {
+		t.Fatalf("expected %d failures, got %d", recentFailuresSize, len(failures))
+	}
+	if f := failures[0]; f.ID != running.ID() || f.Pkg != "react@18.3.1" || f.Error != "install failed" {
+		t.Fatalf("the newest failure should be listed first: %+v", f)
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/ije/gox/utils"
+)
+
+// Advisory is a security advisory of a package version.
+type Advisory struct {
+	ID       string `json:"id"`
+	Summary  string `json:"summary,omitempty"`
+	Severity string `json:"severity,omitempty"`
+}
+
+// IsMalicious returns true if the advisory reports a malicious package.
+func (a *Advisory) IsMalicious() bool {
+	return strings.HasPrefix(a.ID, "MAL-")
+}
+
+// osvVuln is the OSV record, see https://ossf.github.io/osv-schema/
+type osvVuln struct {
+	ID               string `json:"id"`
+	Summary          string `json:"summary"`
+	Withdrawn        string `json:"withdrawn"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+	Affected []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string              `json:"type"`
+			Events []map[string]string `json:"events"`
+		} `json:"ranges"`
+		Versions []string `json:"versions"`
+	} `json:"affected"`
+}
+
+func (v *osvVuln) advisory() Advisory {
+	return Advisory{ID: v.ID, Summary: v.Summary, Severity: strings.ToLower(v.DatabaseSpecific.Severity)}
+}
+
+// affects checks whether the npm package version is affected by the vulnerability.
+func (v *osvVuln) affects(name string, version string) bool {
+	if v.Withdrawn != "" {
+		return false
+	}
+	ver, err := semver.NewVersion(version)
+	if err != nil {
+		return false
+	}
+	for _, a := range v.Affected {
+		if a.Package.Ecosystem != "npm" || a.Package.Name != name {
+			continue
+		}
+		for _, affected := range a.Versions {
+			if affected == version {
+				return true
+			}
+		}
+		for _, r := range a.Ranges {
+			if r.Type != "SEMVER" {
+				continue
+			}
+			var introduced *semver.Version
+			for _, event := range r.Events {
+				if s, ok := event["introduced"]; ok {
+					introduced, _ = semver.NewVersion(s)
+					if s == "0" {
+						introduced = semver.MustParse("0.0.0-0")
+					}
+					continue
+				}
+				if introduced == nil || ver.LessThan(introduced) {
+					continue
+				}
+				if s, ok := event["fixed"]; ok {
+					if fixed, err := semver.NewVersion(s); err == nil && ver.LessThan(fixed) {
+						return true
+					}
+					introduced = nil
+				} else if s, ok := event["last_affected"]; ok {
+					if last, err := semver.NewVersion(s); err == nil && !ver.GreaterThan(last) {
+						return true
+					}
+					introduced = nil
+				}
+			}
+			if introduced != nil && !ver.LessThan(introduced) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the advisories of the mirror directory, mapped by the package name
+var advisoryMirror struct {
+	once  sync.Once
+	vulns map[string][]*osvVuln
+}
+
+// loadAdvisoryMirror loads the OSV JSON files of the mirror directory, e.g. the extracted
+// https://osv-vulnerabilities.storage.googleapis.com/npm/all.zip
+func loadAdvisoryMirror(dir string) map[string][]*osvVuln {
+	advisoryMirror.once.Do(func() {
+		vulns := map[string][]*osvVuln{}
+		count := 0
+		err := filepath.Walk(dir, func(filename string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() || !strings.HasSuffix(filename, ".json") {
+				return err
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			var v osvVuln
+			if json.Unmarshal(data, &v) != nil || v.ID == "" {
+				return nil
+			}
+			names := map[string]struct{}{}
+			for _, a := range v.Affected {
+				if a.Package.Ecosystem == "npm" {
+					names[a.Package.Name] = struct{}{}
+				}
+			}
+			for name := range names {
+				vulns[name] = append(vulns[name], &v)
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			log.Component("npm").Errorf("failed to load the advisories mirror: %v", err)
+		} else {
+			log.Component("npm").Infof("loaded %d advisories from %s", count, dir)
+		}
+		advisoryMirror.vulns = vulns
+	})
+	return advisoryMirror.vulns
+}
+
+// queryOSV queries the advisories of the npm package version with the OSV API.
+func queryOSV(api string, name string, version string) (advisories []Advisory, err error) {
+	body, _ := json.Marshal(map[string]any{
+		"package": map[string]string{"ecosystem": "npm", "name": name},
+		"version": version,
+	})
+	client := withClientTimeout(httpClient, time.Duration(cfg.Advisories.Timeout)*time.Second)
+	res, err := client.Post(api, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	var ret struct {
+		Vulns []osvVuln `json:"vulns"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&ret)
+	if err != nil {
+		return
+	}
+	advisories = make([]Advisory, 0, len(ret.Vulns))
+	for _, v := range ret.Vulns {
+		if v.Withdrawn == "" {
+			advisories = append(advisories, v.advisory())
+		}
+	}
+	return
+}
+
+// getAdvisories returns the advisories of the npm package version, the results are cached for the
+// `cacheTTL` of the `advisories` config.
+func getAdvisories(name string, version string) (advisories []Advisory, err error) {
+	if _, err := semver.NewVersion(version); err != nil {
+		return nil, errors.New("invalid version " + version)
+	}
+	if mirror := cfg.Advisories.Mirror; mirror != "" {
+		for _, v := range loadAdvisoryMirror(mirror)[name] {
+			if v.affects(name, version) {
+				advisories = append(advisories, v.advisory())
+			}
+		}
+		sortAdvisories(advisories)
+		return
+	}
+
+	cacheKey := "advisories:" + name + "@" + version
+	if data, err := cache.Get(cacheKey); err == nil && json.Unmarshal(data, &advisories) == nil {
+		return advisories, nil
+	}
+	advisories, err = queryOSV(cfg.Advisories.API, name, version)
+	if err != nil {
+		return
+	}
+	sortAdvisories(advisories)
+	cache.Set(cacheKey, utils.MustEncodeJSON(advisories), time.Duration(cfg.Advisories.CacheTTL)*time.Second)
+	return
+}
+
+func sortAdvisories(advisories []Advisory) {
+	sort.Slice(advisories, func(i, j int) bool {
+		return advisories[i].ID < advisories[j].ID
+	})
+}
+
+// checkAdvisories checks the package version against the advisories, returns a policy violation
+// if the package should be blocked. The check is skipped (with an error log) if the advisories
+// are not available.
+func checkAdvisories(name string, version string) (advisories []Advisory, violation *PolicyViolation) {
+	if cfg.Advisories.Action == "" {
+		return
+	}
+	advisories, err := getAdvisories(name, version)
+	if err != nil {
+		log.Component("npm").Errorf("failed to check the advisories of %s@%s: %v", name, version, err)
+		return
+	}
+	if len(advisories) == 0 {
+		return
+	}
+	block := cfg.Advisories.Action == "block"
+	if !block && cfg.Advisories.BlockMalicious {
+		for _, a := range advisories {
+			if a.IsMalicious() {
+				block = true
+				break
+			}
+		}
+	}
+	if block {
+		violation = &PolicyViolation{
+			Package: name,
+			Version: version,
+			Policy:  "advisories",
+			Reason:  "the version has known advisories: " + advisoriesString(advisories),
+		}
+	}
+	return
+}
+
+// advisoriesString returns the advisory IDs with the severities, e.g. "GHSA-xxxx-xxxx-xxxx (high), MAL-2024-1".
+func advisoriesString(advisories []Advisory) string {
+	ids := make([]string, len(advisories))
+	for i, a := range advisories {
+		ids[i] = a.ID
+		if a.Severity != "" {
+			ids[i] += " (" + a.Severity + ")"
+		}
+	}
+	return strings.Join(ids, ", ")
+}
+
+// logAdvisories notes the advisories of the package version in the build log.
+func logAdvisories(buildId string, name string, version string) {
+	if cfg.Advisories.Action == "" {
+		return
+	}
+	if advisories, err := getAdvisories(name, version); err == nil && len(advisories) > 0 {
+		log.Component("npm").With("buildKey", buildId).Warnf("%s@%s has known advisories: %s", name, version, advisoriesString(advisories))
+	}
+}
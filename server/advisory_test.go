@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestAdvisoriesAPI(t *testing.T) {
+	defer func(prevCfg *config.Config, prevCache storage.Cache) {
+		cfg = prevCfg
+		cache = prevCache
+	}(cfg, cache)
+
+	var err error
+	cache, err = storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := 0
+	osv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var q struct {
+			Package struct {
+				Ecosystem string `json:"ecosystem"`
+				Name      string `json:"name"`
+			} `json:"package"`
+			Version string `json:"version"`
+		}
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&q) != nil || q.Package.Ecosystem != "npm" {
+			w.WriteHeader(400)
+			return
+		}
+		queries++
+		switch q.Package.Name + "@" + q.Version {
+		case "lodash@4.17.20":
+			w.Write([]byte(`{"vulns":[{"id":"GHSA-35jh-r3h4-6jhm","summary":"Command Injection in lodash","database_specific":{"severity":"HIGH"}}]}`))
+		case "evil-pkg@1.0.0":
+			w.Write([]byte(`{"vulns":[{"id":"MAL-2024-1234","summary":"Malicious code in evil-pkg (npm)"}]}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer osv.Close()
+
+	cfg = &config.Config{Advisories: config.Advisories{Action: "warn", API: osv.URL, BlockMalicious: true, CacheTTL: 60, Timeout: 5}}
+
+	advisories, v := checkAdvisories("lodash", "4.17.20")
+	if v != nil || len(advisories) != 1 || advisoriesString(advisories) != "GHSA-35jh-r3h4-6jhm (high)" {
+		t.Fatalf("unexpected advisories: %v %v", advisories, v)
+	}
+	advisories, _ = checkAdvisories("lodash", "4.17.20")
+	if len(advisories) != 1 || queries != 1 {
+		t.Fatalf("the result should be cached, queries: %d", queries)
+	}
+	if advisories, v = checkAdvisories("lodash", "4.17.21"); v != nil || len(advisories) != 0 {
+		t.Fatalf("unexpected advisories: %v %v", advisories, v)
+	}
+	if _, v = checkAdvisories("evil-pkg", "1.0.0"); v == nil || v.Policy != "advisories" {
+		t.Fatal("the malicious package should be blocked")
+	}
+
+	cfg.Advisories.Action = "block"
+	if _, v = checkAdvisories("lodash", "4.17.20"); v == nil {
+		t.Fatal("the package with advisories should be blocked")
+	}
+
+	// the check is skipped if the API is unavailable
+	cfg.Advisories.API = osv.URL + "/404"
+	if advisories, v = checkAdvisories("react", "18.3.1"); v != nil || len(advisories) != 0 {
+		t.Fatalf("unexpected advisories: %v %v", advisories, v)
+	}
+}
+
+func TestAdvisoriesMirror(t *testing.T) {
+	defer func(prev *config.Config) {
+		cfg = prev
+	}(cfg)
+
+	dir := t.TempDir()
+	for filename, data := range map[string]string{
+		"GHSA-35jh-r3h4-6jhm.json": `{"id":"GHSA-35jh-r3h4-6jhm","database_specific":{"severity":"HIGH"},"affected":[{"package":{"ecosystem":"npm","name":"lodash"},"ranges":[{"type":"SEMVER","events":[{"introduced":"0"},{"fixed":"4.17.21"}]}]}]}`,
+		"GHSA-x5rq-j2xg-h7qm.json": `{"id":"GHSA-x5rq-j2xg-h7qm","affected":[{"package":{"ecosystem":"npm","name":"minimist"},"ranges":[{"type":"SEMVER","events":[{"introduced":"1.0.0"},{"last_affected":"1.2.5"}]}]}]}`,
+		"MAL-2024-1234.json":       `{"id":"MAL-2024-1234","affected":[{"package":{"ecosystem":"npm","name":"evil-pkg"},"versions":["1.0.0"]}]}`,
+		"GHSA-withdrawn.json":      `{"id":"GHSA-withdrawn","withdrawn":"2024-01-01T00:00:00Z","affected":[{"package":{"ecosystem":"npm","name":"react"},"ranges":[{"type":"SEMVER","events":[{"introduced":"0"}]}]}]}`,
+	} {
+		if err := os.WriteFile(path.Join(dir, filename), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg = &config.Config{Advisories: config.Advisories{Action: "block", Mirror: dir}}
+	for pkg, expected := range map[string]string{
+		"lodash@4.17.20": "GHSA-35jh-r3h4-6jhm (high)",
+		"lodash@4.17.21": "",
+		"minimist@0.2.4": "",
+		"minimist@1.2.5": "GHSA-x5rq-j2xg-h7qm",
+		"minimist@1.2.6": "",
+		"evil-pkg@1.0.0": "MAL-2024-1234",
+		"evil-pkg@1.0.1": "",
+		"react@18.3.1":   "",
+	} {
+		name, version, _ := strings.Cut(pkg, "@")
+		advisories, v := checkAdvisories(name, version)
+		if advisoriesString(advisories) != expected {
+			t.Fatalf("%s: unexpected advisories %q", pkg, advisoriesString(advisories))
+		}
+		if (v != nil) != (expected != "") {
+			t.Fatalf("%s: unexpected violation: %v", pkg, v)
+		}
+	}
+}
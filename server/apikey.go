@@ -0,0 +1,280 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+// the prefix of the records of the API keys in the database
+const apiKeyRecordPrefix = "apikey:"
+
+// apiKeyRecord is the record of an API key, the key itself is never stored but its SHA-256 hash.
+type apiKeyRecord struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Hash      string `json:"hash,omitempty"`
+	Source    string `json:"source,omitempty"`
+	CreatedAt int64  `json:"createdAt,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	// Scopes are the package name patterns that the key can access, e.g. "@myco/*", the key can
+	// access all packages if it's empty.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+func (rec *apiKeyRecord) expired(now time.Time) bool {
+	return rec.ExpiresAt > 0 && now.Unix() >= rec.ExpiresAt
+}
+
+// allows checks whether the key can access the package by the scopes.
+func (rec *apiKeyRecord) allows(pkgName string) bool {
+	if len(rec.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range rec.Scopes {
+		if scope == pkgName {
+			return true
+		}
+		if ok, _ := path.Match(scope, pkgName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAPIKeyScope returns a 403 response if the API key of the request is not allowed to access
+// the package by the scopes, otherwise nil.
+func checkAPIKeyScope(ctx *rex.Context, pkgName string) interface{} {
+	if rec := getAPIKeyRecord(ctx); rec != nil && !rec.allows(pkgName) && !isAdminRequest(ctx) {
+		return throwError(ctx, 403, errForbidden, fmt.Sprintf("the api key is not allowed to access %s", pkgName))
+	}
+	return nil
+}
+
+// parseAPIKeyScopes parses the comma-separated scopes, e.g. "@myco/*,react".
+func parseAPIKeyScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if _, err := path.Match(scope, ""); err != nil {
+			return nil, fmt.Errorf("invalid scope %q", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// hashAPIKey returns the id (the first 16 hex digits of the hash) and the hash of the API key.
+func hashAPIKey(key string) (id string, hash string) {
+	sum := sha256.Sum256([]byte(key))
+	hash = hex.EncodeToString(sum[:])
+	return hash[:16], hash
+}
+
+// lookupAPIKey finds the API key by the id in the config and the database.
+func lookupAPIKey(id string) (*apiKeyRecord, error) {
+	if cfg.AuthSecret != "" {
+		if secretId, hash := hashAPIKey(cfg.AuthSecret); secretId == id {
+			return &apiKeyRecord{ID: id, Name: "authSecret", Hash: hash, Source: "config"}, nil
+		}
+	}
+	for _, k := range cfg.APIKeys {
+		if keyId, hash := hashAPIKey(k.Key); keyId == id {
+			return &apiKeyRecord{ID: id, Name: k.Name, Hash: hash, Source: "config", Scopes: k.Scopes}, nil
+		}
+	}
+	if db == nil {
+		return nil, nil
+	}
+	value, err := db.Get(apiKeyRecordPrefix + id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var rec apiKeyRecord
+	if err = json.Unmarshal(value, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// verifyAPIKey returns the record of the API key if it's valid.
+func verifyAPIKey(key string) *apiKeyRecord {
+	if key == "" {
+		return nil
+	}
+	id, hash := hashAPIKey(key)
+	rec, err := lookupAPIKey(id)
+	if err != nil || rec == nil || rec.expired(time.Now()) {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(rec.Hash), []byte(hash)) != 1 {
+		return nil
+	}
+	return rec
+}
+
+// signAPIToken returns a token of the API key that expires at the `expiresAt` time. The token is
+// `<id>.<expiresAt>.<signature>`, the signature is the base64url-encoded HMAC-SHA256 of
+// `<id>.<expiresAt>` with the token secret of the key, see `getAPITokenSecret`.
+func signAPIToken(rec *apiKeyRecord, expiresAt int64) string {
+	payload := rec.ID + "." + strconv.FormatInt(expiresAt, 10)
+	return payload + "." + getAPITokenSignature(rec, payload)
+}
+
+func getAPITokenSignature(rec *apiKeyRecord, payload string) string {
+	mac := hmac.New(sha256.New, getAPITokenSecret(rec.ID))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var randomTokenSecret []byte
+var randomTokenSecretOnce sync.Once
+
+// getAPITokenSecret returns the secret that signs the tokens of the API key, it's the HMAC-SHA256 of
+// the key id with the server-side secret: the `tokenSecret` config, or the `authSecret` config, or
+// a random secret of the process. The stored records of the keys can't forge the tokens.
+func getAPITokenSecret(id string) []byte {
+	secret := []byte(cfg.TokenSecret)
+	if len(secret) == 0 {
+		secret = []byte(cfg.AuthSecret)
+	}
+	if len(secret) == 0 {
+		randomTokenSecretOnce.Do(func() {
+			randomTokenSecret = make([]byte, 32)
+			rand.Read(randomTokenSecret)
+		})
+		secret = randomTokenSecret
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("token:" + id))
+	return mac.Sum(nil)
+}
+
+// verifyAPIToken returns the record of the API key that signs the token if the token is valid.
+func verifyAPIToken(token string) *apiKeyRecord {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	now := time.Now()
+	if err != nil || now.Unix() >= expiresAt {
+		return nil
+	}
+	rec, err := lookupAPIKey(parts[0])
+	if err != nil || rec == nil || rec.expired(now) {
+		return nil
+	}
+	signature := getAPITokenSignature(rec, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(signature), []byte(parts[2])) {
+		return nil
+	}
+	return rec
+}
+
+// createAPIKey generates an API key and saves its record to the database, the key expires in the
+// `ttl` if it's greater than zero, and can access the packages of the `scopes` only if it's not empty.
+func createAPIKey(name string, ttl time.Duration, scopes []string) (key string, rec *apiKeyRecord, err error) {
+	if name == "" || len(name) > 64 {
+		return "", nil, errors.New("invalid name")
+	}
+	buf := make([]byte, 24)
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+	key = "esm_" + hex.EncodeToString(buf)
+	id, hash := hashAPIKey(key)
+	rec = &apiKeyRecord{ID: id, Name: name, Hash: hash, CreatedAt: time.Now().Unix(), Scopes: scopes}
+	if ttl > 0 {
+		rec.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+	if err = db.Put(apiKeyRecordPrefix+id, utils.MustEncodeJSON(rec)); err != nil {
+		return "", nil, err
+	}
+	return
+}
+
+// listAPIKeys returns the API keys in the config and the database, without the hashes.
+func listAPIKeys() ([]apiKeyRecord, error) {
+	keys := []apiKeyRecord{}
+	for _, k := range cfg.APIKeys {
+		id, _ := hashAPIKey(k.Key)
+		keys = append(keys, apiKeyRecord{ID: id, Name: k.Name, Source: "config", Scopes: k.Scopes})
+	}
+	scanner, ok := db.(storage.DataBaseScanner)
+	if !ok {
+		return nil, errors.New("the database does not support listing the api keys")
+	}
+	err := scanner.Scan(apiKeyRecordPrefix, func(key string, value []byte) error {
+		var rec apiKeyRecord
+		if json.Unmarshal(value, &rec) == nil {
+			rec.Hash = ""
+			keys = append(keys, rec)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// revokeAPIKey removes the API key from the database, the keys in the config can't be revoked.
+func revokeAPIKey(id string) error {
+	value, err := db.Get(apiKeyRecordPrefix + id)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return fmt.Errorf("api key %q not found", id)
+	}
+	return db.Delete(apiKeyRecordPrefix + id)
+}
+
+// getAPIKey returns the id of the API key that authorizes the request by the `Authorization`
+// header or the signed `?token` query, or an empty string if the request is not authorized.
+func getAPIKey(ctx *rex.Context) string {
+	if rec := getAPIKeyRecord(ctx); rec != nil {
+		return rec.ID
+	}
+	return ""
+}
+
+// getAPIKeyRecord returns the record of the API key that authorizes the request, or nil if the
+// request is not authorized. The result is stored in the context to verify the key once per request.
+func getAPIKeyRecord(ctx *rex.Context) *apiKeyRecord {
+	if v, ok := ctx.Store.Get("apiKey"); ok {
+		return v.(*apiKeyRecord)
+	}
+	var rec *apiKeyRecord
+	if v := ctx.R.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		rec = verifyAPIKey(strings.TrimPrefix(v, "Bearer "))
+	}
+	if rec == nil && (ctx.R.Method == "GET" || ctx.R.Method == "HEAD") {
+		if token := ctx.R.URL.Query().Get("token"); token != "" {
+			rec = verifyAPIToken(token)
+		}
+	}
+	ctx.Store.Set("apiKey", rec)
+	return rec
+}
+
+// isAuthRequired checks whether the requests require an API key.
+func isAuthRequired() bool {
+	return cfg.AuthSecret != "" || cfg.RequireAPIKey
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+// AuditEvent is a record of the audit log, a build that is triggered by a request, the prebuild
+// or a background revalidation.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// Event is "build" for now.
+	Event   string `json:"event"`
+	BuildId string `json:"buildId"`
+	// Package is the resolved package version, e.g. "react@18.3.1", the `Request` has the
+	// requested version range.
+	Package string `json:"package"`
+	Target  string `json:"target,omitempty"`
+	// Deps are the resolved dependencies that the build imports.
+	Deps []string `json:"deps,omitempty"`
+	// Trigger is one of "request", "prebuild" and "revalidate".
+	Trigger     string    `json:"trigger"`
+	Request     string    `json:"request,omitempty"`
+	ClientIP    string    `json:"clientIp,omitempty"`
+	APIKey      string    `json:"apiKey,omitempty"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	RequestedAt time.Time `json:"requestedAt"`
+	Duration    int64     `json:"duration"`
+	// Outcome is "success" or "failure".
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// auditTrigger describes who triggers a build.
+type auditTrigger struct {
+	Trigger   string
+	Request   string
+	ClientIP  string
+	APIKey    string
+	UserAgent string
+}
+
+// getAuditTrigger returns the trigger of the build by the request.
+func getAuditTrigger(ctx *rex.Context, trigger string) *auditTrigger {
+	if len(auditSinks) == 0 {
+		return nil
+	}
+	return &auditTrigger{
+		Trigger:   trigger,
+		Request:   redact(ctx.R.URL.RequestURI()),
+		ClientIP:  anonymizeIP(getClientIP(ctx)),
+		APIKey:    getAPIKey(ctx),
+		UserAgent: anonymizeUserAgent(ctx.R.UserAgent()),
+	}
+}
+
+// auditSink writes the JSON encoded audit events.
+type auditSink interface {
+	Write(event []byte) error
+	Close() error
+}
+
+var auditSinks []auditSink
+
+// initAuditLog opens the sinks of the `auditLog` config.
+func initAuditLog(c config.AuditLog) error {
+	for _, s := range c.Sinks {
+		kind, arg, _ := strings.Cut(s, ":")
+		switch kind {
+		case "file":
+			f, err := os.OpenFile(arg, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			auditSinks = append(auditSinks, &fileAuditSink{f: f})
+		case "stdout":
+			auditSinks = append(auditSinks, &fileAuditSink{f: os.Stdout})
+		case "webhook":
+			auditSinks = append(auditSinks, newWebhookAuditSink(arg, c.WebhookSecret))
+		default:
+			return fmt.Errorf("invalid audit log sink %q", s)
+		}
+	}
+	return nil
+}
+
+// closeAuditLog flushes and closes the sinks.
+func closeAuditLog() {
+	for _, sink := range auditSinks {
+		sink.Close()
+	}
+}
+
+// recordAuditEvent writes the event to all the sinks.
+func recordAuditEvent(event *AuditEvent) {
+	if len(auditSinks) == 0 {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, sink := range auditSinks {
+		if err := sink.Write(data); err != nil {
+			log.Component("audit").Errorf("audit log: %v", err)
+		}
+	}
+}
+
+// recordBuildAudit records the outcome of the build task.
+func recordBuildAudit(t *queueTask, output BuildOutput) {
+	if len(auditSinks) == 0 {
+		return
+	}
+	event := &AuditEvent{
+		Time:        time.Now(),
+		Event:       "build",
+		BuildId:     t.ID(),
+		Package:     t.Pkg.String(),
+		Target:      t.Target,
+		Trigger:     "request",
+		RequestedAt: t.createdAt,
+		Duration:    time.Since(t.startedAt).Milliseconds(),
+		Outcome:     "success",
+	}
+	if tr := t.trigger; tr != nil {
+		event.Trigger = tr.Trigger
+		event.Request = tr.Request
+		event.ClientIP = tr.ClientIP
+		event.APIKey = tr.APIKey
+		event.UserAgent = tr.UserAgent
+	}
+	if output.meta != nil {
+		event.Deps = output.meta.Deps
+	}
+	if output.err != nil {
+		event.Outcome = "failure"
+		event.Error = redact(output.err.Error())
+	}
+	recordAuditEvent(event)
+}
+
+// fileAuditSink appends the events to a file as JSON lines.
+type fileAuditSink struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+func (s *fileAuditSink) Write(event []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := s.f.Write(append(event, '\n'))
+	return err
+}
+
+func (s *fileAuditSink) Close() error {
+	if s.f == os.Stdout {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// webhookAuditSink posts the events to a webhook in background, the events are signed with the
+// `X-Esm-Audit-Signature` header (HMAC-SHA256 of the body) if the secret is set.
+type webhookAuditSink struct {
+	lock   sync.Mutex
+	url    string
+	secret string
+	queue  chan []byte
+	done   chan struct{}
+	closed bool
+}
+
+func newWebhookAuditSink(url string, secret string) *webhookAuditSink {
+	s := &webhookAuditSink{url: url, secret: secret, queue: make(chan []byte, 1000), done: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+func (s *webhookAuditSink) Write(event []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf("the webhook sink is closed, drop the event: %s", event)
+	}
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		return fmt.Errorf("the webhook queue is full, drop the event: %s", event)
+	}
+}
+
+func (s *webhookAuditSink) run() {
+	defer close(s.done)
+	client := withClientTimeout(httpClient, 10*time.Second)
+	for event := range s.queue {
+		for attempt := 0; attempt < 3; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			req, err := http.NewRequest("POST", s.url, bytes.NewReader(event))
+			if err != nil {
+				break
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if s.secret != "" {
+				mac := hmac.New(sha256.New, []byte(s.secret))
+				mac.Write(event)
+				req.Header.Set("X-Esm-Audit-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			}
+			res, err := client.Do(req)
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode < 500 {
+					if res.StatusCode >= 400 {
+						log.Component("audit").Errorf("audit log: the webhook responds %d", res.StatusCode)
+					}
+					break
+				}
+				err = fmt.Errorf("the webhook responds %d", res.StatusCode)
+			}
+			if attempt == 2 {
+				log.Component("audit").Errorf("audit log: failed to post the event: %v", err)
+			}
+		}
+	}
+}
+
+// Close waits for the pending events to be posted, at most 5 seconds.
+func (s *webhookAuditSink) Close() error {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.lock.Unlock()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		log.Component("audit").Warnf("audit log: %d events are not posted to the webhook", len(s.queue))
+	}
+	return nil
+}
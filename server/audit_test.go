@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestAuditLog(t *testing.T) {
+	defer func(prev []auditSink) {
+		auditSinks = prev
+	}(auditSinks)
+	auditSinks = nil
+
+	posted := make(chan []byte, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("webhook-secret"))
+		mac.Write(body)
+		if r.Header.Get("X-Esm-Audit-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(401)
+			return
+		}
+		posted <- body
+	}))
+	defer webhook.Close()
+
+	filename := path.Join(t.TempDir(), "audit.log")
+	err := initAuditLog(config.AuditLog{Sinks: []string{"file:" + filename, "webhook:" + webhook.URL}, WebhookSecret: "webhook-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := &queueTask{
+		BuildTask: &BuildTask{id: "v135/react@18.3.1/es2022/react.mjs", Pkg: Pkg{Name: "react", Version: "18.3.1"}, Target: "es2022"},
+		createdAt: time.Now().Add(-time.Second),
+		startedAt: time.Now(),
+	}
+	task.trigger = &auditTrigger{Trigger: "request", Request: "/react@^18?target=es2022", ClientIP: "203.0.113.7", UserAgent: "curl/8.0"}
+	recordBuildAudit(task, BuildOutput{meta: &ESMBuild{Deps: []string{"/v135/scheduler@0.23.2/es2022/scheduler.mjs"}}})
+	recordBuildAudit(task, BuildOutput{err: errors.New("install failed")})
+	closeAuditLog()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(lines))
+	}
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != "build" || event.Package != "react@18.3.1" || event.Request != "/react@^18?target=es2022" || event.ClientIP != "203.0.113.7" || event.Outcome != "success" || len(event.Deps) != 1 {
+		t.Fatalf("unexpected event: %s", lines[0])
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event.Outcome != "failure" || event.Error != "install failed" {
+		t.Fatalf("unexpected event: %s", lines[1])
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case body := <-posted:
+			if !strings.Contains(string(body), `"buildId":"v135/react@18.3.1/es2022/react.mjs"`) {
+				t.Fatalf("unexpected webhook body: %s", body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the event is not posted to the webhook")
+		}
+	}
+}
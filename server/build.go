@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path"
@@ -25,6 +25,14 @@ type ESMBuild struct {
 	TypesOnly        bool     `json:"o,omitempty"`
 	PackageCSS       bool     `json:"s,omitempty"`
 	Deps             []string `json:"p,omitempty"`
+	SideEffectsFree  bool     `json:"e,omitempty"`
+	License          string   `json:"l,omitempty"`
+	Deprecated       string   `json:"dp,omitempty"`
+	// the build info of the build status API
+	BuiltAt        int64    `json:"b,omitempty"`
+	ServerVersion  int      `json:"v,omitempty"`
+	EsbuildVersion string   `json:"ev,omitempty"`
+	Warnings       []string `json:"w,omitempty"`
 }
 
 type BuildTask struct {
@@ -39,6 +47,9 @@ type BuildTask struct {
 	// internal
 	id          string
 	stage       string
+	trigger     *auditTrigger
+	parentSpan  *traceSpan // the span of the request that triggers the build
+	span        *traceSpan
 	wd          string
 	realWd      string
 	installDir  string
@@ -50,10 +61,25 @@ type BuildTask struct {
 }
 
 func (task *BuildTask) Build() (esm *ESMBuild, err error) {
+	// the builds that are not triggered by a request (e.g. prebuild) start a new trace
+	if task.parentSpan != nil {
+		task.span = startSpan(task.parentSpan, "build")
+	} else {
+		task.span = startTrace("build", "")
+	}
+	task.span.SetAttr("esm.build.id", task.ID())
+	task.span.SetAttr("esm.package", task.Pkg.String())
+	task.span.SetAttr("esm.target", task.Target)
+	defer func() {
+		task.span.End(err)
+	}()
+
 	// check request package
 	if !task.Pkg.FromEsmsh && !task.Pkg.FromGithub {
 		var p NpmPackage
+		span := startSpan(task.span, "resolve package")
 		p, _, err = getPackageInfo("", task.Pkg.Name, task.Pkg.Version)
+		span.End(err)
 		if err != nil {
 			return
 		}
@@ -68,43 +94,12 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 			return
 		}
 
-		if cfg.NpmToken != "" || (cfg.NpmUser != "" && cfg.NpmPassword != "") {
-			rcFilePath := path.Join(task.wd, ".npmrc")
-			if !fileExists(rcFilePath) {
-				var output bytes.Buffer
-
-				if cfg.NpmRegistryScope != "" && cfg.NpmRegistry != "" {
-					output.WriteString(fmt.Sprintf("%s:registry=%s\n", cfg.NpmRegistryScope, cfg.NpmRegistry))
-				} else if cfg.NpmRegistryScope == "" && cfg.NpmRegistry != "" {
-					output.WriteString(fmt.Sprintf("registry=%s\n", cfg.NpmRegistry))
-				}
-
-				if cfg.NpmRegistry != "" && cfg.NpmToken != "" {
-					var tokenReg string
-					tokenReg, err = removeHttpPrefix(cfg.NpmRegistry)
-					if err != nil {
-						log.Errorf("Invalid npm registry in config: %v", err)
-						return
-					}
-					output.WriteString(fmt.Sprintf("%s:_authToken=${ESM_NPM_TOKEN}\n", tokenReg))
-				}
-
-				if cfg.NpmRegistry != "" && cfg.NpmUser != "" && cfg.NpmPassword != "" {
-					var tokenReg string
-					tokenReg, err = removeHttpPrefix(cfg.NpmRegistry)
-					if err != nil {
-						log.Errorf("Invalid npm registry in config: %v", err)
-						return
-					}
-					output.WriteString(fmt.Sprintf("%s:username=${ESM_NPM_USER}\n", tokenReg))
-					output.WriteString(fmt.Sprintf("%s:_password=${ESM_NPM_PASSWORD}\n", tokenReg))
-				}
-
-				err = os.WriteFile(rcFilePath, output.Bytes(), 0644)
-				if err != nil {
-					log.Errorf("Failed to create .npmrc file: %v", err)
-					return
-				}
+		rcFilePath := path.Join(task.wd, ".npmrc")
+		if npmrc := getNpmrc(); len(npmrc) > 0 && !fileExists(rcFilePath) {
+			err = os.WriteFile(rcFilePath, npmrc, 0644)
+			if err != nil {
+				task.logger().Errorf("Failed to create .npmrc file: %v", err)
+				return
 			}
 		}
 	}
@@ -119,10 +114,14 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 
 	task.stage = "install"
 
-	err = installPackage(task.wd, task.Pkg)
+	err = installPackage(task.wd, task.Pkg, task.span)
 	if err != nil {
 		return
 	}
+	logSkippedInstallScripts(task.ID(), task.wd, task.Pkg.Name)
+	if !task.Pkg.FromEsmsh && !task.Pkg.FromGithub {
+		logAdvisories(task.ID(), task.Pkg.Name, task.Pkg.Version)
+	}
 
 	if l, e := filepath.EvalSymlinks(path.Join(task.wd, "node_modules", task.Pkg.Name)); e == nil {
 		task.realWd = l
@@ -161,7 +160,7 @@ func (task *BuildTask) build() (err error) {
 			}
 			buffer := bytes.NewBufferString("export default ")
 			buffer.Write(json)
-			_, err = fs.WriteFile(task.getSavepath(), buffer)
+			_, err = task.writeFile(task.getSavepath(), buffer)
 			if err != nil {
 				return err
 			}
@@ -212,7 +211,7 @@ func (task *BuildTask) build() (err error) {
 			wd:     task.installDir,
 		}
 		if !formJson {
-			err = installPackage(task.wd, t.Pkg)
+			err = installPackage(task.wd, t.Pkg, task.span)
 			if err != nil {
 				return
 			}
@@ -231,7 +230,7 @@ func (task *BuildTask) build() (err error) {
 			fmt.Fprintf(buf, `export { default } from "%s";`, importPath)
 		}
 
-		_, err = fs.WriteFile(task.getSavepath(), buf)
+		_, err = task.writeFile(task.getSavepath(), buf)
 		if err != nil {
 			return
 		}
@@ -301,31 +300,39 @@ func (task *BuildTask) build() (err error) {
 		"global.require.resolve":      "__rResolve$",
 		"global.process.env.NODE_ENV": fmt.Sprintf(`"%s"`, nodeEnv),
 	}
-	if task.Target == "node" {
+	if task.isNodeTarget() {
 		define = map[string]string{}
 	}
+	// use `?define` query
+	for key, value := range task.Args.define {
+		define[key] = value
+	}
 	browserExclude := map[string]*stringSet{}
 	implicitExternal := newStringSet()
 
+	esbuildTarget, supported := getEsbuildTarget(task.Target)
+	if supported == nil {
+		supported = map[string]bool{}
+	}
+	// prevent features that can not be polyfilled
+	supported["bigint"] = true
+	supported["top-level-await"] = true
+
 rebuild:
 	options := api.BuildOptions{
 		Outdir:            "/esbuild",
 		Write:             false,
 		Bundle:            true,
 		Format:            api.FormatESModule,
-		Target:            targets[task.Target],
+		Target:            esbuildTarget,
+		Supported:         supported,
 		Platform:          api.PlatformBrowser,
 		MinifyWhitespace:  !task.Dev,
-		MinifyIdentifiers: !task.Dev,
+		MinifyIdentifiers: !task.Dev && !task.Args.noMinifyIdents,
 		MinifySyntax:      !task.Dev,
 		KeepNames:         task.Args.keepNames,         // prevent class/function names erasing
 		IgnoreAnnotations: task.Args.ignoreAnnotations, // some libs maybe use wrong side-effect annotations
 		Conditions:        task.Args.conditions.Values(),
-		// prevent features that can not be polyfilled
-		Supported: map[string]bool{
-			"bigint":          true,
-			"top-level-await": true,
-		},
 		Plugins: []api.Plugin{{
 			Name: "esm",
 			Setup: func(build api.PluginBuild) {
@@ -430,6 +437,7 @@ rebuild:
 									} else if v, ok := npm.PeerDependencies[pkgName]; ok {
 										version = v
 									}
+									pkgName, version = resolveNpmAlias(pkgName, version)
 									if !regexpFullVersion.MatchString(version) {
 										p, _, err := getPackageInfo(task.installDir, pkgName, version)
 										if err == nil {
@@ -475,6 +483,12 @@ rebuild:
 							return api.OnResolveResult{Path: fullFilepath, Namespace: "wasm"}, nil
 						}
 
+						// bundle the imported css files of dependencies into the package css,
+						// instead of importing them as JS modules which fails
+						if strings.HasSuffix(fullFilepath, ".css") && fileExists(fullFilepath) {
+							return api.OnResolveResult{Path: fullFilepath}, nil
+						}
+
 						// bundles all dependencies in `bundle` mode, apart from peer dependencies and `?external` query
 						if task.Bundle && !task.Args.external.Has(getPkgName(specifier)) && !implicitExternal.Has(specifier) {
 							if internalNodeModules[specifier] {
@@ -492,8 +506,12 @@ rebuild:
 							}
 							pkgName, _ := splitPkgPath(specifier)
 							if !internalNodeModules[pkgName] {
+								// the standalone build bundles the peer dependencies as well
 								_, ok := npm.PeerDependencies[pkgName]
-								if !ok {
+								if !ok || task.Args.globalName != "" {
+									if v := task.checkDependencyPolicy(pkgName); v != nil {
+										return api.OnResolveResult{}, v
+									}
 									return api.OnResolveResult{}, nil
 								}
 							}
@@ -529,6 +547,12 @@ rebuild:
 							return api.OnResolveResult{}, nil
 						}
 
+						// bundle the vendored copies of the `bundleDependencies` instead of importing them from
+						// the registry that may resolve different versions
+						if pkgName, _ := splitPkgPath(specifier); includes(npm.BundleDependencies, pkgName) && dirExists(path.Join(task.realWd, "node_modules", pkgName)) {
+							return api.OnResolveResult{}, nil
+						}
+
 						if isLocalSpecifier(specifier) {
 							// is sub-module of current package and non-dynamic import
 							if strings.HasPrefix(fullFilepath, task.realWd) && args.Kind != api.ResolveJSDynamicImport {
@@ -589,13 +613,19 @@ rebuild:
 
 						// check `sideEffects`
 						sideEffects := api.SideEffectsTrue
-						pkgName, _ := splitPkgPath(specifier)
+						pkgName, subpath := splitPkgPath(specifier)
 						if f := path.Join(task.installDir, "node_modules", pkgName, "package.json"); fileExists(f) {
 							var np NpmPackage
 							if utils.ParseJSONFile(f, &np) == nil {
 								if !np.SideEffects {
 									sideEffects = api.SideEffectsFalse
 								}
+								// inline the tiny dependencies to reduce the requests
+								if subpath == "" && pkgName != npm.Name && !task.Args.external.Has(pkgName) && task.isTinyDependency(np) {
+									if _, ok := npm.PeerDependencies[pkgName]; !ok {
+										return api.OnResolveResult{}, nil
+									}
+								}
 							}
 						}
 
@@ -660,17 +690,56 @@ rebuild:
 		SourceRoot: "/",
 		Sourcemap:  api.SourceMapExternal,
 	}
-	if task.Target == "node" {
+	if task.isNodeTarget() {
 		options.Platform = api.PlatformNode
-	} else {
-		options.Define = define
+	}
+	options.Define = define
+	// apply the build plugins registered by `RegisterBuildPlugin`
+	if plugins := getBuildPlugins(); len(plugins) > 0 {
+		options.Plugins = append(plugins, options.Plugins...)
+	}
+	// the standalone build is a classic script that assigns the exports to a global variable
+	if task.Args.globalName != "" {
+		options.Format = api.FormatIIFE
+		options.GlobalName = task.Args.globalName
+	}
+	// prepend/append the banner/footer configured by the operator, e.g. license headers
+	if banner := task.getBanner(); banner != "" {
+		options.Banner = map[string]string{"js": banner}
+	}
+	if cfg.Footer != "" {
+		options.Footer = map[string]string{"js": cfg.Footer}
+	}
+	// shake out the members that are not in the `?exports` query
+	if task.Args.exports.Len() > 0 {
+		options.TreeShaking = api.TreeShakingTrue
+	}
+	// use `?jsx`, `?jsx-import-source`, `?jsx-factory` and `?jsx-fragment` queries
+	// for the packages that ship untranspiled `.jsx`/`.tsx` files
+	switch task.Args.jsx {
+	case "automatic":
+		options.JSX = api.JSXAutomatic
+		options.JSXImportSource = task.Args.jsxImportSource
+	case "classic":
+		options.JSX = api.JSXTransform
+		options.JSXFactory = task.Args.jsxFactory
+		options.JSXFragment = task.Args.jsxFragment
 	}
 	if input != nil {
 		options.Stdin = input
 	} else if entryPoint != "" {
 		options.EntryPoints = []string{entryPoint}
 	}
-	result := api.Build(options)
+	span := startSpan(task.span, "esbuild")
+	result, err := runESBuild(options)
+	if err == nil {
+		span.SetAttr("esbuild.errors", len(result.Errors))
+		span.SetAttr("esbuild.warnings", len(result.Warnings))
+	}
+	span.End(err)
+	if err != nil {
+		return
+	}
 	if len(result.Errors) > 0 {
 		// mark the missing module as external to exclude it from the bundle
 		msg := result.Errors[0].Text
@@ -682,7 +751,7 @@ rebuild:
 			}
 			name := strings.Split(msg, "\"")[1]
 			if !implicitExternal.Has(name) {
-				log.Warnf("build(%s): implicit external '%s'", task.ID(), name)
+				task.logger().Warnf("implicit external '%s'", name)
 				implicitExternal.Add(name)
 				goto rebuild
 			}
@@ -705,13 +774,19 @@ rebuild:
 				}
 			}
 		}
-		err = errors.New("esbuild: " + msg)
+		err = &BuildError{
+			Message: "esbuild: " + msg,
+			Log:     api.FormatMessages(result.Errors, api.FormatMessagesOptions{Kind: api.ErrorMessage}),
+		}
 		return
 	}
 
 	for _, w := range result.Warnings {
 		if strings.HasPrefix(w.Text, "Could not resolve \"") {
-			log.Warnf("esbuild(%s): %s", task.ID(), w.Text)
+			task.logger().Warnf("esbuild: %s", w.Text)
+		}
+		if len(esm.Warnings) < maxBuildWarnings {
+			esm.Warnings = append(esm.Warnings, formatBuildWarning(w))
 		}
 	}
 
@@ -732,7 +807,7 @@ rebuild:
 			}
 
 			// add nodejs compatibility
-			if task.Target != "node" {
+			if !task.isNodeTarget() {
 				ids := newStringSet()
 				for _, r := range regexpGlobalIdent.FindAll(jsContent, -1) {
 					ids.Add(string(r))
@@ -744,7 +819,7 @@ rebuild:
 						fmt.Fprintf(header, `import __Process$ from "https://deno.land/std@%s/node/process.ts";%s`, task.Args.denoStdVersion, EOL)
 					} else if task.Bundle {
 						var js []byte
-						js, err = bundleNodePolyfill("process", "__Process$", "default", targets[task.Target])
+						js, err = bundleNodePolyfill("process", "__Process$", "default", task.Target)
 						if err != nil {
 							return
 						}
@@ -760,7 +835,7 @@ rebuild:
 						fmt.Fprintf(header, `import { Buffer as __Buffer$ } from "https://deno.land/std@%s/node/buffer.ts";%s`, task.Args.denoStdVersion, EOL)
 					} else if task.Bundle {
 						var js []byte
-						js, err = bundleNodePolyfill("buffer", "__Buffer$", "Buffer", targets[task.Target])
+						js, err = bundleNodePolyfill("buffer", "__Buffer$", "Buffer", task.Target)
 						if err != nil {
 							return
 						}
@@ -804,7 +879,7 @@ rebuild:
 									wd:     task.installDir,
 								}
 								if !formJson {
-									e = installPackage(task.wd, t.Pkg)
+									e = installPackage(task.wd, t.Pkg, task.span)
 								}
 								if e == nil {
 									m, _, _, e := t.analyze(true)
@@ -847,20 +922,23 @@ rebuild:
 			finalContent.WriteString(filepath.Base(task.ID()))
 			finalContent.WriteString(".map")
 
-			_, err = fs.WriteFile(task.getSavepath(), finalContent)
+			_, err = task.writeFile(task.getSavepath(), bytes.NewReader(finalContent.Bytes()))
 			if err != nil {
 				return
 			}
+			writePrecompressedVariant(task.getSavepath(), finalContent.Bytes())
 		}
 	}
 
 	for _, file := range result.OutputFiles {
 		if strings.HasSuffix(file.Path, ".css") {
 			savePath := task.getSavepath()
-			_, err = fs.WriteFile(strings.TrimSuffix(savePath, path.Ext(savePath))+".css", bytes.NewReader(file.Contents))
+			cssPath := strings.TrimSuffix(savePath, path.Ext(savePath)) + ".css"
+			_, err = task.writeFile(cssPath, bytes.NewReader(file.Contents))
 			if err != nil {
 				return
 			}
+			writePrecompressedVariant(cssPath, file.Contents)
 			esm.PackageCSS = true
 		} else if strings.HasSuffix(file.Path, ".js.map") {
 			var sourceMap map[string]interface{}
@@ -875,7 +953,7 @@ rebuild:
 				}
 				buf := bytes.NewBuffer(nil)
 				if json.NewEncoder(buf).Encode(sourceMap) == nil {
-					_, err = fs.WriteFile(task.getSavepath()+".map", buf)
+					_, err = task.writeFile(task.getSavepath()+".map", buf)
 					if err != nil {
 						return
 					}
@@ -887,6 +965,7 @@ rebuild:
 	esm.Deps = filter(task.imports, func(dep string) bool {
 		return strings.HasPrefix(dep, "/") || strings.HasPrefix(dep, "http:") || strings.HasPrefix(dep, "https:")
 	})
+	esm.SideEffectsFree = !npm.SideEffects
 
 	task.checkDTS()
 	task.storeToDB()
@@ -897,7 +976,7 @@ func (task *BuildTask) resolveExternal(specifier string, kind api.ResolveKind) s
 	var resolvedPath string
 	// node builtin module
 	if internalNodeModules[specifier] && !task.Args.external.Has(getPkgName(specifier)) {
-		if task.Target == "node" {
+		if task.isNodeTarget() {
 			resolvedPath = fmt.Sprintf("node:%s", specifier)
 		} else if task.Target == "denonext" && !denoNextUnspportedNodeModules[specifier] {
 			resolvedPath = fmt.Sprintf("node:%s", specifier)
@@ -982,7 +1061,7 @@ func (task *BuildTask) resolveExternal(specifier string, kind api.ResolveKind) s
 		case "abort-controller":
 			resolvedPath = jsDataUrl(`export const AbortSignal=globalThis.AbortSignal;export const AbortController=globalThis.AbortController;export default AbortController`)
 		case "node-fetch":
-			if task.Target != "node" {
+			if !task.isNodeTarget() {
 				resolvedPath = fmt.Sprintf("%s/v%d/node_fetch.js", cfg.CdnBasePath, task.BuildVersion)
 			}
 		}
@@ -995,11 +1074,15 @@ func (task *BuildTask) resolveExternal(specifier string, kind api.ResolveKind) s
 			version = task.Pkg.Version
 		} else if pkg, ok := task.Args.deps.Get(pkgName); ok {
 			version = pkg.Version
+		} else if v, ok := task.getLockedVersion(pkgName); ok {
+			version = v
 		} else if v, ok := task.npm.Dependencies[pkgName]; ok {
 			version = v
 		} else if v, ok := task.npm.PeerDependencies[pkgName]; ok {
 			version = v
 		}
+		// import the aliased package, e.g. `"foo": "npm:bar@^2"`
+		pkgName, version = resolveNpmAlias(pkgName, version)
 		if !regexpFullVersion.MatchString(version) {
 			p, _, err := getPackageInfo(task.installDir, pkgName, version)
 			if err == nil {
@@ -1017,6 +1100,8 @@ func (task *BuildTask) resolveExternal(specifier string, kind api.ResolveKind) s
 			external:   newStringSet(task.Args.external.Values()...),
 			exports:    newStringSet(),
 			conditions: newStringSet(),
+			// the transitive dependencies are resolved with the lockfile as well
+			lock: task.Args.lock,
 		}
 		if stableBuild[pkgName] {
 			args.alias = map[string]string{}
@@ -1044,10 +1129,23 @@ func (task *BuildTask) resolveExternal(specifier string, kind api.ResolveKind) s
 	return resolvedPath
 }
 
+// writeFile writes the file to the storage, the write is traced as a span of the build.
+func (task *BuildTask) writeFile(name string, r io.Reader) (n int64, err error) {
+	span := startSpan(task.span, "storage write")
+	span.SetAttr("esm.storage.path", name)
+	n, err = fs.WriteFile(name, r)
+	span.SetAttr("esm.storage.size", n)
+	span.End(err)
+	return
+}
+
 func (task *BuildTask) storeToDB() {
+	task.esm.BuiltAt = time.Now().Unix()
+	task.esm.ServerVersion = VERSION
+	task.esm.EsbuildVersion = getEsbuildVersion()
 	err := db.Put(task.ID(), utils.MustEncodeJSON(task.esm))
 	if err != nil {
-		log.Errorf("db: %v", err)
+		task.logger().Errorf("db: %v", err)
 	}
 }
 
@@ -1068,6 +1166,11 @@ func (task *BuildTask) checkDTS() {
 			}
 		}
 		typesPkgName := toTypesPackageName(name)
+		// use the types package pinned by the `typesOverrides` config
+		if n, v, ok := getTypesOverride(name, task.Pkg.Version); ok {
+			typesPkgName = n
+			versions = []string{v}
+		}
 		pkg, ok := task.Args.deps.Get(typesPkgName)
 		if ok {
 			// use the version of the `?deps` query if it exists
@@ -1082,6 +1185,13 @@ func (task *BuildTask) checkDTS() {
 			}
 		}
 	}
+	if dts == "" && cfg.StubTypes {
+		var err error
+		dts, err = task.buildStubDTS()
+		if err != nil {
+			task.logger().Errorf("buildStubDTS: %v", err)
+		}
+	}
 	if dts != "" {
 		bv := task.BuildVersion
 		if stableBuild[task.Pkg.Name] {
@@ -1094,10 +1204,14 @@ func (task *BuildTask) checkDTS() {
 func (task *BuildTask) buildDTS(dts string) {
 	start := time.Now()
 	task.stage = "transform-dts"
+	span := startSpan(task.span, "transform dts")
+	span.SetAttr("esm.dts", dts)
 	n, err := task.TransformDTS(dts)
+	span.SetAttr("esm.dts.files", n)
+	span.End(err)
 	if err != nil && os.IsExist(err) {
-		log.Errorf("TransformDTS(%s): %v", dts, err)
+		task.logger().Errorf("TransformDTS(%s): %v", dts, err)
 		return
 	}
-	log.Debugf("transform dts '%s'(%d related dts files) in %v", dts, n, time.Since(start))
+	task.logger().Debugf("transform dts '%s'(%d related dts files) in %v", dts, n, time.Since(start))
 }
@@ -10,6 +10,7 @@ import (
 
 type BuildArgs struct {
 	alias             map[string]string
+	define            map[string]string
 	deps              PkgSlice
 	conditions        *stringSet
 	external          *stringSet
@@ -18,6 +19,15 @@ type BuildArgs struct {
 	ignoreAnnotations bool
 	ignoreRequire     bool
 	keepNames         bool
+	noMinifyIdents    bool
+	jsx               string
+	jsxImportSource   string
+	jsxFactory        string
+	jsxFragment       string
+	globalName        string
+	banner            string
+	tsVersion         string
+	lock              string
 }
 
 func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
@@ -39,6 +49,14 @@ func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
 						args.alias[name] = to
 					}
 				}
+			} else if strings.HasPrefix(p, "df/") {
+				args.define = map[string]string{}
+				for _, p := range strings.Split(strings.TrimPrefix(p, "df/"), ",") {
+					key, value := utils.SplitByFirstByte(p, ':')
+					if regexpJSMemberPath.MatchString(key) && value != "" {
+						args.define[key] = value
+					}
+				}
 			} else if strings.HasPrefix(p, "d/") {
 				for _, p := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(p, "d/"), "deps:"), ",") {
 					m, _, err := validatePkgPath(p)
@@ -64,6 +82,22 @@ func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
 				for _, name := range strings.Split(strings.TrimPrefix(p, "c/"), ",") {
 					args.conditions.Add(name)
 				}
+			} else if strings.HasPrefix(p, "jsx/") {
+				args.jsx = strings.TrimPrefix(p, "jsx/")
+			} else if strings.HasPrefix(p, "jsxis/") {
+				args.jsxImportSource = strings.TrimPrefix(p, "jsxis/")
+			} else if strings.HasPrefix(p, "jsxf/") {
+				args.jsxFactory = strings.TrimPrefix(p, "jsxf/")
+			} else if strings.HasPrefix(p, "jsxff/") {
+				args.jsxFragment = strings.TrimPrefix(p, "jsxff/")
+			} else if strings.HasPrefix(p, "gn/") {
+				args.globalName = strings.TrimPrefix(p, "gn/")
+			} else if strings.HasPrefix(p, "tsv/") {
+				args.tsVersion = strings.TrimPrefix(p, "tsv/")
+			} else if strings.HasPrefix(p, "lk/") {
+				args.lock = strings.TrimPrefix(p, "lk/")
+			} else if strings.HasPrefix(p, "bn/") {
+				args.banner = strings.TrimPrefix(p, "bn/")
 			} else if strings.HasPrefix(p, "dsv/") {
 				args.denoStdVersion = strings.TrimPrefix(p, "dsv/")
 			} else {
@@ -72,6 +106,8 @@ func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
 					args.ignoreRequire = true
 				case "kn":
 					args.keepNames = true
+				case "nmi":
+					args.noMinifyIdents = true
 				case "ia":
 					args.ignoreAnnotations = true
 				}
@@ -96,6 +132,14 @@ func encodeBuildArgsPrefix(args BuildArgs, pkg Pkg, forTypes bool) string {
 				lines = append(lines, fmt.Sprintf("a/%s", strings.Join(ss, ",")))
 			}
 		}
+		if len(args.define) > 0 && !forTypes {
+			var ss sort.StringSlice
+			for key, value := range args.define {
+				ss = append(ss, fmt.Sprintf("%s:%s", key, value))
+			}
+			ss.Sort()
+			lines = append(lines, fmt.Sprintf("df/%s", strings.Join(ss, ",")))
+		}
 		if len(args.deps) > 0 {
 			var ss sort.StringSlice
 			for _, p := range args.deps {
@@ -147,16 +191,43 @@ func encodeBuildArgsPrefix(args BuildArgs, pkg Pkg, forTypes bool) string {
 			lines = append(lines, fmt.Sprintf("c/%s", strings.Join(ss, ",")))
 		}
 	}
+	if args.tsVersion != "" {
+		lines = append(lines, fmt.Sprintf("tsv/%s", args.tsVersion))
+	}
+	if args.lock != "" {
+		lines = append(lines, fmt.Sprintf("lk/%s", args.lock))
+	}
 	if !forTypes {
 		if args.denoStdVersion != "" && args.denoStdVersion != denoStdVersion {
 			lines = append(lines, fmt.Sprintf("dsv/%s", args.denoStdVersion))
 		}
+		if args.jsx != "" {
+			lines = append(lines, fmt.Sprintf("jsx/%s", args.jsx))
+		}
+		if args.jsxImportSource != "" {
+			lines = append(lines, fmt.Sprintf("jsxis/%s", args.jsxImportSource))
+		}
+		if args.jsxFactory != "" {
+			lines = append(lines, fmt.Sprintf("jsxf/%s", args.jsxFactory))
+		}
+		if args.jsxFragment != "" {
+			lines = append(lines, fmt.Sprintf("jsxff/%s", args.jsxFragment))
+		}
+		if args.globalName != "" {
+			lines = append(lines, fmt.Sprintf("gn/%s", args.globalName))
+		}
+		if args.banner != "" {
+			lines = append(lines, fmt.Sprintf("bn/%s", args.banner))
+		}
 		if args.ignoreRequire {
 			lines = append(lines, "ir")
 		}
 		if args.keepNames {
 			lines = append(lines, "kn")
 		}
+		if args.noMinifyIdents {
+			lines = append(lines, "nmi")
+		}
 		if args.ignoreAnnotations {
 			lines = append(lines, "ia")
 		}
@@ -166,3 +237,12 @@ func encodeBuildArgsPrefix(args BuildArgs, pkg Pkg, forTypes bool) string {
 	}
 	return ""
 }
+
+// toDefineValue converts the value of the `?define` query to the esbuild define value,
+// the value that is not a JSON literal is treated as a string, e.g. `production` -> `"production"`.
+func toDefineValue(value string) string {
+	if regexpJSONLiteral.MatchString(value) {
+		return value
+	}
+	return fmt.Sprintf("%q", value)
+}
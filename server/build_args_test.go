@@ -15,7 +15,8 @@ func TestEncodeBuildArgs(t *testing.T) {
 	conditions.Add("react-server")
 	prefix := encodeBuildArgsPrefix(
 		BuildArgs{
-			alias: map[string]string{"a": "b"},
+			alias:  map[string]string{"a": "b"},
+			define: map[string]string{"process.env.NODE_ENV": `"production"`, "__DEV__": "false"},
 			deps: PkgSlice{
 				Pkg{Name: "c", Version: "1.0.0"},
 				Pkg{Name: "d", Version: "1.0.0"},
@@ -28,6 +29,13 @@ func TestEncodeBuildArgs(t *testing.T) {
 			denoStdVersion:    "0.128.0",
 			ignoreRequire:     true,
 			keepNames:         true,
+			noMinifyIdents:    true,
+			jsx:               "automatic",
+			jsxImportSource:   "preact",
+			globalName:        "Foo",
+			banner:            "license",
+			tsVersion:         "4.9",
+			lock:              "3f9a2c1b7e6d4a05",
 			ignoreAnnotations: true,
 		},
 		Pkg{Name: "foo"},
@@ -40,6 +48,9 @@ func TestEncodeBuildArgs(t *testing.T) {
 	if len(args.alias) != 1 || args.alias["a"] != "b" {
 		t.Fatal("invalid alias")
 	}
+	if len(args.define) != 2 || args.define["process.env.NODE_ENV"] != `"production"` || args.define["__DEV__"] != "false" {
+		t.Fatal("invalid define")
+	}
 	if len(args.deps) != 3 {
 		t.Fatal("invalid deps")
 	}
@@ -61,7 +72,70 @@ func TestEncodeBuildArgs(t *testing.T) {
 	if !args.keepNames {
 		t.Fatal("keepNames should be true")
 	}
+	if !args.noMinifyIdents {
+		t.Fatal("noMinifyIdents should be true")
+	}
+	if args.jsx != "automatic" || args.jsxImportSource != "preact" {
+		t.Fatal("invalid jsx options")
+	}
+	if args.globalName != "Foo" {
+		t.Fatal("invalid globalName")
+	}
+	if args.banner != "license" {
+		t.Fatal("invalid banner")
+	}
+	if args.tsVersion != "4.9" {
+		t.Fatal("invalid tsVersion")
+	}
+	if args.lock != "3f9a2c1b7e6d4a05" {
+		t.Fatal("invalid lock")
+	}
 	if !args.ignoreAnnotations {
 		t.Fatal("ignoreAnnotations should be true")
 	}
 }
+
+func TestToDefineValue(t *testing.T) {
+	tests := map[string]string{
+		"production":   `"production"`,
+		`"production"`: `"production"`,
+		"false":        "false",
+		"42":           "42",
+		"null":         "null",
+	}
+	for value, expected := range tests {
+		if v := toDefineValue(value); v != expected {
+			t.Fatalf("invalid define value %s of '%s', should be %s", v, value, expected)
+		}
+	}
+}
+
+func TestToGlobalName(t *testing.T) {
+	tests := map[string]string{
+		"react":          "react",
+		"lodash-es":      "lodashEs",
+		"@scope/foo-bar": "fooBar",
+		"3d-view":        "dView",
+		"big.js":         "bigJs",
+	}
+	for name, expected := range tests {
+		if v := toGlobalName(name); v != expected {
+			t.Fatalf("invalid global name '%s' of '%s', should be '%s'", v, name, expected)
+		}
+	}
+}
+
+func TestToTSVersion(t *testing.T) {
+	for input, expected := range map[string]string{
+		"5":     "5.0",
+		"5.3":   "5.3",
+		"5.3.2": "5.3",
+		"5.x":   "",
+		"next":  "",
+	} {
+		v, ok := toTSVersion(input)
+		if v != expected || ok != (expected != "") {
+			t.Fatalf("invalid ts version of '%s': expected '%s', got '%s'", input, expected, v)
+		}
+	}
+}
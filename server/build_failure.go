@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// BuildFailure is returned by the build queue when the build task failed recently, the task
+// will not be retried until the `RetryAt` time.
+type BuildFailure struct {
+	ID       string    `json:"id"`
+	Message  string    `json:"error"`
+	Log      []string  `json:"log,omitempty"`
+	Limit    string    `json:"limit,omitempty"`
+	Attempts int       `json:"attempts"`
+	RetryAt  time.Time `json:"retryAt"`
+}
+
+func (f *BuildFailure) Error() string {
+	return f.Message
+}
+
+// BuildError is the error of a failed build with the messages of esbuild.
+type BuildError struct {
+	Message string
+	Log     []string
+}
+
+func (e *BuildError) Error() string {
+	return e.Message
+}
+
+// getBuildLog returns the build log of the build error or the build failure.
+func getBuildLog(err error) []string {
+	switch e := err.(type) {
+	case *BuildError:
+		return e.Log
+	case *BuildFailure:
+		return e.Log
+	}
+	return nil
+}
+
+// RetryAfter returns the seconds to wait before retrying the build.
+func (f *BuildFailure) RetryAfter() int {
+	d := time.Until(f.RetryAt)
+	if d < time.Second {
+		return 1
+	}
+	return int(d.Seconds())
+}
+
+// getBuildFailure returns the recent failure of the build task, or false if the task should be
+// (re)built.
+func getBuildFailure(id string) (*BuildFailure, bool) {
+	f, ok := loadBuildFailure(id)
+	if !ok || time.Now().After(f.RetryAt) {
+		return nil, false
+	}
+	return f, true
+}
+
+// recordBuildFailure caches the failure of the build task, the retry delay grows exponentially
+// from the `buildFailureTTL` config to the `buildFailureMaxTTL` config on the repeated failures.
+func recordBuildFailure(id string, err error) {
+	if cache == nil || cfg.BuildFailureTTL <= 0 {
+		return
+	}
+	f := &BuildFailure{ID: id, Message: redact(err.Error()), Log: redactLines(getBuildLog(err)), Limit: getBuildLimit(err), Attempts: 1}
+	if prev, ok := loadBuildFailure(id); ok {
+		f.Attempts = prev.Attempts + 1
+	}
+	f.RetryAt = time.Now().Add(getBuildFailureBackoff(f.Attempts))
+	data, e := json.Marshal(f)
+	if e != nil {
+		return
+	}
+	// keep the record after the retry time to grow the backoff on the next failure
+	ttl := time.Until(f.RetryAt) + time.Duration(cfg.BuildFailureMaxTTL)*time.Second
+	if e := cache.Set("build-failure:"+id, data, ttl); e != nil {
+		log.Error("cache:", e)
+	}
+}
+
+// clearBuildFailure deletes the failure record of the build task.
+func clearBuildFailure(id string) {
+	if cache != nil && cfg.BuildFailureTTL > 0 {
+		cache.Delete("build-failure:" + id)
+	}
+}
+
+func loadBuildFailure(id string) (*BuildFailure, bool) {
+	if cache == nil || cfg.BuildFailureTTL <= 0 {
+		return nil, false
+	}
+	data, err := cache.Get("build-failure:" + id)
+	if err != nil {
+		return nil, false
+	}
+	var f BuildFailure
+	if json.Unmarshal(data, &f) != nil {
+		return nil, false
+	}
+	return &f, true
+}
+
+func getBuildFailureBackoff(attempts int) time.Duration {
+	ttl := time.Duration(cfg.BuildFailureTTL) * time.Second
+	maxTTL := time.Duration(cfg.BuildFailureMaxTTL) * time.Second
+	for i := 1; i < attempts && ttl < maxTTL; i++ {
+		ttl *= 2
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
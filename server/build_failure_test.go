@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestBuildFailure(t *testing.T) {
+	memoryCache, err := storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prevCache storage.Cache, prevCfg *config.Config) {
+		cache, cfg = prevCache, prevCfg
+	}(cache, cfg)
+	cache, cfg = memoryCache, &config.Config{BuildFailureTTL: 30, BuildFailureMaxTTL: 100}
+
+	id := "v135/broken@1.0.0/es2022/broken.mjs"
+	if _, ok := getBuildFailure(id); ok {
+		t.Fatal("should not have the build failure")
+	}
+	for i, ttl := range []time.Duration{30, 60, 100, 100} {
+		recordBuildFailure(id, errors.New("Could not resolve \"foo\""))
+		f, ok := getBuildFailure(id)
+		if !ok {
+			t.Fatal("should have the build failure")
+		}
+		if f.Attempts != i+1 || f.Message != "Could not resolve \"foo\"" {
+			t.Fatalf("unexpected build failure: %+v", f)
+		}
+		if d := time.Until(f.RetryAt); d > ttl*time.Second || d < (ttl-2)*time.Second {
+			t.Fatalf("attempt %d: expected retry after %ds, got %v", i+1, ttl, d)
+		}
+	}
+
+	// the queue returns the failure without building the task
+	q := newBuildQueue(1)
+	task := &BuildTask{id: id}
+	select {
+	case output := <-q.Add(task, "127.0.0.1").C:
+		if f, ok := output.err.(*BuildFailure); !ok || f.ID != id {
+			t.Fatalf("expected the build failure, got %v", output.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("should fail fast")
+	}
+	if q.Len() != 0 {
+		t.Fatal("the task should not be queued")
+	}
+
+	clearBuildFailure(id)
+	if _, ok := getBuildFailure(id); ok {
+		t.Fatal("the build failure should be cleared")
+	}
+}
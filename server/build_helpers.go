@@ -9,11 +9,18 @@ import (
 	"path"
 	"strings"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/esm-dev/esm.sh/server/storage"
 	"github.com/evanw/esbuild/pkg/api"
 	"github.com/ije/gox/utils"
 )
 
+// logger returns the logger of the build, the records have the fields of the package, the target
+// and the build key, so the logs of the concurrent builds are attributable.
+func (task *BuildTask) logger() *structLogger {
+	return log.Component("build").With("pkg", task.Pkg.Name, "version", task.Pkg.Version, "target", task.Target, "buildKey", task.ID())
+}
+
 func (task *BuildTask) ID() string {
 	if task.id != "" {
 		return task.id
@@ -114,11 +121,45 @@ func (task *BuildTask) getSavepath() string {
 	return path.Join("builds", task.ID())
 }
 
+// checkDependencyPolicy checks the installed dependency against the `policy` config before
+// bundling it into the build.
+func (task *BuildTask) checkDependencyPolicy(pkgName string) *PolicyViolation {
+	if cfg.Policy.IsEmpty() || isLocalSpecifier(pkgName) {
+		return nil
+	}
+	var p NpmPackageTemp
+	err := utils.ParseJSONFile(path.Join(task.realWd, "node_modules", pkgName, "package.json"), &p)
+	if err != nil {
+		// let esbuild report the missing dependency
+		return nil
+	}
+	info := p.ToNpmPackage()
+	if v := checkPackagePolicy(&cfg.Policy, pkgName, p.Version, info.License, true); v != nil {
+		return v
+	}
+	return checkInstallScriptsPolicy(info)
+}
+
+// getLockedVersion returns the version of the package in the lockfile of `?lock` query.
+func (task *BuildTask) getLockedVersion(name string) (string, bool) {
+	if task.Args.lock == "" {
+		return "", false
+	}
+	versions, err := getLockfile(task.Args.lock)
+	if err != nil {
+		return "", false
+	}
+	version, ok := versions[name]
+	return version, ok
+}
+
 func (task *BuildTask) getPackageInfo(name string) (pkg Pkg, p NpmPackage, fromPackageJSON bool, err error) {
 	pkgName, subpath := splitPkgPath(name)
 	var version string
 	if pkg, ok := task.Args.deps.Get(pkgName); ok {
 		version = pkg.Version
+	} else if v, ok := task.getLockedVersion(pkgName); ok {
+		version = v
 	} else if v, ok := task.npm.Dependencies[pkgName]; ok {
 		version = v
 	} else if v, ok = task.npm.PeerDependencies[pkgName]; ok {
@@ -139,7 +180,34 @@ func (task *BuildTask) getPackageInfo(name string) (pkg Pkg, p NpmPackage, fromP
 }
 
 func (task *BuildTask) isServerTarget() bool {
-	return task.Target == "deno" || task.Target == "denonext" || task.Target == "node"
+	return task.Target == "deno" || task.Target == "denonext" || task.isNodeTarget()
+}
+
+func (task *BuildTask) isNodeTarget() bool {
+	return task.Target == "node" || regexpNodeTarget.MatchString(task.Target)
+}
+
+// isTinyDependency returns true if the dependency has no dependencies and the size
+// of its entry is below the `inlineDepThreshold` config, e.g. `ms`, `is-number`.
+func (task *BuildTask) isTinyDependency(dep NpmPackage) bool {
+	if cfg == nil || cfg.InlineDepThreshold <= 0 || len(dep.Dependencies) > 0 {
+		return false
+	}
+	entry := dep.Module
+	if entry == "" {
+		entry = dep.Main
+	}
+	if entry == "" {
+		entry = "index.js"
+	}
+	pkgDir := path.Join(task.installDir, "node_modules", dep.Name)
+	for _, name := range []string{entry, entry + ".js", path.Join(entry, "index.js")} {
+		fi, err := os.Stat(path.Join(pkgDir, name))
+		if err == nil && !fi.IsDir() {
+			return fi.Size() < int64(cfg.InlineDepThreshold)
+		}
+	}
+	return false
 }
 
 func (task *BuildTask) isDenoTarget() bool {
@@ -167,6 +235,8 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 	esm = &ESMBuild{}
 
 	defer func() {
+		esm.License = npm.License
+		esm.Deprecated = npm.Deprecated
 		esm.FromCJS = npm.Main != "" && npm.Module == ""
 		esm.TypesOnly = isTypesOnlyPackage(npm)
 	}()
@@ -293,6 +363,17 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 											}
 											newExports.Set(key, subNewDefinies)
 										}
+										if sub, ok := value.(*orderedMap); ok {
+											subNewDefinies := newOrderedMap()
+											for e := sub.l.Front(); e != nil; e = e.Next() {
+												subKey, subValue := sub.Entry(e)
+												if s1, ok := subValue.(string); ok && s1 != name {
+													subNewDefinies.Set(subKey, strings.Replace(s1, "*", suffix, -1))
+													hitExports = true
+												}
+											}
+											newExports.Set(key, subNewDefinies)
+										}
 									}
 									exports = newExports
 								} else if s, ok := exports.(string); ok {
@@ -307,6 +388,15 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 						}
 					}
 				}
+				// use the declaration file next to the entry module, e.g. `./dist/sub.mjs` -> `./dist/sub.d.mts`
+				if npm.Types == "" {
+					for _, entry := range []string{npm.Module, npm.Main} {
+						if dts := toSiblingDTS(entry); dts != "" && fileExists(path.Join(wd, "node_modules", npm.Name, dts)) {
+							npm.Types = dts
+							break
+						}
+					}
+				}
 			}
 		}
 	}
@@ -346,7 +436,7 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 		npm.Module = ""
 		esm.HasExportDefault = ret.ExportDefault
 		esm.NamedExports = ret.Exports
-		log.Warnf("fake ES module '%s' of '%s'", npm.Main, npm.Name)
+		task.logger().Warnf("fake ES module '%s' of '%s'", npm.Main, npm.Name)
 		return
 	}
 
@@ -392,33 +482,12 @@ func (task *BuildTask) fixNpmPackage(p NpmPackage) NpmPackage {
 	}
 
 	if len(p.TypesVersions) > 0 {
-		var usedCondition string
-		for c, e := range p.TypesVersions {
-			if c == "*" && strings.HasPrefix(c, ">") || strings.HasPrefix(c, ">=") {
-				if usedCondition == "" || c == "*" || c > usedCondition {
-					if om, ok := e.(*orderedMap); ok {
-						d, ok := om.m["*"]
-						if !ok {
-							d, ok = om.m["."]
-						}
-						if ok {
-							if a, ok := d.([]interface{}); ok && len(a) > 0 {
-								if t, ok := a[0].(string); ok {
-									usedCondition = c
-									if strings.HasSuffix(t, "*") {
-										f := p.Types
-										if f == "" {
-											f = "index.d.ts"
-										}
-										t = path.Join(t[:len(t)-1], f)
-									}
-									p.Types = t
-								}
-							}
-						}
-					}
-				}
-			}
+		types := p.Types
+		if types == "" {
+			types = "index.d.ts"
+		}
+		if t, ok := resolveTypesVersions(p.TypesVersions, task.Args.tsVersion, types); ok {
+			p.Types = t
 		}
 	}
 
@@ -456,6 +525,22 @@ func (task *BuildTask) fixNpmPackage(p NpmPackage) NpmPackage {
 	}
 
 	nmDir := path.Join(task.wd, "node_modules")
+
+	// the build artifacts are usually not committed to the github repo,
+	// build from the source entry if the declared entry is missing
+	if task.Pkg.FromGithub {
+		entry := p.Module
+		if entry == "" {
+			entry = p.Main
+		}
+		if entry != "" && !existsEntry(path.Join(nmDir, p.Name, entry)) {
+			if source := findSourceEntry(path.Join(nmDir, p.Name), p.Source); source != "" {
+				p.Module = source
+				p.Main = ""
+			}
+		}
+	}
+
 	if p.Module == "" {
 		if p.JsNextMain != "" && fileExists(path.Join(nmDir, p.Name, p.JsNextMain)) {
 			p.Module = p.JsNextMain
@@ -473,9 +558,22 @@ func (task *BuildTask) fixNpmPackage(p NpmPackage) NpmPackage {
 			p.Main = "./index.js"
 		} else if fileExists(path.Join(nmDir, p.Name, "index.cjs")) {
 			p.Main = "./index.cjs"
+		} else {
+			// the package ships only typescript sources
+			for _, name := range []string{"index.ts", "index.mts", "index.tsx", "src/index.ts", "src/index.tsx"} {
+				if fileExists(path.Join(nmDir, p.Name, name)) {
+					p.Module = "./" + name
+					break
+				}
+			}
 		}
 	}
 
+	// compile the typescript entry with esbuild, e.g. `"main": "index.ts"`
+	if p.Module == "" && isTSFile(p.Main) {
+		p.Module = p.Main
+	}
+
 	if p.Module != "" && !strings.HasPrefix(p.Module, "./") && !strings.HasPrefix(p.Module, "../") {
 		p.Module = "." + utils.CleanPath(p.Module)
 	}
@@ -557,6 +655,133 @@ func (task *BuildTask) fixNpmPackage(p NpmPackage) NpmPackage {
 	return p
 }
 
+// toSiblingDTS returns the declaration file path of the given module path by the typescript rules.
+func toSiblingDTS(modulePath string) string {
+	switch ext := path.Ext(modulePath); ext {
+	case ".js", ".jsx":
+		return strings.TrimSuffix(modulePath, ext) + ".d.ts"
+	case ".mjs":
+		return strings.TrimSuffix(modulePath, ext) + ".d.mts"
+	case ".cjs":
+		return strings.TrimSuffix(modulePath, ext) + ".d.cts"
+	case "":
+		if modulePath != "" {
+			return modulePath + ".d.ts"
+		}
+	}
+	return ""
+}
+
+// existsEntry checks if the entry file exists, the extension of the entry can be omitted.
+func existsEntry(filename string) bool {
+	if fileExists(filename) {
+		return true
+	}
+	for _, ext := range []string{".js", ".mjs", ".cjs"} {
+		if fileExists(filename + ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// findSourceEntry finds the source entry of the package, the `source` field of package.json
+// takes precedence over the conventional entries.
+func findSourceEntry(pkgDir string, source string) string {
+	candidates := []string{"src/index.ts", "src/index.tsx", "src/index.mts", "src/index.js", "src/index.mjs", "src/main.ts", "index.ts", "mod.ts", "lib/index.ts"}
+	if source != "" {
+		candidates = append([]string{source}, candidates...)
+	}
+	for _, name := range candidates {
+		if fileExists(path.Join(pkgDir, name)) {
+			return "./" + strings.TrimPrefix(utils.CleanPath(name), "/")
+		}
+	}
+	return ""
+}
+
+// resolveTypesVersions resolves the types path by the `typesVersions` field of package.json, the
+// entry of the newest version range that matches the typescript version is used.
+// see https://www.typescriptlang.org/docs/handbook/declaration-files/publishing.html#version-selection-with-typesversions
+func resolveTypesVersions(typesVersions map[string]interface{}, tsVersion string, subpath string) (string, bool) {
+	if tsVersion == "" {
+		tsVersion = tsLatestVersion
+	}
+	tsv, err := semver.NewVersion(tsVersion)
+	if err != nil {
+		return "", false
+	}
+
+	var paths map[string]interface{}
+	var lowerBound *semver.Version
+	for r, v := range typesVersions {
+		c, err := semver.NewConstraint(r)
+		if err != nil || !c.Check(tsv) {
+			continue
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// the key order of `typesVersions` is lost in the map, use the lower bound of the range
+		// to find the newest matched entry
+		lb := semver.MustParse("0.0.0")
+		if !strings.HasPrefix(r, "<") {
+			if s := regexpVersionNumber.FindString(r); s != "" {
+				if v, err := semver.NewVersion(s); err == nil {
+					lb = v
+				}
+			}
+		}
+		if lowerBound == nil || lb.GreaterThan(lowerBound) {
+			paths = m
+			lowerBound = lb
+		}
+	}
+	if paths == nil {
+		return "", false
+	}
+
+	subpath = strings.TrimPrefix(subpath, "./")
+	star := ""
+	target, ok := paths[subpath]
+	if !ok {
+		// use the wildcard pattern with the longest prefix
+		prefixLen := -1
+		for pattern, v := range paths {
+			prefix, suffix := utils.SplitByFirstByte(pattern, '*')
+			if len(prefix)+len(suffix) == len(pattern) || len(prefix) <= prefixLen {
+				continue
+			}
+			if len(subpath) >= len(prefix)+len(suffix) && strings.HasPrefix(subpath, prefix) && strings.HasSuffix(subpath, suffix) {
+				star = subpath[len(prefix) : len(subpath)-len(suffix)]
+				prefixLen = len(prefix)
+				target = v
+			}
+		}
+	}
+	if a, ok := target.([]interface{}); ok && len(a) > 0 {
+		if s, ok := a[0].(string); ok {
+			return strings.TrimPrefix(strings.Replace(s, "*", star, 1), "./"), true
+		}
+	}
+	return "", false
+}
+
+// getBanner returns the `banner` config joined with the named banner of the `?banner` query.
+func (task *BuildTask) getBanner() string {
+	banners := []string{}
+	if cfg.Banner != "" {
+		banners = append(banners, cfg.Banner)
+	}
+	if task.Args.banner != "" {
+		if banner, ok := cfg.Banners[task.Args.banner]; ok && banner != "" {
+			banners = append(banners, banner)
+		}
+	}
+	return strings.Join(banners, "\n")
+}
+
 // see https://nodejs.org/api/packages.html
 func (task *BuildTask) applyConditions(p *NpmPackage, exports interface{}, pType string) {
 	s, ok := exports.(string)
@@ -578,22 +803,34 @@ func (task *BuildTask) applyConditions(p *NpmPackage, exports interface{}, pType
 		if pType == "module" || hasRequireCondition || hasNodeCondition {
 			conditions = append(conditions, "default")
 		}
-		switch task.Target {
-		case "deno", "denonext":
+		switch {
+		case task.isDenoTarget():
 			targetConditions = []string{"deno", "worker"}
 			conditions = append(conditions, "browser")
 			// priority use `node` condition for solid.js (< 1.5.6) in deno
 			if (p.Name == "solid-js" || strings.HasPrefix(p.Name, "solid-js/")) && semverLessThan(p.Version, "1.5.6") {
 				targetConditions = []string{"node"}
 			}
-		case "node":
+		case task.isNodeTarget():
 			targetConditions = []string{"node"}
+		case task.Target == "workerd":
+			targetConditions = []string{"workerd", "worker"}
+			conditions = append(conditions, "browser")
 		}
 		if task.Dev {
 			targetConditions = append(targetConditions, "development")
 		}
 		if task.Args.conditions.Len() > 0 {
-			targetConditions = append(task.Args.conditions.Values(), targetConditions...)
+			// the custom conditions are matched in the key order of the `exports` object like node does,
+			// the order of the `?conditions` query doesn't matter
+			customConditions := []string{}
+			for e := om.l.Front(); e != nil; e = e.Next() {
+				key := e.Value.(string)
+				if task.Args.conditions.Has(key) {
+					customConditions = append(customConditions, key)
+				}
+			}
+			targetConditions = append(customConditions, targetConditions...)
 		}
 		for _, condition := range append(targetConditions, conditions...) {
 			v, ok := om.m[condition]
@@ -602,6 +839,8 @@ func (task *BuildTask) applyConditions(p *NpmPackage, exports interface{}, pType
 				break
 			}
 		}
+		// prefer the types of the ES module to the types of the commonjs module
+		moduleTypes := p.Types
 		for _, condition := range append(targetConditions, "require", "node", "default") {
 			v, ok := om.m[condition]
 			if ok {
@@ -609,6 +848,9 @@ func (task *BuildTask) applyConditions(p *NpmPackage, exports interface{}, pType
 				break
 			}
 		}
+		if moduleTypes != "" {
+			p.Types = moduleTypes
+		}
 		for e := om.l.Front(); e != nil; e = e.Next() {
 			key := e.Value.(string)
 			value := om.m[key]
@@ -631,11 +873,8 @@ func queryESMBuild(id string) (*ESMBuild, bool) {
 		var esm ESMBuild
 		err = json.Unmarshal(value, &esm)
 		if err == nil {
-			if strings.HasPrefix(id, "stable/") {
-				id = fmt.Sprintf("v%d/", STABLE_VERSION) + strings.TrimPrefix(id, "stable/")
-			}
 			if !esm.TypesOnly {
-				_, err = fs.Stat(path.Join("builds", id))
+				_, err = fs.Stat(getBuildSavepath(id))
 			}
 			if err == nil || os.IsExist(err) {
 				return &esm, true
@@ -643,6 +882,9 @@ func queryESMBuild(id string) (*ESMBuild, bool) {
 		}
 		// delete the invalid db entry
 		db.Delete(id)
+	} else if locker != nil || cfg.ReadOnly {
+		// the module may be built by another replica
+		return loadSharedBuild(id)
 	}
 	return nil, false
 }
@@ -714,7 +956,8 @@ func copyRawBuildFile(id string, name string, dir string) (err error) {
 	return
 }
 
-func bundleNodePolyfill(name string, globalName string, namedExport string, target api.Target) ([]byte, error) {
+func bundleNodePolyfill(name string, globalName string, namedExport string, target string) ([]byte, error) {
+	esbuildTarget, supported := getEsbuildTarget(target)
 	ret := api.Build(api.BuildOptions{
 		Stdin: &api.StdinOptions{
 			Contents: fmt.Sprintf(`import * as e from "node_%s.js";globalThis.%s=e.%s`, name, globalName, namedExport),
@@ -722,7 +965,8 @@ func bundleNodePolyfill(name string, globalName string, namedExport string, targ
 		},
 		Write:             false,
 		Bundle:            true,
-		Target:            target,
+		Target:            esbuildTarget,
+		Supported:         supported,
 		Format:            api.FormatIIFE,
 		Platform:          api.PlatformBrowser,
 		MinifyWhitespace:  true,
@@ -759,9 +1003,11 @@ func bundleNodePolyfill(name string, globalName string, namedExport string, targ
 	return ret.OutputFiles[0].Contents, nil
 }
 
-func minify(code string, target api.Target, loader api.Loader) ([]byte, error) {
+func minify(code string, target string, loader api.Loader) ([]byte, error) {
+	esbuildTarget, supported := getEsbuildTarget(target)
 	ret := api.Transform(code, api.TransformOptions{
-		Target:            target,
+		Target:            esbuildTarget,
+		Supported:         supported,
 		Format:            api.FormatESModule,
 		Platform:          api.PlatformBrowser,
 		MinifyWhitespace:  true,
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestApplyConditions(t *testing.T) {
+	exports := newOrderedMap()
+	err := json.Unmarshal([]byte(`{
+		"react-server": "./server.mjs",
+		"development": "./dev.mjs",
+		"import": "./index.mjs",
+		"require": "./index.cjs"
+	}`), exports)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		conditions []string
+		module     string
+	}{
+		{nil, "./index.mjs"},
+		{[]string{"development"}, "./dev.mjs"},
+		{[]string{"react-server"}, "./server.mjs"},
+		{[]string{"development", "react-server"}, "./server.mjs"},
+		{[]string{"custom"}, "./index.mjs"},
+	} {
+		task := &BuildTask{
+			Target: "es2022",
+			Args:   BuildArgs{conditions: newStringSet(c.conditions...)},
+		}
+		p := NpmPackage{Name: "foo"}
+		task.applyConditions(&p, exports, "module")
+		if p.Module != c.module {
+			t.Fatalf("conditions %v: expected module '%s', got '%s'", c.conditions, c.module, p.Module)
+		}
+	}
+}
+
+func TestResolveTypesVersions(t *testing.T) {
+	var typesVersions map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"<4.0": { "*": ["ts3.4/*"] },
+		">=4.0": { "index.d.ts": ["ts4.0/index.d.ts"], "*": ["ts4.0/*"] },
+		">=5.0": { "*": ["ts5.0/*"], "utils/*": ["ts5.0/utils/*.d.ts"] }
+	}`), &typesVersions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		tsVersion string
+		subpath   string
+		expected  string
+	}{
+		{"", "index.d.ts", "ts5.0/index.d.ts"},
+		{"5.3", "./foo.d.ts", "ts5.0/foo.d.ts"},
+		{"5.3", "utils/bar", "ts5.0/utils/bar.d.ts"},
+		{"4.9", "index.d.ts", "ts4.0/index.d.ts"},
+		{"4.9", "foo.d.ts", "ts4.0/foo.d.ts"},
+		{"3.9", "index.d.ts", "ts3.4/index.d.ts"},
+	} {
+		types, ok := resolveTypesVersions(typesVersions, c.tsVersion, c.subpath)
+		if !ok || types != c.expected {
+			t.Fatalf("ts@%s %s: expected '%s', got '%s'", c.tsVersion, c.subpath, c.expected, types)
+		}
+	}
+}
+
+func TestApplyConditionsTypes(t *testing.T) {
+	exports := newOrderedMap()
+	err := json.Unmarshal([]byte(`{
+		"import": { "types": "./esm/index.d.mts", "default": "./esm/index.mjs" },
+		"require": { "types": "./cjs/index.d.ts", "default": "./cjs/index.js" }
+	}`), exports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &BuildTask{
+		Target: "es2022",
+		Args:   BuildArgs{conditions: newStringSet()},
+	}
+	p := NpmPackage{Name: "foo"}
+	task.applyConditions(&p, exports, "module")
+	if p.Module != "./esm/index.mjs" || p.Main != "./cjs/index.js" {
+		t.Fatalf("invalid entries: module '%s', main '%s'", p.Module, p.Main)
+	}
+	if p.Types != "./esm/index.d.mts" {
+		t.Fatalf("should use the types of the ES module, got '%s'", p.Types)
+	}
+}
+
+func TestToSiblingDTS(t *testing.T) {
+	for input, expected := range map[string]string{
+		"./dist/sub.js":  "./dist/sub.d.ts",
+		"./dist/sub.mjs": "./dist/sub.d.mts",
+		"./dist/sub.cjs": "./dist/sub.d.cts",
+		"./dist/sub":     "./dist/sub.d.ts",
+		"./dist/sub.css": "",
+		"":               "",
+	} {
+		if dts := toSiblingDTS(input); dts != expected {
+			t.Fatalf("invalid sibling dts of '%s': expected '%s', got '%s'", input, expected, dts)
+		}
+	}
+}
+
+func TestFindSourceEntry(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"src/index.ts", "lib/main.ts", "dist/index.js"} {
+		ensureDir(path.Dir(path.Join(dir, name)))
+		if err := os.WriteFile(path.Join(dir, name), []byte("export default 1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !existsEntry(path.Join(dir, "dist/index")) {
+		t.Fatal("dist/index should exist")
+	}
+	if existsEntry(path.Join(dir, "dist/index.mjs")) {
+		t.Fatal("dist/index.mjs should not exist")
+	}
+	if s := findSourceEntry(dir, ""); s != "./src/index.ts" {
+		t.Fatalf("expected ./src/index.ts, got %s", s)
+	}
+	if s := findSourceEntry(dir, "lib/main.ts"); s != "./lib/main.ts" {
+		t.Fatalf("expected ./lib/main.ts, got %s", s)
+	}
+	if s := findSourceEntry(t.TempDir(), ""); s != "" {
+		t.Fatalf("expected empty entry, got %s", s)
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	rtmetrics "runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// BuildLimitError is returned when a build exceeds a limit of the `buildLimits` config.
+type BuildLimitError struct {
+	// Limit is the name of the exceeded limit, e.g. "timeout", "maxMemory", "maxExtractedSize".
+	Limit   string
+	Message string
+}
+
+func (e *BuildLimitError) Error() string {
+	return fmt.Sprintf("build resource limit exceeded (%s): %s", e.Limit, e.Message)
+}
+
+// getBuildLimit returns the name of the exceeded limit of the build error, or an empty string.
+func getBuildLimit(err error) string {
+	var e *BuildLimitError
+	if errors.As(err, &e) {
+		return e.Limit
+	}
+	if f, ok := err.(*BuildFailure); ok {
+		return f.Limit
+	}
+	return ""
+}
+
+// heapSize returns the bytes of the heap objects of the server.
+func heapSize() uint64 {
+	sample := []rtmetrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	rtmetrics.Read(sample)
+	if sample[0].Value.Kind() != rtmetrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// runESBuild runs esbuild with the options, the build is canceled if it takes longer than the
+// `timeout`, or the heap of the server exceeds the `maxMemory` of the `buildLimits` config.
+func runESBuild(options api.BuildOptions) (result api.BuildResult, err error) {
+	ctx, ctxErr := api.Context(options)
+	if ctxErr != nil {
+		return api.BuildResult{Errors: ctxErr.Errors}, nil
+	}
+	defer ctx.Dispose()
+
+	done := make(chan struct{})
+	exceeded := make(chan *BuildLimitError, 1)
+	go func() {
+		timeout := time.Duration(cfg.BuildLimits.Timeout) * time.Second
+		maxMemory := uint64(cfg.BuildLimits.MaxMemory) * 1024 * 1024
+		if timeout <= 0 {
+			timeout = 10 * time.Minute
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+				exceeded <- &BuildLimitError{Limit: "timeout", Message: fmt.Sprintf("esbuild is not finished in %v", timeout)}
+				ctx.Cancel()
+				return
+			case <-ticker.C:
+				if maxMemory > 0 {
+					if size := heapSize(); size > maxMemory {
+						exceeded <- &BuildLimitError{Limit: "maxMemory", Message: fmt.Sprintf("the heap size %dMB exceeds %dMB", size/1024/1024, cfg.BuildLimits.MaxMemory)}
+						ctx.Cancel()
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	result = ctx.Rebuild()
+	close(done)
+	select {
+	case e := <-exceeded:
+		err = e
+	default:
+	}
+	return
+}
+
+// checkTarballLimits checks the extracted size and the file count of the tarball against the
+// `maxExtractedSize` and `maxExtractedFiles` of the `buildLimits` config, to stop the zip-bombs
+// before they are extracted.
+func checkTarballLimits(tarballPath string) error {
+	f, err := os.Open(tarballPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	counter := &extractCounter{}
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := counter.add(path.Base(tarballPath), h); err != nil {
+			return err
+		}
+	}
+}
+
+// extractCounter counts the extracted files of a tarball.
+type extractCounter struct {
+	size  int64
+	files int
+}
+
+func (c *extractCounter) add(name string, h *tar.Header) error {
+	c.files++
+	if h.Typeflag == tar.TypeReg {
+		c.size += h.Size
+	}
+	if max := cfg.BuildLimits.MaxExtractedFiles; max > 0 && c.files > max {
+		return &BuildLimitError{Limit: "maxExtractedFiles", Message: fmt.Sprintf("%s has more than %d files", name, cfg.BuildLimits.MaxExtractedFiles)}
+	}
+	if max := cfg.BuildLimits.MaxExtractedSize; max > 0 && c.size > max {
+		return &BuildLimitError{Limit: "maxExtractedSize", Message: fmt.Sprintf("%s is larger than %d bytes after extraction", name, cfg.BuildLimits.MaxExtractedSize)}
+	}
+	return nil
+}
+
+// runInstallCommand runs the pnpm command with the `installTimeout` and the `installMemory`
+// limits, the process is moved into the `cgroup` if it's set.
+func runInstallCommand(dir string, env []string, name string, args ...string) (output []byte, err error) {
+	timeout := time.Duration(cfg.BuildLimits.InstallTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	if cfg.BuildLimits.InstallMemory > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("NODE_OPTIONS=--max-old-space-size=%d", cfg.BuildLimits.InstallMemory))
+	}
+	buf := bytes.NewBuffer(nil)
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	if cg := cfg.BuildLimits.Cgroup; cg != "" {
+		// the child processes that are spawned later inherit the cgroup
+		if e := os.WriteFile(path.Join(cg, "cgroup.procs"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); e != nil {
+			log.Warnf("failed to move the %s process into the cgroup %s: %v", name, cg, e)
+		}
+	}
+	err = cmd.Wait()
+	output = buf.Bytes()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = &BuildLimitError{Limit: "installTimeout", Message: fmt.Sprintf("%s is not finished in %v", name, timeout)}
+		} else if bytes.Contains(output, []byte("JavaScript heap out of memory")) {
+			err = &BuildLimitError{Limit: "installMemory", Message: fmt.Sprintf("%s exceeds the heap size of %dMB", name, cfg.BuildLimits.InstallMemory)}
+		} else if cfg.BuildLimits.Cgroup != "" && strings.Contains(err.Error(), "signal: killed") {
+			err = &BuildLimitError{Limit: "cgroup", Message: fmt.Sprintf("%s is killed by the cgroup %s", name, cfg.BuildLimits.Cgroup)}
+		}
+	}
+	return
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func writeTestTarball(t *testing.T, filename string, files int, size int) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	data := []byte(strings.Repeat("0", size))
+	for i := 0; i < files; i++ {
+		tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("package/%d.js", i), Mode: 0644, Size: int64(size), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	tw.Close()
+	gw.Close()
+}
+
+func TestCheckTarballLimits(t *testing.T) {
+	defer func(prev *config.Config) {
+		cfg = prev
+	}(cfg)
+	cfg = &config.Config{BuildLimits: config.BuildLimits{MaxExtractedSize: 1024 * 1024, MaxExtractedFiles: 100}}
+
+	dir := t.TempDir()
+	for name, c := range map[string]struct {
+		files int
+		size  int
+		limit string
+	}{
+		"ok.tgz":       {10, 1024, ""},
+		"files.tgz":    {101, 1, "maxExtractedFiles"},
+		"zip-bomb.tgz": {2, 1024 * 1024, "maxExtractedSize"},
+	} {
+		filename := path.Join(dir, name)
+		writeTestTarball(t, filename, c.files, c.size)
+		if limit := getBuildLimit(checkTarballLimits(filename)); limit != c.limit {
+			t.Fatalf("%s: expected limit %q, got %q", name, c.limit, limit)
+		}
+	}
+}
+
+func TestRunInstallCommandTimeout(t *testing.T) {
+	defer func(prev *config.Config) {
+		cfg = prev
+	}(cfg)
+	cfg = &config.Config{BuildLimits: config.BuildLimits{InstallTimeout: 1}}
+
+	_, err := runInstallCommand(t.TempDir(), os.Environ(), "sleep", "5")
+	if getBuildLimit(err) != "installTimeout" {
+		t.Fatalf("expected the install timeout error, got %v", err)
+	}
+	err = fmt.Errorf("Fail to install package: %w", err)
+	if getBuildLimit(err) != "installTimeout" || !strings.Contains(err.Error(), "build resource limit exceeded (installTimeout)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	output, err := runInstallCommand(t.TempDir(), os.Environ(), "echo", "ok")
+	if err != nil || strings.TrimSpace(string(output)) != "ok" {
+		t.Fatalf("unexpected output %q: %v", output, err)
+	}
+}
+
+func TestRunESBuild(t *testing.T) {
+	defer func(prev *config.Config) {
+		cfg = prev
+	}(cfg)
+	cfg = &config.Config{BuildLimits: config.BuildLimits{Timeout: 10}}
+
+	ret, err := runESBuild(api.BuildOptions{
+		Stdin: &api.StdinOptions{Contents: `export const foo = 1 + 1`, Loader: api.LoaderJS},
+		Write: false,
+	})
+	if err != nil || len(ret.Errors) > 0 || len(ret.OutputFiles) != 1 {
+		t.Fatalf("unexpected result: %v %v", ret.Errors, err)
+	}
+	if !strings.Contains(string(ret.OutputFiles[0].Contents), "foo = 1 + 1") {
+		t.Fatalf("unexpected output: %s", ret.OutputFiles[0].Contents)
+	}
+}
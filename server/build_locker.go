@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+const (
+	buildLockTTL          = 30 * time.Second
+	buildLockPollInterval = 500 * time.Millisecond
+)
+
+// buildWithLock builds the task with the `locker` config to de-duplicate the builds across the
+// server replicas: the replica that holds the lock builds the task and publishes the build
+// record to the shared storage, the others wait for the record.
+func buildWithLock(task *BuildTask) (*ESMBuild, error) {
+	// the `raw` and `types` tasks write the local files only
+	if locker == nil || task.Target == "raw" || task.Target == "types" {
+		return task.Build()
+	}
+
+	key := "build:" + task.ID()
+	owner := newLockOwner()
+	deadline := time.Now().Add(10 * time.Minute)
+	for {
+		ok, err := locker.Lock(key, owner, buildLockTTL)
+		if err != nil {
+			task.logger().Warnf("locker: %v, build without the lock", err)
+			return task.Build()
+		}
+		if ok {
+			break
+		}
+		// another replica is building the task
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("build '%s': timeout to wait for the lock", task.ID())
+		}
+		time.Sleep(buildLockPollInterval)
+		if esm, ok := loadSharedBuild(task.ID()); ok {
+			return esm, nil
+		}
+	}
+
+	// refresh the lock until the build is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(buildLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				locker.Unlock(key, owner)
+				return
+			case <-ticker.C:
+				if ok, err := locker.Refresh(key, owner, buildLockTTL); err != nil || !ok {
+					task.logger().Warnf("locker: lost the lock of the build")
+				}
+			}
+		}
+	}()
+
+	// the task may be built by another replica before the lock is acquired
+	if esm, ok := loadSharedBuild(task.ID()); ok {
+		return esm, nil
+	}
+
+	esm, err := task.Build()
+	if err == nil && esm != nil {
+		_, err := fs.WriteFile(getBuildSavepath(task.ID())+".meta", bytes.NewReader(utils.MustEncodeJSON(esm)))
+		if err != nil {
+			task.logger().Errorf("fs: %v", err)
+		}
+	}
+	return esm, err
+}
+
+// loadSharedBuild loads the build record that is published by another replica, and stores it
+// into the database.
+func loadSharedBuild(id string) (*ESMBuild, bool) {
+	f, err := fs.OpenFile(getBuildSavepath(id) + ".meta")
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	var esm ESMBuild
+	if json.NewDecoder(f).Decode(&esm) != nil {
+		return nil, false
+	}
+	if err = db.Put(id, utils.MustEncodeJSON(esm)); err != nil {
+		log.Component("build").Errorf("db: %v", err)
+	}
+	return &esm, true
+}
+
+// getBuildSavepath returns the path of the build in the storage.
+func getBuildSavepath(id string) string {
+	if strings.HasPrefix(id, "stable/") {
+		id = fmt.Sprintf("v%d/", STABLE_VERSION) + strings.TrimPrefix(id, "stable/")
+	}
+	return path.Join("builds", id)
+}
+
+func newLockOwner() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
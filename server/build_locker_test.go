@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestBuildWithLock(t *testing.T) {
+	dir := t.TempDir()
+	localFS, err := storage.OpenFS("local:" + path.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltDB, err := storage.OpenDB("bolt:" + path.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltDB.Close()
+	memoryLocker, err := storage.OpenLocker("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prevFS storage.FileSystem, prevDB storage.DataBase, prevLocker storage.Locker) {
+		fs, db, locker = prevFS, prevDB, prevLocker
+	}(fs, db, locker)
+	fs, db, locker = localFS, boltDB, memoryLocker
+
+	id := "v135/react@18.2.0/es2022/react.mjs"
+	task := &BuildTask{id: id, Target: "es2022"}
+
+	// another replica is building the module
+	locker.Lock("build:"+id, "replica-2", time.Minute)
+	go func() {
+		time.Sleep(time.Second)
+		fs.WriteFile(path.Join("builds", id), bytes.NewBufferString("export default {}"))
+		fs.WriteFile(path.Join("builds", id)+".meta", bytes.NewReader(utils.MustEncodeJSON(ESMBuild{HasExportDefault: true})))
+		locker.Unlock("build:"+id, "replica-2")
+	}()
+
+	esm, err := buildWithLock(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !esm.HasExportDefault {
+		t.Fatalf("unexpected build record: %+v", esm)
+	}
+	// the record is stored into the local database
+	if esm, ok := queryESMBuild(id); !ok || !esm.HasExportDefault {
+		t.Fatal("the build record should be stored into the database")
+	}
+
+	// the record of the build by another replica
+	id = "v135/react@18.2.0/es2022/jsx-runtime.js"
+	fs.WriteFile(path.Join("builds", id), bytes.NewBufferString("export {}"))
+	fs.WriteFile(path.Join("builds", id)+".meta", bytes.NewReader(utils.MustEncodeJSON(ESMBuild{FromCJS: true})))
+	if esm, ok := queryESMBuild(id); !ok || !esm.FromCJS {
+		t.Fatal("should load the build record from the shared storage")
+	}
+}
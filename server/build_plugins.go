@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+var (
+	buildPluginsLock sync.RWMutex
+	buildPlugins     []api.Plugin
+)
+
+// RegisterBuildPlugin registers an esbuild plugin that will be applied to all builds,
+// the plugins run in the registration order before the internal `esm` plugin, so they
+// can rewrite or externalize the imports.
+func RegisterBuildPlugin(plugin api.Plugin) error {
+	if plugin.Name == "" || plugin.Setup == nil {
+		return fmt.Errorf("invalid build plugin: missing name or setup")
+	}
+
+	buildPluginsLock.Lock()
+	defer buildPluginsLock.Unlock()
+
+	for _, p := range buildPlugins {
+		if p.Name == plugin.Name {
+			return fmt.Errorf("build plugin '%s' has been registered", plugin.Name)
+		}
+	}
+	buildPlugins = append(buildPlugins, plugin)
+	return nil
+}
+
+// getBuildPlugins returns the registered build plugins.
+func getBuildPlugins() []api.Plugin {
+	buildPluginsLock.RLock()
+	defer buildPluginsLock.RUnlock()
+
+	plugins := make([]api.Plugin, len(buildPlugins))
+	copy(plugins, buildPlugins)
+	return plugins
+}
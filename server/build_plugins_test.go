@@ -0,0 +1,24 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func TestRegisterBuildPlugin(t *testing.T) {
+	plugin := api.Plugin{Name: "test", Setup: func(build api.PluginBuild) {}}
+	if err := RegisterBuildPlugin(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterBuildPlugin(plugin); err == nil {
+		t.Fatal("should not register the plugin twice")
+	}
+	if err := RegisterBuildPlugin(api.Plugin{Name: "no-setup"}); err == nil {
+		t.Fatal("should not register the plugin without setup")
+	}
+	plugins := getBuildPlugins()
+	if len(plugins) != 1 || plugins[0].Name != "test" {
+		t.Fatalf("invalid build plugins: %v", plugins)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// the max number of the esbuild warnings that are kept in the build meta
+const maxBuildWarnings = 20
+
+// BuildStatus is the result of the build status API.
+type BuildStatus struct {
+	ID     string `json:"id"`
+	Exists bool   `json:"exists"`
+	// Status is "built", "building", "queued" or "missing"
+	Status         string   `json:"status"`
+	BuiltAt        string   `json:"builtAt,omitempty"`
+	ServerVersion  int      `json:"serverVersion,omitempty"`
+	EsbuildVersion string   `json:"esbuildVersion,omitempty"`
+	Size           int64    `json:"size"`
+	Deps           []string `json:"deps"`
+	MissingDeps    []string `json:"missingDeps"`
+	Warnings       []string `json:"warnings"`
+	Types          string   `json:"types,omitempty"`
+}
+
+// getBuildStatus returns the status of the module build of the package path (`PKG@VERSION/SUBPATH`)
+// without triggering a build, the default target is "es2022".
+func getBuildStatus(pathname string, target string, dev bool, bundle bool) (*BuildStatus, error) {
+	pkg, _, err := validatePkgPath("/" + strings.TrimPrefix(pathname, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if target == "" {
+		target = "es2022"
+	} else if !isValidTarget(target) {
+		return nil, fmt.Errorf("invalid target '%s'", target)
+	}
+	task := &BuildTask{
+		Args: BuildArgs{
+			alias:      map[string]string{},
+			deps:       PkgSlice{},
+			external:   newStringSet(),
+			exports:    newStringSet(),
+			conditions: newStringSet(),
+		},
+		BuildVersion: VERSION,
+		Pkg:          pkg,
+		Target:       target,
+		Dev:          dev,
+		Bundle:       bundle,
+	}
+	status := &BuildStatus{
+		ID:          task.ID(),
+		Status:      "missing",
+		Deps:        []string{},
+		MissingDeps: []string{},
+		Warnings:    []string{},
+	}
+
+	esm, ok := queryESMBuild(status.ID)
+	if !ok {
+		buildQueue.lock.RLock()
+		if t, ok := buildQueue.tasks[status.ID]; ok {
+			if t.inProcess {
+				status.Status = "building"
+			} else {
+				status.Status = "queued"
+			}
+		}
+		buildQueue.lock.RUnlock()
+		return status, nil
+	}
+
+	status.Exists = true
+	status.Status = "built"
+	status.ServerVersion = esm.ServerVersion
+	status.EsbuildVersion = esm.EsbuildVersion
+	status.Types = esm.Dts
+	if esm.Warnings != nil {
+		status.Warnings = esm.Warnings
+	}
+	if !esm.TypesOnly {
+		fi, err := fs.Stat(getBuildSavepath(status.ID))
+		if err != nil {
+			return nil, err
+		}
+		status.Size = fi.Size()
+		// the builds before the build info was recorded
+		if esm.BuiltAt == 0 {
+			esm.BuiltAt = fi.ModTime().Unix()
+		}
+	}
+	if esm.BuiltAt > 0 {
+		status.BuiltAt = time.Unix(esm.BuiltAt, 0).UTC().Format(time.RFC3339)
+	}
+	for _, dep := range esm.Deps {
+		status.Deps = append(status.Deps, dep)
+		// the deps of the other packages, not the node polyfills or the remote modules
+		if !strings.HasPrefix(dep, "/") || !strings.Contains(dep, "@") {
+			continue
+		}
+		id, _, _ := strings.Cut(strings.TrimPrefix(dep, "/"), "?")
+		if _, ok := queryESMBuild(id); !ok {
+			status.MissingDeps = append(status.MissingDeps, dep)
+		}
+	}
+	return status, nil
+}
+
+// formatBuildWarning formats the esbuild warning as `file:line:column: text`.
+func formatBuildWarning(w api.Message) string {
+	text := w.Text
+	if w.Location != nil {
+		text = fmt.Sprintf("%s:%d:%d: %s", w.Location.File, w.Location.Line, w.Location.Column, text)
+	}
+	return redact(text)
+}
+
+var esbuildVersion struct {
+	once    sync.Once
+	version string
+}
+
+// getEsbuildVersion returns the version of the esbuild module that is linked into the server.
+func getEsbuildVersion() string {
+	esbuildVersion.once.Do(func() {
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/evanw/esbuild" {
+				esbuildVersion.version = strings.TrimPrefix(dep.Version, "v")
+				if dep.Replace != nil {
+					esbuildVersion.version = strings.TrimPrefix(dep.Replace.Version, "v")
+				}
+				break
+			}
+		}
+	})
+	return esbuildVersion.version
+}
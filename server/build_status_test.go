@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestBuildStatus(t *testing.T) {
+	dir := t.TempDir()
+	localFS, err := storage.OpenFS("local:" + path.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltDB, err := storage.OpenDB("bolt:" + path.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltDB.Close()
+	defer func(prevFS storage.FileSystem, prevDB storage.DataBase, prevQueue *BuildQueue, prevCfg *config.Config) {
+		fs, db, buildQueue, cfg = prevFS, prevDB, prevQueue, prevCfg
+	}(fs, db, buildQueue, cfg)
+	fs, db, buildQueue, cfg = localFS, boltDB, newBuildQueue(0), &config.Config{}
+
+	id := fmt.Sprintf("v%d/react-dom@18.3.1/es2022/client.js", VERSION)
+	builtDep := fmt.Sprintf("/v%d/scheduler@0.23.2/es2022/scheduler.mjs", VERSION)
+	missingDep := fmt.Sprintf("/v%d/react@18.3.1/es2022/react.mjs", VERSION)
+	fs.WriteFile(path.Join("builds", id), bytes.NewBufferString("export default {}"))
+	db.Put(id, utils.MustEncodeJSON(ESMBuild{
+		Deps:           []string{builtDep, missingDep, "/node/process.mjs"},
+		BuiltAt:        1700000000,
+		ServerVersion:  VERSION,
+		EsbuildVersion: "0.19.2",
+		Warnings:       []string{"client.js:1:0: the import is never used"},
+	}))
+	fs.WriteFile(path.Join("builds", builtDep[1:]), bytes.NewBufferString("export default {}"))
+	db.Put(builtDep[1:], utils.MustEncodeJSON(ESMBuild{}))
+
+	status, err := getBuildStatus("react-dom@18.3.1/client", "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Exists || status.Status != "built" || status.ID != id || status.Size != 17 || status.BuiltAt != "2023-11-14T22:13:20Z" || status.EsbuildVersion != "0.19.2" || status.ServerVersion != VERSION {
+		t.Fatalf("unexpected build status: %+v", status)
+	}
+	if len(status.Deps) != 3 || len(status.MissingDeps) != 1 || status.MissingDeps[0] != missingDep || len(status.Warnings) != 1 {
+		t.Fatalf("unexpected build status: %+v", status)
+	}
+
+	// the status API doesn't trigger the build
+	status, err = getBuildStatus("lodash-es@4.17.21", "deno", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Exists || status.Status != "missing" || status.ID != fmt.Sprintf("v%d/lodash-es@4.17.21/deno/lodash-es.development.mjs", VERSION) || buildQueue.Len() != 0 {
+		t.Fatalf("unexpected build status: %+v", status)
+	}
+	buildQueue.Add(&BuildTask{id: status.ID}, "")
+	if status, _ = getBuildStatus("lodash-es@4.17.21", "deno", true, false); status.Status != "queued" {
+		t.Fatalf("unexpected build status: %+v", status)
+	}
+
+	if _, err = getBuildStatus("react@18.3.1", "es1999", false, false); err == nil {
+		t.Fatal("the target should be invalid")
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/rex"
+)
+
+// isCorruptedArtifact checks whether the error is returned for a corrupted file by the
+// `storageChecksum` config.
+func isCorruptedArtifact(err error) bool {
+	return errors.Is(err, storage.ErrChecksumMismatch)
+}
+
+// discardCorruptedArtifact removes the corrupted file and the record of the build, so the next
+// request rebuilds the artifact.
+func discardCorruptedArtifact(savePath string) error {
+	log.Component("storage").Errorf("storage: %s is corrupted, discard it to rebuild", savePath)
+	if id := strings.TrimPrefix(savePath, "builds/"); id != savePath {
+		if strings.HasSuffix(id, ".css") {
+			// the css file is a part of the build of the module
+			id = strings.TrimSuffix(id, ".css") + ".mjs"
+		}
+		db.Delete(id)
+	}
+	remover, ok := fs.(storage.FileSystemRemover)
+	if !ok {
+		return errors.New("the storage does not support removing files")
+	}
+	_, err := remover.RemoveAll(savePath)
+	return err
+}
+
+// serveCorruptedArtifact discards the corrupted file and redirects the client to the same url to
+// rebuild the artifact.
+func serveCorruptedArtifact(ctx *rex.Context, savePath string) interface{} {
+	ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	if err := discardCorruptedArtifact(savePath); err != nil {
+		log.Component("storage").Errorf("storage: failed to discard %s: %v", savePath, err)
+		return throwError(ctx, 500, errInternal, "the file is corrupted")
+	}
+	return rex.Redirect(ctx.R.URL.RequestURI(), 307)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/rex"
+)
+
+func TestServeCorruptedArtifact(t *testing.T) {
+	defer func(prevCfg *config.Config, prevFS storage.FileSystem, prevDB storage.DataBase) {
+		cfg, fs, db = prevCfg, prevFS, prevDB
+	}(cfg, fs, db)
+
+	root := t.TempDir()
+	localFS, err := storage.OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB, err := storage.OpenDB("bolt:" + filepath.Join(t.TempDir(), "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testDB.Close()
+	cfg = &config.Config{}
+	fs = storage.NewChecksumFS(localFS, []string{"builds/"}, 1)
+	db = testDB
+
+	id := "v135/foo@1.0.0/es2022/foo.mjs"
+	savePath := "builds/" + id
+	if _, err = fs.WriteFile(savePath, bytes.NewReader([]byte("export default 1;\n"))); err != nil {
+		t.Fatal(err)
+	}
+	db.Put(id, []byte(`{}`))
+
+	router := &rex.Router{}
+	router.Use(func(ctx *rex.Context) interface{} {
+		fi, err := fs.Stat(savePath)
+		if err != nil {
+			return throwError(ctx, 404, errNotFound, "not found")
+		}
+		return serveStorageFile(ctx, savePath, fi.ModTime())
+	})
+	request := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "https://esm.sh/foo@1.0.0/es2022/foo.mjs", nil))
+		return rec
+	}
+
+	if rec := request(); rec.Code != 200 || rec.Body.String() != "export default 1;\n" {
+		t.Fatalf("unexpected response: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// corrupt the file
+	if err = os.WriteFile(filepath.Join(root, savePath), []byte("export default 2;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec := request()
+	if rec.Code != 307 || rec.Header().Get("Location") != "/foo@1.0.0/es2022/foo.mjs" {
+		t.Fatalf("unexpected response: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err = fs.Stat(savePath); err != storage.ErrNotFound {
+		t.Fatal("the corrupted file should be removed")
+	}
+	if value, _ := db.Get(id); value != nil {
+		t.Fatal("the build record should be removed")
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPResolver resolves the IP of the client from the `clientIPHeader` of the requests sent
+// by the trusted proxies.
+type clientIPResolver struct {
+	proxies []*net.IPNet
+	header  string
+}
+
+func newClientIPResolver(proxies []string, header string) *clientIPResolver {
+	r := &clientIPResolver{header: header}
+	for _, p := range proxies {
+		if _, ipNet, err := net.ParseCIDR(p); err == nil {
+			r.proxies = append(r.proxies, ipNet)
+		}
+	}
+	return r
+}
+
+func (r *clientIPResolver) isTrusted(ip net.IP) bool {
+	for _, ipNet := range r.proxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the IP of the client. The header is only honored if the peer is a trusted proxy,
+// or a unix socket peer (the proxy on the same host). For the `X-Forwarded-For` header, the rightmost
+// IP that is not a trusted proxy is the client, since the leftmost ones can be spoofed.
+func (r *clientIPResolver) resolve(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer != nil && !r.isTrusted(peer) {
+		return peer.String()
+	}
+	value := req.Header.Get(r.header)
+	if r.header != "X-Forwarded-For" {
+		if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+			return ip.String()
+		}
+		return host
+	}
+	ips := strings.Split(value, ",")
+	client := host
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(ips[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// clientIPHandler returns a handler that resolves the IP of the client, and overrides the
+// `X-Real-IP` header of the request with it for the access logger and the handlers.
+func clientIPHandler(h http.Handler, r *clientIPResolver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Set("X-Real-IP", r.resolve(req))
+		h.ServeHTTP(w, req)
+	})
+}
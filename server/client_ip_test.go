@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	xff := newClientIPResolver([]string{"10.0.0.0/8", "192.168.1.1/32"}, "X-Forwarded-For")
+	cf := newClientIPResolver([]string{"10.0.0.0/8"}, "Cf-Connecting-Ip")
+	for _, c := range []struct {
+		resolver   *clientIPResolver
+		remoteAddr string
+		header     string
+		value      string
+		expected   string
+	}{
+		{xff, "1.2.3.4:1234", "X-Forwarded-For", "5.6.7.8", "1.2.3.4"},
+		{xff, "10.0.0.1:1234", "X-Forwarded-For", "5.6.7.8", "5.6.7.8"},
+		{xff, "10.0.0.1:1234", "X-Forwarded-For", "6.6.6.6, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{xff, "10.0.0.1:1234", "X-Forwarded-For", "10.0.0.2, 10.0.0.3", "10.0.0.2"},
+		{xff, "10.0.0.1:1234", "X-Forwarded-For", "", "10.0.0.1"},
+		{xff, "[2001:db8::1]:1234", "X-Forwarded-For", "5.6.7.8", "2001:db8::1"},
+		{xff, "@", "X-Forwarded-For", "5.6.7.8", "5.6.7.8"},
+		{cf, "10.0.0.1:1234", "Cf-Connecting-Ip", "2001:db8::2", "2001:db8::2"},
+		{cf, "10.0.0.1:1234", "X-Forwarded-For", "5.6.7.8", "10.0.0.1"},
+		{cf, "1.2.3.4:1234", "Cf-Connecting-Ip", "5.6.7.8", "1.2.3.4"},
+	} {
+		req := httptest.NewRequest("GET", "https://esm.sh/react", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.value != "" {
+			req.Header.Set(c.header, c.value)
+		}
+		if ip := c.resolver.resolve(req); ip != c.expected {
+			t.Fatalf("%s %s=%q: expected %s, got %s", c.remoteAddr, c.header, c.value, c.expected, ip)
+		}
+	}
+}
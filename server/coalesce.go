@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// coalescedCall is a in-flight request that the identical requests wait for.
+type coalescedCall struct {
+	done     chan struct{}
+	response *coalescedResponse
+}
+
+// coalescedResponse records the response of a coalesced request.
+type coalescedResponse struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *coalescedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *coalescedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *coalescedResponse) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = 200
+	}
+	return r.body.Write(p)
+}
+
+var (
+	coalescedCallsLock sync.Mutex
+	coalescedCalls     = map[string]*coalescedCall{}
+)
+
+// coalesce returns a handle that coalesces the concurrent identical GET requests, only the first
+// request is handled by the `handle` (storage lookups and builds), the others wait for its response
+// up to the `timeout`, or get a `202` response with the `Retry-After` header.
+func coalesce(handle rex.Handle, timeout time.Duration) rex.Handle {
+	router := &rex.Router{}
+	router.Use(handle)
+	return func(ctx *rex.Context) interface{} {
+		r := ctx.R
+		// the conditional and range requests are not coalesced
+		if r.Method != "GET" || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" || r.Header.Get("Range") != "" {
+			return handle(ctx)
+		}
+		// the responses depend on the scopes of the API key, the `?token` query is a part of the key already
+		if r.Header.Get("Authorization") != "" {
+			return handle(ctx)
+		}
+
+		key := getCoalescingKey(r)
+		coalescedCallsLock.Lock()
+		call, ok := coalescedCalls[key]
+		if !ok {
+			call = &coalescedCall{done: make(chan struct{})}
+			coalescedCalls[key] = call
+		}
+		coalescedCallsLock.Unlock()
+
+		if !ok {
+			response := &coalescedResponse{header: http.Header{}}
+			func() {
+				defer func() {
+					coalescedCallsLock.Lock()
+					delete(coalescedCalls, key)
+					coalescedCallsLock.Unlock()
+					call.response = response
+					close(call.done)
+				}()
+				router.ServeHTTP(response, r)
+			}()
+		} else {
+			select {
+			case <-call.done:
+			case <-time.After(timeout):
+				header := ctx.W.Header()
+				header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+				header.Set("Retry-After", strconv.Itoa(int(timeout/time.Second)+1))
+				return rex.Status(http.StatusAccepted, "the module is being processed, please try again later")
+			}
+		}
+
+		response := call.response
+		header := ctx.W.Header()
+		for key, values := range response.header {
+			if isCoalescedHeader(key) {
+				header[key] = values
+			}
+		}
+		status := response.status
+		if status == 0 {
+			status = 200
+		}
+		body := response.body.Bytes()
+		if header.Get("Content-Encoding") != "" {
+			return rex.Status(status, body)
+		}
+		// the string response can be compressed by the compression middleware
+		return rex.Status(status, string(body))
+	}
+}
+
+// the headers of the module response that are sent to all the coalesced requests,
+// the others (e.g. `Set-Cookie`, `X-Request-Id`) belong to the first request only
+var coalescedHeaders = map[string]bool{
+	"Cache-Control":       true,
+	"Content-Disposition": true,
+	"Content-Encoding":    true,
+	"Content-Location":    true,
+	"Content-Type":        true,
+	"Etag":                true,
+	"Last-Modified":       true,
+	"Link":                true,
+	"Location":            true,
+	"Retry-After":         true,
+	"Vary":                true,
+	"Warning":             true,
+	"X-Deno-Types":        true,
+	"X-Typescript-Types":  true,
+}
+
+func isCoalescedHeader(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	return coalescedHeaders[key] || strings.HasPrefix(key, "X-Esm-")
+}
+
+// getCoalescingKey returns the key of the identical requests: the origin, the url, the target and the
+// request headers that change the response.
+func getCoalescingKey(r *http.Request) string {
+	target := strings.ToLower(r.URL.Query().Get("target"))
+	if !isValidTarget(target) {
+		if v := strings.ToLower(r.Header.Get("X-Esm-Target")); isValidTarget(v) {
+			target = v
+		} else {
+			target = getBuildTargetByClientHints(r.Header.Get("Sec-CH-UA-Full-Version-List"), r.Header.Get("Sec-CH-UA"))
+			if target == "" {
+				target = getBuildTargetByUA(r.UserAgent())
+			}
+		}
+	}
+	// the brotli-compressed files in the storage are served to the clients that accept brotli only
+	encoding := ""
+	if acceptsEncoding(r.Header.Get("Accept-Encoding"), "br") {
+		encoding = "br"
+	}
+	return strings.Join([]string{
+		r.Header.Get("X-Real-Origin"),
+		r.Host,
+		r.URL.RequestURI(),
+		target,
+		encoding,
+		r.Header.Get("Origin"),
+		r.Header.Get("X-Esm-Worker-Version"),
+	}, " ")
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+func TestCoalesce(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	handle := coalesce(func(ctx *rex.Context) interface{} {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		ctx.W.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		ctx.W.Header().Set("X-Esm-Id", "foo")
+		ctx.W.Header().Set("X-Request-Id", "leader")
+		return "export default " + ctx.R.URL.Query().Get("v")
+	}, 200*time.Millisecond)
+	router := &rex.Router{}
+	router.Use(handle)
+
+	request := func(url string, origin ...string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("User-Agent", "Deno/1.40.0")
+		if len(origin) > 0 {
+			req.Header.Set("Origin", origin[0])
+		}
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = request("https://esm.sh/foo?v=1")
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected 1 call, got %d", n)
+	}
+	for _, rec := range results {
+		if rec.Code != 200 || rec.Body.String() != "export default 1" || rec.Header().Get("Content-Type") != "application/javascript; charset=utf-8" {
+			t.Fatalf("unexpected response: %d %q", rec.Code, rec.Body.String())
+		}
+		// only the headers of the module response are shared
+		if rec.Header().Get("X-Esm-Id") != "foo" || rec.Header().Get("X-Request-Id") != "" {
+			t.Fatalf("unexpected headers: %v", rec.Header())
+		}
+	}
+
+	// the different urls are not coalesced
+	request("https://esm.sh/foo?v=2")
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected 2 calls, got %d", n)
+	}
+
+	// the requests of different origins are not coalesced
+	release = make(chan struct{})
+	go request("https://esm.sh/foo?v=2", "https://a.example.com")
+	time.Sleep(50 * time.Millisecond)
+	go request("https://esm.sh/foo?v=2", "https://b.example.com")
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Fatalf("expected 4 calls, got %d", n)
+	}
+
+	// the requests with an API key are not coalesced
+	release = make(chan struct{})
+	for _, key := range []string{"key-a", "key-b"} {
+		go func(key string) {
+			req := httptest.NewRequest("GET", "https://esm.sh/foo?v=2", nil)
+			req.Header.Set("Authorization", "Bearer "+key)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}(key)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 6 {
+		t.Fatalf("expected 6 calls, got %d", n)
+	}
+
+	// the waiting requests time out with 202
+	release = make(chan struct{})
+	go request("https://esm.sh/foo?v=3")
+	time.Sleep(50 * time.Millisecond)
+	rec := request("https://esm.sh/foo?v=3")
+	close(release)
+	if rec.Code != http.StatusAccepted || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("unexpected response: %d %v", rec.Code, rec.Header())
+	}
+}
@@ -1,18 +1,25 @@
 package server
 
 import (
+	"crypto/sha1"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/evanw/esbuild/pkg/api"
 	"github.com/ije/esbuild-internal/compat"
-	"github.com/mssola/useragent"
+	"github.com/ije/gox/utils"
 )
 
 var regexpBrowserVersion = regexp.MustCompile(`^(\d+)(?:\.(\d+))?(?:\.(\d+))?$`)
-var v1_33_2 = semver.MustParse("1.33.2")
+var regexpChromeVersion = regexp.MustCompile(`Chrome/(\d+)`)
+var regexpSamsungBrowserVersion = regexp.MustCompile(`SamsungBrowser/(\d+)`)
+var regexpClientHintBrand = regexp.MustCompile(`"([^"]+)"\s*;\s*v\s*=\s*"([^"]+)"`)
+var regexpNodeTarget = regexp.MustCompile(`^node([1-9]\d)$`)
+var regexpElectronVersion = regexp.MustCompile(`Electron/(\d+)`)
 
 var targets = map[string]api.Target{
 	"es2015":   api.ES2015,
@@ -27,17 +34,166 @@ var targets = map[string]api.Target{
 	"deno":     api.ESNext,
 	"denonext": api.ESNext,
 	"node":     api.ESNext,
+	"workerd":  api.ESNext,
 }
 
+// the default build targets of Deno versions, the key is the minimum Deno version of the target,
+// a Deno version below all the keys gets the `deno` target. can be overridden by the `denoTargets` config.
+var defaultDenoTargets = map[string]string{
+	"1.33.2": "denonext",
+}
+
+// the V8 version that Deno is based on, sorted by the Deno version in descending order,
+// the chromium version of V8 `x.y` is `x*10+y`.
+// see https://github.com/denoland/deno/releases
+var denoV8Versions = []struct {
+	deno string
+	v8   string
+}{
+	{"1.38.0", "12.0"},
+	{"1.37.0", "11.8"},
+	{"1.35.0", "11.6"},
+	{"1.34.0", "11.5"},
+	{"1.33.0", "11.4"},
+	{"1.32.0", "11.2"},
+	{"1.30.0", "11.0"},
+	{"1.28.0", "10.9"},
+	{"1.27.0", "10.8"},
+	{"1.26.0", "10.7"},
+	{"1.25.0", "10.6"},
+	{"1.23.0", "10.4"},
+	{"1.22.0", "10.3"},
+	{"1.21.0", "10.1"},
+	{"1.19.0", "10.0"},
+	{"1.18.0", "9.8"},
+	{"1.16.0", "9.7"},
+	{"1.15.0", "9.5"},
+	{"1.14.0", "9.4"},
+	{"1.13.0", "9.3"},
+	{"1.12.0", "9.2"},
+	{"1.9.0", "9.1"},
+	{"1.8.0", "9.0"},
+	{"1.7.0", "8.9"},
+	{"1.5.0", "8.8"},
+	{"1.4.0", "8.7"},
+	{"1.3.0", "8.6"},
+	{"1.2.0", "8.5"},
+	{"1.0.0", "8.4"},
+}
+
+// the minimum node version of the `node<version>` targets, es modules are supported since node 12
+const minNodeTargetVersion = 12
+
+// the UA prefixes of the edge runtimes that fetch modules server-side, like Cloudflare Workers,
+// they get the `workerd` target: esnext with node builtins polyfilled.
+var edgeRuntimeUAPrefixes = []string{
+	"Cloudflare-Workers",
+	"Vercel-Edge",
+	"Fastly",
+}
+
+// the es targets in ascending order of the supported features, used to clamp the build targets
+var esTargets = []string{
+	"es2015",
+	"es2016",
+	"es2017",
+	"es2018",
+	"es2019",
+	"es2020",
+	"es2021",
+	"es2022",
+	"esnext",
+}
+
+// the prefix of the feature targets, see `toFeatureTarget`
+const featureTargetPrefix = "esnext-"
+
 var browsers = map[string]api.EngineName{
-	"chrome":  api.EngineChrome,
-	"edge":    api.EngineEdge,
-	"firefox": api.EngineFirefox,
-	"ios":     api.EngineIOS,
-	"opera":   api.EngineOpera,
-	"safari":  api.EngineSafari,
+	"chrome":           api.EngineChrome,
+	"edge":             api.EngineEdge,
+	"firefox":          api.EngineFirefox,
+	"ios":              api.EngineIOS,
+	"opera":            api.EngineOpera,
+	"safari":           api.EngineSafari,
+	"samsung internet": api.EngineChrome,
+	"uc browser":       api.EngineChrome,
+	"electron":         api.EngineChrome,
+	"android webview":  api.EngineChrome,
+}
+
+// the brands of the `Sec-CH-UA` client hints, the `Chromium` brand is preferred if present
+var clientHintBrands = map[string]api.EngineName{
+	"Chromium":       api.EngineChrome,
+	"Google Chrome":  api.EngineChrome,
+	"Microsoft Edge": api.EngineEdge,
+	"Opera":          api.EngineOpera,
+}
+
+// the chromium version that Samsung Internet is based on
+// see https://en.wikipedia.org/wiki/Samsung_Internet#History
+var samsungChromiumVersions = map[int]int{
+	4:  44,
+	5:  51,
+	6:  56,
+	7:  59,
+	8:  63,
+	9:  67,
+	10: 71,
+	11: 75,
+	12: 79,
+	13: 83,
+	14: 87,
+	15: 90,
+	16: 92,
+	17: 96,
+	18: 99,
+	19: 102,
+	20: 106,
+	21: 110,
+	22: 111,
 }
 
+// the chromium version that Electron is based on, used when the UA doesn't contain the `Chrome/x.y.z` token
+// see https://releases.electronjs.org
+var electronChromiumVersions = map[int]int{
+	1:  52,
+	2:  61,
+	3:  66,
+	4:  69,
+	5:  73,
+	6:  76,
+	7:  78,
+	8:  80,
+	9:  83,
+	10: 85,
+	11: 87,
+	12: 89,
+	13: 91,
+	14: 93,
+	15: 94,
+	16: 96,
+	17: 98,
+	18: 100,
+	19: 102,
+	20: 104,
+	21: 106,
+	22: 108,
+	23: 110,
+	24: 112,
+	25: 114,
+	26: 116,
+	27: 118,
+	28: 120,
+}
+
+// the Android WebView (`; wv)` UA) was introduced in Android 5.0 that ships chromium 37
+const androidWebViewChromiumVersion = 37
+
+// UC Browser ships the U3 engine that is based on chromium 57 at least
+const ucBrowserChromiumVersion = 57
+
+// the JS features to check, the index of a feature is used as the bit of feature targets,
+// so changing the order requires a new build version.
 var jsFeatures = []compat.JSFeature{
 	compat.ArbitraryModuleNamespaceNames,
 	compat.ArraySpread,
@@ -94,7 +250,7 @@ var jsFeatures = []compat.JSFeature{
 	compat.UnicodeEscapes,
 }
 
-func validateESMAFeatures(target api.Target) int {
+func getUnsupportedESMAFeatures(target api.Target) compat.JSFeature {
 	constraints := make(map[compat.Engine][]int)
 
 	switch target {
@@ -119,10 +275,10 @@ func validateESMAFeatures(target api.Target) int {
 		panic("invalid target")
 	}
 
-	return countFeatures(compat.UnsupportedJSFeatures(constraints))
+	return compat.UnsupportedJSFeatures(constraints)
 }
 
-func validateEngineFeatures(engine api.Engine) int {
+func getUnsupportedEngineFeatures(engine api.Engine) compat.JSFeature {
 	constraints := make(map[compat.Engine][]int)
 
 	if match := regexpBrowserVersion.FindStringSubmatch(engine.Version); match != nil {
@@ -155,68 +311,554 @@ func validateEngineFeatures(engine api.Engine) int {
 		}
 	}
 
-	return countFeatures(compat.UnsupportedJSFeatures(constraints))
+	return compat.UnsupportedJSFeatures(constraints)
 }
 
-func countFeatures(feature compat.JSFeature) int {
-	n := 0
+// isTargetCovered returns true if all the unsupported features of `jsFeatures`
+// are also unsupported by the given es target, that means they will be transpiled.
+func isTargetCovered(unsupported compat.JSFeature, target api.Target) bool {
+	unsupportedByTarget := getUnsupportedESMAFeatures(target)
 	for _, f := range jsFeatures {
-		if feature&f != 0 {
-			n++
+		if unsupported&f != 0 && unsupportedByTarget&f == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// toFeatureTarget returns the feature target keyed by the bitmask of the unsupported features,
+// the bit `i` of the mask is set if the `jsFeatures[i]` is not supported by the engine.
+// e.g. `esnext-3` means `esnext` without `ArbitraryModuleNamespaceNames` and `ArraySpread`.
+func toFeatureTarget(unsupported compat.JSFeature) string {
+	var mask uint64
+	for i, f := range jsFeatures {
+		if unsupported&f != 0 {
+			mask |= 1 << i
 		}
 	}
-	return n
+	if mask == 0 {
+		return "esnext"
+	}
+	return featureTargetPrefix + strconv.FormatUint(mask, 16)
+}
+
+// parseFeatureTarget returns the unsupported features of the given feature target.
+func parseFeatureTarget(target string) (unsupported compat.JSFeature, ok bool) {
+	if !strings.HasPrefix(target, featureTargetPrefix) {
+		return
+	}
+	hex := strings.TrimPrefix(target, featureTargetPrefix)
+	// reject non-canonical forms to avoid duplicate builds
+	if hex == "" || hex[0] == '0' || strings.ToLower(hex) != hex {
+		return
+	}
+	mask, err := strconv.ParseUint(hex, 16, 64)
+	if err != nil || mask>>len(jsFeatures) != 0 {
+		return
+	}
+	for i, f := range jsFeatures {
+		if mask&(1<<i) != 0 {
+			unsupported |= f
+		}
+	}
+	return unsupported, true
+}
+
+// parseNodeTarget returns the node engine of the given `node<version>` target, e.g. `node16`.
+func parseNodeTarget(target string) (engine api.Engine, ok bool) {
+	m := regexpNodeTarget.FindStringSubmatch(target)
+	if m == nil {
+		return
+	}
+	if major, _ := strconv.Atoi(m[1]); major < minNodeTargetVersion {
+		return
+	}
+	return api.Engine{Name: api.EngineNode, Version: m[1]}, true
+}
+
+// isValidTarget returns true if the given target is a known target, a `node<version>` target or a feature target.
+// feature targets are accepted only if the `featureTargets` config is enabled and the UA resolver could produce
+// them, that prevents clients from creating arbitrary build variants in the storage.
+func isValidTarget(target string) bool {
+	if _, ok := targets[target]; ok {
+		return true
+	}
+	if _, ok := parseNodeTarget(target); ok {
+		return true
+	}
+	if cfg == nil || !cfg.FeatureTargets {
+		return false
+	}
+	if _, ok := parseFeatureTarget(target); !ok {
+		return false
+	}
+	return getReachableFeatureTargets()[target]
+}
+
+// the engines that the UA resolver and the client hints map to, see `browsers` and `clientHintBrands`
+var featureTargetEngines = []compat.Engine{
+	compat.Chrome,
+	compat.Edge,
+	compat.Firefox,
+	compat.IOS,
+	compat.Opera,
+	compat.Safari,
+}
+
+var reachableFeatureTargets map[string]bool
+var reachableFeatureTargetsOnce sync.Once
+
+// getReachableFeatureTargets returns the feature targets that the browser engines could produce,
+// the unsupported features of an engine only change at the minimum versions of the `jsFeatures`.
+func getReachableFeatureTargets() map[string]bool {
+	reachableFeatureTargetsOnce.Do(func() {
+		reachableFeatureTargets = map[string]bool{}
+		for _, engine := range featureTargetEngines {
+			versions := [][]int{{0}}
+			for _, f := range jsFeatures {
+				if v := getFeatureMinVersion(engine, f); v != "" {
+					version := []int{}
+					for _, part := range strings.Split(v, ".") {
+						n, _ := strconv.Atoi(part)
+						version = append(version, n)
+					}
+					versions = append(versions, version)
+				}
+			}
+			for _, version := range versions {
+				unsupported := compat.UnsupportedJSFeatures(map[compat.Engine][]int{engine: version})
+				if target := toFeatureTarget(unsupported); target != "esnext" {
+					reachableFeatureTargets[target] = true
+				}
+			}
+		}
+	})
+	return reachableFeatureTargets
+}
+
+// getEsbuildTarget returns the esbuild target and the unsupported features of the given target.
+func getEsbuildTarget(target string) (api.Target, map[string]bool) {
+	if engine, ok := parseNodeTarget(target); ok {
+		return api.ESNext, toSupportedMap(getUnsupportedEngineFeatures(engine))
+	}
+	if engine, ok := getDenoTargetEngine(target); ok {
+		return api.ESNext, toSupportedMap(getUnsupportedEngineFeatures(engine))
+	}
+	if unsupported, ok := parseFeatureTarget(target); ok {
+		return api.ESNext, toSupportedMap(unsupported)
+	}
+	if t, ok := targets[target]; ok {
+		return t, nil
+	}
+	return api.ESNext, nil
+}
+
+// toSupportedMap converts the unsupported features to the `Supported` option of esbuild.
+func toSupportedMap(unsupported compat.JSFeature) map[string]bool {
+	supported := map[string]bool{}
+	for name, f := range compat.StringToJSFeature {
+		if unsupported&f != 0 {
+			supported[name] = false
+		}
+	}
+	return supported
 }
 
 func getBrowserInfo(ua string) (name string, version string) {
-	name, version = useragent.New(ua).Browser()
-	if name == "HeadlessChrome" {
-		return "Chrome", version
+	// Samsung Internet and UC Browser are chromium based, use the chromium version instead
+	if m := regexpSamsungBrowserVersion.FindStringSubmatch(ua); m != nil {
+		major, _ := strconv.Atoi(m[1])
+		if v, ok := samsungChromiumVersions[major]; ok {
+			return "Samsung Internet", strconv.Itoa(v)
+		}
+		return "Samsung Internet", getChromiumVersion(ua, 0)
+	}
+	if strings.Contains(ua, "UCBrowser/") {
+		return "UC Browser", getChromiumVersion(ua, ucBrowserChromiumVersion)
+	}
+	// Electron apps and Android WebViews embed chromium, the UA parser reports them as
+	// the app name or the stock Android browser that results in wrong build targets
+	if m := regexpElectronVersion.FindStringSubmatch(ua); m != nil {
+		major, _ := strconv.Atoi(m[1])
+		return "Electron", getChromiumVersion(ua, electronChromiumVersions[major])
+	}
+	if strings.Contains(ua, "; wv)") {
+		return "Android WebView", getChromiumVersion(ua, androidWebViewChromiumVersion)
+	}
+	return parseUA(ua)
+}
+
+// getChromiumVersion returns the major version of the `Chrome/x.y.z` token in the UA,
+// or the fallback version if the token is not found.
+func getChromiumVersion(ua string, fallback int) string {
+	if m := regexpChromeVersion.FindStringSubmatch(ua); m != nil {
+		return m[1]
+	}
+	if fallback > 0 {
+		return strconv.Itoa(fallback)
 	}
-	if name == "Safari" && strings.Contains(ua, "iPhone;") {
-		return "iOS", version
+	return ""
+}
+
+// getBrowserEngine returns the esbuild engine of the browser by the given UA.
+func getBrowserEngine(ua string) (api.Engine, bool) {
+	name, version := getBrowserInfo(ua)
+	if name == "" || version == "" {
+		return api.Engine{}, false
+	}
+	engine, ok := browsers[strings.ToLower(name)]
+	if !ok {
+		return api.Engine{}, false
+	}
+	return api.Engine{Name: engine, Version: version}, true
+}
+
+// getFeatureNames returns the esbuild names of the given features, e.g. "async-await".
+func getFeatureNames(features compat.JSFeature) []string {
+	names := []string{}
+	for _, f := range jsFeatures {
+		if features&f != 0 {
+			for name, feature := range compat.StringToJSFeature {
+				if feature == f {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+	}
+	return names
+}
+
+// getESTargetIndex returns the index of the given target in `esTargets`,
+// a feature target is ranked as the highest es target that covers its unsupported features.
+// returns -1 if the target is not a browser target.
+func getESTargetIndex(target string) int {
+	for i, t := range esTargets {
+		if t == target {
+			return i
+		}
+	}
+	unsupported, ok := parseFeatureTarget(target)
+	if !ok {
+		return -1
+	}
+	for i := len(esTargets) - 2; i > 0; i-- {
+		if isTargetCovered(unsupported, targets[esTargets[i]]) {
+			return i
+		}
 	}
-	return
+	return 0
 }
 
+// checkTargetClamp checks the `minTarget` and `maxTarget` of the config.
+func checkTargetClamp(minTarget string, maxTarget string) error {
+	minIndex, maxIndex := 0, len(esTargets)-1
+	if minTarget != "" {
+		if minIndex = getESTargetIndex(minTarget); minIndex < 0 || minTarget != esTargets[minIndex] {
+			return fmt.Errorf("invalid min target '%s'", minTarget)
+		}
+	}
+	if maxTarget != "" {
+		if maxIndex = getESTargetIndex(maxTarget); maxIndex < 0 || maxTarget != esTargets[maxIndex] {
+			return fmt.Errorf("invalid max target '%s'", maxTarget)
+		}
+	}
+	if minIndex > maxIndex {
+		return fmt.Errorf("min target '%s' is greater than max target '%s'", minTarget, maxTarget)
+	}
+	return nil
+}
+
+// clampBuildTarget clamps the browser target by the `minTarget` and `maxTarget` of the config,
+// this bounds the number of builds and prevents ancient bots from triggering es2015 builds.
+func clampBuildTarget(target string) string {
+	if cfg == nil || (cfg.MinTarget == "" && cfg.MaxTarget == "") {
+		return target
+	}
+	i := getESTargetIndex(target)
+	if i < 0 {
+		return target
+	}
+	if cfg.MinTarget != "" && i < getESTargetIndex(cfg.MinTarget) {
+		return cfg.MinTarget
+	}
+	if cfg.MaxTarget != "" && i > getESTargetIndex(cfg.MaxTarget) {
+		return cfg.MaxTarget
+	}
+	return target
+}
+
+// getDenoTarget returns the build target of the given Deno version by the `denoTargets` config.
+func getDenoTarget(version *semver.Version) string {
+	denoTargets := defaultDenoTargets
+	if cfg != nil && len(cfg.DenoTargets) > 0 {
+		denoTargets = cfg.DenoTargets
+	}
+	var cutoff *semver.Version
+	target := "deno"
+	for v, t := range denoTargets {
+		minVersion, err := semver.NewVersion(v)
+		if err != nil || version.LessThan(minVersion) {
+			continue
+		}
+		if cutoff == nil || minVersion.GreaterThan(cutoff) {
+			cutoff = minVersion
+			target = t
+		}
+	}
+	return target
+}
+
+// checkDenoTargets checks the `denoTargets` config.
+func checkDenoTargets(denoTargets map[string]string) error {
+	for v, t := range denoTargets {
+		if _, err := semver.NewVersion(v); err != nil {
+			return fmt.Errorf("invalid deno version '%s': %v", v, err)
+		}
+		if !isValidTarget(t) {
+			return fmt.Errorf("invalid target '%s' of deno version '%s'", t, v)
+		}
+	}
+	return nil
+}
+
+// getDenoEngine returns the chrome engine of the V8 that the Deno UA is based on.
+func getDenoEngine(ua string) (api.Engine, bool) {
+	if !strings.HasPrefix(ua, "Deno/") {
+		return api.Engine{}, false
+	}
+	version, err := semver.NewVersion(strings.TrimPrefix(ua, "Deno/"))
+	if err != nil {
+		return api.Engine{}, false
+	}
+	for _, entry := range denoV8Versions {
+		if !version.LessThan(semver.MustParse(entry.deno)) {
+			major, minor := utils.SplitByFirstByte(entry.v8, '.')
+			x, _ := strconv.Atoi(major)
+			y, _ := strconv.Atoi(minor)
+			return api.Engine{Name: api.EngineChrome, Version: strconv.Itoa(x*10 + y)}, true
+		}
+	}
+	return api.Engine{}, false
+}
+
+// getDenoTargetEngine returns the V8 engine of the oldest Deno version that gets the `deno` or the
+// `denonext` target by the `denoTargets` config, the output of the target is tuned for the engine.
+func getDenoTargetEngine(target string) (api.Engine, bool) {
+	if target != "deno" && target != "denonext" {
+		return api.Engine{}, false
+	}
+	// a Deno version below all the keys of the `denoTargets` gets the `deno` target
+	minVersion := semver.MustParse(denoV8Versions[len(denoV8Versions)-1].deno)
+	if target != "deno" {
+		denoTargets := defaultDenoTargets
+		if cfg != nil && len(cfg.DenoTargets) > 0 {
+			denoTargets = cfg.DenoTargets
+		}
+		var cutoff *semver.Version
+		for v, t := range denoTargets {
+			version, err := semver.NewVersion(v)
+			if err != nil || t != target {
+				continue
+			}
+			if cutoff == nil || version.LessThan(cutoff) {
+				cutoff = version
+			}
+		}
+		if cutoff == nil {
+			return api.Engine{}, false
+		}
+		minVersion = cutoff
+	}
+	return getDenoEngine("Deno/" + minVersion.String())
+}
+
+// cache the build targets of UAs, production traffic has a small set of distinct UAs
+var uaTargetCache = newLRUCache(1024)
+
+// cache the build targets of client hints, separated from the UA cache that is keyed by the raw UA strings
+var clientHintsTargetCache = newLRUCache(1024)
+
 func getBuildTargetByUA(ua string) string {
+	key := getTargetCacheKey(ua)
+	if target, ok := uaTargetCache.Get(key); ok {
+		return target
+	}
+	target := clampBuildTarget(resolveBuildTargetByUA(ua))
+	uaTargetCache.Set(key, target)
+	return target
+}
+
+// getTargetCacheKey hashes the given UA, the UAs are sent by the clients and can be arbitrarily long.
+func getTargetCacheKey(ua string) string {
+	sum := sha1.Sum([]byte(ua))
+	return string(sum[:])
+}
+
+func resolveBuildTargetByUA(ua string) string {
 	if ua == "" || strings.HasPrefix(ua, "curl/") {
 		return "esnext"
 	}
 	if strings.HasPrefix(ua, "Deno/") {
 		uaVersion, err := semver.NewVersion(strings.TrimPrefix(ua, "Deno/"))
-		if err == nil && uaVersion.LessThan(v1_33_2) {
-			return "deno"
+		if err != nil {
+			return "denonext"
 		}
-		return "denonext"
+		return getDenoTarget(uaVersion)
 	}
 	if ua == "undici" || strings.HasPrefix(ua, "Node/") || strings.HasPrefix(ua, "Bun/") {
 		return "node"
 	}
-	name, version := getBrowserInfo(ua)
-	if name == "" || version == "" {
-		return "esnext"
+	for _, prefix := range edgeRuntimeUAPrefixes {
+		if strings.HasPrefix(ua, prefix) {
+			return "workerd"
+		}
+	}
+	if engine, ok := getBrowserEngine(ua); ok {
+		return getBuildTargetByEngine(engine)
+	}
+	return "esnext"
+}
+
+// getBuildTargetByEngine returns the build target of the given browser engine.
+func getBuildTargetByEngine(engine api.Engine) string {
+	if cfg != nil && cfg.FeatureTargets {
+		return toFeatureTarget(getUnsupportedEngineFeatures(engine))
+	}
+	// select the newest es target that transpiles all the features the engine doesn't support,
+	// counting the features would bump an engine that misses a single new feature down several years
+	unsupported := getUnsupportedEngineFeatures(engine)
+	for _, target := range []string{
+		"es2022",
+		"es2021",
+		"es2020",
+		"es2019",
+		"es2018",
+		"es2017",
+		"es2016",
+	} {
+		if isTargetCovered(unsupported, targets[target]) {
+			return target
+		}
+	}
+	return "es2015"
+}
+
+// getClientHintsEngine returns the browser engine by the `Sec-CH-UA-Full-Version-List`
+// or `Sec-CH-UA` client hints, e.g. `"Chromium";v="118", "Google Chrome";v="118", "Not=A?Brand";v="99"`.
+func getClientHintsEngine(chUA string) (api.Engine, bool) {
+	var engine api.Engine
+	for _, m := range regexpClientHintBrand.FindAllStringSubmatch(chUA, -1) {
+		name, ok := clientHintBrands[m[1]]
+		// use the major version only, the full version (e.g. "120.0.6099.71") has four parts
+		major, _ := utils.SplitByFirstByte(m[2], '.')
+		if !ok || !regexpBrowserVersion.MatchString(major) {
+			continue
+		}
+		if m[1] == "Chromium" {
+			return api.Engine{Name: name, Version: major}, true
+		}
+		if engine.Version == "" {
+			engine = api.Engine{Name: name, Version: major}
+		}
 	}
-	if engine, ok := browsers[strings.ToLower(name)]; ok {
-		unspportEngineFeatures := validateEngineFeatures(api.Engine{
-			Name:    engine,
-			Version: version,
-		})
-		for _, target := range []string{
-			"es2022",
-			"es2021",
-			"es2020",
-			"es2019",
-			"es2018",
-			"es2017",
-			"es2016",
-			"es2015",
-		} {
-			unspportESMAFeatures := validateESMAFeatures(targets[target])
-			if unspportEngineFeatures <= unspportESMAFeatures {
-				return target
+	return engine, engine.Version != ""
+}
+
+// getBuildTargetByClientHints returns the build target by the client hints,
+// or an empty string if the client hints are not present or not recognized.
+func getBuildTargetByClientHints(fullVersionList string, chUA string) string {
+	if fullVersionList == "" && chUA == "" {
+		return ""
+	}
+	key := getTargetCacheKey(fullVersionList + "|" + chUA)
+	if target, ok := clientHintsTargetCache.Get(key); ok {
+		return target
+	}
+	target := ""
+	engine, ok := getClientHintsEngine(fullVersionList)
+	if !ok {
+		engine, ok = getClientHintsEngine(chUA)
+	}
+	if ok {
+		target = clampBuildTarget(getBuildTargetByEngine(engine))
+	}
+	clientHintsTargetCache.Set(key, target)
+	return target
+}
+
+// the engines of the `/compat.json` API
+var compatEngines = []compat.Engine{
+	compat.Chrome,
+	compat.Edge,
+	compat.Firefox,
+	compat.IOS,
+	compat.Opera,
+	compat.Safari,
+	compat.Node,
+	compat.Deno,
+}
+
+var compatData map[string]interface{}
+var compatDataOnce sync.Once
+
+// getCompatData returns the engine→feature support matrix and the unsupported features
+// of the es targets, the data is derived from the `jsFeatures` and the compat table of esbuild.
+func getCompatData() map[string]interface{} {
+	compatDataOnce.Do(func() {
+		engines := map[string]map[string]interface{}{}
+		for _, engine := range compatEngines {
+			versions := map[string]interface{}{}
+			for _, f := range jsFeatures {
+				// `null` means the feature is not supported by any version of the engine
+				var version interface{}
+				if v := getFeatureMinVersion(engine, f); v != "" {
+					version = v
+				}
+				versions[getFeatureNames(f)[0]] = version
 			}
+			engines[engine.String()] = versions
 		}
+		esTargetFeatures := map[string][]string{}
+		for _, target := range esTargets {
+			esTargetFeatures[target] = getFeatureNames(getUnsupportedESMAFeatures(targets[target]))
+		}
+		compatData = map[string]interface{}{
+			"features": getFeatureNames(^compat.JSFeature(0)),
+			"engines":  engines,
+			"targets":  esTargetFeatures,
+		}
+	})
+	return compatData
+}
+
+// getFeatureMinVersion returns the minimum version of the engine that supports the feature,
+// or an empty string if the feature is not supported by any version.
+func getFeatureMinVersion(engine compat.Engine, feature compat.JSFeature) string {
+	isSupported := func(version ...int) bool {
+		return compat.UnsupportedJSFeatures(map[compat.Engine][]int{engine: version})&feature == 0
 	}
-	return "esnext"
+	for major := 0; major <= 200; major++ {
+		if !isSupported(major, 999, 999) {
+			continue
+		}
+		for minor := 0; minor <= 999; minor++ {
+			if !isSupported(major, minor, 999) {
+				continue
+			}
+			for patch := 0; patch <= 999; patch++ {
+				if isSupported(major, minor, patch) {
+					version := strconv.Itoa(major)
+					if minor > 0 || patch > 0 {
+						version += "." + strconv.Itoa(minor)
+					}
+					if patch > 0 {
+						version += "." + strconv.Itoa(patch)
+					}
+					return version
+				}
+			}
+		}
+	}
+	return ""
 }
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/esbuild-internal/compat"
+)
+
+func TestGetBrowserInfo(t *testing.T) {
+	tests := []struct {
+		ua      string
+		name    string
+		version string
+	}{
+		{
+			ua:      "Mozilla/5.0 (Linux; Android 11; SAMSUNG SM-G991B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/14.2 Chrome/87.0.4280.141 Mobile Safari/537.36",
+			name:    "Samsung Internet",
+			version: "87",
+		},
+		{
+			ua:      "Mozilla/5.0 (Linux; Android 7.0; SAMSUNG SM-G930F) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/5.4 Chrome/51.0.2704.106 Mobile Safari/537.36",
+			name:    "Samsung Internet",
+			version: "51",
+		},
+		{
+			ua:      "Mozilla/5.0 (Linux; U; Android 10; en-US; RMX1911 Build/QKQ1.200209.002) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/78.0.3904.108 UCBrowser/13.4.0.1306 Mobile Safari/537.36",
+			name:    "UC Browser",
+			version: "78",
+		},
+		{
+			ua:      "UCWEB/2.0 (Linux; U; Adr 4.4.2; en-US; SM-G900F) U2/1.0.0 UCBrowser/10.10.0.796 U2/1.0.0 Mobile",
+			name:    "UC Browser",
+			version: "57",
+		},
+		{
+			ua:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Slack/4.29.149 Chrome/106.0.5249.199 Electron/21.3.3 Safari/537.36",
+			name:    "Electron",
+			version: "106",
+		},
+		{
+			ua:      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Electron/13.6.9",
+			name:    "Electron",
+			version: "91",
+		},
+		{
+			ua:      "Mozilla/5.0 (Linux; Android 10; K; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/114.0.5735.196 Mobile Safari/537.36",
+			name:    "Android WebView",
+			version: "114",
+		},
+		{
+			ua:      "Mozilla/5.0 (Linux; Android 5.0; SM-G900P Build/LRX21T; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Mobile Safari/537.36",
+			name:    "Android WebView",
+			version: "37",
+		},
+	}
+	for _, tt := range tests {
+		name, version := getBrowserInfo(tt.ua)
+		if name != tt.name || version != tt.version {
+			t.Fatalf("invalid browser info(%s %s), should be '%s %s'", name, version, tt.name, tt.version)
+		}
+	}
+}
+
+func TestGetBuildTargetByUA(t *testing.T) {
+	target := getBuildTargetByUA("Mozilla/5.0 (Linux; Android 7.0; SAMSUNG SM-G930F) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/5.4 Chrome/51.0.2704.106 Mobile Safari/537.36")
+	if target == "esnext" || target == "es2022" {
+		t.Fatalf("invalid target '%s' for Samsung Internet 5", target)
+	}
+	target = getBuildTargetByUA("Mozilla/5.0 (Linux; Android 11; SAMSUNG SM-G991B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/14.2 Chrome/87.0.4280.141 Mobile Safari/537.36")
+	if target == "esnext" {
+		t.Fatalf("invalid target '%s' for Samsung Internet 14", target)
+	}
+	target = getBuildTargetByUA("Mozilla/5.0 (Linux; Android 7.0; SM-G930V Build/NRD90M; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/59.0.3071.125 Mobile Safari/537.36")
+	if target == "esnext" || target == "es2022" {
+		t.Fatalf("invalid target '%s' for Android WebView 59", target)
+	}
+	target = getBuildTargetByUA("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) my-app/1.0.0 Chrome/61.0.3163.100 Electron/2.0.18 Safari/537.36")
+	if target == "esnext" || target == "es2022" {
+		t.Fatalf("invalid target '%s' for Electron 2", target)
+	}
+	for _, ua := range []string{"Cloudflare-Workers", "Vercel-Edge/1.0", "Fastly/1.0"} {
+		if target := getBuildTargetByUA(ua); target != "workerd" {
+			t.Fatalf("invalid target '%s' for '%s', should be 'workerd'", target, ua)
+		}
+	}
+}
+
+func TestFeatureTarget(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{FeatureTargets: true}
+
+	unsupported := getUnsupportedEngineFeatures(api.Engine{Name: api.EngineSafari, Version: "14"})
+	target := toFeatureTarget(unsupported)
+	if !strings.HasPrefix(target, featureTargetPrefix) {
+		t.Fatalf("invalid feature target '%s'", target)
+	}
+	features, ok := parseFeatureTarget(target)
+	if !ok {
+		t.Fatalf("could not parse feature target '%s'", target)
+	}
+	if toFeatureTarget(features) != target {
+		t.Fatalf("invalid features of target '%s'", target)
+	}
+	if !isValidTarget(target) {
+		t.Fatalf("target '%s' should be valid", target)
+	}
+	for _, target := range []string{"esnext-", "esnext-0", "esnext-03", "esnext-A", "esnext-xyz", "esnext-ffffffffffffffff"} {
+		if isValidTarget(target) {
+			t.Fatalf("target '%s' should be invalid", target)
+		}
+	}
+	if toFeatureTarget(0) != "esnext" {
+		t.Fatal("feature target without unsupported features should be 'esnext'")
+	}
+
+	// masks that no browser engine could produce are rejected
+	reachable := getReachableFeatureTargets()
+	for mask := uint64(1); mask < 1<<len(jsFeatures); mask++ {
+		target := featureTargetPrefix + strconv.FormatUint(mask, 16)
+		if !reachable[target] {
+			if isValidTarget(target) {
+				t.Fatalf("unreachable target '%s' should be invalid", target)
+			}
+			break
+		}
+	}
+
+	cfg = &config.Config{}
+	if isValidTarget(target) {
+		t.Fatalf("target '%s' should be invalid if the feature targets are disabled", target)
+	}
+}
+
+func TestClampBuildTarget(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{MinTarget: "es2018", MaxTarget: "es2022"}
+
+	tests := map[string]string{
+		"es2015":   "es2018",
+		"es2018":   "es2018",
+		"es2020":   "es2020",
+		"esnext":   "es2022",
+		"deno":     "deno",
+		"denonext": "denonext",
+		"node":     "node",
+	}
+	for target, expected := range tests {
+		if clamped := clampBuildTarget(target); clamped != expected {
+			t.Fatalf("invalid clamped target '%s' of '%s', should be '%s'", clamped, target, expected)
+		}
+	}
+
+	if checkTargetClamp("es2018", "es2022") != nil {
+		t.Fatal("target clamp 'es2018-es2022' should be valid")
+	}
+	if checkTargetClamp("es2022", "es2018") == nil {
+		t.Fatal("target clamp 'es2022-es2018' should be invalid")
+	}
+	if checkTargetClamp("deno", "") == nil {
+		t.Fatal("min target 'deno' should be invalid")
+	}
+}
+
+func TestNodeTarget(t *testing.T) {
+	for _, target := range []string{"node12", "node16", "node20"} {
+		if !isValidTarget(target) {
+			t.Fatalf("target '%s' should be valid", target)
+		}
+	}
+	for _, target := range []string{"node0", "node8", "node016", "node16.0", "nodenext"} {
+		if isValidTarget(target) {
+			t.Fatalf("target '%s' should be invalid", target)
+		}
+	}
+	_, supported := getEsbuildTarget("node12")
+	if supported["optional-chain"] {
+		t.Fatal("optional chain should not be supported by node12")
+	}
+	if _, ok := supported["optional-chain"]; !ok {
+		t.Fatal("optional chain should be lowered for node12")
+	}
+	_, supported = getEsbuildTarget("node20")
+	if _, ok := supported["optional-chain"]; ok {
+		t.Fatal("optional chain should be supported by node20")
+	}
+	if !(&BuildTask{Target: "node16"}).isNodeTarget() || !(&BuildTask{Target: "node16"}).isServerTarget() {
+		t.Fatal("target 'node16' should be a node target")
+	}
+}
+
+func TestDenoTarget(t *testing.T) {
+	tests := map[string]string{
+		"Deno/1.30.0": "deno",
+		"Deno/1.33.1": "deno",
+		"Deno/1.33.2": "denonext",
+		"Deno/1.38.0": "denonext",
+	}
+	for ua, expected := range tests {
+		if target := resolveBuildTargetByUA(ua); target != expected {
+			t.Fatalf("invalid target '%s' for '%s', should be '%s'", target, ua, expected)
+		}
+	}
+
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{DenoTargets: map[string]string{"1.0.0": "es2020", "1.33.2": "denonext"}}
+	if target := resolveBuildTargetByUA("Deno/1.20.0"); target != "es2020" {
+		t.Fatalf("invalid target '%s' for 'Deno/1.20.0', should be 'es2020'", target)
+	}
+	if target := resolveBuildTargetByUA("Deno/0.42.0"); target != "deno" {
+		t.Fatalf("invalid target '%s' for 'Deno/0.42.0', should be 'deno'", target)
+	}
+	if checkDenoTargets(map[string]string{"1.x": "denonext"}) == nil {
+		t.Fatal("deno version '1.x' should be invalid")
+	}
+	if checkDenoTargets(map[string]string{"1.33.2": "foo"}) == nil {
+		t.Fatal("target 'foo' should be invalid")
+	}
+
+	engine, ok := getDenoEngine("Deno/1.33.4")
+	if !ok || engine.Name != api.EngineChrome || engine.Version != "114" {
+		t.Fatalf("invalid engine %v of 'Deno/1.33.4'", engine)
+	}
+
+	// the output of the deno targets is tuned for the oldest Deno version of the target
+	cfg = &config.Config{}
+	if engine, ok := getDenoTargetEngine("denonext"); !ok || engine.Version != "114" {
+		t.Fatalf("invalid engine %v of the 'denonext' target", engine)
+	}
+	_, supported := getEsbuildTarget("deno")
+	if v, ok := supported["class-static-blocks"]; !ok || v {
+		t.Fatal("the 'deno' target should transpile the class static blocks")
+	}
+	_, supported = getEsbuildTarget("denonext")
+	if _, ok := supported["class-static-blocks"]; ok {
+		t.Fatal("the 'denonext' target should keep the class static blocks")
+	}
+}
+
+func TestClientHints(t *testing.T) {
+	engine, ok := getClientHintsEngine(`"Not_A Brand";v="8.0.0.0", "Chromium";v="120.0.6099.71", "Google Chrome";v="120.0.6099.71"`)
+	if !ok || engine.Name != api.EngineChrome || engine.Version != "120" {
+		t.Fatalf("invalid engine %v", engine)
+	}
+	engine, ok = getClientHintsEngine(`"Microsoft Edge";v="92", " Not;A Brand";v="99"`)
+	if !ok || engine.Name != api.EngineEdge || engine.Version != "92" {
+		t.Fatalf("invalid engine %v", engine)
+	}
+	if _, ok = getClientHintsEngine(`" Not A;Brand";v="99"`); ok {
+		t.Fatal("unknown brands should not be recognized")
+	}
+	if target := getBuildTargetByClientHints("", `"Chromium";v="80", "Google Chrome";v="80"`); target == "" || target == "esnext" || target == "es2022" {
+		t.Fatalf("invalid target '%s' for Chrome 80", target)
+	}
+	if target := getBuildTargetByClientHints("", ""); target != "" {
+		t.Fatalf("invalid target '%s' without client hints", target)
+	}
+
+	// a UA that looks like a client hints key must not poison the client hints cache
+	chUA := `"Chromium";v="70", "Google Chrome";v="70"`
+	getBuildTargetByUA("ch:|" + chUA)
+	if target := getBuildTargetByClientHints("", chUA); target == "esnext" {
+		t.Fatalf("invalid target '%s' for Chrome 70", target)
+	}
+}
+
+func TestGetBuildTargetByEngine(t *testing.T) {
+	tests := []struct {
+		engine api.Engine
+		target string
+	}{
+		{api.Engine{Name: api.EngineChrome, Version: "120"}, "es2022"},
+		{api.Engine{Name: api.EngineChrome, Version: "80"}, "es2019"},
+		{api.Engine{Name: api.EngineChrome, Version: "63"}, "es2017"},
+		{api.Engine{Name: api.EngineChrome, Version: "51"}, "es2015"},
+		{api.Engine{Name: api.EngineFirefox, Version: "115"}, "es2022"},
+		{api.Engine{Name: api.EngineFirefox, Version: "78"}, "es2019"},
+		{api.Engine{Name: api.EngineSafari, Version: "16.4"}, "es2021"},
+		{api.Engine{Name: api.EngineSafari, Version: "14"}, "es2017"},
+		{api.Engine{Name: api.EngineIOS, Version: "12"}, "es2015"},
+	}
+	for _, tt := range tests {
+		if target := getBuildTargetByEngine(tt.engine); target != tt.target {
+			t.Fatalf("invalid target '%s' for %v, should be '%s'", target, tt.engine, tt.target)
+		}
+	}
+	// the features that can not be transpiled (e.g. `RegexpSetNotation`) should not bump the target down
+	if !isTargetCovered(compat.RegexpSetNotation, api.ES2022) {
+		t.Fatal("es2022 should cover the regexp set notation")
+	}
+	if isTargetCovered(compat.OptionalChain, api.ES2020) {
+		t.Fatal("es2020 should not cover the optional chain")
+	}
+}
+
+func TestCompatData(t *testing.T) {
+	data := getCompatData()
+	engines := data["engines"].(map[string]map[string]interface{})
+	if v := engines["chrome"]["optional-chain"]; v != "91" {
+		t.Fatalf("invalid chrome version '%v' of optional chain, should be '91'", v)
+	}
+	if v := engines["safari"]["class-static-blocks"]; v != "16.4" {
+		t.Fatalf("invalid safari version '%v' of class static blocks, should be '16.4'", v)
+	}
+	if v := engines["safari"]["regexp-set-notation"]; v != nil {
+		t.Fatalf("regexp set notation should not be supported by safari, got '%v'", v)
+	}
+	features := data["targets"].(map[string][]string)
+	if len(features["es2015"]) <= len(features["es2022"]) {
+		t.Fatal("es2015 should have more unsupported features than es2022")
+	}
+}
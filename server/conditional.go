@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// conditional returns a handle that adds the strong `ETag` header (the hash of the body) to the
+// in-memory responses of the `handle`, e.g. the entry modules of `pkg@latest` and the JSON APIs,
+// and replies `304 Not Modified` to the conditional requests that match the ETag.
+func conditional(handle rex.Handle) rex.Handle {
+	return func(ctx *rex.Context) interface{} {
+		ret := handle(ctx)
+		if ctx.R.Method != "GET" && ctx.R.Method != "HEAD" {
+			return ret
+		}
+		header := ctx.W.Header()
+		var data []byte
+		switch r := ret.(type) {
+		case string:
+			data = []byte(r)
+		case []byte:
+			data = r
+		case map[string]interface{}:
+			buf := bytes.NewBuffer(nil)
+			if json.NewEncoder(buf).Encode(r) != nil {
+				return ret
+			}
+			header.Set("Content-Type", "application/json; charset=utf-8")
+			data = buf.Bytes()
+			ret = buf.String()
+		default:
+			return ret
+		}
+		if header.Get("ETag") == "" {
+			header.Set("ETag", getETag(data))
+		}
+		if isNotModified(ctx.R, header.Get("ETag"), time.Time{}) {
+			return notModified()
+		}
+		return ret
+	}
+}
+
+// getETag returns the strong ETag of the data.
+func getETag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum(data))
+}
+
+// getFileETag returns the strong ETag of the file in the storage, the files are never modified
+// in place so the path and the modification time identify the content.
+func getFileETag(savePath string, modTime time.Time, encoding string) string {
+	sum := sha1.Sum([]byte(savePath))
+	etag := fmt.Sprintf("%x-%x", sum[:8], modTime.UnixNano())
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+	return `"` + etag + `"`
+}
+
+// isNotModified checks whether the conditional request matches the ETag, or the `modTime` if the
+// request has no `If-None-Match` header.
+func isNotModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			// the weak comparison is used for the `If-None-Match` header
+			if v == "*" || strings.TrimPrefix(v, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modTime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// notModified returns a `304 Not Modified` response, the headers of the body are removed.
+func notModified() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		header.Del("Content-Encoding")
+		w.WriteHeader(http.StatusNotModified)
+	})
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/rex"
+)
+
+func TestConditional(t *testing.T) {
+	router := &rex.Router{}
+	router.Use(conditional(func(ctx *rex.Context) interface{} {
+		switch ctx.Path.String() {
+		case "/status.json":
+			return map[string]interface{}{"version": 135}
+		case "/error":
+			return rex.Err(404, "not found")
+		}
+		ctx.W.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		return "export * from \"/v135/react@18.2.0/es2022/react.mjs\";\n"
+	}))
+
+	request := func(url string, etag string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, url := range []string{"https://esm.sh/react@latest", "https://esm.sh/status.json"} {
+		rec := request(url, "")
+		etag := rec.Header().Get("ETag")
+		if rec.Code != 200 || etag == "" || etag[0] != '"' {
+			t.Fatalf("unexpected response of %s: %d %q", url, rec.Code, etag)
+		}
+		rec = request(url, etag)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+			t.Fatalf("expected 304 for %s, got %d", url, rec.Code)
+		}
+		rec = request(url, `"foo", W/`+etag)
+		if rec.Code != http.StatusNotModified {
+			t.Fatalf("expected 304 for %s, got %d", url, rec.Code)
+		}
+		rec = request(url, `"foo"`)
+		if rec.Code != 200 {
+			t.Fatalf("expected 200 for %s, got %d", url, rec.Code)
+		}
+	}
+
+	rec := request("https://esm.sh/status.json", "")
+	if rec.Header().Get("Content-Type") != "application/json; charset=utf-8" || rec.Body.String() != "{\"version\":135}\n" {
+		t.Fatalf("unexpected json response: %q", rec.Body.String())
+	}
+
+	// the error responses have no ETag
+	rec = request("https://esm.sh/error", "*")
+	if rec.Code != 404 || rec.Header().Get("ETag") != "" {
+		t.Fatalf("unexpected error response: %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestServeStorageFileConditional(t *testing.T) {
+	localFS, err := storage.OpenFS("local:" + path.Join(t.TempDir(), "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prevFS storage.FileSystem, prevCfg *config.Config) {
+		fs, cfg = prevFS, prevCfg
+	}(fs, cfg)
+	fs, cfg = localFS, &config.Config{}
+
+	savePath := "types/v135/foo@1.0.0/index.d.ts"
+	fs.WriteFile(savePath, bytes.NewReader([]byte("export declare const foo: string;\n")))
+	modTime := time.Now().Add(-time.Hour)
+
+	router := &rex.Router{}
+	router.Use(func(ctx *rex.Context) interface{} {
+		return serveStorageFile(ctx, savePath, modTime)
+	})
+	request := func(header string, value string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "https://esm.sh/v135/foo@1.0.0/index.d.ts", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != 200 || etag == "" || rec.Header().Get("Last-Modified") == "" {
+		t.Fatalf("unexpected response: %d %v", rec.Code, rec.Header())
+	}
+	if rec = request("If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rec.Code)
+	}
+	if rec = request("If-Modified-Since", modTime.UTC().Format(http.TimeFormat)); rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rec.Code)
+	}
+	if rec = request("If-Modified-Since", modTime.Add(-time.Minute).UTC().Format(http.TimeFormat)); rec.Code != 200 {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+}
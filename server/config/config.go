@@ -1,8 +1,13 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -10,32 +15,137 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/ije/gox/utils"
 )
 
 const MinBuildConcurrency = 4
 
 type Config struct {
-	Port             uint16  `json:"port,omitempty"`
-	TlsPort          uint16  `json:"tlsPort,omitempty"`
-	NsPort           uint16  `json:"nsPort,omitempty"`
-	BuildConcurrency uint16  `json:"buildConcurrency,omitempty"`
-	BanList          BanList `json:"banList,omitempty"`
-	AuthSecret       string  `json:"authSecret,omitempty"`
-	WorkDir          string  `json:"workDir,omitempty"`
-	Cache            string  `json:"cache,omitempty"`
-	Database         string  `json:"database,omitempty"`
-	Storage          string  `json:"storage,omitempty"`
-	LogLevel         string  `json:"logLevel,omitempty"`
-	LogDir           string  `json:"logDir,omitempty"`
-	CdnOrigin        string  `json:"cdnOrigin,omitempty"`
-	CdnBasePath      string  `json:"cdnBasePath,omitempty"`
-	NpmRegistry      string  `json:"npmRegistry,omitempty"`
-	NpmToken         string  `json:"npmToken,omitempty"`
-	NpmRegistryScope string  `json:"npmRegistryScope,omitempty"`
-	NpmUser          string  `json:"npmUser,omitempty"`
-	NpmPassword      string  `json:"npmPassword,omitempty"`
-	NoCompress       bool    `json:"noCompress,omitempty"`
+	Listen                  string                 `json:"listen,omitempty"`
+	Port                    uint16                 `json:"port,omitempty"`
+	TlsPort                 uint16                 `json:"tlsPort,omitempty"`
+	TlsHosts                []string               `json:"tlsHosts,omitempty"`
+	NsPort                  uint16                 `json:"nsPort,omitempty"`
+	ShutdownTimeout         int                    `json:"shutdownTimeout,omitempty"`
+	BuildConcurrency        uint16                 `json:"buildConcurrency,omitempty"`
+	BuildFailureTTL         int                    `json:"buildFailureTTL,omitempty"`
+	BuildFailureMaxTTL      int                    `json:"buildFailureMaxTTL,omitempty"`
+	BuildLimits             BuildLimits            `json:"buildLimits,omitempty"`
+	StaleIfError            int                    `json:"staleIfError,omitempty"`
+	CoalesceRequests        bool                   `json:"coalesceRequests,omitempty"`
+	CoalesceTimeout         int                    `json:"coalesceTimeout,omitempty"`
+	BanList                 BanList                `json:"banList,omitempty"`
+	Policy                  PackagePolicy          `json:"policy,omitempty"`
+	Advisories              Advisories             `json:"advisories,omitempty"`
+	Cors                    CORS                   `json:"cors,omitempty"`
+	Headers                 []HeaderRule           `json:"headers,omitempty"`
+	RateLimit               RateLimit              `json:"rateLimit,omitempty"`
+	ColdBuild               ColdBuild              `json:"coldBuild,omitempty"`
+	TrustedProxies          []string               `json:"trustedProxies,omitempty"`
+	ClientIPHeader          string                 `json:"clientIPHeader,omitempty"`
+	AuthSecret              string                 `json:"authSecret,omitempty"`
+	RequireAPIKey           bool                   `json:"requireApiKey,omitempty"`
+	APIKeys                 []APIKey               `json:"apiKeys,omitempty"`
+	AdminSecret             string                 `json:"adminSecret,omitempty"`
+	TokenSecret             string                 `json:"tokenSecret,omitempty"`
+	AuditLog                AuditLog               `json:"auditLog,omitempty"`
+	SigningKey              string                 `json:"signingKey,omitempty"`
+	PrebuildFile            string                 `json:"prebuildFile,omitempty"`
+	ReadOnly                bool                   `json:"readOnly,omitempty"`
+	BuilderOrigin           string                 `json:"builderOrigin,omitempty"`
+	WorkDir                 string                 `json:"workDir,omitempty"`
+	Cache                   string                 `json:"cache,omitempty"`
+	Database                string                 `json:"database,omitempty"`
+	Storage                 string                 `json:"storage,omitempty"`
+	Locker                  string                 `json:"locker,omitempty"`
+	StorageDedup            bool                   `json:"storageDedup,omitempty"`
+	StorageQuota            StorageQuota           `json:"storageQuota,omitempty"`
+	StorageCompression      string                 `json:"storageCompression,omitempty"`
+	StorageChecksum         StorageChecksum        `json:"storageChecksum,omitempty"`
+	Precompress             bool                   `json:"precompress,omitempty"`
+	ModulePreload           bool                   `json:"modulePreload,omitempty"`
+	HotCacheSize            int64                  `json:"hotCacheSize,omitempty"`
+	LogLevel                string                 `json:"logLevel,omitempty"`
+	LogDir                  string                 `json:"logDir,omitempty"`
+	LogFormat               string                 `json:"logFormat,omitempty"`
+	LogLevels               map[string]string      `json:"logLevels,omitempty"`
+	LogSinks                []string               `json:"logSinks,omitempty"`
+	AccessLogSinks          []string               `json:"accessLogSinks,omitempty"`
+	LogPrivacy              LogPrivacy             `json:"logPrivacy,omitempty"`
+	Tracing                 Tracing                `json:"tracing,omitempty"`
+	CdnOrigin               string                 `json:"cdnOrigin,omitempty"`
+	CdnBasePath             string                 `json:"cdnBasePath,omitempty"`
+	NpmRegistry             string                 `json:"npmRegistry,omitempty"`
+	NpmToken                string                 `json:"npmToken,omitempty"`
+	NpmRegistryScope        string                 `json:"npmRegistryScope,omitempty"`
+	NpmUser                 string                 `json:"npmUser,omitempty"`
+	NpmPassword             string                 `json:"npmPassword,omitempty"`
+	NpmAuth                 string                 `json:"npmAuth,omitempty"`
+	NpmCertFile             string                 `json:"npmCertFile,omitempty"`
+	NpmKeyFile              string                 `json:"npmKeyFile,omitempty"`
+	NpmCAFile               string                 `json:"npmCAFile,omitempty"`
+	NpmRegistries           map[string]NpmRegistry `json:"npmRegistries,omitempty"`
+	NpmRegistryMirrors      []NpmRegistry          `json:"npmRegistryMirrors,omitempty"`
+	NpmRegistryTimeout      int                    `json:"npmRegistryTimeout,omitempty"`
+	NpmDistTagsTTL          int                    `json:"npmDistTagsTTL,omitempty"`
+	NpmVersionTTL           int                    `json:"npmVersionTTL,omitempty"`
+	NpmStaleWhileRevalidate int                    `json:"npmStaleWhileRevalidate,omitempty"`
+	NpmTarballMaxSize       int64                  `json:"npmTarballMaxSize,omitempty"`
+	NpmDefaultTag           string                 `json:"npmDefaultTag,omitempty"`
+	NpmPrerelease           bool                   `json:"npmPrerelease,omitempty"`
+	NpmRejectDeprecated     bool                   `json:"npmRejectDeprecated,omitempty"`
+	NpmTarballConcurrency   int                    `json:"npmTarballConcurrency,omitempty"`
+	NoCompress              bool                   `json:"noCompress,omitempty"`
+	FeatureTargets          bool                   `json:"featureTargets,omitempty"`
+	MinTarget               string                 `json:"minTarget,omitempty"`
+	MaxTarget               string                 `json:"maxTarget,omitempty"`
+	DenoTargets             map[string]string      `json:"denoTargets,omitempty"`
+	UAParsers               []string               `json:"uaParsers,omitempty"`
+	InlineDepThreshold      int                    `json:"inlineDepThreshold,omitempty"`
+	Banner                  string                 `json:"banner,omitempty"`
+	Footer                  string                 `json:"footer,omitempty"`
+	Banners                 map[string]string      `json:"banners,omitempty"`
+	StubTypes               bool                   `json:"stubTypes,omitempty"`
+	TypesOverrides          map[string]string      `json:"typesOverrides,omitempty"`
+	NoDts                   bool                   `json:"noDts,omitempty"`
+	TypesHeader             string                 `json:"typesHeader,omitempty"`
+}
+
+// NpmRegistry is the registry and the credentials of a package scope.
+type NpmRegistry struct {
+	Registry string `json:"registry"`
+	Token    string `json:"token,omitempty"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Auth is the legacy `_auth` credentials, the base64 encoded `user:password`.
+	Auth string `json:"auth,omitempty"`
+	// CertFile and KeyFile are the PEM files of the client certificate for mutual TLS,
+	// CAFile is the PEM file of the CA certificates to verify the registry. The files are
+	// reloaded when they are changed.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	CAFile   string `json:"caFile,omitempty"`
+	// Timeout is the timeout of the requests to the registry in seconds.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// HasCredentials returns true if the registry requires the credentials or the client certificate.
+func (r *NpmRegistry) HasCredentials() bool {
+	return r.Token != "" || r.User != "" || r.Auth != "" || r.CertFile != ""
+}
+
+func (r *NpmRegistry) validate() error {
+	if r.Auth != "" {
+		data, err := base64.StdEncoding.DecodeString(r.Auth)
+		if err != nil || !strings.Contains(string(data), ":") {
+			return errors.New("invalid auth: should be the base64 encoded `user:password`")
+		}
+	}
+	if (r.CertFile == "") != (r.KeyFile == "") {
+		return errors.New("the certFile and keyFile should be set together")
+	}
+	return nil
 }
 
 type BanList struct {
@@ -48,6 +158,337 @@ type BanScope struct {
 	Excludes []string `json:"excludes"`
 }
 
+// PackagePolicy controls which packages the server builds. When the `allow` list is not
+// empty, only the matched packages are allowed. The `deny` list takes precedence over the
+// `allow` list.
+type PackagePolicy struct {
+	Allow []PolicyRule `json:"allow,omitempty"`
+	Deny  []PolicyRule `json:"deny,omitempty"`
+	// AllowLicenses and DenyLicenses are the SPDX license identifiers, e.g. "MIT", the glob patterns,
+	// e.g. "GPL-*", or the groups "copyleft" and "weak-copyleft". The packages without a license are
+	// denied if the `allowLicenses` list is not empty.
+	AllowLicenses []string `json:"allowLicenses,omitempty"`
+	DenyLicenses  []string `json:"denyLicenses,omitempty"`
+	// DenyInstallScripts denies the packages whose functionality depends on the install scripts,
+	// e.g. the native addons built by node-gyp. The lifecycle scripts are never run by the server.
+	DenyInstallScripts bool `json:"denyInstallScripts,omitempty"`
+}
+
+// Advisories checks the requested package versions against the OSV advisories (which include the
+// GitHub advisories and the malicious packages reports) before building. The `action` is one of
+// "block" (deny the request), "warn" (add the `X-Esm-Advisories` header) and "log" (note the
+// advisories in the build log), the empty action disables the check. The advisories are queried
+// from the OSV API, or loaded from the `mirror` directory of the OSV JSON files.
+type Advisories struct {
+	Action string `json:"action,omitempty"`
+	// API is the OSV query API, default is "https://api.osv.dev/v1/query".
+	API    string `json:"api,omitempty"`
+	Mirror string `json:"mirror,omitempty"`
+	// BlockMalicious blocks the malicious packages (the `MAL-*` advisories) with any action.
+	BlockMalicious bool `json:"blockMalicious,omitempty"`
+	// CacheTTL is the TTL of the query results in seconds, default is 3600.
+	CacheTTL int `json:"cacheTTL,omitempty"`
+	// Timeout is the timeout of the API requests in seconds, default is 10.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// PolicyRule matches the packages by the name and the version range. The name can be a glob
+// pattern, e.g. "@scope/*", "react-*". A rule can be a string as well, e.g. "lodash@<4.17.21".
+type PolicyRule struct {
+	Package string `json:"package"`
+	Version string `json:"version,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func (r *PolicyRule) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		r.Package = s
+		if i := strings.LastIndexByte(s, '@'); i > 0 {
+			r.Package = s[:i]
+			r.Version = s[i+1:]
+		}
+		return nil
+	}
+	type rule PolicyRule
+	return json.Unmarshal(data, (*rule)(r))
+}
+
+// IsEmpty returns true if no policy is configured.
+func (p *PackagePolicy) IsEmpty() bool {
+	return len(p.Allow) == 0 && len(p.Deny) == 0 && len(p.AllowLicenses) == 0 && len(p.DenyLicenses) == 0 && !p.DenyInstallScripts
+}
+
+func (p *PackagePolicy) validate() error {
+	for _, rules := range [][]PolicyRule{p.Allow, p.Deny} {
+		for _, r := range rules {
+			if _, err := path.Match(r.Package, ""); err != nil || r.Package == "" {
+				return fmt.Errorf("invalid package pattern %q", r.Package)
+			}
+			if r.Version != "" {
+				if _, err := semver.NewConstraint(r.Version); err != nil {
+					return fmt.Errorf("invalid version range %q of %s", r.Version, r.Package)
+				}
+			}
+		}
+	}
+	for _, pattern := range append(append([]string{}, p.AllowLicenses...), p.DenyLicenses...) {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid license pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// LogPrivacy minimizes the personal data in the logs, e.g. for the GDPR compliance.
+type LogPrivacy struct {
+	// Mode "gdpr" truncates the client IPs, drops the user agents and keeps the logs for 30 days,
+	// unless the other options are set.
+	Mode string `json:"mode,omitempty"`
+	// AnonymizeIP is "truncate" (zeros the last octet of IPv4, or the last 80 bits of IPv6) or
+	// "hash" (a keyed hash with a salt that is rotated daily and never stored).
+	AnonymizeIP   string `json:"anonymizeIp,omitempty"`
+	DropUserAgent bool   `json:"dropUserAgent,omitempty"`
+	// Retention is the days to keep the log files, default is no limit.
+	Retention int `json:"retention,omitempty"`
+}
+
+// Tracing exports the OpenTelemetry traces of the requests and the builds to the OTLP/HTTP
+// `endpoint` (e.g. "http://localhost:4318/v1/traces") with the JSON encoding.
+type Tracing struct {
+	Endpoint    string            `json:"endpoint,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"serviceName,omitempty"`
+	// SampleRate is the rate (0-1) of the traces that are sampled, default is 1. The sampling
+	// decision of the `traceparent` header of the request is respected.
+	SampleRate float64 `json:"sampleRate,omitempty"`
+}
+
+// StorageChecksum stores the checksums of the built modules and the type definitions, and
+// verifies them when the files are read, the corrupted files are rebuilt.
+type StorageChecksum struct {
+	// Verify is "always" or "sampled", default is empty that disables the checksums.
+	Verify string `json:"verify,omitempty"`
+	// SampleRate is the rate (0-1) of the reads that are verified in the "sampled" mode, default is 0.1.
+	SampleRate float64 `json:"sampleRate,omitempty"`
+}
+
+// StorageQuota limits the storage usage of the built modules, the type definitions and the
+// package tarballs, the files are evicted by the `eviction` policy when the quota is exceeded.
+type StorageQuota struct {
+	// MaxSize is the max total size in bytes.
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// MaxObjects is the max number of the files.
+	MaxObjects int `json:"maxObjects,omitempty"`
+	// Eviction is one of "lru", "lfu" and "ttl", default is "lru".
+	Eviction string `json:"eviction,omitempty"`
+	// TTL evicts the files that are not accessed in the TTL (in seconds).
+	TTL int `json:"ttl,omitempty"`
+	// Tiers are the TTLs by the access count, so the rarely requested files are evicted sooner
+	// than the popular ones.
+	Tiers []StorageQuotaTier `json:"tiers,omitempty"`
+	// Interval is the interval of the eviction in seconds, default is 600.
+	Interval int `json:"interval,omitempty"`
+}
+
+// StorageQuotaTier is a retention tier of the storage quota, the files that are requested at
+// least `minHits` times are evicted if they are not accessed in the `ttl` (in seconds, 0 means
+// no TTL).
+type StorageQuotaTier struct {
+	MinHits int64 `json:"minHits"`
+	TTL     int   `json:"ttl"`
+}
+
+// IsEmpty returns true if no quota is configured.
+func (q *StorageQuota) IsEmpty() bool {
+	return q.MaxSize <= 0 && q.MaxObjects <= 0 && q.TTL <= 0 && len(q.Tiers) == 0
+}
+
+func (q *StorageQuota) validate() error {
+	switch q.Eviction {
+	case "", "lru", "lfu":
+	case "ttl":
+		if q.TTL <= 0 && len(q.Tiers) == 0 {
+			return errors.New("the ttl eviction requires the `ttl` or `tiers` option")
+		}
+	default:
+		return fmt.Errorf("invalid eviction policy %q", q.Eviction)
+	}
+	if q.MaxSize < 0 || q.MaxObjects < 0 || q.TTL < 0 || q.Interval < 0 {
+		return errors.New("negative value")
+	}
+	for _, tier := range q.Tiers {
+		if tier.MinHits < 0 || tier.TTL < 0 {
+			return errors.New("negative value in tiers")
+		}
+	}
+	return nil
+}
+
+// APIKey is an API key to access the server, the requests are authorized with the
+// `Authorization: Bearer <key>` header or a signed `?token` query. The `scopes` restrict the
+// packages that the key can access, e.g. `["@myco/*"]`, default is all packages.
+type APIKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// CORS is the CORS policy of the server, the `rules` override the policy for the requests under
+// the paths.
+type CORS struct {
+	CORSPolicy
+	Rules []CORSRule `json:"rules,omitempty"`
+}
+
+// CORSPolicy is a CORS policy, the origins may contain a wildcard, e.g. "https://*.example.com".
+type CORSPolicy struct {
+	// AllowedOrigins is the list of the origins allowed to load the modules, default is ["*"].
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	// AllowedHeaders is the list of the request headers allowed besides `X-Esm-Target`.
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	// ExposedHeaders is the list of the response headers exposed besides the types headers.
+	ExposedHeaders []string `json:"exposedHeaders,omitempty"`
+	// MaxAge is the time in seconds that the preflight responses can be cached.
+	MaxAge int `json:"maxAge,omitempty"`
+	// AllowCredentials allows the requests with the cookies or the `Authorization` header.
+	AllowCredentials bool `json:"allowCredentials,omitempty"`
+}
+
+// CORSRule is the CORS policy of the requests under the `path` prefix (the build version
+// prefix like "/v135" is ignored), the omitted fields except `allowCredentials` inherit the
+// top-level policy.
+type CORSRule struct {
+	Path string `json:"path"`
+	CORSPolicy
+}
+
+func (p *CORSPolicy) validate() error {
+	if p.MaxAge < 0 {
+		return errors.New("negative max age")
+	}
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" && p.AllowCredentials {
+			return errors.New("the credentials can not be allowed for all origins")
+		}
+		if strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("invalid origin %q: only one wildcard is allowed", origin)
+		}
+	}
+	return nil
+}
+
+func (c *CORS) validate() error {
+	if len(c.AllowedOrigins) == 0 {
+		c.AllowedOrigins = []string{"*"}
+	}
+	if err := c.CORSPolicy.validate(); err != nil {
+		return err
+	}
+	for i, rule := range c.Rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("invalid path %q of the rule at index %d", rule.Path, i)
+		}
+		if len(rule.AllowedOrigins) == 0 {
+			rule.AllowedOrigins = c.AllowedOrigins
+		}
+		if len(rule.AllowedHeaders) == 0 {
+			rule.AllowedHeaders = c.AllowedHeaders
+		}
+		if len(rule.ExposedHeaders) == 0 {
+			rule.ExposedHeaders = c.ExposedHeaders
+		}
+		if rule.MaxAge == 0 {
+			rule.MaxAge = c.MaxAge
+		}
+		if err := rule.CORSPolicy.validate(); err != nil {
+			return fmt.Errorf("rule at index %d: %v", i, err)
+		}
+		c.Rules[i] = rule
+	}
+	return nil
+}
+
+// BuildLimits limits the resources of the builds, a build that exceeds a limit fails with the
+// `BUILD_LIMIT_EXCEEDED` error instead of exhausting the server.
+type BuildLimits struct {
+	// Timeout is the max duration of a build in seconds, default is 600.
+	Timeout int `json:"timeout,omitempty"`
+	// MaxMemory is the max heap size of the server in MB, the esbuild runs are canceled when the
+	// heap exceeds it. Default is 0 (no limit).
+	MaxMemory int `json:"maxMemory,omitempty"`
+	// InstallTimeout is the max duration of a pnpm process in seconds, default is 300.
+	InstallTimeout int `json:"installTimeout,omitempty"`
+	// InstallMemory is the max heap size of a pnpm process in MB, default is 0 (no limit).
+	InstallMemory int `json:"installMemory,omitempty"`
+	// Cgroup is a cgroup v2 directory that the pnpm processes are moved into, its `memory.max`
+	// and `cpu.max` limit the installs, e.g. "/sys/fs/cgroup/esm-install".
+	Cgroup string `json:"cgroup,omitempty"`
+	// MaxExtractedSize and MaxExtractedFiles limit the extracted files of a package tarball, default
+	// are 1GB and 100000.
+	MaxExtractedSize  int64 `json:"maxExtractedSize,omitempty"`
+	MaxExtractedFiles int   `json:"maxExtractedFiles,omitempty"`
+}
+
+// ColdBuild requires the requests that trigger a new build (the build is not in the storage) to
+// have the `header` (with the `value` if it's set) or an API key, the other requests get the
+// `status` (404 or 202, default is 404). The built modules are served to all the requests.
+type ColdBuild struct {
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// AuditLog records the build-triggering events (who requested which package version, the resolved
+// versions and the outcome) to the sinks: "file:<path>" (JSON lines, append-only), "stdout" (JSON
+// lines) and "webhook:<url>" (POST JSON). The webhook requests are signed with the `webhookSecret`.
+type AuditLog struct {
+	Sinks         []string `json:"sinks,omitempty"`
+	WebhookSecret string   `json:"webhookSecret,omitempty"`
+}
+
+// HeaderRule sets the response headers of the requests whose path matches the `path` pattern. The
+// pattern without `*` matches the path prefix, otherwise the `*` matches any characters and the
+// whole path must match. The empty value removes the header.
+type HeaderRule struct {
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+}
+
+// RateLimit limits the requests by the token buckets of the client IPs, and of the API keys for
+// the authorized requests. The requests that trigger a build take a token of the `builds` bucket
+// as well.
+type RateLimit struct {
+	IP    RateLimitRule `json:"ip,omitempty"`
+	Token RateLimitRule `json:"token,omitempty"`
+}
+
+// RateLimitRule is the token buckets of all the requests and the build-triggering requests.
+type RateLimitRule struct {
+	Requests TokenBucket `json:"requests,omitempty"`
+	Builds   TokenBucket `json:"builds,omitempty"`
+}
+
+// TokenBucket is a token bucket that is refilled at the `rate` (tokens per second) up to the
+// `burst`, the zero rate means no limit.
+type TokenBucket struct {
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+func (r *RateLimit) validate() error {
+	for _, b := range []*TokenBucket{&r.IP.Requests, &r.IP.Builds, &r.Token.Requests, &r.Token.Builds} {
+		if b.Rate < 0 || b.Burst < 0 {
+			return errors.New("negative value")
+		}
+		if b.Rate > 0 && b.Burst == 0 {
+			// allow the requests of one second at once by default
+			b.Burst = int(math.Ceil(b.Rate))
+		}
+	}
+	return nil
+}
+
 // Load loads config from the given file. Panic if failed to load.
 func Load(filename string) (*Config, error) {
 	var (
@@ -97,6 +538,15 @@ func fixConfig(c *Config) *Config {
 	if c.Port == 0 {
 		c.Port = 8080
 	}
+	if c.Listen != "" && c.Listen != "systemd" {
+		if strings.HasPrefix(c.Listen, "unix:") {
+			if c.Listen == "unix:" {
+				panic("invalid listen address: the socket path is required")
+			}
+		} else if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			panic("invalid listen address: " + err.Error())
+		}
+	}
 	if c.NsPort == 0 {
 		c.NsPort = 8088
 	}
@@ -141,6 +591,33 @@ func fixConfig(c *Config) *Config {
 	if c.BuildConcurrency < MinBuildConcurrency {
 		c.BuildConcurrency = MinBuildConcurrency
 	}
+	if c.BuildFailureTTL == 0 {
+		c.BuildFailureTTL = 30
+	}
+	if c.BuildLimits.Timeout <= 0 {
+		c.BuildLimits.Timeout = 600
+	}
+	if c.BuildLimits.InstallTimeout <= 0 {
+		c.BuildLimits.InstallTimeout = 300
+	}
+	if c.BuildLimits.MaxExtractedSize <= 0 {
+		c.BuildLimits.MaxExtractedSize = 1024 * 1024 * 1024
+	}
+	if c.BuildLimits.MaxExtractedFiles <= 0 {
+		c.BuildLimits.MaxExtractedFiles = 100000
+	}
+	if c.BuildLimits.MaxMemory < 0 || c.BuildLimits.InstallMemory < 0 {
+		panic("invalid build limits: the memory limits must be positive")
+	}
+	if cg := c.BuildLimits.Cgroup; cg != "" && !strings.HasPrefix(cg, "/") {
+		panic(fmt.Sprintf("invalid build limits: the cgroup %q must be an absolute path", cg))
+	}
+	if c.BuildFailureMaxTTL <= 0 {
+		c.BuildFailureMaxTTL = 3600
+	}
+	if c.CoalesceTimeout <= 0 {
+		c.CoalesceTimeout = 30
+	}
 	if c.Cache == "" {
 		c.Cache = "memory:default"
 	}
@@ -156,6 +633,68 @@ func fixConfig(c *Config) *Config {
 	if c.LogLevel == "" {
 		c.LogLevel = "info"
 	}
+	if c.LogFormat == "" {
+		c.LogFormat = "text"
+	} else if c.LogFormat != "text" && c.LogFormat != "json" {
+		panic(fmt.Sprintf("invalid log format %q: must be \"text\" or \"json\"", c.LogFormat))
+	}
+	for component, level := range c.LogLevels {
+		switch strings.ToLower(level) {
+		case "debug", "info", "warn", "error", "fatal":
+		default:
+			panic(fmt.Sprintf("invalid log level %q of the component %q", level, component))
+		}
+	}
+	for _, sink := range append(append([]string{}, c.LogSinks...), c.AccessLogSinks...) {
+		kind, arg, _ := strings.Cut(sink, ":")
+		if !((kind == "stdout" || kind == "stderr" || kind == "syslog") || (kind == "file" && arg != "")) {
+			panic(fmt.Sprintf("invalid log sink %q", sink))
+		}
+	}
+	switch c.LogPrivacy.Mode {
+	case "":
+	case "gdpr":
+		if c.LogPrivacy.AnonymizeIP == "" {
+			c.LogPrivacy.AnonymizeIP = "truncate"
+		}
+		if c.LogPrivacy.Retention == 0 {
+			c.LogPrivacy.Retention = 30
+		}
+		c.LogPrivacy.DropUserAgent = true
+	default:
+		panic(fmt.Sprintf("invalid log privacy mode %q: only \"gdpr\" is supported", c.LogPrivacy.Mode))
+	}
+	if ip := c.LogPrivacy.AnonymizeIP; ip != "" && ip != "truncate" && ip != "hash" {
+		panic(fmt.Sprintf("invalid log privacy anonymizeIp %q: must be \"truncate\" or \"hash\"", ip))
+	}
+	if c.LogPrivacy.Retention < 0 {
+		panic("invalid log privacy retention: must be a positive number of days")
+	}
+	if c.Tracing.Endpoint == "" {
+		if v := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); v != "" {
+			c.Tracing.Endpoint = v
+		} else if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+			c.Tracing.Endpoint = strings.TrimRight(v, "/") + "/v1/traces"
+		}
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, e := url.Parse(c.Tracing.Endpoint); e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			panic(fmt.Sprintf("invalid tracing endpoint %q", c.Tracing.Endpoint))
+		}
+	}
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = os.Getenv("OTEL_SERVICE_NAME")
+		if c.Tracing.ServiceName == "" {
+			c.Tracing.ServiceName = "esm.sh"
+		}
+	}
+	if c.Tracing.SampleRate == 0 {
+		c.Tracing.SampleRate = 1
+	} else if c.Tracing.SampleRate < 0 || c.Tracing.SampleRate > 1 {
+		panic("invalid tracing sample rate: must be between 0 and 1")
+	}
+	c.MinTarget = strings.ToLower(c.MinTarget)
+	c.MaxTarget = strings.ToLower(c.MaxTarget)
 	if c.NpmRegistry != "" {
 		_, e := url.Parse(c.NpmRegistry)
 		if e != nil {
@@ -173,6 +712,21 @@ func fixConfig(c *Config) *Config {
 	if c.NpmToken == "" {
 		c.NpmToken = os.Getenv("NPM_TOKEN")
 	}
+	if c.NpmDistTagsTTL <= 0 {
+		c.NpmDistTagsTTL = 10 * 60
+	}
+	if c.NpmVersionTTL <= 0 {
+		c.NpmVersionTTL = 24 * 3600
+	}
+	if c.NpmDefaultTag == "" {
+		c.NpmDefaultTag = "latest"
+	}
+	if c.NpmTarballMaxSize <= 0 {
+		c.NpmTarballMaxSize = 256 * 1024 * 1024
+	}
+	if c.NpmTarballConcurrency <= 0 {
+		c.NpmTarballConcurrency = 4
+	}
 	if c.NpmRegistryScope == "" {
 		c.NpmRegistryScope = os.Getenv("NPM_REGISTRY_SCOPE")
 	}
@@ -182,9 +736,183 @@ func fixConfig(c *Config) *Config {
 	if c.NpmPassword == "" {
 		c.NpmPassword = os.Getenv("NPM_PASSWORD")
 	}
+	if c.NpmAuth == "" {
+		c.NpmAuth = os.Getenv("NPM_AUTH")
+	}
+	if err := (&NpmRegistry{Auth: c.NpmAuth, CertFile: c.NpmCertFile, KeyFile: c.NpmKeyFile}).validate(); err != nil {
+		panic("invalid npm registry config: " + err.Error())
+	}
+	if len(c.NpmRegistries) > 0 {
+		registries := make(map[string]NpmRegistry, len(c.NpmRegistries))
+		for scope, r := range c.NpmRegistries {
+			// both `@scope` and `@scope/*` are accepted
+			scope = strings.TrimSuffix(strings.TrimSuffix(scope, "*"), "/")
+			if !strings.HasPrefix(scope, "@") || strings.Contains(scope, "/") {
+				panic("invalid npm registry scope: " + scope)
+			}
+			u, e := url.Parse(r.Registry)
+			if e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				panic("invalid npm registry url of " + scope)
+			}
+			// the credentials in the url would be exposed in the logs and error messages
+			if u.User != nil {
+				panic("invalid npm registry url of " + scope + ": use the token or user/password fields for the credentials")
+			}
+			if e := r.validate(); e != nil {
+				panic("invalid npm registry config of " + scope + ": " + e.Error())
+			}
+			r.Registry = strings.TrimRight(r.Registry, "/") + "/"
+			registries[scope] = r
+		}
+		c.NpmRegistries = registries
+	}
+	for i, r := range c.NpmRegistryMirrors {
+		u, e := url.Parse(r.Registry)
+		if e != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+			panic(fmt.Sprintf("invalid npm registry mirror url at index %d", i))
+		}
+		if e := r.validate(); e != nil {
+			panic(fmt.Sprintf("invalid npm registry mirror config at index %d: %v", i, e))
+		}
+		c.NpmRegistryMirrors[i].Registry = strings.TrimRight(r.Registry, "/") + "/"
+	}
+	if err := c.Policy.validate(); err != nil {
+		panic("invalid policy: " + err.Error())
+	}
+	switch c.Advisories.Action {
+	case "", "block", "warn", "log":
+	default:
+		panic(fmt.Sprintf("invalid advisories action %q: must be one of \"block\", \"warn\" and \"log\"", c.Advisories.Action))
+	}
+	if c.Advisories.Action != "" && c.Advisories.Mirror == "" {
+		if c.Advisories.API == "" {
+			c.Advisories.API = "https://api.osv.dev/v1/query"
+		} else if u, e := url.Parse(c.Advisories.API); e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			panic(fmt.Sprintf("invalid advisories api %q", c.Advisories.API))
+		}
+	}
+	if c.Advisories.CacheTTL <= 0 {
+		c.Advisories.CacheTTL = 3600
+	}
+	if c.Advisories.Timeout <= 0 {
+		c.Advisories.Timeout = 10
+	}
+	if err := c.StorageQuota.validate(); err != nil {
+		panic("invalid storage quota: " + err.Error())
+	}
+	if err := c.Cors.validate(); err != nil {
+		panic("invalid cors: " + err.Error())
+	}
+	if c.ColdBuild.Status == 0 {
+		c.ColdBuild.Status = 404
+	} else if c.ColdBuild.Status != 404 && c.ColdBuild.Status != 202 {
+		panic(fmt.Sprintf("invalid cold build status %d: must be 404 or 202", c.ColdBuild.Status))
+	}
+	for i, rule := range c.Headers {
+		if !strings.HasPrefix(rule.Path, "/") && !strings.HasPrefix(rule.Path, "*") {
+			panic(fmt.Sprintf("invalid path %q of the header rule at index %d", rule.Path, i))
+		}
+		for key := range rule.Headers {
+			if key == "" || strings.ContainsAny(key, " :\r\n") {
+				panic(fmt.Sprintf("invalid header %q of the header rule at index %d", key, i))
+			}
+		}
+	}
+	for _, sink := range c.AuditLog.Sinks {
+		kind, arg, _ := strings.Cut(sink, ":")
+		switch kind {
+		case "stdout":
+		case "file":
+			if arg == "" {
+				panic("invalid audit log sink: the file path is required")
+			}
+		case "webhook":
+			if u, e := url.Parse(arg); e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				panic(fmt.Sprintf("invalid audit log sink: the webhook url %q is invalid", arg))
+			}
+		default:
+			panic(fmt.Sprintf("invalid audit log sink %q: must be \"file:<path>\", \"stdout\" or \"webhook:<url>\"", sink))
+		}
+	}
+	for i, k := range c.APIKeys {
+		if k.Name == "" || len(k.Key) < 16 {
+			panic(fmt.Sprintf("invalid api key at index %d: the name is required and the key must be at least 16 characters", i))
+		}
+		for _, scope := range k.Scopes {
+			if _, err := path.Match(scope, ""); err != nil || scope == "" {
+				panic(fmt.Sprintf("invalid scope %q of api key %q", scope, k.Name))
+			}
+		}
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		panic("invalid rate limit: " + err.Error())
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = 60
+	}
+	for i, p := range c.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		if _, _, err := net.ParseCIDR(p); err != nil {
+			panic("invalid trusted proxy: " + c.TrustedProxies[i])
+		}
+		c.TrustedProxies[i] = p
+	}
+	switch h := http.CanonicalHeaderKey(c.ClientIPHeader); h {
+	case "":
+		c.ClientIPHeader = "X-Forwarded-For"
+	case "X-Forwarded-For", "X-Real-Ip", "Cf-Connecting-Ip":
+		c.ClientIPHeader = h
+	default:
+		panic("invalid client IP header: " + c.ClientIPHeader)
+	}
+	if c.StorageQuota.Interval == 0 {
+		c.StorageQuota.Interval = 600
+	}
+	if c.BuilderOrigin != "" {
+		u, e := url.Parse(c.BuilderOrigin)
+		if e != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			panic("invalid builder origin: " + c.BuilderOrigin)
+		}
+		c.BuilderOrigin = u.Scheme + "://" + u.Host
+	}
+	if c.StorageCompression != "" && c.StorageCompression != "br" {
+		panic(fmt.Sprintf("invalid storage compression %q: only \"br\" is supported", c.StorageCompression))
+	}
+	switch c.StorageChecksum.Verify {
+	case "", "always":
+	case "sampled":
+		if c.StorageChecksum.SampleRate <= 0 {
+			c.StorageChecksum.SampleRate = 0.1
+		}
+		if c.StorageChecksum.SampleRate > 1 {
+			panic(fmt.Sprintf("invalid storage checksum sample rate %v: must be between 0 and 1", c.StorageChecksum.SampleRate))
+		}
+	default:
+		panic(fmt.Sprintf("invalid storage checksum verify mode %q: must be \"always\" or \"sampled\"", c.StorageChecksum.Verify))
+	}
 	if c.AuthSecret == "" {
 		c.AuthSecret = os.Getenv("SERVER_AUTH_SECRET")
 	}
+	if c.AdminSecret == "" {
+		c.AdminSecret = os.Getenv("SERVER_ADMIN_SECRET")
+	}
+	if c.TokenSecret == "" {
+		c.TokenSecret = os.Getenv("SERVER_TOKEN_SECRET")
+	}
+	if c.SigningKey == "" {
+		c.SigningKey = os.Getenv("SERVER_SIGNING_KEY")
+	}
+	if c.SigningKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.SigningKey); err != nil || (len(key) != 32 && len(key) != 64) {
+			panic("invalid signing key: must be the base64 encoded Ed25519 seed (32 bytes) or private key (64 bytes)")
+		}
+	}
 	return c
 }
 
@@ -71,3 +71,50 @@ func TestBanList_IsPackageBanned(t *testing.T) {
 		})
 	}
 }
+
+func TestPackagePolicy_validate(t *testing.T) {
+	valid := PackagePolicy{
+		Allow: []PolicyRule{{Package: "@myco/*"}, {Package: "react", Version: "^18.0.0"}},
+		Deny:  []PolicyRule{{Package: "lodash", Version: "<4.17.21"}},
+	}
+	if err := valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []PackagePolicy{
+		{Deny: []PolicyRule{{Package: ""}}},
+		{Deny: []PolicyRule{{Package: "[invalid"}}},
+		{Allow: []PolicyRule{{Package: "react", Version: "not a range"}}},
+	} {
+		if err := p.validate(); err == nil {
+			t.Fatalf("should fail on %v", p)
+		}
+	}
+}
+
+func TestCORS_validate(t *testing.T) {
+	c := CORS{
+		CORSPolicy: CORSPolicy{ExposedHeaders: []string{"X-Request-Id"}, MaxAge: 600},
+		Rules: []CORSRule{
+			{Path: "/@myco/", CORSPolicy: CORSPolicy{AllowedOrigins: []string{"https://*.myco.com"}, AllowCredentials: true}},
+		},
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.AllowedOrigins) != 1 || c.AllowedOrigins[0] != "*" {
+		t.Fatalf("unexpected default origins: %v", c.AllowedOrigins)
+	}
+	if rule := c.Rules[0]; rule.MaxAge != 600 || len(rule.ExposedHeaders) != 1 || rule.AllowedOrigins[0] != "https://*.myco.com" {
+		t.Fatalf("the rule should inherit the policy: %+v", rule)
+	}
+	for _, c := range []CORS{
+		{CORSPolicy: CORSPolicy{AllowCredentials: true}},
+		{CORSPolicy: CORSPolicy{AllowedOrigins: []string{"https://*.*.com"}}},
+		{Rules: []CORSRule{{Path: "@myco/"}}},
+		{Rules: []CORSRule{{Path: "/@myco/", CORSPolicy: CORSPolicy{AllowCredentials: true}}}},
+	} {
+		if err := c.validate(); err == nil {
+			t.Fatalf("should fail on %+v", c)
+		}
+	}
+}
@@ -13,6 +13,13 @@ const (
 	nodejsLatestLTS  = "18.16.0"
 	nodeTypesVersion = "18.16.19"
 	denoStdVersion   = "0.177.1"
+	// the typescript version to select the `typesVersions` of package.json by default
+	tsLatestVersion = "5.3"
+	// the npm compatibility registry of JSR, the `@scope/pkg` package of JSR is published as `@jsr/scope__pkg`
+	jsrNpmRegistry = "https://npm.jsr.io/"
+	// the path prefix of the server APIs, it's reserved by the npm registry as well (e.g. `/-/v1/search`)
+	// so the APIs never shadow the packages
+	apiPathPrefix = "/-/"
 )
 
 // fix some npm package versions
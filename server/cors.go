@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+// corsRule is a CORS middleware for the requests under the path prefix.
+type corsRule struct {
+	path   string
+	handle rex.Handle
+}
+
+// corsHandler returns a CORS middleware of the policy, the first rule that matches the request
+// path overrides the top-level policy.
+func corsHandler(c config.CORS) rex.Handle {
+	defaultHandle := newCorsHandle(c.CORSPolicy)
+	rules := make([]corsRule, len(c.Rules))
+	for i, rule := range c.Rules {
+		rules[i] = corsRule{path: rule.Path, handle: newCorsHandle(rule.CORSPolicy)}
+	}
+	return func(ctx *rex.Context) interface{} {
+		if len(rules) > 0 {
+			pathname := strings.TrimPrefix(ctx.R.URL.Path, cfg.CdnBasePath)
+			if !strings.HasPrefix(pathname, "/") {
+				pathname = "/" + pathname
+			}
+			if loc := regexpBuildVersionPath.FindStringIndex(pathname); loc != nil {
+				pathname = "/" + pathname[loc[1]:]
+			} else if strings.HasPrefix(pathname, "/stable/") {
+				pathname = strings.TrimPrefix(pathname, "/stable")
+			}
+			for _, rule := range rules {
+				if strings.HasPrefix(pathname, rule.path) {
+					return rule.handle(ctx)
+				}
+			}
+		}
+		return defaultHandle(ctx)
+	}
+}
+
+func newCorsHandle(p config.CORSPolicy) rex.Handle {
+	return rex.Cors(rex.CORS{
+		AllowedOrigins: p.AllowedOrigins,
+		AllowedMethods: []string{
+			http.MethodGet,
+			http.MethodPost,
+		},
+		AllowedHeaders:   append([]string{"X-Esm-Target"}, p.AllowedHeaders...),
+		ExposedHeaders:   append([]string{"X-TypeScript-Types", "X-Deno-Types", "X-Esm-Deprecated", "X-Esm-Advisories", "X-Esm-License", "X-Esm-Error-Code", "X-Esm-Integrity", "X-Esm-Signature", "Accept-Ranges", "Content-Range"}, p.ExposedHeaders...),
+		MaxAge:           p.MaxAge,
+		AllowCredentials: p.AllowCredentials,
+	})
+}
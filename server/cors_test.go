@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+func TestCorsHandler(t *testing.T) {
+	defer func(prevCfg *config.Config) {
+		cfg = prevCfg
+	}(cfg)
+	cfg = &config.Config{}
+
+	router := &rex.Router{}
+	router.Use(
+		corsHandler(config.CORS{
+			CORSPolicy: config.CORSPolicy{AllowedOrigins: []string{"*"}, MaxAge: 600},
+			Rules: []config.CORSRule{{
+				Path: "/@myco/",
+				CORSPolicy: config.CORSPolicy{
+					AllowedOrigins:   []string{"https://*.myco.com"},
+					ExposedHeaders:   []string{"X-Request-Id"},
+					MaxAge:           600,
+					AllowCredentials: true,
+				},
+			}},
+		}),
+		func(ctx *rex.Context) interface{} {
+			return "ok"
+		},
+	)
+	request := func(method string, url string, origin string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("GET", "https://esm.sh/react@18.2.0", "https://example.com")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("unexpected headers: %v", rec.Header())
+	}
+
+	for _, url := range []string{"https://esm.sh/@myco/ui@1.0.0", "https://esm.sh/v135/@myco/ui@1.0.0/es2022/ui.mjs"} {
+		rec = request("GET", url, "https://app.myco.com")
+		h := rec.Header()
+		if h.Get("Access-Control-Allow-Origin") != "https://app.myco.com" || h.Get("Access-Control-Allow-Credentials") != "true" || h.Get("Access-Control-Expose-Headers") == "" {
+			t.Fatalf("unexpected headers of %s: %v", url, h)
+		}
+		rec = request("GET", url, "https://example.com")
+		if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Fatalf("the origin should not be allowed for %s", url)
+		}
+	}
+
+	rec = request("OPTIONS", "https://esm.sh/@myco/ui@1.0.0", "https://app.myco.com")
+	if rec.Code != 204 || rec.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Fatalf("unexpected preflight response: %d %v", rec.Code, rec.Header())
+	}
+}
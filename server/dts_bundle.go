@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+var (
+	regexpDeclareModifier = regexp.MustCompile(`^(export\s+)?declare\s+`)
+	regexpAmbientBlock    = regexp.MustCompile(`^declare\s+(global\b|module\s*['"])`)
+	// matches the `import`/`export` statements at the beginning of a line
+	regexpDTSModuleSyntax       = regexp.MustCompile(`(?m)^(import|export)\b`)
+	regexpTopLevelDeclareModule = regexp.MustCompile(`(?m)^declare\s+module\s*['"]`)
+)
+
+// bundleDTS rolls up the transformed declaration file and its local imports into a single file,
+// the local modules are wrapped in `declare module "<url>" {}` blocks so editors can resolve
+// all the types of the entrypoint with one request.
+func bundleDTS(savePath string, url string) (output []byte, err error) {
+	bundlePath := path.Join("types-bundle", strings.TrimPrefix(savePath, "types/"))
+	r, err := fs.OpenFile(bundlePath)
+	if err == nil {
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	if err != storage.ErrNotFound {
+		return
+	}
+
+	references := newStringSet()
+	modules := bytes.NewBuffer(nil)
+	marker := newStringSet(savePath)
+	entry, err := bundleDTSModule(savePath, url, references, modules, marker)
+	if err != nil {
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for _, ref := range references.Values() {
+		fmt.Fprintf(buf, "%s\n", ref)
+	}
+	buf.Write(entry)
+	if modules.Len() > 0 {
+		buf.WriteString("\n// bundled by esm.sh\n")
+		buf.Write(modules.Bytes())
+	}
+	output = buf.Bytes()
+
+	_, err = fs.WriteFile(bundlePath, bytes.NewReader(output))
+	return
+}
+
+func bundleDTSModule(savePath string, url string, references *stringSet, modules *bytes.Buffer, marker *stringSet) (output []byte, err error) {
+	r, err := fs.OpenFile(savePath)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	deps := [][2]string{}
+	buf := bytes.NewBuffer(nil)
+	err = walkDts(r, buf, func(specifier string, kind string, position int) string {
+		if !isLocalSpecifier(specifier) || kind == "declareModule" || kind == "referencePath" {
+			return specifier
+		}
+		depSavePath := path.Join(path.Dir(savePath), specifier)
+		if !isBundleableDTS(depSavePath) {
+			// keep the relative specifier that is resolved to the unbundled file
+			return specifier
+		}
+		scheme, rest := splitURLScheme(url)
+		depUrl := scheme + path.Join(path.Dir(rest), specifier)
+		deps = append(deps, [2]string{depSavePath, depUrl})
+		return depUrl
+	})
+	if err != nil {
+		return
+	}
+
+	for _, dep := range deps {
+		depSavePath, depUrl := dep[0], dep[1]
+		if marker.Has(depSavePath) {
+			continue
+		}
+		marker.Add(depSavePath)
+		var code []byte
+		code, err = bundleDTSModule(depSavePath, depUrl, references, modules, marker)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(modules, "declare module \"%s\" {\n", depUrl)
+		for _, line := range bytes.Split(code, []byte{'\n'}) {
+			if len(line) == 0 {
+				continue
+			}
+			// `declare` modifier is not allowed in the ambient module
+			if !regexpAmbientBlock.Match(line) {
+				line = regexpDeclareModifier.ReplaceAll(line, []byte("$1"))
+			}
+			modules.WriteString("  ")
+			modules.Write(line)
+			modules.WriteByte('\n')
+		}
+		modules.WriteString("}\n")
+	}
+
+	// hoist the reference tags to the top of the bundle
+	lines := bytes.Split(buf.Bytes(), []byte{'\n'})
+	out := bytes.NewBuffer(nil)
+	for _, line := range lines {
+		if bytes.HasPrefix(line, bytesStripleSlash) && regexpReferenceTag.Match(line) {
+			references.Add(string(line))
+			continue
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	output = bytes.TrimRight(out.Bytes(), "\n")
+	output = append(output, '\n')
+	return
+}
+
+// isBundleableDTS checks if the declaration file is a module that can be wrapped in the
+// `declare module` block, the global scripts and the files that declare modules are not.
+func isBundleableDTS(savePath string) bool {
+	r, err := fs.OpenFile(savePath)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return false
+	}
+	return regexpDTSModuleSyntax.Match(data) && !regexpTopLevelDeclareModule.Match(data)
+}
+
+func splitURLScheme(url string) (scheme string, rest string) {
+	i := strings.Index(url, "://")
+	if i == -1 {
+		return "", url
+	}
+	return url[:i+3], url[i+3:]
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestBundleDTS(t *testing.T) {
+	localFS, err := storage.OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prev storage.FileSystem) { fs = prev }(fs)
+	fs = localFS
+
+	dir := "types/esm.sh/v135/foo@1.0.0/X-ZQ"
+	files := map[string]string{
+		"index.d.ts": `/// <reference path="./global.d.ts" />
+import { Bar } from "./bar.d.ts";
+export declare function foo(): Bar;
+export * from "./global.d.ts";
+`,
+		"bar.d.ts": `import type { Baz } from "./baz.d.ts";
+export declare interface Bar { baz: Baz }
+`,
+		"baz.d.ts": `export type Baz = string;
+declare const version: string;
+export { version };
+`,
+		"global.d.ts": `declare var FOO: string;
+`,
+	}
+	for name, content := range files {
+		_, err = fs.WriteFile(path.Join(dir, name), strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := bundleDTS(path.Join(dir, "index.d.ts"), "https://esm.sh/v135/foo@1.0.0/X-ZQ/index.d.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dts := string(data)
+	for _, s := range []string{
+		`/// <reference path="./global.d.ts" />`,
+		`import { Bar } from "https://esm.sh/v135/foo@1.0.0/X-ZQ/bar.d.ts";`,
+		`export * from "./global.d.ts";`,
+		`declare module "https://esm.sh/v135/foo@1.0.0/X-ZQ/bar.d.ts" {`,
+		`  import type { Baz } from "https://esm.sh/v135/foo@1.0.0/X-ZQ/baz.d.ts";`,
+		`  export interface Bar { baz: Baz }`,
+		`declare module "https://esm.sh/v135/foo@1.0.0/X-ZQ/baz.d.ts" {`,
+		`  const version: string;`,
+	} {
+		if !strings.Contains(dts, s) {
+			t.Fatalf("missing %q in the bundled dts:\n%s", s, dts)
+		}
+	}
+	if strings.Index(dts, `/// <reference`) != 0 {
+		t.Fatalf("the reference tags should be hoisted:\n%s", dts)
+	}
+}
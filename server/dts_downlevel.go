@@ -0,0 +1,44 @@
+package server
+
+import (
+	"regexp"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// the declaration syntax that older TypeScript compilers don't understand, the rules are applied
+// when the requested TypeScript version is lower than the `since` version.
+var dtsDownlevelRules = []struct {
+	since   string
+	regexp  *regexp.Regexp
+	replace string
+}{
+	// `const` modifier of type parameters (TS 5.0), e.g. `function foo<const T>(x: T): T`
+	{"5.0", regexp.MustCompile(`([<,]\s*)const\s+([A-Za-z_$][\w$]*)`), "$1$2"},
+	// `export type *` (TS 5.0)
+	{"5.0", regexp.MustCompile(`(?m)^(\s*)export\s+type\s+\*`), "${1}export *"},
+	// `accessor` modifier of class fields (TS 4.9)
+	{"4.9", regexp.MustCompile(`(?m)^(\s*(?:(?:public|private|protected|static|readonly|declare|abstract|override)\s+)*)accessor\s+([\w$#\[])`), "$1$2"},
+	// variance annotations of type parameters (TS 4.7), e.g. `interface Foo<in out T>`
+	{"4.7", regexp.MustCompile(`([<,]\s*)(?:in\s+out|in|out)\s+([A-Za-z_$][\w$]*)(\s*[,>=]|\s+extends\b)`), "$1$2$3"},
+}
+
+// downlevelDTS strips the declaration syntax that is not supported by the given TypeScript version.
+func downlevelDTS(data []byte, tsVersion string) []byte {
+	if tsVersion == "" {
+		return data
+	}
+	tsv, err := semver.NewVersion(tsVersion)
+	if err != nil {
+		return data
+	}
+	for _, rule := range dtsDownlevelRules {
+		if tsv.LessThan(semver.MustParse(rule.since)) {
+			// replace until no match since the adjacent matches (e.g. `<in T, out U>`) share the separator
+			for rule.regexp.Match(data) {
+				data = rule.regexp.ReplaceAll(data, []byte(rule.replace))
+			}
+		}
+	}
+	return data
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestDownlevelDTS(t *testing.T) {
+	dts := `export declare function tuple<const T extends readonly unknown[]>(...args: T): T;
+export type * from "./types.d.ts";
+export declare class Foo {
+  static accessor bar: string;
+}
+export interface State<in out T, out U = string> {
+  get: () => T;
+}
+`
+	if got := string(downlevelDTS([]byte(dts), "")); got != dts {
+		t.Fatalf("expected unchanged output, got:\n%s", got)
+	}
+	if got := string(downlevelDTS([]byte(dts), "5.3")); got != dts {
+		t.Fatalf("expected unchanged output, got:\n%s", got)
+	}
+
+	expected := `export declare function tuple<T extends readonly unknown[]>(...args: T): T;
+export * from "./types.d.ts";
+export declare class Foo {
+  static accessor bar: string;
+}
+export interface State<in out T, out U = string> {
+  get: () => T;
+}
+`
+	if got := string(downlevelDTS([]byte(dts), "4.9")); got != expected {
+		t.Fatalf("unexpected output for ts 4.9:\n%s", got)
+	}
+
+	expected = `export declare function tuple<T extends readonly unknown[]>(...args: T): T;
+export * from "./types.d.ts";
+export declare class Foo {
+  static bar: string;
+}
+export interface State<T, U = string> {
+  get: () => T;
+}
+`
+	if got := string(downlevelDTS([]byte(dts), "4.5")); got != expected {
+		t.Fatalf("unexpected output for ts 4.5:\n%s", got)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	regexpExportAssignment = regexp.MustCompile(`(?m)^(\s*)export\s*=\s*([\w$]+(?:\.[\w$]+)*)\s*;?[ \t]*$`)
+	regexpImportRequire    = regexp.MustCompile(`(?m)^(\s*)(export\s+)?import\s+([\w$]+)\s*=\s*require\(\s*('[^']+'|"[^"]+")\s*\)\s*;?[ \t]*$`)
+	regexpCJSConstruct     = regexp.MustCompile(`(?m)^\s*(export\s*=|(export\s+)?import\s+[\w$]+\s*=\s*require\()`)
+)
+
+// toESMDeclaration rewrites the CJS-only constructs of a declaration file into ESM-compatible
+// declarations, `export = foo` becomes `export default foo` and `import foo = require("foo")`
+// becomes `import foo from "foo"`. The constructs that can't be rewritten are kept as they are
+// and listed in a comment at the top of the output.
+func toESMDeclaration(data []byte, origin string) (output []byte, err error) {
+	data = regexpExportAssignment.ReplaceAll(data, []byte("${1}export default ${2};"))
+	data = regexpImportRequire.ReplaceAllFunc(data, func(m []byte) []byte {
+		s := regexpImportRequire.FindSubmatch(m)
+		if len(s[2]) > 0 {
+			// `export import foo = require("foo")` re-exports the module as a namespace
+			return []byte(fmt.Sprintf("%simport * as %s from %s;\n%sexport { %s };", s[1], s[3], s[4], s[1], s[3]))
+		}
+		return []byte(fmt.Sprintf("%simport %s from %s;", s[1], s[3], s[4]))
+	})
+
+	// the modules declared in the file (e.g. the `?bundle` types) must keep their names
+	declared := newStringSet()
+	err = walkDts(bytes.NewReader(data), bytes.NewBuffer(nil), func(specifier string, kind string, position int) string {
+		if kind == "declareModule" {
+			declared.Add(specifier)
+		}
+		return specifier
+	})
+	if err != nil {
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = walkDts(bytes.NewReader(data), buf, func(specifier string, kind string, position int) string {
+		if kind == "declareModule" || kind == "referencePath" || declared.Has(specifier) {
+			return specifier
+		}
+		// the dependency declarations are rewritten as well
+		if (isLocalSpecifier(specifier) || strings.HasPrefix(specifier, origin+"/")) && endsWith(strings.Split(specifier, "?")[0], ".d.ts", ".d.mts", ".d.cts") {
+			if strings.Contains(specifier, "?") {
+				return specifier + "&esm"
+			}
+			return specifier + "?esm"
+		}
+		return specifier
+	})
+	if err != nil {
+		return
+	}
+
+	unsupported := regexpCJSConstruct.FindAll(buf.Bytes(), -1)
+	if len(unsupported) == 0 {
+		return buf.Bytes(), nil
+	}
+	out := bytes.NewBuffer(nil)
+	out.WriteString("// esm.sh: the following CJS constructs can't be rewritten to ESM:\n")
+	for _, c := range unsupported {
+		fmt.Fprintf(out, "//   %s\n", strings.TrimSpace(string(c)))
+	}
+	out.Write(buf.Bytes())
+	return out.Bytes(), nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToESMDeclaration(t *testing.T) {
+	dts := `import Bar = require("./bar.d.ts");
+export import Baz = require("https://esm.sh/v135/baz@1.0.0/index.d.ts");
+import type { Qux } from "qux";
+declare function foo(): Bar;
+declare namespace foo {
+  const version: string;
+}
+export = foo;
+`
+	data, err := toESMDeclaration([]byte(dts), "https://esm.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(data)
+	for _, s := range []string{
+		`import Bar from "./bar.d.ts?esm";`,
+		`import * as Baz from "https://esm.sh/v135/baz@1.0.0/index.d.ts?esm";`,
+		`export { Baz };`,
+		`import type { Qux } from "qux";`,
+		`export default foo;`,
+	} {
+		if !strings.Contains(output, s) {
+			t.Fatalf("expected %q in output:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, "esm.sh: the following CJS constructs") {
+		t.Fatalf("unexpected unsupported constructs comment:\n%s", output)
+	}
+
+	data, err = toESMDeclaration([]byte("declare const foo: { bar: string };\nexport = { foo };\n"), "https://esm.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output = string(data)
+	if !strings.HasPrefix(output, "// esm.sh: the following CJS constructs can't be rewritten to ESM:\n//   export =\n") {
+		t.Fatalf("expected unsupported constructs comment, got:\n%s", output)
+	}
+}
@@ -196,7 +196,9 @@ func (task *BuildTask) transformDTS(dts string, aliasDepsPrefix string, marker *
 
 			depTypePkgName, _ := splitPkgPath(res)
 			maybeVersion := []string{"latest"}
-			if v, ok := pkgInfo.Dependencies[depTypePkgName]; ok {
+			if v, ok := task.getLockedVersion(depTypePkgName); ok {
+				maybeVersion = []string{v, "latest"}
+			} else if v, ok := pkgInfo.Dependencies[depTypePkgName]; ok {
 				maybeVersion = []string{v, "latest"}
 			} else if v, ok := pkgInfo.PeerDependencies[depTypePkgName]; ok {
 				maybeVersion = []string{v, "latest"}
@@ -216,7 +218,14 @@ func (task *BuildTask) transformDTS(dts string, aliasDepsPrefix string, marker *
 				subpath = pkg.Submodule
 				info, fromPackageJSON, err = getPackageInfo(installDir, pkg.Name, version)
 				if err != nil || ((info.Types == "" && info.Typings == "") && !strings.HasPrefix(info.Name, "@types/")) {
-					p, ok, e := getPackageInfo(installDir, toTypesPackageName(pkg.Name), version)
+					aliasName, aliasVersion := resolveNpmAlias(pkg.Name, version)
+					typesName, typesVersion := toTypesPackageName(aliasName), aliasVersion
+					if err == nil {
+						if n, v, ok := getTypesOverride(aliasName, info.Version); ok {
+							typesName, typesVersion = n, v
+						}
+					}
+					p, ok, e := getPackageInfo(installDir, typesName, typesVersion)
 					if e == nil {
 						info = p
 						fromPackageJSON = ok
@@ -316,12 +325,17 @@ func (task *BuildTask) transformDTS(dts string, aliasDepsPrefix string, marker *
 		}
 	}
 
+	// strip the syntax that is not supported by the TypeScript version of `?ts` query
+	if task.Args.tsVersion != "" {
+		buf = bytes.NewBuffer(downlevelDTS(buf.Bytes(), task.Args.tsVersion))
+	}
+
 	if footer.Len() > 0 {
 		buf.WriteString("\n// added by esm.sh\n")
 		io.Copy(buf, footer)
 	}
 
-	_, err = fs.WriteFile(savePath, buf)
+	_, err = task.writeFile(savePath, buf)
 	if err != nil {
 		return
 	}
@@ -359,6 +373,47 @@ func (task *BuildTask) transformDTS(dts string, aliasDepsPrefix string, marker *
 	return
 }
 
+// buildStubDTS generates the type declarations of the untyped package by the exported names
+// of the module, all the exports are typed as `any`.
+func (task *BuildTask) buildStubDTS() (dts string, err error) {
+	submodule := task.Pkg.Submodule
+	if submodule == "" {
+		submodule = "index"
+	}
+	dts = fmt.Sprintf(
+		"%s@%s/%s%s.d.ts",
+		task.Pkg.Name,
+		task.Pkg.Version,
+		encodeBuildArgsPrefix(task.Args, task.Pkg, true),
+		submodule,
+	)
+	bv := task.BuildVersion
+	if stableBuild[task.Pkg.Name] {
+		bv = STABLE_VERSION
+	}
+	savePath := path.Join("types", getTypesRoot(task.CdnOrigin), fmt.Sprintf("v%d%s", bv, task.ghPrefix()), dts)
+
+	names := []string{}
+	for _, name := range task.esm.NamedExports {
+		if name != "default" && name != "__esModule" && regexpJSIdent.MatchString(name) {
+			names = append(names, fmt.Sprintf("__stub$ as %s", name))
+		}
+	}
+	buf := bytes.NewBufferString("// generated by esm.sh, the package has no type declarations\n")
+	buf.WriteString("declare const __stub$: any;\n")
+	if len(names) > 0 {
+		fmt.Fprintf(buf, "export { %s };\n", strings.Join(names, ", "))
+	}
+	if task.esm.HasExportDefault || task.esm.FromCJS {
+		buf.WriteString("export default __stub$;\n")
+	}
+	if len(names) == 0 && !task.esm.HasExportDefault && !task.esm.FromCJS {
+		buf.WriteString("export {};\n")
+	}
+	_, err = task.writeFile(savePath, buf)
+	return
+}
+
 // to remove `global { ... }`
 func removeGlobalBlock(input []byte) (output []byte, err error) {
 	start := bytes.Index(input, []byte("global {"))
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestBuildStubDTS(t *testing.T) {
+	localFS, err := storage.OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prev storage.FileSystem) { fs = prev }(fs)
+	fs = localFS
+
+	task := &BuildTask{
+		Args:         BuildArgs{external: newStringSet(), exports: newStringSet(), conditions: newStringSet()},
+		Pkg:          Pkg{Name: "foo", Version: "1.0.0"},
+		CdnOrigin:    "https://esm.sh",
+		BuildVersion: 135,
+		esm: &ESMBuild{
+			NamedExports: []string{"__esModule", "foo", "class", "not-an-ident"},
+			FromCJS:      true,
+		},
+	}
+	dts, err := task.buildStubDTS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dts != "foo@1.0.0/index.d.ts" {
+		t.Fatalf("invalid dts path: %s", dts)
+	}
+	r, err := fs.OpenFile("types/esm.sh/v135/" + dts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"declare const __stub$: any;",
+		"export { __stub$ as foo, __stub$ as class };",
+		"export default __stub$;",
+	} {
+		if !strings.Contains(string(data), s) {
+			t.Fatalf("missing %q in the stub dts:\n%s", s, data)
+		}
+	}
+}
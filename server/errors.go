@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/ije/rex"
+)
+
+// the stable codes of the error responses
+const (
+	errBadRequest         = "BAD_REQUEST"
+	errInvalidPath        = "INVALID_PATH"
+	errInvalidPackageName = "INVALID_PACKAGE_NAME"
+	errInvalidQuery       = "INVALID_QUERY"
+	errUnauthorized       = "UNAUTHORIZED"
+	errForbidden          = "FORBIDDEN"
+	errPolicyDenied       = "POLICY_DENIED"
+	errNotFound           = "NOT_FOUND"
+	errPackageNotFound    = "PACKAGE_NOT_FOUND"
+	errVersionNotFound    = "VERSION_NOT_FOUND"
+	errFileNotFound       = "FILE_NOT_FOUND"
+	errModuleNotFound     = "MODULE_NOT_FOUND"
+	errTypesNotFound      = "TYPES_NOT_FOUND"
+	errMethodNotAllowed   = "METHOD_NOT_ALLOWED"
+	errBuildTimeout       = "BUILD_TIMEOUT"
+	errBuildNotAllowed    = "BUILD_NOT_ALLOWED"
+	errRateLimited        = "RATE_LIMITED"
+	errRegistryError      = "REGISTRY_ERROR"
+	errInstallFailed      = "INSTALL_FAILED"
+	errBuildFailed        = "BUILD_FAILED"
+	errBuildLimitExceeded = "BUILD_LIMIT_EXCEEDED"
+	errInternal           = "INTERNAL_ERROR"
+	errNotSupported       = "NOT_SUPPORTED"
+	errReadOnly           = "READ_ONLY"
+	errShuttingDown       = "SHUTTING_DOWN"
+)
+
+// httpError is the envelope of the error responses: `{"error": {"status", "code", "message", ...}}`.
+type httpError struct {
+	Status   int         `json:"status"`
+	Code     string      `json:"code"`
+	Message  string      `json:"message"`
+	Pkg      string      `json:"pkg,omitempty"`
+	BuildLog []string    `json:"buildLog,omitempty"`
+	Policy   interface{} `json:"policy,omitempty"`
+	// Limit is the exceeded limit of the `buildLimits` config.
+	Limit string `json:"limit,omitempty"`
+}
+
+// throwError returns an error response with the status and the code.
+func throwError(ctx *rex.Context, status int, code string, message string) interface{} {
+	return sendError(ctx, &httpError{Status: status, Code: code, Message: message})
+}
+
+// throwPkgError returns an error response of the package.
+func throwPkgError(ctx *rex.Context, pkg Pkg, status int, code string, message string) interface{} {
+	return sendError(ctx, &httpError{Status: status, Code: code, Message: message, Pkg: pkg.String()})
+}
+
+// throwResolveError returns an error response of the package resolving error, the errors of the
+// bad paths, the missing packages and versions, and the registry failures are distinguished.
+func throwResolveError(ctx *rex.Context, err error) interface{} {
+	message := err.Error()
+	status, code := 500, errInternal
+	switch {
+	case message == "invalid path":
+		status, code = 400, errInvalidPath
+	case strings.HasPrefix(message, "invalid package name"):
+		status, code = 400, errInvalidPackageName
+	case strings.Contains(message, "version '") && strings.HasSuffix(message, "not found"):
+		status, code = 404, errVersionNotFound
+	case strings.HasSuffix(message, "not found"):
+		status, code = 404, errPackageNotFound
+	case strings.HasPrefix(message, "npm:"):
+		code = errRegistryError
+	}
+	return throwError(ctx, status, code, message)
+}
+
+// throwBuildError returns an error response of the failed build with the build log. The module
+// requests (the `Accept` header doesn't ask for JSON or HTML) get a module that throws the error.
+func throwBuildError(ctx *rex.Context, pkg Pkg, code string, err error) interface{} {
+	if errors.Is(err, errServerShuttingDown) {
+		header := ctx.W.Header()
+		header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+		header.Set("Retry-After", "10")
+		return throwPkgError(ctx, pkg, http.StatusServiceUnavailable, errShuttingDown, "Service Unavailable: the server is shutting down")
+	}
+	setBuildFailureHeaders(ctx.W.Header(), err)
+	limit := getBuildLimit(err)
+	if limit != "" {
+		code = errBuildLimitExceeded
+	}
+	accept := ctx.R.Header.Get("Accept")
+	if code == errBuildFailed && !strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html") {
+		return throwErrorJS(ctx, err)
+	}
+	return sendError(ctx, &httpError{Status: 500, Code: code, Message: err.Error(), Pkg: pkg.String(), BuildLog: getBuildLog(err), Limit: limit})
+}
+
+// sendError writes the error as a HTML page for the browsers (the `Accept` header contains
+// `text/html`), otherwise as JSON.
+func sendError(ctx *rex.Context, e *httpError) interface{} {
+	e.Message = redact(e.Message)
+	e.BuildLog = redactLines(e.BuildLog)
+	header := ctx.W.Header()
+	header.Set("X-Esm-Error-Code", e.Code)
+	if e.Status >= 500 && header.Get("Cache-Control") == "" {
+		header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	}
+	header.Add("Vary", "Accept")
+	if strings.Contains(ctx.R.Header.Get("Accept"), "text/html") {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		return rex.Status(e.Status, renderErrorPage(e))
+	}
+	return rex.Status(e.Status, map[string]interface{}{"error": e})
+}
+
+func renderErrorPage(e *httpError) string {
+	buf := bytes.NewBuffer(nil)
+	title := fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	fmt.Fprintf(buf, "<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n<title>%s - esm.sh</title>\n</head>\n<body>\n", html.EscapeString(title))
+	fmt.Fprintf(buf, "<h1>%s</h1>\n", html.EscapeString(title))
+	fmt.Fprintf(buf, "<p><code>%s</code> %s</p>\n", e.Code, html.EscapeString(e.Message))
+	if e.Pkg != "" {
+		fmt.Fprintf(buf, "<p>Package: <code>%s</code></p>\n", html.EscapeString(e.Pkg))
+	}
+	if len(e.BuildLog) > 0 {
+		fmt.Fprintf(buf, "<pre>%s</pre>\n", html.EscapeString(strings.Join(e.BuildLog, "\n")))
+	}
+	buf.WriteString("</body>\n</html>\n")
+	return buf.String()
+}
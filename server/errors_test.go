@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ije/rex"
+)
+
+func TestThrowError(t *testing.T) {
+	pkg := Pkg{Name: "foo", Version: "1.0.0"}
+	router := &rex.Router{}
+	router.Use(func(ctx *rex.Context) interface{} {
+		switch ctx.Path.String() {
+		case "/range":
+			return throwResolveError(ctx, errors.New("npm: version '^9.0.0' of foo not found"))
+		case "/missing":
+			return throwResolveError(ctx, errors.New("npm: package 'foo' not found"))
+		case "/registry":
+			return throwResolveError(ctx, errors.New("npm: registry https://registry.npmjs.org/ responded 502 Bad Gateway"))
+		case "/build":
+			return throwBuildError(ctx, pkg, errBuildFailed, &BuildError{Message: "esbuild: syntax error", Log: []string{"index.js:1:0: ERROR: <unexpected>"}})
+		}
+		return throwError(ctx, 400, errInvalidPath, "invalid path")
+	})
+	request := func(path string, accept string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "https://esm.sh"+path, nil)
+		req.Header.Set("Accept", accept)
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for path, expected := range map[string]struct {
+		status int
+		code   string
+	}{
+		"/range":    {404, errVersionNotFound},
+		"/missing":  {404, errPackageNotFound},
+		"/registry": {500, errRegistryError},
+		"/invalid":  {400, errInvalidPath},
+	} {
+		rec := request(path, "application/json")
+		var ret struct {
+			Error httpError `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &ret); err != nil {
+			t.Fatalf("%s: invalid json: %v", path, err)
+		}
+		if rec.Code != expected.status || ret.Error.Status != expected.status || ret.Error.Code != expected.code || rec.Header().Get("X-Esm-Error-Code") != expected.code {
+			t.Fatalf("%s: unexpected response: %d %s", path, rec.Code, rec.Body.String())
+		}
+	}
+
+	// the browsers get a html page
+	rec := request("/build", "text/html,application/xhtml+xml,*/*;q=0.8")
+	if rec.Code != 500 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") || !strings.Contains(rec.Body.String(), "&lt;unexpected&gt;") {
+		t.Fatalf("unexpected response: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// the programmatic clients get the build log
+	rec = request("/build", "application/json")
+	var ret struct {
+		Error httpError `json:"error"`
+	}
+	if json.Unmarshal(rec.Body.Bytes(), &ret) != nil || ret.Error.Pkg != "foo@1.0.0" || len(ret.Error.BuildLog) != 1 {
+		t.Fatalf("unexpected response: %s", rec.Body.String())
+	}
+
+	// the module imports get a module that throws the error
+	rec = request("/build", "*/*")
+	if rec.Code != 500 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/javascript") || !strings.Contains(rec.Body.String(), "throw new Error") {
+		t.Fatalf("unexpected response: %d %s", rec.Code, rec.Body.String())
+	}
+}
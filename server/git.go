@@ -37,7 +37,7 @@ func listRepoRefs(repo string) (refs []GitRef, err error) {
 			return
 		}
 		if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
-			log.Error("cache:", err)
+			log.Component("npm").Error("cache:", err)
 		}
 	}
 
@@ -73,14 +73,20 @@ func listRepoRefs(repo string) (refs []GitRef, err error) {
 
 func ghInstall(wd, name, hash string) (err error) {
 	url := fmt.Sprintf(`https://codeload.github.com/%s/tar.gz/%s`, name, hash)
-	res, err := fetch(url)
+	tarballPath := path.Join(wd, ".tarballs", strings.ReplaceAll(name+"@"+hash, "/", "-")+".tgz")
+	err = downloadTarball(httpClient, url, tarballPath, nil)
 	if err != nil {
 		return
 	}
-	defer res.Body.Close()
+	defer os.Remove(tarballPath)
+	tarball, err := os.Open(tarballPath)
+	if err != nil {
+		return
+	}
+	defer tarball.Close()
 
 	// unzip tarball
-	unziped, err := gzip.NewReader(res.Body)
+	unziped, err := gzip.NewReader(tarball)
 	if err != nil {
 		return
 	}
@@ -88,6 +94,7 @@ func ghInstall(wd, name, hash string) (err error) {
 	// extract tarball
 	tr := tar.NewReader(unziped)
 	rootDir := path.Join(wd, "node_modules", name)
+	counter := &extractCounter{}
 	for {
 		h, err := tr.Next()
 		if err == io.EOF {
@@ -96,6 +103,9 @@ func ghInstall(wd, name, hash string) (err error) {
 		if err != nil {
 			return err
 		}
+		if err := counter.add(name+"@"+hash, h); err != nil {
+			return err
+		}
 		// strip tarball root dir
 		hname := strings.Join(strings.Split(h.Name, "/")[1:], "/")
 		if strings.HasPrefix(hname, ".") {
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+// matchPathPattern checks whether the path matches the pattern of the header rule.
+func matchPathPattern(pattern string, pathname string) bool {
+	if !strings.Contains(pattern, "*") {
+		return strings.HasPrefix(pathname, pattern)
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(pathname, parts[0]) {
+		return false
+	}
+	pathname = pathname[len(parts[0]):]
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		i := strings.Index(pathname, part)
+		if i < 0 {
+			return false
+		}
+		pathname = pathname[i+len(part):]
+	}
+	return strings.HasSuffix(pathname, parts[last])
+}
+
+// headersHandler returns a handler that applies the header rules of the config to the responses,
+// after the built-in headers are set.
+func headersHandler(h http.Handler, rules []config.HeaderRule) http.Handler {
+	if len(rules) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathname := strings.TrimPrefix(r.URL.Path, cfg.CdnBasePath)
+		if !strings.HasPrefix(pathname, "/") {
+			pathname = "/" + pathname
+		}
+		var matched []config.HeaderRule
+		for _, rule := range rules {
+			if matchPathPattern(rule.Path, pathname) {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		hw := &headersWriter{ResponseWriter: w, rules: matched}
+		h.ServeHTTP(hw, r)
+		if !hw.wroteHeader {
+			// the empty response
+			hw.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// headersWriter applies the header rules before the headers are written.
+type headersWriter struct {
+	http.ResponseWriter
+	rules       []config.HeaderRule
+	wroteHeader bool
+}
+
+func (w *headersWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		for _, rule := range w.rules {
+			for key, value := range rule.Headers {
+				if value == "" {
+					header.Del(key)
+				} else {
+					header.Set(key, value)
+				}
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headersWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *headersWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+func TestMatchPathPattern(t *testing.T) {
+	for pattern, paths := range map[string][2][]string{
+		"/v135/":   {{"/v135/react@18.2.0/es2022/react.mjs"}, {"/react@18.2.0"}},
+		"*.wasm":   {{"/foo@1.0.0/foo.wasm"}, {"/foo@1.0.0/foo.wasm.map"}},
+		"/*/*.css": {{"/foo@1.0.0/dist/foo.css"}, {"/foo.css.js"}},
+	} {
+		for _, p := range paths[0] {
+			if !matchPathPattern(pattern, p) {
+				t.Fatalf("%s should match %s", pattern, p)
+			}
+		}
+		for _, p := range paths[1] {
+			if matchPathPattern(pattern, p) {
+				t.Fatalf("%s should not match %s", pattern, p)
+			}
+		}
+	}
+}
+
+func TestHeadersHandler(t *testing.T) {
+	defer func(prev *config.Config) {
+		cfg = prev
+	}(cfg)
+	cfg = &config.Config{}
+
+	router := &rex.Router{}
+	router.Use(func(ctx *rex.Context) interface{} {
+		ctx.W.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		ctx.W.Header().Set("X-Esm-Path", "/foo")
+		return "ok"
+	})
+	handler := headersHandler(router, []config.HeaderRule{
+		{Path: "/", Headers: map[string]string{"Cross-Origin-Resource-Policy": "cross-origin", "X-Esm-Path": ""}},
+		{Path: "*.wasm", Headers: map[string]string{"Cache-Control": "public, max-age=86400"}},
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "https://esm.sh/foo@1.0.0/foo.wasm", nil))
+	h := rec.Header()
+	if h.Get("Cross-Origin-Resource-Policy") != "cross-origin" || h.Get("Cache-Control") != "public, max-age=86400" || h.Get("X-Esm-Path") != "" {
+		t.Fatalf("unexpected headers: %v", h)
+	}
+	if rec.Body.String() != "ok" {
+		t.Fatalf("unexpected body: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "https://esm.sh/react", nil))
+	if rec.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Fatalf("unexpected headers: %v", rec.Header())
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+const (
+	// the timeout of a dependency check of the readiness probe
+	dependencyCheckTimeout = 3 * time.Second
+	// the results of the storage and the registry checks are reused in the period, the probes
+	// of many replicas should not flood the registry
+	dependencyCheckTTL = 5 * time.Second
+)
+
+// dependencyStatus is the status of a dependency in the `/-/readyz` response.
+type dependencyStatus struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Latency int64  `json:"latency"`
+}
+
+func (s dependencyStatus) ok() bool {
+	return s.Status == "ok"
+}
+
+var dependencyChecks struct {
+	lock      sync.Mutex
+	checkedAt time.Time
+	storage   dependencyStatus
+	registry  dependencyStatus
+}
+
+// healthProbes returns a handler that serves the `/-/healthz` and the `/-/readyz` probes of the
+// load balancers and Kubernetes, the probes bypass the auth, the rate limit and the access log.
+func healthProbes(h http.Handler) http.Handler {
+	startTime := time.Now()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, cfg.CdnBasePath) {
+		case apiPathPrefix + "healthz":
+			// the process is alive as long as it responds
+			writeProbeResponse(w, 200, map[string]interface{}{
+				"status":  "ok",
+				"version": VERSION,
+				"uptime":  time.Since(startTime).String(),
+			})
+		case apiPathPrefix + "readyz":
+			checks := checkDependencies()
+			status := 200
+			ready := "ok"
+			for _, check := range checks {
+				if !check.ok() {
+					status = 503
+					ready = "unavailable"
+				}
+			}
+			writeProbeResponse(w, status, map[string]interface{}{
+				"status": ready,
+				"checks": checks,
+			})
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+func writeProbeResponse(w http.ResponseWriter, status int, data map[string]interface{}) {
+	header := w.Header()
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// checkDependencies checks the storage, the npm registry and the build workers, the results of the
+// storage and the registry checks are cached for the `dependencyCheckTTL`.
+func checkDependencies() map[string]dependencyStatus {
+	dependencyChecks.lock.Lock()
+	if time.Since(dependencyChecks.checkedAt) > dependencyCheckTTL {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			dependencyChecks.storage = checkDependency(checkStorage)
+		}()
+		go func() {
+			defer wg.Done()
+			dependencyChecks.registry = checkDependency(checkNpmRegistries)
+		}()
+		wg.Wait()
+		dependencyChecks.checkedAt = time.Now()
+	}
+	checks := map[string]dependencyStatus{
+		"storage":  dependencyChecks.storage,
+		"registry": dependencyChecks.registry,
+	}
+	dependencyChecks.lock.Unlock()
+
+	// the build workers are checked every time since the check is cheap
+	checks["builds"] = checkDependency(func(ctx context.Context) error {
+		return checkBuildWorkers()
+	})
+	return checks
+}
+
+func checkDependency(check func(ctx context.Context) error) dependencyStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), dependencyCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := check(ctx)
+	s := dependencyStatus{Status: "ok", Latency: time.Since(start).Milliseconds()}
+	if err != nil {
+		s.Status = "down"
+		s.Error = redact(err.Error())
+	}
+	return s
+}
+
+// checkStorage checks whether the storage is reachable, a missing file is fine.
+func checkStorage(ctx context.Context) error {
+	if fs == nil {
+		return errors.New("the storage is not initialized")
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := fs.Stat(".readyz")
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("the storage does not respond in %v", dependencyCheckTimeout)
+	}
+}
+
+// checkNpmRegistries checks whether the default registry or one of the mirrors is reachable.
+func checkNpmRegistries(ctx context.Context) error {
+	registries := append([]config.NpmRegistry{getDefaultNpmRegistry()}, cfg.NpmRegistryMirrors...)
+	errs := make([]string, 0, len(registries))
+	for _, registry := range registries {
+		err := pingNpmRegistry(ctx, registry)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+func pingNpmRegistry(ctx context.Context, registry config.NpmRegistry) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", registry.Registry, nil)
+	if err != nil {
+		return err
+	}
+	setNpmRegistryAuth(req.Header, registry)
+	client, err := getNpmRegistryClient(registry)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("registry %s: %v", registry.Registry, err)
+	}
+	res.Body.Close()
+	if res.StatusCode >= 500 || res.StatusCode == 429 {
+		return fmt.Errorf("registry %s responded %s", registry.Registry, res.Status)
+	}
+	return nil
+}
+
+// checkBuildWorkers checks whether the build queue accepts new builds and no build worker is stuck
+// longer than the build timeout.
+func checkBuildWorkers() error {
+	if isShuttingDown() {
+		return errServerShuttingDown
+	}
+	if buildQueue == nil {
+		return errors.New("the build queue is not initialized")
+	}
+	buildQueue.lock.RLock()
+	defer buildQueue.lock.RUnlock()
+	if buildQueue.closed {
+		return errors.New("the build queue is closed")
+	}
+	// a build is canceled after the build timeout, the worker is stuck if it runs much longer
+	stuckAfter := time.Duration(cfg.BuildLimits.Timeout)*time.Second + time.Minute
+	for _, t := range buildQueue.processes {
+		if elapsed := time.Since(t.startedAt); !t.startedAt.IsZero() && elapsed > stuckAfter {
+			return fmt.Errorf("the build %s is stuck for %v", t.ID(), elapsed.Round(time.Second))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestHealthProbes(t *testing.T) {
+	defer func(prevCfg *config.Config, prevFS storage.FileSystem, prevQueue *BuildQueue) {
+		cfg = prevCfg
+		fs = prevFS
+		buildQueue = prevQueue
+		shuttingDown = 0
+		dependencyChecks.checkedAt = time.Time{}
+	}(cfg, fs, buildQueue)
+
+	registryDown := false
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if registryDown {
+			w.WriteHeader(503)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer registry.Close()
+
+	localFS, err := storage.OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs = localFS
+	cfg = &config.Config{NpmRegistry: registry.URL + "/", BuildLimits: config.BuildLimits{Timeout: 600}}
+	buildQueue = newBuildQueue(1)
+
+	handler := healthProbes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}))
+	probe := func(path string) (int, map[string]interface{}) {
+		dependencyChecks.checkedAt = time.Time{}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var ret map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &ret)
+		return rec.Code, ret
+	}
+	checkStatus := func(ret map[string]interface{}, name string) string {
+		return ret["checks"].(map[string]interface{})[name].(map[string]interface{})["status"].(string)
+	}
+
+	// the probes are under the reserved prefix, `/healthz` is a package name
+	if code, _ := probe("/healthz"); code != 404 {
+		t.Fatalf("expected 404, got %d", code)
+	}
+	if code, ret := probe("/-/healthz"); code != 200 || ret["status"] != "ok" {
+		t.Fatalf("unexpected healthz response: %d %v", code, ret)
+	}
+	if code, _ := probe("/react@18"); code != 404 {
+		t.Fatal("the other requests should be passed to the handler")
+	}
+	if code, ret := probe("/-/readyz"); code != 200 || ret["status"] != "ok" {
+		t.Fatalf("unexpected readyz response: %d %v", code, ret)
+	}
+
+	// the registry outage
+	registryDown = true
+	code, ret := probe("/-/readyz")
+	if code != 503 || checkStatus(ret, "registry") != "down" || checkStatus(ret, "storage") != "ok" {
+		t.Fatalf("unexpected readyz response: %d %v", code, ret)
+	}
+	// one of the mirrors is reachable
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer mirror.Close()
+	cfg.NpmRegistryMirrors = []config.NpmRegistry{{Registry: mirror.URL + "/"}}
+	if code, ret := probe("/-/readyz"); code != 200 {
+		t.Fatalf("unexpected readyz response: %d %v", code, ret)
+	}
+
+	// the stuck build worker
+	stuck := &queueTask{BuildTask: &BuildTask{id: "v135/react@18.3.1/es2022/react.mjs"}, inProcess: true, startedAt: time.Now().Add(-time.Hour)}
+	buildQueue.processes = append(buildQueue.processes, stuck)
+	if code, ret := probe("/-/readyz"); code != 503 || checkStatus(ret, "builds") != "down" {
+		t.Fatalf("unexpected readyz response: %d %v", code, ret)
+	}
+	buildQueue.processes = nil
+
+	// the server is draining
+	shuttingDown = 1
+	if code, _ := probe("/-/readyz"); code != 503 {
+		t.Fatal("the server should not be ready when it's shutting down")
+	}
+	if code, _ := probe("/-/healthz"); code != 200 {
+		t.Fatal("the server should be alive when it's shutting down")
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+var (
+	httpRequests        = newCounterVec("esm_http_requests_total", "The number of the HTTP requests by the route and the status.", "route", "status")
+	httpRequestDuration = newHistogramVec("esm_http_request_duration_seconds", "The duration of the HTTP requests by the route.", defaultBuckets, "route")
+	cacheRequests       = newCounterVec("esm_cache_requests_total", "The number of the cache lookups by the tier and the result (hit or miss).", "tier", "result")
+	buildDuration       = newHistogramVec("esm_build_duration_seconds", "The duration of the builds by the outcome (success or failure).", defaultBuckets, "outcome")
+	npmRegistryDuration = newHistogramVec("esm_npm_registry_request_duration_seconds", "The duration of the npm registry requests by the registry host and the status.", defaultBuckets, "registry", "status")
+	targetRequests      = newCounterVec("esm_target_requests_total", "The number of the module requests by the build target and the source it's resolved from.", "target", "source")
+)
+
+// the hot cache in front of the storage, it's nil if the `hotCacheSize` config is not set
+var hotCache *storage.HotCacheFS
+
+func init() {
+	newGaugeFunc("esm_build_queue_depth", "The number of the build tasks in the queue, including the tasks in process.", func() float64 {
+		if buildQueue == nil {
+			return 0
+		}
+		return float64(buildQueue.Len())
+	})
+	newGaugeFunc("esm_build_queue_processing", "The number of the build tasks in process.", func() float64 {
+		if buildQueue == nil {
+			return 0
+		}
+		return float64(buildQueue.Processing())
+	})
+	newGaugeFunc("esm_http_requests_in_flight", "The number of the HTTP requests in process.", func() float64 {
+		return float64(atomic.LoadInt64(&activeRequests))
+	})
+	onCollectMetrics(func() {
+		if hotCache != nil {
+			_, hits, misses := hotCache.Stats()
+			cacheRequests.set(uint64(hits), "hot", "hit")
+			cacheRequests.set(uint64(misses), "hot", "miss")
+		}
+		cacheRequests.set(atomic.LoadUint64(&uaTargetCache.hits), "ua", "hit")
+		cacheRequests.set(atomic.LoadUint64(&uaTargetCache.misses), "ua", "miss")
+		cacheRequests.set(atomic.LoadUint64(&clientHintsTargetCache.hits), "client-hints", "hit")
+		cacheRequests.set(atomic.LoadUint64(&clientHintsTargetCache.misses), "client-hints", "miss")
+	})
+}
+
+// recordCacheLookup counts a lookup of the cache tier.
+func recordCacheLookup(tier string, hit bool) {
+	if hit {
+		cacheRequests.Inc(tier, "hit")
+	} else {
+		cacheRequests.Inc(tier, "miss")
+	}
+}
+
+// recordRegistryRequest observes the duration of a npm registry request.
+func recordRegistryRequest(registry string, start time.Time, resp *http.Response, err error) {
+	host := registry
+	if u, e := url.Parse(registry); e == nil && u.Host != "" {
+		host = u.Host
+	}
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	npmRegistryDuration.Observe(time.Since(start).Seconds(), host, status)
+}
+
+// the routes of the `esm_http_requests_total` metric that are named by the path
+var metricsRoutes = map[string]bool{
+	"/":                            true,
+	"/-/admin":                     true,
+	"/-/admin.json":                true,
+	"/-/api-keys":                  true,
+	"/-/lock":                      true,
+	"/-/metrics":                   true,
+	"/-/prebuild":                  true,
+	"/-/purge":                     true,
+	"/-/snapshot":                  true,
+	"/-/token":                     true,
+	"/build":                       true,
+	"/compat.json":                 true,
+	"/error.js":                    true,
+	"/esma-target":                 true,
+	"/favicon.ico":                 true,
+	"/server":                      true,
+	"/status.json":                 true,
+	"/.well-known/esm-signing-key": true,
+}
+
+// getMetricsRoute returns the route of the request path, the package paths are grouped by the
+// kind to bound the cardinality of the metric.
+func getMetricsRoute(pathname string) string {
+	if metricsRoutes[pathname] {
+		return pathname
+	}
+	switch {
+	case strings.HasPrefix(pathname, "/embed/"):
+		return "embed"
+	case strings.HasPrefix(pathname, apiPathPrefix+"status/"):
+		return "status"
+	case strings.HasSuffix(pathname, ".d.ts") || strings.HasSuffix(pathname, ".d.mts"):
+		return "types"
+	case strings.HasSuffix(pathname, ".map"):
+		return "sourcemap"
+	case strings.HasSuffix(pathname, ".css"):
+		return "css"
+	case regexpBuildVersionPath.MatchString(pathname) || strings.HasPrefix(pathname, "/stable/"):
+		return "build"
+	}
+	return "module"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrumentRequests counts the requests by the route and the status, and observes the durations.
+func instrumentRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		pathname := strings.TrimPrefix(r.URL.Path, cfg.CdnBasePath)
+		if !strings.HasPrefix(pathname, "/") {
+			pathname = "/" + pathname
+		}
+		route := getMetricsRoute(pathname)
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				status = 200
+			}
+			httpRequests.Inc(route, strconv.Itoa(status))
+			httpRequestDuration.Observe(time.Since(start).Seconds(), route)
+		}()
+		h.ServeHTTP(rec, r)
+	})
+}
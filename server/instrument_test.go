@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestGetMetricsRoute(t *testing.T) {
+	for pathname, expected := range map[string]string{
+		"/":                                              "/",
+		"/status.json":                                   "/status.json",
+		"/react@18.3.1":                                  "module",
+		"/v135/react@18.3.1/es2022/react.mjs":            "build",
+		"/stable/react@18.3.1/es2022/react.mjs":          "build",
+		"/v135/@types/react@18.3.1/index.d.ts":           "types",
+		"/v135/react@18.3.1/es2022/react.mjs.map":        "sourcemap",
+		"/v135/normalize.css@8.0.1/es2022/normalize.css": "css",
+		"/embed/test.js":                                 "embed",
+		"/-/status/react-dom@18.3.1/client":              "status",
+	} {
+		if route := getMetricsRoute(pathname); route != expected {
+			t.Fatalf("%s: expected %q, got %q", pathname, expected, route)
+		}
+	}
+}
+
+func TestInstrumentRequests(t *testing.T) {
+	defer func(prev *config.Config) {
+		cfg = prev
+	}(cfg)
+	cfg = &config.Config{CdnBasePath: "/cdn"}
+
+	handler := instrumentRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".d.ts") {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	before := httpRequests.Get("module", "200")
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/cdn/react@18.3.1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/cdn/v135/@types/react@18.3.1/index.d.ts", nil))
+	if httpRequests.Get("module", "200") != before+1 || httpRequests.Get("types", "404") == 0 {
+		t.Fatal("the requests should be counted by the route and the status")
+	}
+	if httpRequestDuration.Count("module") == 0 {
+		t.Fatal("the request duration should be observed")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writeMetrics(buf)
+	for _, s := range []string{
+		"# TYPE esm_http_request_duration_seconds histogram\n",
+		`esm_http_request_duration_seconds_bucket{route="module",le="+Inf"} `,
+		`esm_http_request_duration_seconds_count{route="module"} `,
+		`esm_http_requests_total{route="types",status="404"} 1`,
+		"# TYPE esm_build_queue_depth gauge\n",
+		`esm_cache_requests_total{tier="ua",result="hit"} `,
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("missing %q in metrics:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := &histogramVec{name: "test_seconds", help: "test", labels: []string{"outcome"}, buckets: []float64{0.1, 1}, values: map[string]*histogram{}}
+	h.Observe(0.05, "success")
+	h.Observe(0.5, "success")
+	h.Observe(5, "success")
+	buf := bytes.NewBuffer(nil)
+	h.write(buf)
+	expected := strings.Join([]string{
+		"# HELP test_seconds test",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{outcome="success",le="0.1"} 1`,
+		`test_seconds_bucket{outcome="success",le="1"} 2`,
+		`test_seconds_bucket{outcome="success",le="+Inf"} 3`,
+		`test_seconds_sum{outcome="success"} 5.55`,
+		`test_seconds_count{outcome="success"} 3`,
+	}, "\n") + "\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// the max number of the modules of the integrity manifest
+const maxIntegrityManifestModules = 1000
+
+// getIntegrity returns the SRI hash (sha384) of the data.
+func getIntegrity(data []byte) string {
+	sum := sha512.Sum384(data)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// getFileIntegrity returns the SRI hash (sha384) of the file in the storage, the hashes are cached
+// by the path and the modtime of the file.
+func getFileIntegrity(savePath string, modTime time.Time) (string, error) {
+	cacheKey := fmt.Sprintf("integrity:%s@%d", savePath, modTime.UnixNano())
+	if data, err := cache.Get(cacheKey); err == nil && len(data) > 0 {
+		return string(data), nil
+	}
+	r, err := fs.OpenFile(savePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha512.New384()
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	integrity := "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+	cache.Set(cacheKey, []byte(integrity), 24*time.Hour)
+	return integrity, nil
+}
+
+// getIntegrityManifest returns the SRI hashes of the build and the builds it imports recursively,
+// keyed by the module url. The result can be used as the `integrity` field of an import map.
+func getIntegrityManifest(cdnOrigin string, buildId string) (map[string]string, error) {
+	manifest := map[string]string{}
+	visited := map[string]bool{buildId: true}
+	queue := []string{buildId}
+	for len(queue) > 0 && len(manifest) < maxIntegrityManifestModules {
+		id := queue[0]
+		queue = queue[1:]
+		savePath := getBuildSavepath(id)
+		fi, err := fs.Stat(savePath)
+		if err != nil {
+			// e.g. the node polyfills that are not stored as the builds
+			continue
+		}
+		integrity, err := getFileIntegrity(savePath, fi.ModTime())
+		if err != nil {
+			return nil, err
+		}
+		manifest[fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, id)] = integrity
+		if esm, ok := queryESMBuild(id); ok {
+			for _, dep := range esm.Deps {
+				if !strings.HasPrefix(dep, "/") {
+					continue
+				}
+				dep, _, _ = strings.Cut(strings.TrimPrefix(dep, "/"), "?")
+				if !visited[dep] {
+					visited[dep] = true
+					queue = append(queue, dep)
+				}
+			}
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"path"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestIntegrityManifest(t *testing.T) {
+	dir := t.TempDir()
+	localFS, err := storage.OpenFS("local:" + path.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltDB, err := storage.OpenDB("bolt:" + path.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltDB.Close()
+	memoryCache, err := storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prevFS storage.FileSystem, prevDB storage.DataBase, prevCache storage.Cache, prevCfg *config.Config) {
+		fs, db, cache, cfg = prevFS, prevDB, prevCache, prevCfg
+	}(fs, db, cache, cfg)
+	fs, db, cache, cfg = localFS, boltDB, memoryCache, &config.Config{WorkDir: dir}
+
+	builds := map[string][]string{
+		"v135/react@18.2.0/es2022/react.mjs":         nil,
+		"v135/react-dom@18.2.0/es2022/react-dom.mjs": {"/v135/react@18.2.0/es2022/react.mjs", "/v135/node_process.js"},
+		"v135/react-dom@18.2.0/es2022/client.js":     {"/v135/react-dom@18.2.0/es2022/react-dom.mjs", "/v135/react@18.2.0/es2022/react.mjs"},
+	}
+	for id, deps := range builds {
+		fs.WriteFile(path.Join("builds", id), bytes.NewBufferString("export default \""+id+"\""))
+		db.Put(id, utils.MustEncodeJSON(ESMBuild{Deps: deps}))
+	}
+
+	manifest, err := getIntegrityManifest("https://esm.sh", "v135/react-dom@18.2.0/es2022/client.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 3 {
+		t.Fatalf("unexpected manifest: %v", manifest)
+	}
+	for id := range builds {
+		if manifest["https://esm.sh/"+id] != getIntegrity([]byte("export default \""+id+"\"")) {
+			t.Fatalf("unexpected integrity of %s: %s", id, manifest["https://esm.sh/"+id])
+		}
+	}
+	// sha384 of the empty string
+	if getIntegrity(nil) != "sha384-OLBgp1GsljhM2TJ+sbHjaiH9txEUvgdDTAzHv2P24donTt6/529l+9Ua0vFImLlb" {
+		t.Fatalf("unexpected integrity: %s", getIntegrity(nil))
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// the lifecycle scripts that npm runs on install, they are never run by the server since the
+// packages are installed with the `--ignore-scripts` flag.
+var installScripts = []string{"preinstall", "install", "postinstall"}
+
+// the tools that build or download the native addons in the install scripts
+var nativeBuildTools = []string{"node-gyp", "node-pre-gyp", "prebuild-install", "cmake-js", "node-gyp-build"}
+
+// getInstallScripts returns the install lifecycle scripts of the `scripts` field.
+func getInstallScripts(scripts map[string]string) map[string]string {
+	var ret map[string]string
+	for _, name := range installScripts {
+		if script, ok := scripts[name]; ok && script != "" {
+			if ret == nil {
+				ret = map[string]string{}
+			}
+			ret[name] = script
+		}
+	}
+	return ret
+}
+
+// dependsOnInstallScripts checks whether the functionality of the package depends on the install
+// scripts, i.e. the package has a native addon that is built (or downloaded) on install.
+func dependsOnInstallScripts(p *NpmPackage) bool {
+	if p.Gypfile {
+		return true
+	}
+	for _, script := range p.Scripts {
+		for _, tool := range nativeBuildTools {
+			if strings.Contains(script, tool) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkInstallScriptsPolicy returns a policy violation if the package depends on the install
+// scripts and the `denyInstallScripts` policy is enabled.
+func checkInstallScriptsPolicy(p *NpmPackage) *PolicyViolation {
+	if !cfg.Policy.DenyInstallScripts || !dependsOnInstallScripts(p) {
+		return nil
+	}
+	return &PolicyViolation{
+		Package: p.Name,
+		Version: p.Version,
+		Policy:  "denyInstallScripts",
+		Reason:  "the package depends on the install scripts to build a native addon, which are never run",
+	}
+}
+
+// logSkippedInstallScripts notes the install scripts of the installed package that are skipped in
+// the build log.
+func logSkippedInstallScripts(buildId string, wd string, pkgName string) {
+	var p NpmPackageTemp
+	if utils.ParseJSONFile(path.Join(wd, "node_modules", pkgName, "package.json"), &p) != nil {
+		return
+	}
+	scripts := getInstallScripts(p.Scripts)
+	if len(scripts) == 0 {
+		return
+	}
+	names := make([]string, 0, len(scripts))
+	for name := range scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Component("build").With("buildKey", buildId).Infof("skipped the lifecycle scripts (%s) of %s@%s", strings.Join(names, ", "), p.Name, p.Version)
+}
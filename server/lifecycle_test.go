@@ -0,0 +1,42 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestInstallScriptsPolicy(t *testing.T) {
+	defer func(prev *config.Config) {
+		cfg = prev
+	}(cfg)
+	cfg = &config.Config{Policy: config.PackagePolicy{DenyInstallScripts: true}}
+
+	for data, native := range map[string]bool{
+		`{"name":"left-pad","version":"1.3.0","scripts":{"test":"node test.js"}}`:                                               false,
+		`{"name":"core-js","version":"3.36.0","scripts":{"postinstall":"node -e \"try{require('./postinstall')}catch(e){}\""}}`: false,
+		`{"name":"bcrypt","version":"5.1.1","scripts":{"install":"node-pre-gyp install --fallback-to-build"}}`:                  true,
+		`{"name":"fsevents","version":"1.2.13","gypfile":true}`:                                                                 true,
+	} {
+		var p NpmPackage
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := p.Scripts["test"]; ok {
+			t.Fatal("only the install scripts should be kept")
+		}
+		v := checkInstallScriptsPolicy(&p)
+		if (v != nil) != native {
+			t.Fatalf("%s: unexpected violation: %v", p.Name, v)
+		}
+		if v != nil && v.Policy != "denyInstallScripts" {
+			t.Fatalf("unexpected policy: %s", v.Policy)
+		}
+	}
+
+	cfg.Policy.DenyInstallScripts = false
+	if v := checkInstallScriptsPolicy(&NpmPackage{Name: "fsevents", Gypfile: true}); v != nil {
+		t.Fatal("the policy is disabled")
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newServer returns a http server with the timeouts that stop the slow clients from holding the
+// connections, the write timeout is not set since a request may wait for a long build.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       5 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// tlsHosts returns the host names that the autocert is allowed to issue the certificates for,
+// the `tlsHosts` of the config and the host of the `cdnOrigin`.
+func tlsHosts() []string {
+	hosts := append([]string{}, cfg.TlsHosts...)
+	if cfg.CdnOrigin != "" {
+		if u, err := url.Parse(cfg.CdnOrigin); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
+}
+
+// listen starts the HTTP server on the `listen` address of the config (or the `port` if it's not
+// set), and the HTTPS server with the autocert certificates if the `tlsPort` is set. The returned
+// channel receives the errors of the servers.
+func listen(handler http.Handler, isDev bool) ([]*http.Server, chan error) {
+	c := make(chan error, 2)
+	listeners, err := openListeners(cfg.Listen)
+	if err != nil {
+		c <- err
+		return nil, c
+	}
+	servers := make([]*http.Server, 0, len(listeners)+1)
+	for _, l := range listeners {
+		s := newServer(handler)
+		servers = append(servers, s)
+		go func(l net.Listener) {
+			if err := s.Serve(l); err != nil && err != http.ErrServerClosed {
+				c <- fmt.Errorf("server shutdown: %v", err)
+			}
+		}(l)
+	}
+
+	if cfg.TlsPort > 0 && !isDev {
+		hosts := tlsHosts()
+		if len(hosts) == 0 {
+			c <- errors.New("the `tlsHosts` or `cdnOrigin` config is required by the `tlsPort`")
+			return servers, c
+		}
+		cacheDir := path.Join(cfg.WorkDir, "autotls")
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			c <- fmt.Errorf("can't create the autotls cache dir: %v", err)
+			return servers, c
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(hosts...),
+		}
+		s := newServer(handler)
+		s.Addr = fmt.Sprintf(":%d", cfg.TlsPort)
+		s.TLSConfig = m.TLSConfig()
+		servers = append(servers, s)
+		go func() {
+			if err := s.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				c <- fmt.Errorf("server(https) shutdown: %v", err)
+			}
+		}()
+	}
+	return servers, c
+}
+
+// openListeners opens the listeners of the address:
+//   - `unix:<path>` listens on the unix socket, the stale socket file is removed.
+//   - `systemd` uses the sockets passed by the systemd socket activation.
+//   - `[host]:port` listens on the TCP address, the empty address listens on the `port` of the config.
+func openListeners(addr string) ([]net.Listener, error) {
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", cfg.Port)
+	}
+	if addr == "systemd" {
+		return systemdListeners()
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		sockPath := strings.TrimPrefix(addr, "unix:")
+		if fi, err := os.Lstat(sockPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(sockPath)
+		}
+		l, err := net.Listen("unix", sockPath)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// systemdListeners returns the listeners of the sockets passed by the systemd socket activation,
+// see https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+func systemdListeners() ([]net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || n <= 0 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// the passed file descriptors start from 3 (SD_LISTEN_FDS_START)
+	listeners := make([]net.Listener, n)
+	for i := 0; i < n; i++ {
+		fd := 3 + i
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid systemd socket(fd %d): %v", fd, err)
+		}
+		listeners[i] = l
+	}
+	return listeners, nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	sockPath := path.Join(t.TempDir(), "esm.sock")
+	for i := 0; i < 2; i++ {
+		// the stale socket file of the previous process is removed
+		listeners, err := openListeners("unix:" + sockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			listeners[0].(*net.UnixListener).SetUnlinkOnClose(false)
+			listeners[0].Close()
+			continue
+		}
+		s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})}
+		go s.Serve(listeners[0])
+		defer s.Close()
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+		},
+	}}
+	res, err := client.Get("http://esm.sh/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if data, _ := io.ReadAll(res.Body); string(data) != "ok" {
+		t.Fatalf("unexpected response: %s", data)
+	}
+
+	if _, err := openListeners("systemd"); err == nil {
+		t.Fatal("should fail without the sockets passed by systemd")
+	}
+}
+
+func TestTLSHosts(t *testing.T) {
+	prevCfg := cfg
+	defer func() { cfg = prevCfg }()
+
+	cfg = &config.Config{TlsHosts: []string{"esm.example.com"}, CdnOrigin: "https://cdn.example.com:8443"}
+	hosts := tlsHosts()
+	if len(hosts) != 2 || hosts[0] != "esm.example.com" || hosts[1] != "cdn.example.com" {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+
+	cfg = &config.Config{}
+	if hosts := tlsHosts(); len(hosts) != 0 {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+}
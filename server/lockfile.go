@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/ije/gox/utils"
+)
+
+var (
+	regexpLockToken = regexp.MustCompile(`^[0-9a-f]{16}$`)
+	// matches the package keys of the pnpm lockfile, e.g. `/react@18.2.0:`, `/@babel/core@7.0.0(react@18.2.0):`
+	// and `/react/18.2.0:` (lockfile v5)
+	regexpPnpmLockPackage = regexp.MustCompile(`(?m)^  ['"]?/?((?:@[\w.-]+/)?[\w.-]+)[@/](\d+\.\d+\.\d+[\w.+-]*)[(_:'"]`)
+)
+
+// the parsed lockfiles, mapped by the lock token
+var lockfiles sync.Map
+
+// parseLockfile parses the package-lock.json or pnpm-lock.yaml to the map of the package
+// versions, the highest version is used if a package is locked with multiple versions.
+func parseLockfile(data []byte) (versions map[string]string, err error) {
+	versions = map[string]string{}
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		var lock struct {
+			Packages     map[string]struct{ Version string } `json:"packages"`
+			Dependencies map[string]struct{ Version string } `json:"dependencies"`
+		}
+		err = json.Unmarshal(data, &lock)
+		if err != nil {
+			return nil, fmt.Errorf("invalid package-lock.json: %v", err)
+		}
+		// lockfile v2/v3
+		for key, p := range lock.Packages {
+			i := strings.LastIndex(key, "node_modules/")
+			if i >= 0 && p.Version != "" {
+				addLockedVersion(versions, key[i+13:], p.Version)
+			}
+		}
+		// lockfile v1
+		if len(lock.Packages) == 0 {
+			for name, p := range lock.Dependencies {
+				addLockedVersion(versions, name, p.Version)
+			}
+		}
+	} else {
+		for _, m := range regexpPnpmLockPackage.FindAllSubmatch(data, -1) {
+			addLockedVersion(versions, string(m[1]), string(m[2]))
+		}
+	}
+	if len(versions) == 0 {
+		return nil, errors.New("no packages found in the lockfile")
+	}
+	return
+}
+
+func addLockedVersion(versions map[string]string, name string, version string) {
+	if !validatePackageName(name) || !regexpFullVersion.MatchString(version) {
+		return
+	}
+	if v, ok := versions[name]; ok {
+		a, e1 := semver.NewVersion(v)
+		b, e2 := semver.NewVersion(version)
+		if e1 == nil && e2 == nil && !b.GreaterThan(a) {
+			return
+		}
+	}
+	versions[name] = version
+}
+
+// saveLockfile saves the locked versions to the storage, returns the token of the lockfile.
+func saveLockfile(versions map[string]string) (token string, err error) {
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha1.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s@%s\n", name, versions[name])
+	}
+	token = hex.EncodeToString(h.Sum(nil))[:16]
+	savePath := path.Join("locks", token+".json")
+	if _, err = fs.Stat(savePath); err == nil {
+		return
+	}
+	_, err = fs.WriteFile(savePath, bytes.NewReader(utils.MustEncodeJSON(versions)))
+	if err == nil {
+		lockfiles.Store(token, versions)
+	}
+	return
+}
+
+// getLockfile returns the locked versions of the lock token.
+func getLockfile(token string) (versions map[string]string, err error) {
+	if v, ok := lockfiles.Load(token); ok {
+		return v.(map[string]string), nil
+	}
+	if !regexpLockToken.MatchString(token) {
+		return nil, errors.New("invalid lock token")
+	}
+	r, err := fs.OpenFile(path.Join("locks", token+".json"))
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &versions)
+	if err == nil {
+		lockfiles.Store(token, versions)
+	}
+	return
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestParseLockfile(t *testing.T) {
+	versions, err := parseLockfile([]byte(`{
+  "name": "app",
+  "lockfileVersion": 3,
+  "packages": {
+    "": { "name": "app", "version": "1.0.0" },
+    "node_modules/react": { "version": "18.2.0" },
+    "node_modules/@babel/core": { "version": "7.23.0" },
+    "node_modules/foo/node_modules/react": { "version": "17.0.2" },
+    "node_modules/bar": { "resolved": "file:../bar" }
+  }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions["react"] != "18.2.0" || versions["@babel/core"] != "7.23.0" {
+		t.Fatalf("unexpected versions of package-lock.json: %v", versions)
+	}
+
+	versions, err = parseLockfile([]byte(`{"lockfileVersion": 1, "dependencies": {"react": {"version": "16.14.0"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions["react"] != "16.14.0" {
+		t.Fatalf("unexpected versions of package-lock.json v1: %v", versions)
+	}
+
+	versions, err = parseLockfile([]byte(`lockfileVersion: '6.0'
+
+packages:
+
+  /react@18.2.0:
+    resolution: {integrity: sha512-xxx}
+
+  /@babel/core@7.23.0(supports-color@8.1.1):
+    resolution: {integrity: sha512-xxx}
+
+  /loose-envify/1.4.0:
+    resolution: {integrity: sha512-xxx}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions["react"] != "18.2.0" || versions["@babel/core"] != "7.23.0" || versions["loose-envify"] != "1.4.0" {
+		t.Fatalf("unexpected versions of pnpm-lock.yaml: %v", versions)
+	}
+
+	if _, err = parseLockfile([]byte(`{}`)); err == nil {
+		t.Fatal("should fail for the empty lockfile")
+	}
+}
+
+func TestSaveLockfile(t *testing.T) {
+	localFS, err := storage.OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prev storage.FileSystem) { fs = prev }(fs)
+	fs = localFS
+
+	token, err := saveLockfile(map[string]string{"react": "18.2.0", "react-dom": "18.2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token2, err := saveLockfile(map[string]string{"react-dom": "18.2.0", "react": "18.2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != token2 || !regexpLockToken.MatchString(token) {
+		t.Fatalf("unstable lock token: %s, %s", token, token2)
+	}
+
+	lockfiles.Delete(token)
+	versions, err := getLockfile(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions["react-dom"] != "18.2.0" {
+		t.Fatalf("unexpected versions: %v", versions)
+	}
+	if _, err = getLockfile("../../etc/passwd"); err == nil {
+		t.Fatal("should reject the invalid token")
+	}
+}
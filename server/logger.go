@@ -0,0 +1,546 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/gox/utils"
+)
+
+// the level of the records that are printed without a level, e.g. the access logs
+const levelNone logx.Level = -1
+
+// logField is a field of the structured log records.
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+// logSink writes the formatted log records, a record is a line of text or JSON without the
+// trailing newline.
+type logSink interface {
+	Write(level logx.Level, record []byte) error
+	Close() error
+}
+
+// logOutput is the sinks of the log records with the format and the levels.
+type logOutput struct {
+	// format is "text" or "json"
+	format string
+	level  logx.Level
+	// levels are the levels of the components that override the `level`
+	levels map[string]logx.Level
+	sinks  []logSink
+}
+
+// structLogger writes the structured log records to the sinks, the secrets in the messages and the
+// fields are redacted. The records of the child loggers (`Component` and `With`) include the
+// component and the fields of the parents.
+type structLogger struct {
+	out       *logOutput
+	component string
+	fields    []logField
+}
+
+// newLogger returns a logger that writes the records of the `level` to the sinks in the `format`.
+func newLogger(format string, level string, levels map[string]string, sinks []logSink) *structLogger {
+	out := &logOutput{format: format, level: logx.LevelByName(level), levels: map[string]logx.Level{}, sinks: sinks}
+	if out.level < logx.L_DEBUG {
+		out.level = logx.L_INFO
+	}
+	for component, name := range levels {
+		if l := logx.LevelByName(name); l >= logx.L_DEBUG {
+			out.levels[component] = l
+		}
+	}
+	return &structLogger{out: out}
+}
+
+// Component returns a child logger of the component, the level of the component is set by the
+// `logLevels` config.
+func (l *structLogger) Component(name string) *structLogger {
+	return &structLogger{out: l.out, component: name, fields: l.fields}
+}
+
+// With returns a child logger with the fields of the key-value pairs.
+func (l *structLogger) With(kvs ...interface{}) *structLogger {
+	fields := make([]logField, len(l.fields), len(l.fields)+len(kvs)/2)
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		fields = append(fields, logField{fmt.Sprint(kvs[i]), kvs[i+1]})
+	}
+	return &structLogger{out: l.out, component: l.component, fields: fields}
+}
+
+// Enabled checks whether the records of the level are written.
+func (l *structLogger) Enabled(level logx.Level) bool {
+	if level == levelNone {
+		return true
+	}
+	min := l.out.level
+	if v, ok := l.out.levels[l.component]; ok {
+		min = v
+	}
+	return level >= min
+}
+
+func (l *structLogger) Print(v ...interface{}) {
+	l.print(sprint(v...))
+}
+
+// Printf prints the record without a level, the messages of rex are prefixed with the level
+// (e.g. "[error] ...") that is parsed for the JSON format.
+func (l *structLogger) Printf(format string, v ...interface{}) {
+	l.print(fmt.Sprintf(format, v...))
+}
+
+func (l *structLogger) print(msg string) {
+	if l.out.format == "json" {
+		for _, level := range []logx.Level{logx.L_ERROR, logx.L_WARN, logx.L_INFO} {
+			if s := strings.TrimPrefix(msg, "["+level.String()+"] "); s != msg {
+				l.write(level, s, nil)
+				return
+			}
+		}
+		if s := strings.TrimPrefix(msg, "[panic] "); s != msg {
+			l.write(logx.L_ERROR, s, []logField{{"panic", true}})
+			return
+		}
+	}
+	l.write(levelNone, msg, nil)
+}
+
+func (l *structLogger) Debug(v ...interface{}) {
+	if l.Enabled(logx.L_DEBUG) {
+		l.write(logx.L_DEBUG, sprint(v...), nil)
+	}
+}
+
+func (l *structLogger) Debugf(format string, v ...interface{}) {
+	if l.Enabled(logx.L_DEBUG) {
+		l.write(logx.L_DEBUG, fmt.Sprintf(format, v...), nil)
+	}
+}
+
+func (l *structLogger) Info(v ...interface{}) {
+	l.write(logx.L_INFO, sprint(v...), nil)
+}
+
+func (l *structLogger) Infof(format string, v ...interface{}) {
+	l.write(logx.L_INFO, fmt.Sprintf(format, v...), nil)
+}
+
+func (l *structLogger) Warn(v ...interface{}) {
+	l.write(logx.L_WARN, sprint(v...), nil)
+}
+
+func (l *structLogger) Warnf(format string, v ...interface{}) {
+	l.write(logx.L_WARN, fmt.Sprintf(format, v...), nil)
+}
+
+func (l *structLogger) Error(v ...interface{}) {
+	l.write(logx.L_ERROR, sprint(v...), nil)
+}
+
+func (l *structLogger) Errorf(format string, v ...interface{}) {
+	l.write(logx.L_ERROR, fmt.Sprintf(format, v...), nil)
+}
+
+func (l *structLogger) Fatal(v ...interface{}) {
+	l.write(logx.L_FATAL, sprint(v...), nil)
+	l.Close()
+	os.Exit(1)
+}
+
+func (l *structLogger) Fatalf(format string, v ...interface{}) {
+	l.write(logx.L_FATAL, fmt.Sprintf(format, v...), nil)
+	l.Close()
+	os.Exit(1)
+}
+
+// Close flushes and closes the sinks.
+func (l *structLogger) Close() {
+	for _, sink := range l.out.sinks {
+		sink.Close()
+	}
+}
+
+func (l *structLogger) write(level logx.Level, msg string, extra []logField) {
+	if !l.Enabled(level) || len(l.out.sinks) == 0 {
+		return
+	}
+	fields := l.fields
+	if len(extra) > 0 {
+		fields = append(fields[:len(fields):len(fields)], extra...)
+	}
+	record := formatLogRecord(l.out.format, time.Now(), level, l.component, redact(strings.TrimSuffix(msg, "\n")), fields)
+	for _, sink := range l.out.sinks {
+		if err := sink.Write(level, record); err != nil {
+			fmt.Fprintf(os.Stderr, "log: %v\n", err)
+		}
+	}
+}
+
+// formatLogRecord formats the record in the text format (`2006/01/02 15:04:05 [info] message
+// key=value`) or the JSON format (`{"time":"...","level":"info","msg":"message","key":"value"}`).
+func formatLogRecord(format string, t time.Time, level logx.Level, component string, msg string, fields []logField) []byte {
+	buf := bytes.NewBuffer(nil)
+	if format == "json" {
+		name := level.String()
+		if level == levelNone {
+			name = "info"
+		}
+		buf.WriteString(`{"time":`)
+		writeJSONValue(buf, t.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSONValue(buf, name)
+		if component != "" {
+			buf.WriteString(`,"component":`)
+			writeJSONValue(buf, component)
+		}
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(buf, msg)
+		for _, f := range fields {
+			buf.WriteByte(',')
+			writeJSONValue(buf, f.Key)
+			buf.WriteByte(':')
+			writeJSONValue(buf, redactLogValue(f.Value))
+		}
+		buf.WriteByte('}')
+		return buf.Bytes()
+	}
+	buf.WriteString(t.Format("2006/01/02 15:04:05 "))
+	if level != levelNone {
+		buf.WriteString("[" + level.String() + "] ")
+	}
+	buf.WriteString(msg)
+	if component != "" {
+		buf.WriteString(" component=" + component)
+	}
+	for _, f := range fields {
+		s := fmt.Sprint(redactLogValue(f.Value))
+		if s == "" || strings.ContainsAny(s, " \t\"=") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(" " + f.Key + "=" + s)
+	}
+	return buf.Bytes()
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+func redactLogValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return redact(v)
+	case error:
+		return redact(v.Error())
+	case fmt.Stringer:
+		return redact(v.String())
+	}
+	return v
+}
+
+// accessLogger is the logger of rex for the access records.
+type accessLogger struct {
+	*structLogger
+}
+
+// Printf logs the access record of rex, the arguments are the client IP, the host, the protocol,
+// the method, the request URI, the content length, the referer, the user agent, the status, the
+// written bytes and the duration.
+func (l *accessLogger) Printf(format string, v ...interface{}) {
+	if l.out.format != "json" || len(v) != 11 {
+		l.structLogger.Printf(format, v...)
+		return
+	}
+	duration := v[10]
+	if d, ok := duration.(time.Duration); ok {
+		duration = int64(d)
+	}
+	l.write(levelNone, fmt.Sprintf("%v %v", v[3], v[4]), []logField{
+		{"ip", v[0]},
+		{"host", v[1]},
+		{"proto", v[2]},
+		{"method", v[3]},
+		{"uri", v[4]},
+		{"contentLength", v[5]},
+		{"referer", v[6]},
+		{"userAgent", strings.ReplaceAll(fmt.Sprint(v[7]), `\"`, `"`)},
+		{"status", v[8]},
+		{"written", v[9]},
+		{"durationMs", duration},
+	})
+}
+
+// openLogSink opens the sink of the `logSinks` config: "stdout", "stderr",
+// "file:<path>?maxFileSize=64MB&fileDateFormat=20060102" or "syslog:[<network>://<addr>]".
+func openLogSink(s string, format string) (logSink, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "stdout", "stderr":
+		w := os.Stdout
+		if kind == "stderr" {
+			w = os.Stderr
+		}
+		_, noColor := os.LookupEnv("NO_COLOR")
+		return &consoleLogSink{w: w, color: format == "text" && !noColor}, nil
+	case "file":
+		filename, query, _ := strings.Cut(arg, "?")
+		args, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log sink %q: %v", s, err)
+		}
+		sink := &fileLogSink{path: filename, dateFormat: args.Get("fileDateFormat")}
+		if v := args.Get("maxFileSize"); v != "" {
+			if sink.maxSize, err = utils.ParseBytes(v); err != nil {
+				return nil, fmt.Errorf("invalid log sink %q: invalid maxFileSize", s)
+			}
+		}
+		return sink, os.MkdirAll(path.Dir(filename), 0755)
+	case "syslog":
+		network, addr := "", ""
+		if arg != "" {
+			u, err := url.Parse(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid log sink %q: %v", s, err)
+			}
+			network, addr = u.Scheme, u.Host
+			if network == "unix" || network == "unixgram" {
+				addr = u.Path
+			}
+		}
+		hostname, _ := os.Hostname()
+		return &syslogSink{network: network, addr: addr, hostname: hostname}, nil
+	}
+	return nil, fmt.Errorf("invalid log sink %q", s)
+}
+
+// consoleLogSink writes the records to stdout or stderr, the text records are colored by the
+// level unless the `NO_COLOR` env is set.
+type consoleLogSink struct {
+	lock  sync.Mutex
+	w     *os.File
+	color bool
+}
+
+func (s *consoleLogSink) Write(level logx.Level, record []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.color {
+		color := ""
+		switch level {
+		case logx.L_INFO:
+			color = "\033[32m"
+		case logx.L_WARN:
+			color = "\033[33m"
+		case logx.L_ERROR, logx.L_FATAL:
+			color = "\033[31m"
+		}
+		if color != "" {
+			_, err := fmt.Fprintf(s.w, "%s%s\033[0m\n", color, record)
+			return err
+		}
+	}
+	_, err := s.w.Write(append(record, '\n'))
+	return err
+}
+
+func (s *consoleLogSink) Close() error {
+	return nil
+}
+
+// fileLogSink appends the records to a file, the file is rotated daily by the `dateFormat`
+// (`{name}-{date}.log`) and by the `maxSize` (the previous files are renamed to `{name}_{n}.log`).
+type fileLogSink struct {
+	lock       sync.Mutex
+	path       string
+	dateFormat string
+	maxSize    int64
+	filename   string
+	f          *os.File
+	size       int64
+}
+
+func (s *fileLogSink) Write(level logx.Level, record []byte) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	filename := s.path
+	if s.dateFormat != "" {
+		ext := path.Ext(s.path)
+		filename = strings.TrimSuffix(s.path, ext) + "-" + time.Now().Format(s.dateFormat) + ext
+	}
+	if s.f != nil && (filename != s.filename || (s.maxSize > 0 && s.size+int64(len(record)) > s.maxSize)) {
+		s.f.Close()
+		s.f = nil
+		if filename == s.filename {
+			os.Rename(filename, nextLogFilename(filename))
+		}
+	}
+	if s.f == nil {
+		s.f, err = os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return
+		}
+		s.filename = filename
+		s.size = 0
+		if fi, e := s.f.Stat(); e == nil {
+			s.size = fi.Size()
+		}
+	}
+	n, err := s.f.Write(append(record, '\n'))
+	s.size += int64(n)
+	return
+}
+
+func (s *fileLogSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// nextLogFilename returns the first unused name of the rotated file, e.g. "main_1.log".
+func nextLogFilename(filename string) string {
+	ext := path.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+	for i := 1; ; i++ {
+		p := name + "_" + strconv.Itoa(i) + ext
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p
+		}
+	}
+}
+
+// syslogSink sends the records to the syslog server with the RFC 5424 format, the local syslog
+// (`/dev/log`) is used if the address is not set.
+type syslogSink struct {
+	lock     sync.Mutex
+	network  string
+	addr     string
+	hostname string
+	conn     net.Conn
+}
+
+func (s *syslogSink) Write(level logx.Level, record []byte) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// the facility is "daemon" (3)
+	priority := 3*8 + syslogSeverity(level)
+	msg := fmt.Sprintf("<%d>1 %s %s esm.sh %d - - %s", priority, time.Now().Format(time.RFC3339), s.hostname, os.Getpid(), record)
+	if s.network == "tcp" {
+		// the octet counting framing of RFC 6587
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	for i := 0; i < 2; i++ {
+		if s.conn == nil {
+			if s.conn, err = s.dial(); err != nil {
+				return
+			}
+		}
+		if _, err = s.conn.Write([]byte(msg)); err == nil {
+			return
+		}
+		// reconnect once, e.g. the syslog server is restarted
+		s.conn.Close()
+		s.conn = nil
+	}
+	return
+}
+
+func (s *syslogSink) dial() (net.Conn, error) {
+	if s.network != "" {
+		return net.DialTimeout(s.network, s.addr, 5*time.Second)
+	}
+	for _, p := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, p); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("syslog: the local syslog is not available")
+}
+
+func (s *syslogSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func syslogSeverity(level logx.Level) int {
+	switch level {
+	case logx.L_DEBUG:
+		return 7
+	case logx.L_WARN:
+		return 4
+	case logx.L_ERROR:
+		return 3
+	case logx.L_FATAL:
+		return 2
+	}
+	return 6
+}
+
+// openLoggers opens the main logger and the access logger of the config. The main logs are written
+// to the stdout and the `main-v{VERSION}.log` file, and the access logs are written to the daily
+// rotated `access.log` file, unless the `logSinks` and `accessLogSinks` are set.
+func openLoggers(c *config.Config) (mainLogger *structLogger, access *accessLogger, err error) {
+	sinks := c.LogSinks
+	if len(sinks) == 0 {
+		filename := path.Join(c.LogDir, fmt.Sprintf("main-v%d.log", VERSION))
+		if c.LogPrivacy.Retention > 0 {
+			// rotate the main log daily to remove the expired logs by the retention
+			filename += "?fileDateFormat=20060102"
+		}
+		sinks = []string{"stdout", "file:" + filename}
+	}
+	accessSinks := c.AccessLogSinks
+	if len(accessSinks) == 0 {
+		accessSinks = []string{"file:" + path.Join(c.LogDir, "access.log") + "?fileDateFormat=20060102"}
+	}
+	var mainSinks, accessLogSinks []logSink
+	for _, s := range sinks {
+		sink, err := openLogSink(s, c.LogFormat)
+		if err != nil {
+			return nil, nil, err
+		}
+		mainSinks = append(mainSinks, sink)
+	}
+	for _, s := range accessSinks {
+		sink, err := openLogSink(s, c.LogFormat)
+		if err != nil {
+			return nil, nil, err
+		}
+		accessLogSinks = append(accessLogSinks, sink)
+	}
+	mainLogger = newLogger(c.LogFormat, c.LogLevel, c.LogLevels, mainSinks)
+	access = &accessLogger{newLogger(c.LogFormat, "info", nil, accessLogSinks).Component("access")}
+	return
+}
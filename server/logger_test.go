@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	logx "github.com/ije/gox/log"
+)
+
+// bufferLogSink keeps the records in memory for the tests.
+type bufferLogSink struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (s *bufferLogSink) Write(level logx.Level, record []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.buf.Write(record)
+	s.buf.WriteByte('\n')
+	return nil
+}
+
+func (s *bufferLogSink) Close() error {
+	return nil
+}
+
+func (s *bufferLogSink) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.buf.Reset()
+}
+
+func (s *bufferLogSink) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buf.String()
+}
+
+func (s *bufferLogSink) Records(t *testing.T) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(s.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestStructLogger(t *testing.T) {
+	defer func(prev *structLogger) {
+		log = prev
+	}(log)
+
+	sink := &bufferLogSink{}
+	l := newLogger("json", "info", map[string]string{"npm": "warn", "build": "debug"}, []logSink{sink})
+	log = l
+
+	l.Debugf("debug %d", 1)
+	l.Infof("server is ready")
+	l.Component("npm").Infof("lookup react")
+	l.Component("npm").Warnf("use the stale metadata of %s", "react")
+	task := &BuildTask{id: "v135/react@18.3.1/es2022/react.mjs", Pkg: Pkg{Name: "react", Version: "18.3.1"}, Target: "es2022"}
+	task.logger().Debugf("analyze")
+	l.Printf("[error] %s", "internal error")
+
+	records := sink.Records(t)
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d: %s", len(records), sink.String())
+	}
+	if r := records[0]; r["level"] != "info" || r["msg"] != "server is ready" || r["component"] != nil {
+		t.Fatalf("unexpected record: %v", r)
+	}
+	if r := records[1]; r["level"] != "warn" || r["component"] != "npm" || r["msg"] != "use the stale metadata of react" {
+		t.Fatalf("unexpected record: %v", r)
+	}
+	if r := records[2]; r["level"] != "debug" || r["component"] != "build" || r["pkg"] != "react" || r["version"] != "18.3.1" || r["target"] != "es2022" || r["buildKey"] != task.ID() {
+		t.Fatalf("unexpected record: %v", r)
+	}
+	if r := records[3]; r["level"] != "error" || r["msg"] != "internal error" {
+		t.Fatalf("unexpected record: %v", r)
+	}
+
+	// text format
+	sink.Reset()
+	l = newLogger("text", "info", nil, []logSink{sink})
+	l.With("pkg", "react", "error", "exit status 1").Component("build").Errorf("install failed")
+	if line := strings.TrimSpace(sink.String()); !strings.HasSuffix(line, `[error] install failed component=build pkg=react error="exit status 1"`) {
+		t.Fatalf("unexpected line: %s", line)
+	}
+
+	// access logs
+	sink.Reset()
+	access := &accessLogger{newLogger("json", "info", nil, []logSink{sink}).Component("access")}
+	access.Printf(`%s %s %s %s %s %d %s "%s" %d %d %dms`, "203.0.113.7", "esm.sh", "HTTP/1.1", "GET", "/react@18", int64(0), "-", `curl/8.0 \"x\"`, 200, 1024, time.Duration(3))
+	r := sink.Records(t)[0]
+	if r["component"] != "access" || r["msg"] != "GET /react@18" || r["status"] != float64(200) || r["userAgent"] != `curl/8.0 "x"` || r["durationMs"] != float64(3) {
+		t.Fatalf("unexpected access record: %v", r)
+	}
+}
+
+func TestFileLogSink(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := openLogSink("file:"+path.Join(dir, "main.log")+"?maxFileSize=64", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sink.Write(logx.L_INFO, []byte(strings.Repeat("x", 39))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+	for _, name := range []string{"main.log", "main_1.log", "main_2.log"} {
+		data, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 40 {
+			t.Fatalf("%s: unexpected size %d", name, len(data))
+		}
+	}
+
+	sink, err = openLogSink("file:"+path.Join(dir, "access.log")+"?fileDateFormat=20060102", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write(logx.L_INFO, []byte("GET /react"))
+	sink.Close()
+	if _, err := os.Stat(path.Join(dir, "access-"+time.Now().Format("20060102")+".log")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openLogSink("kafka:localhost:9092", "text"); err == nil {
+		t.Fatal("the sink should be invalid")
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := openLogSink("syslog:udp://"+conn.LocalAddr().String(), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Write(logx.L_WARN, []byte(`{"msg":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	// <daemon.warning>
+	if !strings.HasPrefix(msg, "<28>1 ") || !strings.HasSuffix(msg, ` esm.sh `+strconv.Itoa(os.Getpid())+` - - {"msg":"hello"}`) {
+		t.Fatalf("unexpected syslog message: %s", msg)
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// counterVec is a Prometheus counter with labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]*uint64
+}
+
+// metric is a metric of the `/-/metrics` endpoint.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsLock sync.Mutex
+	metrics     []metric
+	collectors  []func()
+)
+
+func registerMetric(m metric) {
+	metricsLock.Lock()
+	metrics = append(metrics, m)
+	metricsLock.Unlock()
+}
+
+// onCollectMetrics adds a function that updates the metrics before they are written, e.g. to
+// copy the statistics of the caches.
+func onCollectMetrics(fn func()) {
+	metricsLock.Lock()
+	collectors = append(collectors, fn)
+	metricsLock.Unlock()
+}
+
+// newCounterVec creates a counter with the label names and registers it to the `/-/metrics` endpoint.
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]*uint64{}}
+	registerMetric(c)
+	return c
+}
+
+// Inc increments the counter of the label values.
+func (c *counterVec) Inc(values ...string) {
+	key := strings.Join(values, "\x00")
+	c.lock.Lock()
+	v, ok := c.values[key]
+	if !ok {
+		v = new(uint64)
+		c.values[key] = v
+	}
+	c.lock.Unlock()
+	atomic.AddUint64(v, 1)
+}
+
+// set sets the counter of the label values, it's used to copy the counters that are maintained
+// elsewhere.
+func (c *counterVec) set(value uint64, values ...string) {
+	key := strings.Join(values, "\x00")
+	c.lock.Lock()
+	v, ok := c.values[key]
+	if !ok {
+		v = new(uint64)
+		c.values[key] = v
+	}
+	c.lock.Unlock()
+	atomic.StoreUint64(v, value)
+}
+
+// Get returns the counter of the label values.
+func (c *counterVec) Get(values ...string) uint64 {
+	c.lock.Lock()
+	v, ok := c.values[strings.Join(values, "\x00")]
+	c.lock.Unlock()
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(v)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	c.lock.Unlock()
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range keys {
+		c.lock.Lock()
+		v := c.values[key]
+		c.lock.Unlock()
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, key, ""), atomic.LoadUint64(v))
+	}
+}
+
+// the default buckets of the histograms in seconds
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// histogramVec is a Prometheus histogram with labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogramVec creates a histogram with the label names and registers it to the `/-/metrics`
+// endpoint, the `buckets` are the upper bounds in ascending order.
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+	registerMetric(h)
+	return h
+}
+
+// Observe adds an observation of the label values.
+func (h *histogramVec) Observe(value float64, values ...string) {
+	key := strings.Join(values, "\x00")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, le := range h.buckets {
+		if value <= le {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+// Count returns the number of the observations of the label values.
+func (h *histogramVec) Count(values ...string) uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if v, ok := h.values[strings.Join(values, "\x00")]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range keys {
+		v := h.values[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, strconv.FormatFloat(le, 'g', -1, 64)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), strconv.FormatFloat(v.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), v.count)
+	}
+}
+
+// gaugeFunc is a Prometheus gauge that is read when the metrics are written.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// newGaugeFunc creates a gauge of the function and registers it to the `/-/metrics` endpoint.
+func newGaugeFunc(name string, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, strconv.FormatFloat(g.fn(), 'g', -1, 64))
+}
+
+// formatLabels formats the label pairs of the joined label values, e.g. `{route="module",status="200"}`,
+// the `le` label of the histogram buckets is appended if it's not empty.
+func formatLabels(labels []string, key string, le string) string {
+	values := strings.Split(key, "\x00")
+	pairs := make([]string, 0, len(labels)+1)
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, value))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeMetrics writes the registered metrics in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	for _, fn := range collectors {
+		fn()
+	}
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
@@ -157,7 +157,7 @@ func startNodeServices() (err error) {
 		return
 	}
 
-	log.Debug("node services process started, pid is", cmd.Process.Pid)
+	log.Component("node-services").Debug("node services process started, pid is", cmd.Process.Pid)
 
 	// wait the process to exit
 	err = cmd.Wait()
@@ -206,9 +206,9 @@ func cjsLexer(buildDir string, importPath string, nodeEnv string) (ret cjsExport
 			kill(nsPidFile)
 		}
 		if ret.Stack != "" {
-			log.Errorf("[ns] cjsLexer: %s\n---\n%s\n---", ret.Error, ret.Stack)
+			log.Component("node-services").Errorf("[ns] cjsLexer: %s\n---\n%s\n---", ret.Error, ret.Stack)
 		} else {
-			log.Errorf("[ns] cjsLexer: %s", ret.Error)
+			log.Component("node-services").Errorf("[ns] cjsLexer: %s", ret.Error)
 		}
 	}
 	return
@@ -113,7 +113,7 @@ CheckNodejs:
 			if err != nil {
 				return
 			}
-			log.Infof("nodejs %s installed", nodejsLatestLTS)
+			log.Component("npm").Infof("nodejs %s installed", nodejsLatestLTS)
 			installed = true
 			goto CheckNodejs
 		} else {
@@ -1,19 +1,23 @@
 package server
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/esm-dev/esm.sh/server/config"
 	"github.com/esm-dev/esm.sh/server/storage"
 
 	"github.com/Masterminds/semver/v3"
@@ -21,6 +25,15 @@ import (
 	"github.com/ije/gox/valid"
 )
 
+// the registries that failed recently, mapped to the time to retry
+var unhealthyRegistries sync.Map
+
+const (
+	registryRetryInterval = time.Minute
+	// the stale metadata is used when all the registries are unreachable
+	staleMetadataTTL = 7 * 24 * time.Hour
+)
+
 // ref https://github.com/npm/validate-npm-package-name
 var npmNaming = valid.Validator{valid.FromTo{'a', 'z'}, valid.FromTo{'A', 'Z'}, valid.FromTo{'0', '9'}, valid.Eq('.'), valid.Eq('-'), valid.Eq('_')}
 
@@ -42,13 +55,28 @@ type NpmPackageTemp struct {
 	JsNextMain       string                 `json:"jsnext:main,omitempty"`
 	Types            string                 `json:"types,omitempty"`
 	Typings          string                 `json:"typings,omitempty"`
+	Source           string                 `json:"source,omitempty"`
 	SideEffects      interface{}            `json:"sideEffects,omitempty"`
 	Dependencies     map[string]string      `json:"dependencies,omitempty"`
 	PeerDependencies map[string]string      `json:"peerDependencies,omitempty"`
+	BundleDeps       interface{}            `json:"bundleDependencies,omitempty"`
+	BundledDeps      interface{}            `json:"bundledDependencies,omitempty"`
 	Imports          map[string]interface{} `json:"imports,omitempty"`
 	TypesVersions    map[string]interface{} `json:"typesVersions,omitempty"`
 	PkgExports       json.RawMessage        `json:"exports,omitempty"`
 	Deprecated       interface{}            `json:"deprecated,omitempty"`
+	License          interface{}            `json:"license,omitempty"`
+	Licenses         []interface{}          `json:"licenses,omitempty"`
+	Scripts          map[string]string      `json:"scripts,omitempty"`
+	Gypfile          bool                   `json:"gypfile,omitempty"`
+	Dist             NpmPackageDist         `json:"dist,omitempty"`
+}
+
+// NpmPackageDist defines the `dist` field of the package metadata
+type NpmPackageDist struct {
+	Tarball   string `json:"tarball,omitempty"`
+	Integrity string `json:"integrity,omitempty"`
+	Shasum    string `json:"shasum,omitempty"`
 }
 
 func (a *NpmPackageTemp) ToNpmPackage() *NpmPackage {
@@ -75,12 +103,54 @@ func (a *NpmPackageTemp) ToNpmPackage() *NpmPackage {
 			deprecated = s
 		}
 	}
+	// `license` is a SPDX expression, or the legacy `{ "type": "MIT" }` object and `licenses` list
+	license := ""
+	if s, ok := a.License.(string); ok {
+		license = s
+	} else if m, ok := a.License.(map[string]interface{}); ok {
+		license, _ = m["type"].(string)
+	} else if len(a.Licenses) > 0 {
+		types := []string{}
+		for _, v := range a.Licenses {
+			if m, ok := v.(map[string]interface{}); ok {
+				if s, ok := m["type"].(string); ok {
+					types = append(types, s)
+				}
+			}
+		}
+		license = strings.Join(types, " OR ")
+	}
 	sideEffects := true
 	if a.SideEffects != nil {
 		if s, ok := a.SideEffects.(string); ok {
 			sideEffects = s != "false"
 		} else if b, ok := a.SideEffects.(bool); ok {
 			sideEffects = b
+		} else if patterns, ok := a.SideEffects.([]interface{}); ok {
+			// `sideEffects: ["*.css"]` means the JS modules are side-effect free
+			sideEffects = false
+			for _, v := range patterns {
+				if p, ok := v.(string); ok && !endsWith(p, ".css", ".scss", ".sass", ".less") {
+					sideEffects = true
+					break
+				}
+			}
+		}
+	}
+	// `bundleDependencies` (or `bundledDependencies`) is a list of the dependency names,
+	// or `true` to bundle all the dependencies
+	bundledDependencies := []string{}
+	for _, v := range []interface{}{a.BundleDeps, a.BundledDeps} {
+		if b, ok := v.(bool); ok && b {
+			for name := range a.Dependencies {
+				bundledDependencies = append(bundledDependencies, name)
+			}
+		} else if names, ok := v.([]interface{}); ok {
+			for _, name := range names {
+				if s, ok := name.(string); ok {
+					bundledDependencies = append(bundledDependencies, s)
+				}
+			}
 		}
 	}
 	var pkgExports interface{} = nil
@@ -100,23 +170,29 @@ func (a *NpmPackageTemp) ToNpmPackage() *NpmPackage {
 		}
 	}
 	return &NpmPackage{
-		Name:             a.Name,
-		Version:          a.Version,
-		Type:             a.Type,
-		Main:             a.Main,
-		Module:           a.Module.MainValue(),
-		ES2015:           a.ES2015.MainValue(),
-		JsNextMain:       a.JsNextMain,
-		Types:            a.Types,
-		Typings:          a.Typings,
-		Browser:          browser,
-		SideEffects:      sideEffects,
-		Dependencies:     a.Dependencies,
-		PeerDependencies: a.PeerDependencies,
-		Imports:          a.Imports,
-		TypesVersions:    a.TypesVersions,
-		PkgExports:       pkgExports,
-		Deprecated:       deprecated,
+		Name:               a.Name,
+		Version:            a.Version,
+		Type:               a.Type,
+		Main:               a.Main,
+		Module:             a.Module.MainValue(),
+		ES2015:             a.ES2015.MainValue(),
+		JsNextMain:         a.JsNextMain,
+		Types:              a.Types,
+		Typings:            a.Typings,
+		Source:             a.Source,
+		Browser:            browser,
+		SideEffects:        sideEffects,
+		Dependencies:       a.Dependencies,
+		PeerDependencies:   a.PeerDependencies,
+		BundleDependencies: bundledDependencies,
+		Imports:            a.Imports,
+		TypesVersions:      a.TypesVersions,
+		PkgExports:         pkgExports,
+		Deprecated:         deprecated,
+		License:            license,
+		Scripts:            getInstallScripts(a.Scripts),
+		Gypfile:            a.Gypfile,
+		Dist:               a.Dist,
 	}
 }
 
@@ -131,14 +207,21 @@ type NpmPackage struct {
 	JsNextMain       string
 	Types            string
 	Typings          string
+	Source           string
 	SideEffects      bool
 	Browser          map[string]string
 	Dependencies     map[string]string
 	PeerDependencies map[string]string
-	Imports          map[string]interface{}
-	TypesVersions    map[string]interface{}
-	PkgExports       interface{}
-	Deprecated       string
+	// the field name matches the `bundleDependencies` of package.json to keep it in the cache
+	BundleDependencies []string
+	Imports            map[string]interface{}
+	TypesVersions      map[string]interface{}
+	PkgExports         interface{}
+	Deprecated         string
+	License            string
+	Scripts            map[string]string
+	Gypfile            bool
+	Dist               NpmPackageDist
 }
 
 func (a *NpmPackage) UnmarshalJSON(b []byte) error {
@@ -169,13 +252,60 @@ func getPackageInfo(wd string, name string, version string) (info NpmPackage, fr
 		}
 	}
 
-	info, err = fetchPackageInfo(name, version)
+	info, err = fetchPackageInfo(resolveNpmAlias(name, version))
 	if err == nil {
 		info, err = fixPkgVersion(info)
 	}
 	return
 }
 
+// fixWorkspaceRange resolves the `workspace:` range that is published by mistake to a range of
+// the published versions, e.g. `workspace:^1.2.0` to `^1.2.0`, `workspace:*` to `latest`.
+func fixWorkspaceRange(version string) string {
+	if !strings.HasPrefix(version, "workspace:") {
+		return version
+	}
+	version = strings.TrimPrefix(version, "workspace:")
+	switch version {
+	case "", "*", "^", "~":
+		return "latest"
+	}
+	return version
+}
+
+// getWorkspaceOverrides returns the pnpm overrides of the dependencies with `workspace:` ranges.
+func getWorkspaceOverrides(pkg Pkg) map[string]string {
+	if pkg.FromGithub || pkg.FromEsmsh {
+		return nil
+	}
+	info, err := fetchPackageInfo(pkg.Name, pkg.Version)
+	if err != nil {
+		return nil
+	}
+	overrides := map[string]string{}
+	for _, deps := range []map[string]string{info.Dependencies, info.PeerDependencies} {
+		for name, version := range deps {
+			if strings.HasPrefix(version, "workspace:") {
+				overrides[name] = fixWorkspaceRange(version)
+			}
+		}
+	}
+	return overrides
+}
+
+// resolveNpmAlias resolves the `npm:` alias of the dependency version,
+// e.g. `"foo": "npm:bar@^2"` is resolved to the package `bar` with version `^2`.
+func resolveNpmAlias(name string, version string) (string, string) {
+	if !strings.HasPrefix(version, "npm:") {
+		return name, version
+	}
+	aliasName, aliasVersion := splitPkgNameVersion(strings.TrimPrefix(version, "npm:"))
+	if aliasVersion == "" {
+		aliasVersion = "latest"
+	}
+	return aliasName, aliasVersion
+}
+
 func fetchPackageInfo(name string, version string) (info NpmPackage, err error) {
 	a := strings.Split(strings.Trim(name, "/"), "/")
 	name = a[0]
@@ -183,13 +313,41 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 		name = a[0] + "/" + a[1]
 	}
 
+	version = fixWorkspaceRange(version)
 	if strings.HasPrefix(version, "=") || strings.HasPrefix(version, "v") {
 		version = version[1:]
 	}
 	if version == "" {
 		version = "latest"
 	}
-	isFullVersion := regexpFullVersion.MatchString(version)
+
+	// resolve the dist-tag or the version range with the packument
+	if !regexpFullVersion.MatchString(version) {
+		var packument *npmPackument
+		var versions map[string]NpmPackage
+		packument, versions, err = getPackument(name)
+		if err != nil {
+			return
+		}
+		resolved, ok := packument.resolve(version, false)
+		if !ok {
+			if _, e := semver.NewConstraint(version); e != nil && version != "latest" {
+				return fetchPackageInfo(name, "latest")
+			}
+			if cfg.NpmRejectDeprecated && len(packument.Deprecated) > 0 {
+				err = fmt.Errorf("npm: non-deprecated version '%s' of %s not found", version, name)
+				return
+			}
+			err = fmt.Errorf("npm: version '%s' of %s not found", version, name)
+			return
+		}
+		// use the version metadata of the fresh packument
+		if v, ok := versions[resolved]; ok && v.Version != "" {
+			cacheVersionMetadata(v)
+			return v, nil
+		}
+		version = resolved
+	}
 
 	cacheKey := fmt.Sprintf("npm:%s@%s", name, version)
 	lock := getFetchLock(cacheKey)
@@ -201,43 +359,29 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 		var data []byte
 		data, err = cache.Get(cacheKey)
 		if err == nil && json.Unmarshal(data, &info) == nil {
+			recordCacheLookup("npm", true)
 			return
 		}
+		recordCacheLookup("npm", false)
 		if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
-			log.Error("cache:", err)
+			log.Component("npm").Error("cache:", err)
 		}
 	}
 
 	start := time.Now()
 	defer func() {
 		if err == nil {
-			log.Debugf("lookup package(%s@%s) in %v", name, info.Version, time.Since(start))
+			log.Component("npm").Debugf("lookup package(%s@%s) in %v", name, info.Version, time.Since(start))
 		}
 	}()
 
-	url := cfg.NpmRegistry + name
-	if cfg.NpmRegistryScope != "" {
-		isInScope := strings.HasPrefix(name, cfg.NpmRegistryScope)
-		if !isInScope {
-			url = "https://registry.npmjs.org/" + name
-		}
-	}
-
-	if isFullVersion {
-		url += "/" + version
-	}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return
-	}
-	if cfg.NpmToken != "" {
-		req.Header.Set("Authorization", "Bearer "+cfg.NpmToken)
-	}
-	if cfg.NpmUser != "" && cfg.NpmPassword != "" {
-		req.SetBasicAuth(cfg.NpmUser, cfg.NpmPassword)
-	}
-	resp, err := httpClient.Do(req)
+	resp, err := requestNpmRegistry(name, version)
 	if err != nil {
+		// all the registries are unreachable, use the stale metadata
+		if stale, ok := getStalePackageInfo(cacheKey, name, version); ok {
+			log.Component("npm").Warnf("npm: use the stale metadata of %s@%s", name, version)
+			return stale, nil
+		}
 		return
 	}
 	defer resp.Body.Close()
@@ -253,77 +397,130 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 		return
 	}
 
-	if isFullVersion {
-		err = json.NewDecoder(resp.Body).Decode(&info)
-		if err != nil {
-			return
-		}
-		if cache != nil {
-			cache.Set(cacheKey, utils.MustEncodeJSON(info), 24*time.Hour)
-		}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
 		return
 	}
+	cacheVersionMetadata(info)
+	return
+}
 
-	var h NpmPackageVerions
-	err = json.NewDecoder(resp.Body).Decode(&h)
+// resolvePrereleaseVersion resolves the version range to the highest matched version, including
+// the pre-release versions. The dist-tags are resolved as usual.
+func resolvePrereleaseVersion(name string, version string) (string, error) {
+	packument, _, err := getPackument(name)
 	if err != nil {
-		return
+		return "", err
 	}
-
-	if len(h.Versions) == 0 {
-		err = fmt.Errorf("npm: versions of %s not found", name)
-		return
+	resolved, ok := packument.resolve(version, true)
+	if !ok {
+		return "", fmt.Errorf("npm: version '%s' of %s not found", version, name)
 	}
+	return resolved, nil
+}
 
-	distVersion, ok := h.DistTags[version]
-	if ok {
-		info = h.Versions[distVersion]
-	} else {
-		var c *semver.Constraints
-		c, err = semver.NewConstraint(version)
-		if err != nil && version != "latest" {
-			return fetchPackageInfo(name, "latest")
-		}
-		vs := make([]*semver.Version, len(h.Versions))
-		i := 0
-		for v := range h.Versions {
-			// ignore prerelease versions
-			if !strings.ContainsRune(version, '-') && strings.ContainsRune(v, '-') {
-				continue
-			}
-			var ver *semver.Version
-			ver, err = semver.NewVersion(v)
-			if err != nil {
-				return
-			}
-			if c.Check(ver) {
-				vs[i] = ver
-				i++
-			}
+// requestNpmRegistry requests the metadata of the package from the registries in order, the
+// packument is requested if the version is empty.
+func requestNpmRegistry(name string, version string) (resp *http.Response, err error) {
+	for _, registry := range getNpmRegistries(name) {
+		resp, err = fetchNpmRegistry(registry, name, version)
+		if err == nil && resp.StatusCode < 500 && resp.StatusCode != 429 {
+			unhealthyRegistries.Delete(registry.Registry)
+			return
 		}
-		if i > 0 {
-			vs = vs[:i]
-			if i > 1 {
-				sort.Sort(semver.Collection(vs))
-			}
-			info = h.Versions[vs[i-1].String()]
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("npm: registry %s responded %s", registry.Registry, resp.Status)
 		}
+		// skip the registry for a while, the next registry of the list is used
+		unhealthyRegistries.Store(registry.Registry, time.Now().Add(registryRetryInterval))
+		log.Component("npm").Warnf("npm: fetch %s from %s: %v", name, registry.Registry, err)
 	}
+	return
+}
+
+// getNpmRegistries returns the registry of the package followed by the mirrors, the registries
+// that failed recently are moved to the end of the list.
+func getNpmRegistries(name string) []config.NpmRegistry {
+	registry := getNpmRegistry(name)
+	if registry.Timeout == 0 && registry.Registry == cfg.NpmRegistry {
+		registry.Timeout = cfg.NpmRegistryTimeout
+	}
+	registries := []config.NpmRegistry{registry}
+	// the mirrors are used for the public packages only
+	if !registry.HasCredentials() {
+		registries = append(registries, cfg.NpmRegistryMirrors...)
+	}
+	if len(registries) == 1 {
+		return registries
+	}
+	healthy := make([]config.NpmRegistry, 0, len(registries))
+	unhealthy := []config.NpmRegistry{}
+	for _, r := range registries {
+		if v, ok := unhealthyRegistries.Load(r.Registry); ok && time.Now().Before(v.(time.Time)) {
+			unhealthy = append(unhealthy, r)
+		} else {
+			healthy = append(healthy, r)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
 
-	if info.Version == "" {
-		err = fmt.Errorf("npm: version '%s' of %s not found", version, name)
+func fetchNpmRegistry(registry config.NpmRegistry, name string, version string) (resp *http.Response, err error) {
+	url := registry.Registry + name
+	if version != "" {
+		url += "/" + version
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	setNpmRegistryAuth(req.Header, registry)
+	client, err := getNpmRegistryClient(registry)
+	if err != nil {
 		return
 	}
+	start := time.Now()
+	resp, err = client.Do(req)
+	recordRegistryRequest(registry.Registry, start, resp, err)
+	return
+}
+
+// setNpmRegistryAuth sets the `Authorization` header with the credentials of the registry.
+func setNpmRegistryAuth(header http.Header, registry config.NpmRegistry) {
+	if registry.Token != "" {
+		header.Set("Authorization", "Bearer "+registry.Token)
+	}
+	if registry.User != "" && registry.Password != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(registry.User+":"+registry.Password)))
+	} else if registry.Auth != "" {
+		header.Set("Authorization", "Basic "+registry.Auth)
+	}
+}
 
-	// cache package info for 10 minutes
+// getStalePackageInfo returns the expired metadata of the package, or the package.json of the
+// installed package.
+func getStalePackageInfo(cacheKey string, name string, version string) (info NpmPackage, ok bool) {
 	if cache != nil {
-		cache.Set(cacheKey, utils.MustEncodeJSON(info), 10*time.Minute)
+		data, err := cache.Get("stale:" + cacheKey)
+		if err == nil && json.Unmarshal(data, &info) == nil {
+			return info, true
+		}
+	}
+	pkgJsonPath := path.Join(cfg.WorkDir, "npm", name+"@"+version, "node_modules", name, "package.json")
+	if fileExists(pkgJsonPath) && utils.ParseJSONFile(pkgJsonPath, &info) == nil {
+		return info, true
 	}
 	return
 }
 
-func installPackage(wd string, pkg Pkg) (err error) {
+func installPackage(wd string, pkg Pkg, parentSpan *traceSpan) (err error) {
 	pkgVersionName := pkg.VersionName()
+	span := startSpan(parentSpan, "install")
+	span.SetAttr("esm.package", pkgVersionName)
+	defer func() {
+		span.End(err)
+	}()
 	lock := getInstallLock(pkgVersionName)
 	lock.Lock()
 	defer lock.Unlock()
@@ -334,6 +531,12 @@ func installPackage(wd string, pkg Pkg) (err error) {
 		err = copyRawBuildFile(pkg.Name, "package.json", wd)
 	} else if pkg.FromGithub || !fileExists(packageFilePath) {
 		fileContent := []byte("{}")
+		if overrides := getWorkspaceOverrides(pkg); len(overrides) > 0 {
+			// pnpm fails to install the dependencies with `workspace:` ranges
+			fileContent = utils.MustEncodeJSON(map[string]interface{}{
+				"pnpm": map[string]interface{}{"overrides": overrides},
+			})
+		}
 		if pkg.FromGithub {
 			fileContent = []byte(fmt.Sprintf(
 				`{"dependencies": {"%s": "%s"}}`,
@@ -348,6 +551,8 @@ func installPackage(wd string, pkg Pkg) (err error) {
 		return fmt.Errorf("ensure package.json failed: %s", pkgVersionName)
 	}
 
+	// the path of the downloaded tarball if the package is installed from it
+	var tarballPath string
 	for i := 0; i < 3; i++ {
 		if pkg.FromEsmsh {
 			err = pnpmInstall(wd)
@@ -367,9 +572,29 @@ func installPackage(wd string, pkg Pkg) (err error) {
 				err = ghInstall(wd, pkg.Name, pkg.Version)
 			}
 		} else if regexpFullVersion.MatchString(pkg.Version) {
-			err = pnpmInstall(wd, pkgVersionName, "--prefer-offline")
+			// download the tarball with range requests instead of the single request of pnpm
+			// that times out for the large packages on slow links
+			if i == 0 {
+				tarballSpan := startSpan(span, "download tarball")
+				tarballPath, err = fetchPackageTarball(pkg)
+				tarballSpan.End(err)
+				if err == nil {
+					err = checkTarballLimits(tarballPath)
+				}
+				if err == nil {
+					err = pnpmInstall(wd, tarballPath, "--prefer-offline")
+					if err == nil && fileExists(path.Join(wd, "node_modules", pkg.Name, "package.json")) {
+						break
+					}
+				} else if errors.Is(err, errTarballTooLarge) || getBuildLimit(err) != "" {
+					return
+				}
+				log.Component("npm").Warnf("npm: install %s from the tarball: %v", pkgVersionName, err)
+				tarballPath = ""
+			}
+			err = pnpmInstall(wd, append([]string{pkgVersionName, "--prefer-offline"}, getPnpmRegistryArgs(pkg.Name, i)...)...)
 		} else {
-			err = pnpmInstall(wd, pkgVersionName)
+			err = pnpmInstall(wd, append([]string{pkgVersionName}, getPnpmRegistryArgs(pkg.Name, i)...)...)
 		}
 		packageFilePath := path.Join(wd, "node_modules", pkg.Name, "package.json")
 		if err == nil && !fileExists(packageFilePath) {
@@ -380,16 +605,113 @@ func installPackage(wd string, pkg Pkg) (err error) {
 				err = fmt.Errorf("pnpm install %s: package.json not found", pkg)
 			}
 		}
-		if err == nil {
+		if err == nil || getBuildLimit(err) != "" {
 			break
 		}
 		if i < 2 {
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
+	// verify the integrity of the installed tarball with the registry metadata
+	if err == nil && !pkg.FromEsmsh && !pkg.FromGithub && regexpFullVersion.MatchString(pkg.Version) {
+		err = verifyPackageIntegrity(wd, pkg, tarballPath)
+		if err != nil {
+			os.RemoveAll(path.Join(wd, "node_modules"))
+			return
+		}
+	}
+	// all the registries are unreachable, reuse the tarballs in the pnpm store
+	if err != nil && !pkg.FromEsmsh && !pkg.FromGithub && regexpFullVersion.MatchString(pkg.Version) {
+		if pnpmInstall(wd, pkgVersionName, "--offline") == nil && fileExists(path.Join(wd, "node_modules", pkg.Name, "package.json")) {
+			log.Component("npm").Warnf("pnpm: install %s from the store offline", pkgVersionName)
+			err = nil
+		}
+	}
 	return
 }
 
+// verifyPackageIntegrity checks the integrity of the package that is recorded in the pnpm lockfile
+// (or of the tarball the package is installed from) against the `dist.integrity` (or `dist.shasum`)
+// of the registry metadata.
+func verifyPackageIntegrity(wd string, pkg Pkg, tarballPath string) error {
+	info, err := fetchPackageInfo(pkg.Name, pkg.Version)
+	if err != nil {
+		// the metadata is not available, e.g. the registries are unreachable
+		log.Component("npm").Warnf("npm: integrity of %s@%s not verified: %v", pkg.Name, pkg.Version, err)
+		return nil
+	}
+	expected := getDistIntegrity(info.Dist)
+	if expected == "" {
+		log.Component("npm").Warnf("npm: integrity of %s@%s not verified: no integrity in the registry metadata", pkg.Name, pkg.Version)
+		return nil
+	}
+	// the lockfile records the `file:` resolution of the tarball without the integrity
+	if tarballPath != "" {
+		err = verifyTarballIntegrity(tarballPath, expected)
+		if err != nil {
+			log.Component("npm").Errorf("npm: integrity of %s@%s mismatched: %v", pkg.Name, pkg.Version, err)
+			return fmt.Errorf("npm: integrity of %s@%s mismatched", pkg.Name, pkg.Version)
+		}
+		return nil
+	}
+	lockfile, err := os.ReadFile(path.Join(wd, "pnpm-lock.yaml"))
+	if err != nil {
+		log.Component("npm").Warnf("npm: integrity of %s@%s not verified: %v", pkg.Name, pkg.Version, err)
+		return nil
+	}
+	integrity, ok := findLockfileIntegrity(lockfile, pkg.Name, pkg.Version)
+	if !ok {
+		log.Component("npm").Warnf("npm: integrity of %s@%s not verified: no integrity in the lockfile", pkg.Name, pkg.Version)
+		return nil
+	}
+	if integrity != expected {
+		log.Component("npm").Errorf("npm: integrity of %s@%s mismatched, expected %s but got %s", pkg.Name, pkg.Version, expected, integrity)
+		return fmt.Errorf("npm: integrity of %s@%s mismatched", pkg.Name, pkg.Version)
+	}
+	return nil
+}
+
+// getDistIntegrity returns the integrity of the tarball, the legacy `shasum` is converted to
+// the sha1 integrity as pnpm does.
+func getDistIntegrity(dist NpmPackageDist) string {
+	if dist.Integrity != "" {
+		return dist.Integrity
+	}
+	if dist.Shasum != "" {
+		if sum, err := hex.DecodeString(dist.Shasum); err == nil {
+			return "sha1-" + base64.StdEncoding.EncodeToString(sum)
+		}
+	}
+	return ""
+}
+
+// findLockfileIntegrity finds the integrity of the package in the pnpm lockfile, e.g.
+//
+//	/react@18.2.0:
+//	  resolution: {integrity: sha512-...}
+func findLockfileIntegrity(lockfile []byte, name string, version string) (string, bool) {
+	re, err := regexp.Compile(`(?m)^\s+['"]?/?` + regexp.QuoteMeta(name+"@"+version) + `(?:\(.*\))?['"]?:\s*\n\s+resolution:\s*\{integrity:\s*([^,}\s]+)`)
+	if err != nil {
+		return "", false
+	}
+	m := re.FindSubmatch(lockfile)
+	if m == nil {
+		return "", false
+	}
+	return string(m[1]), true
+}
+
+// getPnpmRegistryArgs returns the `--registry` argument for the install attempt, the retries
+// switch to the next registry of the mirror list.
+func getPnpmRegistryArgs(name string, attempt int) []string {
+	registries := getNpmRegistries(name)
+	registry := registries[attempt%len(registries)].Registry
+	if registry == "" || registry == getNpmRegistry(name).Registry {
+		return nil
+	}
+	return []string{"--registry", registry}
+}
+
 func pnpmInstall(wd string, packages ...string) (err error) {
 	var args []string
 	if len(packages) > 0 {
@@ -403,33 +725,152 @@ func pnpmInstall(wd string, packages ...string) (err error) {
 		"--loglevel", "error",
 	)
 	start := time.Now()
-	cmd := exec.Command("pnpm", args...)
-	cmd.Dir = wd
-	if cfg.NpmToken != "" {
-		cmd.Env = append(os.Environ(), "ESM_NPM_TOKEN="+cfg.NpmToken)
-	}
-	if cfg.NpmUser != "" && cfg.NpmPassword != "" {
-		data := []byte(cfg.NpmPassword)
-		password := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
-		base64.StdEncoding.Encode(password, data)
-		cmd.Env = append(
-			os.Environ(),
-			"ESM_NPM_USER="+cfg.NpmUser,
-			"ESM_NPM_PASSWORD="+string(password),
-		)
-	}
-	output, err := cmd.CombinedOutput()
+	// the `ignore-scripts` config can't be overridden by the `.npmrc` of the work directory
+	env := append(os.Environ(), "npm_config_ignore_scripts=true")
+	env = append(env, getNpmAuthEnv()...)
+	output, err := runInstallCommand(wd, env, "pnpm", args...)
 	if err != nil {
+		if _, ok := err.(*BuildLimitError); ok {
+			return
+		}
 		return fmt.Errorf("pnpm add %s: %s", strings.Join(packages, ","), string(output))
 	}
 	if len(packages) > 0 {
-		log.Debug("pnpm add", strings.Join(packages, ","), "in", time.Since(start))
+		log.Component("npm").Debug("pnpm add", strings.Join(packages, ","), "in", time.Since(start))
 	} else {
-		log.Debug("pnpm install in", time.Since(start))
+		log.Component("npm").Debug("pnpm install in", time.Since(start))
 	}
 	return
 }
 
+// getNpmRegistry returns the registry and the credentials to fetch the package,
+// the `npmRegistries` config takes precedence over the `npmRegistry` config.
+func getNpmRegistry(name string) config.NpmRegistry {
+	if strings.HasPrefix(name, "@") {
+		scope, _ := utils.SplitByFirstByte(name, '/')
+		if r, ok := cfg.NpmRegistries[scope]; ok {
+			return r
+		}
+		if scope == "@jsr" {
+			return config.NpmRegistry{Registry: jsrNpmRegistry}
+		}
+	}
+	// the packages out of the `npmRegistryScope` are fetched from the public registry without credentials
+	if cfg.NpmRegistryScope != "" && !strings.HasPrefix(name, cfg.NpmRegistryScope) {
+		return config.NpmRegistry{Registry: "https://registry.npmjs.org/"}
+	}
+	return getDefaultNpmRegistry()
+}
+
+// getDefaultNpmRegistry returns the `npmRegistry` config with the credentials.
+func getDefaultNpmRegistry() config.NpmRegistry {
+	return config.NpmRegistry{
+		Registry: cfg.NpmRegistry,
+		Token:    cfg.NpmToken,
+		User:     cfg.NpmUser,
+		Password: cfg.NpmPassword,
+		Auth:     cfg.NpmAuth,
+		CertFile: cfg.NpmCertFile,
+		KeyFile:  cfg.NpmKeyFile,
+		CAFile:   cfg.NpmCAFile,
+	}
+}
+
+// getNpmrc returns the `.npmrc` for pnpm, the credentials are referenced by the env variables
+// that are set by `getNpmAuthEnv` to keep them out of the work directory.
+func getNpmrc() []byte {
+	buf := bytes.NewBuffer(nil)
+	// the lifecycle scripts of the packages are never run
+	buf.WriteString("ignore-scripts=true\n")
+	// the JSR packages are installed from its npm compatibility registry
+	if _, ok := cfg.NpmRegistries["@jsr"]; !ok {
+		fmt.Fprintf(buf, "@jsr:registry=%s\n", jsrNpmRegistry)
+	}
+	defaultRegistry := getDefaultNpmRegistry()
+	if !defaultRegistry.HasCredentials() && len(cfg.NpmRegistries) == 0 && len(cfg.NpmRegistryMirrors) == 0 {
+		return buf.Bytes()
+	}
+	if cfg.NpmRegistry != "" {
+		if cfg.NpmRegistryScope != "" {
+			fmt.Fprintf(buf, "%s:registry=%s\n", cfg.NpmRegistryScope, cfg.NpmRegistry)
+		} else {
+			fmt.Fprintf(buf, "registry=%s\n", cfg.NpmRegistry)
+		}
+		writeNpmrcAuth(buf, defaultRegistry, "")
+	}
+	for i, scope := range getNpmRegistryScopes() {
+		r := cfg.NpmRegistries[scope]
+		fmt.Fprintf(buf, "%s:registry=%s\n", scope, r.Registry)
+		writeNpmrcAuth(buf, r, fmt.Sprintf("_%d", i))
+	}
+	for i, r := range cfg.NpmRegistryMirrors {
+		writeNpmrcAuth(buf, r, fmt.Sprintf("_M%d", i))
+	}
+	return buf.Bytes()
+}
+
+func writeNpmrcAuth(buf *bytes.Buffer, registry config.NpmRegistry, envSuffix string) {
+	host, err := removeHttpPrefix(registry.Registry)
+	if err != nil {
+		return
+	}
+	if registry.Token != "" {
+		fmt.Fprintf(buf, "%s:_authToken=${ESM_NPM_TOKEN%s}\n", host, envSuffix)
+	}
+	if registry.User != "" && registry.Password != "" {
+		fmt.Fprintf(buf, "%s:username=${ESM_NPM_USER%s}\n", host, envSuffix)
+		fmt.Fprintf(buf, "%s:_password=${ESM_NPM_PASSWORD%s}\n", host, envSuffix)
+	} else if registry.Auth != "" {
+		fmt.Fprintf(buf, "%s:_auth=${ESM_NPM_AUTH%s}\n", host, envSuffix)
+	}
+	// pnpm reads the certificate files on every install, so the rotated certificates are used
+	// without restarting the server
+	if registry.CertFile != "" {
+		fmt.Fprintf(buf, "%s:certfile=%s\n", host, registry.CertFile)
+		fmt.Fprintf(buf, "%s:keyfile=%s\n", host, registry.KeyFile)
+	}
+	if registry.CAFile != "" {
+		fmt.Fprintf(buf, "%s:cafile=%s\n", host, registry.CAFile)
+	}
+}
+
+// getNpmAuthEnv returns the env variables of the credentials that are referenced by the `.npmrc`.
+func getNpmAuthEnv() []string {
+	env := []string{}
+	appendAuth := func(r config.NpmRegistry, envSuffix string) {
+		if r.Token != "" {
+			env = append(env, fmt.Sprintf("ESM_NPM_TOKEN%s=%s", envSuffix, r.Token))
+		}
+		if r.User != "" && r.Password != "" {
+			env = append(
+				env,
+				fmt.Sprintf("ESM_NPM_USER%s=%s", envSuffix, r.User),
+				fmt.Sprintf("ESM_NPM_PASSWORD%s=%s", envSuffix, base64.StdEncoding.EncodeToString([]byte(r.Password))),
+			)
+		} else if r.Auth != "" {
+			env = append(env, fmt.Sprintf("ESM_NPM_AUTH%s=%s", envSuffix, r.Auth))
+		}
+	}
+	appendAuth(getDefaultNpmRegistry(), "")
+	for i, scope := range getNpmRegistryScopes() {
+		appendAuth(cfg.NpmRegistries[scope], fmt.Sprintf("_%d", i))
+	}
+	for i, r := range cfg.NpmRegistryMirrors {
+		appendAuth(r, fmt.Sprintf("_M%d", i))
+	}
+	return env
+}
+
+// getNpmRegistryScopes returns the sorted scopes of the `npmRegistries` config.
+func getNpmRegistryScopes() []string {
+	scopes := make([]string, 0, len(cfg.NpmRegistries))
+	for scope := range cfg.NpmRegistries {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
 // ref https://github.com/npm/validate-npm-package-name
 func validatePackageName(name string) bool {
 	scope := ""
@@ -452,6 +893,65 @@ func toTypesPackageName(pkgName string) string {
 	return "@types/" + pkgName
 }
 
+// getTypesOverride returns the types package pinned by the `typesOverrides` config for the given
+// package, the entries with a version range take precedence over the ones without.
+func getTypesOverride(name string, version string) (typesName string, typesVersion string, ok bool) {
+	if cfg == nil {
+		return
+	}
+	v, _ := semver.NewVersion(version)
+	matched := false
+	for key, value := range cfg.TypesOverrides {
+		pkgName, versionRange := splitPkgNameVersion(key)
+		if pkgName != name {
+			continue
+		}
+		if versionRange != "" {
+			c, err := semver.NewConstraint(versionRange)
+			if err != nil || v == nil || !c.Check(v) {
+				continue
+			}
+		} else if matched {
+			continue
+		}
+		typesName, typesVersion = splitPkgNameVersion(value)
+		if typesVersion == "" {
+			typesVersion = "latest"
+		}
+		ok = true
+		matched = versionRange != ""
+	}
+	return
+}
+
+// checkTypesOverrides checks the `typesOverrides` config.
+func checkTypesOverrides(overrides map[string]string) error {
+	for key, value := range overrides {
+		name, versionRange := splitPkgNameVersion(key)
+		if name == "" {
+			return fmt.Errorf("invalid package name '%s' of types overrides", key)
+		}
+		if versionRange != "" {
+			if _, err := semver.NewConstraint(versionRange); err != nil {
+				return fmt.Errorf("invalid version range '%s' of types overrides: %v", key, err)
+			}
+		}
+		if typesName, _ := splitPkgNameVersion(value); typesName == "" {
+			return fmt.Errorf("invalid types package '%s' of types overrides", value)
+		}
+	}
+	return nil
+}
+
+// splitPkgNameVersion splits the `name@version` string, e.g. `@types/react@18` -> `@types/react`, `18`
+func splitPkgNameVersion(s string) (name string, version string) {
+	i := strings.LastIndexByte(s, '@')
+	if i <= 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
 func fixPkgVersion(info NpmPackage) (NpmPackage, error) {
 	for prefix, ver := range fixedPkgVersions {
 		if strings.HasPrefix(info.Name+"@"+info.Version, prefix) {
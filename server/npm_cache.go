@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/ije/gox/utils"
+)
+
+// npmPackument is the compact packument of the metadata cache, it keeps the dist-tags and the
+// version list only, the metadata of the versions is cached separately as it's immutable.
+type npmPackument struct {
+	DistTags map[string]string `json:"distTags"`
+	Versions []string          `json:"versions"`
+	// the versions that are marked as deprecated
+	Deprecated []string `json:"deprecated,omitempty"`
+	FetchedAt  int64    `json:"fetchedAt"`
+}
+
+// the packuments that are being revalidated in background
+var revalidatingPackuments sync.Map
+
+// resolve resolves the dist-tag or the version range to a version of the packument. The pre-release
+// versions are matched only if the range has a pre-release, or the `prerelease` is true. The
+// deprecated versions are skipped for the range if the `npmRejectDeprecated` config is true.
+func (p *npmPackument) resolve(version string, prerelease bool) (string, bool) {
+	if v, ok := p.DistTags[version]; ok {
+		return v, true
+	}
+	c, err := semver.NewConstraint(version)
+	if err != nil {
+		return "", false
+	}
+	var matched *semver.Version
+	for _, v := range p.Versions {
+		if cfg.NpmRejectDeprecated && includes(p.Deprecated, v) {
+			continue
+		}
+		isPrerelease := strings.ContainsRune(v, '-')
+		// ignore prerelease versions
+		if !prerelease && !strings.ContainsRune(version, '-') && isPrerelease {
+			continue
+		}
+		ver, err := semver.NewVersion(v)
+		if err != nil {
+			continue
+		}
+		ok := c.Check(ver)
+		if !ok && prerelease && isPrerelease {
+			// match the pre-release with its release version, e.g. `19.0.0-rc.1` matches `^19.0.0`
+			release, _ := ver.SetPrerelease("")
+			ok = c.Check(&release)
+		}
+		if ok && (matched == nil || ver.GreaterThan(matched)) {
+			matched = ver
+		}
+	}
+	if matched == nil {
+		return "", false
+	}
+	return matched.Original(), true
+}
+
+// getPackument returns the packument of the package, the expired packument is served within the
+// `npmStaleWhileRevalidate` window while it's being revalidated in background. The metadata of
+// the versions is returned if the packument is fetched from the registry.
+func getPackument(name string) (packument *npmPackument, versions map[string]NpmPackage, err error) {
+	cacheKey := "npm-packument:" + name
+	if cache != nil {
+		data, e := cache.Get(cacheKey)
+		recordCacheLookup("npm-packument", e == nil)
+		if e == nil && json.Unmarshal(data, &packument) == nil {
+			if time.Since(time.Unix(packument.FetchedAt, 0)) < time.Duration(cfg.NpmDistTagsTTL)*time.Second {
+				return
+			}
+			if _, loaded := revalidatingPackuments.LoadOrStore(name, true); !loaded {
+				go func() {
+					defer revalidatingPackuments.Delete(name)
+					if _, _, err := fetchPackument(name); err != nil {
+						log.Component("npm").Warnf("npm: revalidate %s: %v", name, err)
+					}
+				}()
+			}
+			return
+		}
+	}
+	return fetchPackument(name)
+}
+
+func fetchPackument(name string) (packument *npmPackument, versions map[string]NpmPackage, err error) {
+	cacheKey := "npm-packument:" + name
+	lock := getFetchLock(cacheKey)
+	lock.Lock()
+	defer lock.Unlock()
+
+	resp, err := requestNpmRegistry(name, "")
+	if err != nil {
+		// all the registries are unreachable, use the stale packument
+		if cache != nil {
+			if data, e := cache.Get("stale:" + cacheKey); e == nil && json.Unmarshal(data, &packument) == nil {
+				log.Component("npm").Warnf("npm: use the stale packument of %s", name)
+				return packument, nil, nil
+			}
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 || resp.StatusCode == 401 {
+		err = fmt.Errorf("npm: package '%s' not found", name)
+		return
+	}
+
+	if resp.StatusCode != 200 {
+		ret, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("npm: could not get metadata of package '%s' (%s: %s)", name, resp.Status, string(ret))
+		return
+	}
+
+	var h NpmPackageVerions
+	err = json.NewDecoder(resp.Body).Decode(&h)
+	if err != nil {
+		return
+	}
+
+	if len(h.Versions) == 0 {
+		err = fmt.Errorf("npm: versions of %s not found", name)
+		return
+	}
+
+	packument = &npmPackument{
+		DistTags:  h.DistTags,
+		Versions:  make([]string, 0, len(h.Versions)),
+		FetchedAt: time.Now().Unix(),
+	}
+	for v, info := range h.Versions {
+		packument.Versions = append(packument.Versions, v)
+		if info.Deprecated != "" {
+			packument.Deprecated = append(packument.Deprecated, v)
+		}
+	}
+	sort.Strings(packument.Versions)
+	sort.Strings(packument.Deprecated)
+
+	if cache != nil {
+		data := utils.MustEncodeJSON(packument)
+		ttl := time.Duration(cfg.NpmDistTagsTTL+cfg.NpmStaleWhileRevalidate) * time.Second
+		cache.Set(cacheKey, data, ttl)
+		cache.Set("stale:"+cacheKey, data, staleMetadataTTL)
+		// the dist-tag versions are likely to be requested
+		for _, v := range h.DistTags {
+			if info, ok := h.Versions[v]; ok && info.Version != "" {
+				cacheVersionMetadata(info)
+			}
+		}
+	}
+	return packument, h.Versions, nil
+}
+
+// cacheVersionMetadata caches the metadata of the package version.
+func cacheVersionMetadata(info NpmPackage) {
+	if cache != nil {
+		cacheKey := fmt.Sprintf("npm:%s@%s", info.Name, info.Version)
+		data := utils.MustEncodeJSON(info)
+		cache.Set(cacheKey, data, time.Duration(cfg.NpmVersionTTL)*time.Second)
+		cache.Set("stale:"+cacheKey, data, staleMetadataTTL)
+	}
+}
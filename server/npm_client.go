@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+// the http clients with the TLS config of the registries, mapped by the registry url and the certificate files
+var registryClients sync.Map
+
+type registryClient struct {
+	client *http.Client
+	// the latest modification time of the certificate files
+	modTime time.Time
+}
+
+// getNpmRegistryClient returns the http client to request the registry. The client of the registry
+// with the client certificate or the CA file is recreated when the files are changed, so the
+// rotated certificates are used without restarting the server.
+func getNpmRegistryClient(registry config.NpmRegistry) (*http.Client, error) {
+	timeout := time.Duration(registry.Timeout) * time.Second
+	if registry.CertFile == "" && registry.CAFile == "" {
+		return withClientTimeout(httpClient, timeout), nil
+	}
+
+	var modTime time.Time
+	for _, filename := range []string{registry.CertFile, registry.KeyFile, registry.CAFile} {
+		if filename == "" {
+			continue
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+
+	key := fmt.Sprintf("%s|%s|%s|%s", registry.Registry, registry.CertFile, registry.KeyFile, registry.CAFile)
+	prev, ok := registryClients.Load(key)
+	if ok && prev.(*registryClient).modTime.Equal(modTime) {
+		return withClientTimeout(prev.(*registryClient).client, timeout), nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if registry.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(registry.CertFile, registry.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate of %s: %v", registry.Registry, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if registry.CAFile != "" {
+		pem, err := os.ReadFile(registry.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no CA certificates found in " + registry.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := httpClient.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{Transport: transport}
+	registryClients.Store(key, &registryClient{client: client, modTime: modTime})
+	if ok {
+		// close the connections with the old certificates
+		prev.(*registryClient).client.CloseIdleConnections()
+	}
+	return withClientTimeout(client, timeout), nil
+}
+
+func withClientTimeout(client *http.Client, timeout time.Duration) *http.Client {
+	if timeout > 0 {
+		return &http.Client{Transport: client.Transport, Timeout: timeout}
+	}
+	return client
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestNpmRegistryClient(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCert(t, nil, nil, "test-ca")
+	writeTestCert(t, path.Join(dir, "ca.pem"), ca, nil)
+	serverCert, serverKey := newTestCert(t, ca, caKey, "127.0.0.1")
+	clientCert, clientKey := newTestCert(t, ca, caKey, "client-1")
+	writeTestCert(t, path.Join(dir, "client.pem"), clientCert, nil)
+	writeTestCert(t, path.Join(dir, "client.key"), nil, clientKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	registry := config.NpmRegistry{
+		Registry: ts.URL + "/",
+		CertFile: path.Join(dir, "client.pem"),
+		KeyFile:  path.Join(dir, "client.key"),
+		CAFile:   path.Join(dir, "ca.pem"),
+	}
+	expectClient := func(cn string) {
+		client, err := getNpmRegistryClient(registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		buf := make([]byte, 64)
+		n, _ := res.Body.Read(buf)
+		if string(buf[:n]) != cn {
+			t.Fatalf("expected client certificate %s, got %s", cn, string(buf[:n]))
+		}
+	}
+	expectClient("client-1")
+
+	// rotate the client certificate
+	clientCert, clientKey = newTestCert(t, ca, caKey, "client-2")
+	writeTestCert(t, path.Join(dir, "client.pem"), clientCert, nil)
+	writeTestCert(t, path.Join(dir, "client.key"), nil, clientKey)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path.Join(dir, "client.pem"), future, future)
+	expectClient("client-2")
+
+	// the registry without the certificate files uses the shared client
+	if client, _ := getNpmRegistryClient(config.NpmRegistry{Registry: "https://registry.npmjs.org/"}); client != httpClient {
+		t.Fatal("should use the shared http client")
+	}
+}
+
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+	signer := key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+	} else {
+		signer = parentKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writeTestCert(t *testing.T, filename string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	var block *pem.Block
+	if cert != nil {
+		block = &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}
+	} else {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	}
+	if err := os.WriteFile(filename, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,430 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestNpmPackageSideEffects(t *testing.T) {
+	cases := []struct {
+		sideEffects interface{}
+		expected    bool
+	}{
+		{nil, true},
+		{false, false},
+		{"false", false},
+		{true, true},
+		{[]interface{}{"*.css"}, false},
+		{[]interface{}{"*.css", "./src/polyfill.js"}, true},
+	}
+	for _, c := range cases {
+		p := (&NpmPackageTemp{Name: "foo", SideEffects: c.sideEffects}).ToNpmPackage()
+		if p.SideEffects != c.expected {
+			t.Fatalf("sideEffects %v: expected %v, got %v", c.sideEffects, c.expected, p.SideEffects)
+		}
+	}
+}
+
+func TestTypesOverride(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{TypesOverrides: map[string]string{
+		"react":          "@types/react@18.0.0",
+		"react@18":       "@types/react@18.2.14",
+		"@scope/foo@^1":  "@types/scope__foo",
+		"bar@invalid!!!": "@types/bar@1.0.0",
+	}}
+	if err := checkTypesOverrides(cfg.TypesOverrides); err == nil {
+		t.Fatal("should fail on the invalid version range")
+	}
+	delete(cfg.TypesOverrides, "bar@invalid!!!")
+	if err := checkTypesOverrides(cfg.TypesOverrides); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		version string
+		types   string
+	}{
+		{"react", "18.2.0", "@types/react@18.2.14"},
+		{"react", "17.0.2", "@types/react@18.0.0"},
+		{"@scope/foo", "1.2.3", "@types/scope__foo@latest"},
+		{"@scope/foo", "2.0.0", ""},
+		{"vue", "3.0.0", ""},
+	} {
+		name, version, ok := getTypesOverride(c.name, c.version)
+		types := ""
+		if ok {
+			types = name + "@" + version
+		}
+		if types != c.types {
+			t.Fatalf("invalid types override of %s@%s: expected '%s', got '%s'", c.name, c.version, c.types, types)
+		}
+	}
+}
+
+func TestNpmRegistries(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		NpmRegistry: "https://registry.npmjs.org/",
+		NpmRegistries: map[string]config.NpmRegistry{
+			"@myco": {Registry: "https://npm.myco.internal/", Token: "secret-token"},
+			"@acme": {Registry: "https://npm.acme.internal/", User: "bot", Password: "secret-password"},
+			"@corp": {Registry: "https://artifactory.corp.internal/", Auth: "Ym90OnNlY3JldA==", CertFile: "/etc/esm/client.pem", KeyFile: "/etc/esm/client.key", CAFile: "/etc/esm/ca.pem"},
+		},
+	}
+
+	if r := getNpmRegistry("@myco/ui"); r.Registry != "https://npm.myco.internal/" || r.Token != "secret-token" {
+		t.Fatalf("unexpected registry of '@myco/ui': %s", r.Registry)
+	}
+	if r := getNpmRegistry("react"); r.Registry != "https://registry.npmjs.org/" || r.Token != "" {
+		t.Fatalf("unexpected registry of 'react': %s", r.Registry)
+	}
+	if r := getNpmRegistry("@jsr/std__path"); r.Registry != jsrNpmRegistry {
+		t.Fatalf("unexpected registry of '@jsr/std__path': %s", r.Registry)
+	}
+
+	npmrc := string(getNpmrc())
+	for _, s := range []string{
+		"ignore-scripts=true\n",
+		"@jsr:registry=https://npm.jsr.io/\n",
+		"@acme:registry=https://npm.acme.internal/\n",
+		"//npm.acme.internal/:username=${ESM_NPM_USER_0}\n",
+		"//npm.acme.internal/:_password=${ESM_NPM_PASSWORD_0}\n",
+		"@corp:registry=https://artifactory.corp.internal/\n",
+		"//artifactory.corp.internal/:_auth=${ESM_NPM_AUTH_1}\n",
+		"//artifactory.corp.internal/:certfile=/etc/esm/client.pem\n",
+		"//artifactory.corp.internal/:keyfile=/etc/esm/client.key\n",
+		"//artifactory.corp.internal/:cafile=/etc/esm/ca.pem\n",
+		"@myco:registry=https://npm.myco.internal/\n",
+		"//npm.myco.internal/:_authToken=${ESM_NPM_TOKEN_2}\n",
+	} {
+		if !strings.Contains(npmrc, s) {
+			t.Fatalf("expected %q in .npmrc:\n%s", s, npmrc)
+		}
+	}
+	if strings.Contains(npmrc, "secret") || strings.Contains(npmrc, "Ym90OnNlY3JldA==") {
+		t.Fatalf("credentials leaked into .npmrc:\n%s", npmrc)
+	}
+
+	env := strings.Join(getNpmAuthEnv(), "\n")
+	for _, s := range []string{
+		"ESM_NPM_USER_0=bot",
+		"ESM_NPM_PASSWORD_0=c2VjcmV0LXBhc3N3b3Jk",
+		"ESM_NPM_AUTH_1=Ym90OnNlY3JldA==",
+		"ESM_NPM_TOKEN_2=secret-token",
+	} {
+		if !strings.Contains(env, s) {
+			t.Fatalf("expected %q in env:\n%s", s, env)
+		}
+	}
+
+	header := http.Header{}
+	setNpmRegistryAuth(header, cfg.NpmRegistries["@corp"])
+	if header.Get("Authorization") != "Basic Ym90OnNlY3JldA==" {
+		t.Fatalf("unexpected authorization header: %s", header.Get("Authorization"))
+	}
+
+	// the credentials of `npmRegistry` are not sent to the public registry
+	cfg.NpmToken = "secret-token"
+	cfg.NpmRegistry = "https://npm.internal/"
+	cfg.NpmRegistryScope = "@internal"
+	if r := getNpmRegistry("react"); r.Registry != "https://registry.npmjs.org/" || r.Token != "" {
+		t.Fatalf("unexpected registry of 'react': %s", r.Registry)
+	}
+}
+
+func TestResolveNpmAlias(t *testing.T) {
+	cases := [][4]string{
+		{"foo", "^1.0.0", "foo", "^1.0.0"},
+		{"foo", "npm:bar@^2", "bar", "^2"},
+		{"foo", "npm:bar", "bar", "latest"},
+		{"foo", "npm:@scope/bar@2.1.0", "@scope/bar", "2.1.0"},
+		{"foo", "npm:@scope/bar", "@scope/bar", "latest"},
+	}
+	for _, c := range cases {
+		name, version := resolveNpmAlias(c[0], c[1])
+		if name != c[2] || version != c[3] {
+			t.Fatalf("resolveNpmAlias(%s, %s): expected %s@%s, got %s@%s", c[0], c[1], c[2], c[3], name, version)
+		}
+	}
+}
+
+func TestFixWorkspaceRange(t *testing.T) {
+	cases := map[string]string{
+		"^1.0.0":           "^1.0.0",
+		"workspace:*":      "latest",
+		"workspace:^":      "latest",
+		"workspace:~":      "latest",
+		"workspace:^1.2.0": "^1.2.0",
+		"workspace:1.2.0":  "1.2.0",
+	}
+	for version, expected := range cases {
+		if v := fixWorkspaceRange(version); v != expected {
+			t.Fatalf("fixWorkspaceRange(%s): expected %s, got %s", version, expected, v)
+		}
+	}
+}
+
+func TestNpmRegistryFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer down.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/foo/1.0.0" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"name":"foo","version":"1.0.0","main":"index.js"}`))
+	}))
+	defer mirror.Close()
+
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		NpmRegistry:        down.URL + "/",
+		NpmRegistryMirrors: []config.NpmRegistry{{Registry: mirror.URL + "/", Timeout: 5}},
+	}
+	defer unhealthyRegistries.Delete(down.URL + "/")
+
+	info, err := fetchPackageInfo("foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "foo" || info.Version != "1.0.0" {
+		t.Fatalf("unexpected package info: %s@%s", info.Name, info.Version)
+	}
+
+	// the failed registry is moved to the end of the list
+	registries := getNpmRegistries("foo")
+	if len(registries) != 2 || registries[0].Registry != mirror.URL+"/" {
+		t.Fatalf("unexpected registries: %v", registries)
+	}
+	if args := getPnpmRegistryArgs("foo", 0); len(args) != 2 || args[1] != mirror.URL+"/" {
+		t.Fatalf("unexpected pnpm registry args: %v", args)
+	}
+}
+
+func TestVerifyPackageIntegrity(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo/1.0.0":
+			w.Write([]byte(`{"name":"foo","version":"1.0.0","dist":{"integrity":"sha512-abc=="}}`))
+		case "/bar/1.0.0":
+			w.Write([]byte(`{"name":"bar","version":"1.0.0","dist":{"shasum":"0a0b"}}`))
+		case "/baz/1.0.0":
+			w.Write([]byte(`{"name":"baz","version":"1.0.0","dist":{"shasum":"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer registry.Close()
+
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{NpmRegistry: registry.URL + "/"}
+
+	wd := t.TempDir()
+	lockfile := `lockfileVersion: '6.0'
+
+packages:
+
+  /foo@1.0.0:
+    resolution: {integrity: sha512-abc==}
+    dev: false
+
+  /bar@1.0.0(react@18.2.0):
+    resolution: {integrity: sha1-CgA=}
+    dev: false
+`
+	if err := os.WriteFile(path.Join(wd, "pnpm-lock.yaml"), []byte(lockfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if integrity, ok := findLockfileIntegrity([]byte(lockfile), "bar", "1.0.0"); !ok || integrity != "sha1-CgA=" {
+		t.Fatalf("unexpected integrity of bar: %s", integrity)
+	}
+	if err := verifyPackageIntegrity(wd, Pkg{Name: "foo", Version: "1.0.0"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	// the shasum `0a0b` is `sha1-Cgs=`, but the lockfile records `sha1-CgA=`
+	if err := verifyPackageIntegrity(wd, Pkg{Name: "bar", Version: "1.0.0"}, ""); err == nil {
+		t.Fatal("integrity of bar should be mismatched")
+	}
+
+	// the packages installed from the tarball are verified by the tarball
+	tarballPath := path.Join(wd, "baz-1.0.0.tgz")
+	if err := os.WriteFile(tarballPath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPackageIntegrity(wd, Pkg{Name: "baz", Version: "1.0.0"}, tarballPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPackageIntegrity(wd, Pkg{Name: "foo", Version: "1.0.0"}, tarballPath); err == nil {
+		t.Fatal("integrity of the foo tarball should be mismatched")
+	}
+}
+
+func TestPackumentCache(t *testing.T) {
+	var requests int
+	latest := "1.0.0"
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/foo" {
+			w.WriteHeader(404)
+			return
+		}
+		requests++
+		fmt.Fprintf(w, `{"dist-tags":{"latest":"%s"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0"},"1.1.0":{"name":"foo","version":"1.1.0"},"2.0.0-beta.1":{"name":"foo","version":"2.0.0-beta.1"}}}`, latest)
+	}))
+	defer registry.Close()
+
+	memCache, err := storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(c storage.Cache) { cache = c }(cache)
+	cache = memCache
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		NpmRegistry:             registry.URL + "/",
+		NpmDistTagsTTL:          60,
+		NpmVersionTTL:           3600,
+		NpmStaleWhileRevalidate: 3600,
+	}
+
+	info, err := fetchPackageInfo("foo", "^1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.1.0" {
+		t.Fatalf("expected foo@1.1.0, got %s", info.Version)
+	}
+	info, err = fetchPackageInfo("foo", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" || requests != 1 {
+		t.Fatalf("expected foo@1.0.0 with 1 request, got %s with %d requests", info.Version, requests)
+	}
+
+	// the expired packument is served while it's being revalidated in background
+	latest = "1.1.0"
+	packument, _, _ := getPackument("foo")
+	packument.FetchedAt -= 120
+	cache.Set("npm-packument:foo", utils.MustEncodeJSON(packument), time.Hour)
+	info, err = fetchPackageInfo("foo", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" {
+		t.Fatalf("expected the stale foo@1.0.0, got %s", info.Version)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := revalidatingPackuments.Load("foo"); !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	info, err = fetchPackageInfo("foo", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.1.0" || requests != 2 {
+		t.Fatalf("expected foo@1.1.0 with 2 requests, got %s with %d requests", info.Version, requests)
+	}
+}
+
+func TestNpmPackageBundleDependencies(t *testing.T) {
+	var p NpmPackage
+	err := json.Unmarshal([]byte(`{"name":"foo","dependencies":{"bar":"1.0.0","baz":"1.0.0"},"bundledDependencies":["bar"]}`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.BundleDependencies) != 1 || p.BundleDependencies[0] != "bar" {
+		t.Fatalf("unexpected bundleDependencies: %v", p.BundleDependencies)
+	}
+
+	err = json.Unmarshal([]byte(`{"name":"foo","dependencies":{"bar":"1.0.0","baz":"1.0.0"},"bundleDependencies":true}`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.BundleDependencies) != 2 {
+		t.Fatalf("unexpected bundleDependencies: %v", p.BundleDependencies)
+	}
+
+	// the field is kept in the cache
+	var cached NpmPackage
+	if err = json.Unmarshal(utils.MustEncodeJSON(p), &cached); err != nil {
+		t.Fatal(err)
+	}
+	if len(cached.BundleDependencies) != 2 {
+		t.Fatalf("unexpected bundleDependencies of the cached package: %v", cached.BundleDependencies)
+	}
+}
+
+func TestPackumentResolvePrerelease(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{}
+	packument := &npmPackument{
+		DistTags: map[string]string{"latest": "18.2.0", "next": "19.0.0-rc.1"},
+		Versions: []string{"18.2.0", "18.3.0-canary.1", "19.0.0-beta.1", "19.0.0-rc.1"},
+	}
+	cases := []struct {
+		version    string
+		prerelease bool
+		expected   string
+	}{
+		{"^18.0.0", false, "18.2.0"},
+		{"^18.0.0", true, "18.3.0-canary.1"},
+		{"^19.0.0", false, ""},
+		{"^19.0.0", true, "19.0.0-rc.1"},
+		{"19.0.0-beta.1", false, "19.0.0-beta.1"},
+		{"next", false, "19.0.0-rc.1"},
+		{"latest", true, "18.2.0"},
+	}
+	for _, c := range cases {
+		resolved, ok := packument.resolve(c.version, c.prerelease)
+		if resolved != c.expected || ok != (c.expected != "") {
+			t.Fatalf("resolve(%s, %v): expected %q, got %q", c.version, c.prerelease, c.expected, resolved)
+		}
+	}
+}
+
+func TestPackumentResolveDeprecated(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{}
+	packument := &npmPackument{
+		DistTags:   map[string]string{"latest": "1.2.0"},
+		Versions:   []string{"1.0.0", "1.1.0", "1.2.0", "2.0.0"},
+		Deprecated: []string{"1.2.0", "2.0.0"},
+	}
+	if v, _ := packument.resolve("^1.0.0", false); v != "1.2.0" {
+		t.Fatalf("expected 1.2.0, got %s", v)
+	}
+
+	// the strict mode falls back to the newest non-deprecated version
+	cfg.NpmRejectDeprecated = true
+	if v, _ := packument.resolve("^1.0.0", false); v != "1.1.0" {
+		t.Fatalf("expected 1.1.0, got %s", v)
+	}
+	if _, ok := packument.resolve("^2.0.0", false); ok {
+		t.Fatal("should refuse the deprecated 2.0.0")
+	}
+	// the dist-tags are resolved as usual
+	if v, _ := packument.resolve("latest", false); v != "1.2.0" {
+		t.Fatalf("expected 1.2.0, got %s", v)
+	}
+
+	if s := toHeaderValue("this version is deprecated,\nplease upgrade\r\n"); s != "this version is deprecated, please upgrade" {
+		t.Fatalf("unexpected header value: %q", s)
+	}
+}
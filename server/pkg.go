@@ -18,7 +18,19 @@ type Pkg struct {
 	FromEsmsh  bool   `json:"fromEsmsh"`
 }
 
+// PkgResolveOptions controls the version resolution of the package path.
+type PkgResolveOptions struct {
+	// Tag is the dist-tag used for the path without a version, e.g. "next".
+	Tag string
+	// Prerelease resolves the version ranges to the pre-release versions.
+	Prerelease bool
+}
+
 func validatePkgPath(pathname string) (pkg Pkg, query string, err error) {
+	return validatePkgPathWithOptions(pathname, PkgResolveOptions{})
+}
+
+func validatePkgPathWithOptions(pathname string, options PkgResolveOptions) (pkg Pkg, query string, err error) {
 	fromGithub := strings.HasPrefix(pathname, "/gh/") && strings.Count(pathname, "/") >= 3
 	if fromGithub {
 		pathname = "/@" + pathname[4:]
@@ -39,6 +51,9 @@ func validatePkgPath(pathname string) (pkg Pkg, query string, err error) {
 	if v, e := url.QueryUnescape(version); e == nil {
 		version = v
 	}
+	if version == "" && options.Tag != "" && !fromGithub {
+		version = options.Tag
+	}
 
 	pkg = Pkg{
 		Name:       name,
@@ -98,6 +113,12 @@ func validatePkgPath(pathname string) (pkg Pkg, query string, err error) {
 		return
 	}
 
+	if options.Prerelease {
+		if v, e := resolvePrereleaseVersion(name, version); e == nil {
+			version = v
+		}
+	}
+
 	p, _, err := getPackageInfo("", name, version)
 	if err == nil {
 		pkg.Version = p.Version
@@ -105,6 +126,23 @@ func validatePkgPath(pathname string) (pkg Pkg, query string, err error) {
 	return
 }
 
+// toJSRNpmPath converts the `/jsr/@scope/pkg@version/subpath` path to the path of the package
+// in the npm compatibility registry of JSR, e.g. `/@jsr/scope__pkg@version/subpath`.
+func toJSRNpmPath(pathname string) (string, bool) {
+	if !strings.HasPrefix(pathname, "/jsr/@") {
+		return pathname, false
+	}
+	segments := strings.SplitN(pathname[6:], "/", 3)
+	if len(segments) < 2 || segments[0] == "" || segments[1] == "" {
+		return pathname, false
+	}
+	npmPath := "/@jsr/" + segments[0] + "__" + segments[1]
+	if len(segments) == 3 {
+		npmPath += "/" + segments[2]
+	}
+	return npmPath, true
+}
+
 func (pkg Pkg) Equels(other Pkg) bool {
 	return pkg.Name == other.Name && pkg.Version == other.Version && pkg.Submodule == other.Submodule
 }
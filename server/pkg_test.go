@@ -49,3 +49,23 @@ func TestPkgPath(t *testing.T) {
 		t.Fatalf("invalid pkg('%v'), should be '@types/react@%s'", pkg, fixedPkgVersions["@types/react@18"])
 	}
 }
+
+func TestToJSRNpmPath(t *testing.T) {
+	cases := map[string]string{
+		"/jsr/@std/encoding":              "/@jsr/std__encoding",
+		"/jsr/@std/encoding@0.224.0":      "/@jsr/std__encoding@0.224.0",
+		"/jsr/@std/encoding@0.224.0/hex":  "/@jsr/std__encoding@0.224.0/hex",
+		"/jsr/@std/path@^1.0.0&dev/posix": "/@jsr/std__path@^1.0.0&dev/posix",
+	}
+	for pathname, expected := range cases {
+		p, ok := toJSRNpmPath(pathname)
+		if !ok || p != expected {
+			t.Fatalf("toJSRNpmPath(%s): expected %s, got %s", pathname, expected, p)
+		}
+	}
+	for _, pathname := range []string{"/jsr/@std", "/jsr/std/path", "/react"} {
+		if _, ok := toJSRNpmPath(pathname); ok {
+			t.Fatalf("toJSRNpmPath(%s): should not be converted", pathname)
+		}
+	}
+}
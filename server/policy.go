@@ -0,0 +1,258 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+// PolicyViolation describes the policy rule that denies a package.
+type PolicyViolation struct {
+	Package string `json:"package"`
+	Version string `json:"version,omitempty"`
+	License string `json:"license,omitempty"`
+	// Policy is one of "deny", "allow", "denyLicenses", "allowLicenses", "denyInstallScripts" and
+	// "advisories".
+	Policy string `json:"policy"`
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (v *PolicyViolation) Error() string {
+	message := fmt.Sprintf("package %s is denied by the %s policy", v.Package, v.Policy)
+	if v.Rule != "" {
+		message += fmt.Sprintf(" (%s)", v.Rule)
+	}
+	if v.Reason != "" {
+		message += ": " + v.Reason
+	}
+	return message
+}
+
+// checkPackagePolicy checks the package against the `policy` config, returns nil if the package
+// is allowed. The version range rules are checked only if the version is exact, and the license
+// rules are checked only if the license is known (`checkLicense` is true).
+func checkPackagePolicy(policy *config.PackagePolicy, name string, version string, license string, checkLicense bool) *PolicyViolation {
+	violation := &PolicyViolation{Package: name, Version: version}
+	for _, rule := range policy.Deny {
+		if matchPolicyRule(rule, name, version) {
+			violation.Policy = "deny"
+			violation.Rule = policyRuleString(rule)
+			violation.Reason = rule.Reason
+			return violation
+		}
+	}
+	if len(policy.Allow) > 0 {
+		allowed := false
+		for _, rule := range policy.Allow {
+			if matchPolicyRule(rule, name, version) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violation.Policy = "allow"
+			violation.Reason = "the package is not in the allow list"
+			return violation
+		}
+	}
+	if !checkLicense {
+		return nil
+	}
+	violation.License = license
+	alternatives := parseLicenseExpression(license)
+	if len(policy.DenyLicenses) > 0 && len(alternatives) > 0 {
+		// the package is denied if all the alternatives of the `OR` expression are denied, an
+		// alternative is denied if any license of the `AND` expression is denied
+		denied := true
+		for _, ids := range alternatives {
+			if !matchAnyLicense(policy.DenyLicenses, ids) {
+				denied = false
+				break
+			}
+		}
+		if denied {
+			violation.Policy = "denyLicenses"
+			violation.Reason = fmt.Sprintf("the license %s is denied", license)
+			return violation
+		}
+	}
+	if len(policy.AllowLicenses) > 0 {
+		for _, ids := range alternatives {
+			allowed := true
+			for _, id := range ids {
+				if !matchLicense(policy.AllowLicenses, id) {
+					allowed = false
+					break
+				}
+			}
+			if allowed {
+				return nil
+			}
+		}
+		violation.Policy = "allowLicenses"
+		if license == "" {
+			violation.Reason = "the package has no license"
+		} else {
+			violation.Reason = fmt.Sprintf("the license %s is not allowed", license)
+		}
+		return violation
+	}
+	return nil
+}
+
+func matchPolicyRule(rule config.PolicyRule, name string, version string) bool {
+	if rule.Package != name {
+		if ok, _ := path.Match(rule.Package, name); !ok {
+			return false
+		}
+	}
+	if rule.Version == "" {
+		return true
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		// the version is not resolved yet, e.g. a github ref
+		return false
+	}
+	c, err := semver.NewConstraint(rule.Version)
+	if err != nil {
+		return false
+	}
+	return c.Check(v)
+}
+
+func policyRuleString(rule config.PolicyRule) string {
+	if rule.Version != "" {
+		return rule.Package + "@" + rule.Version
+	}
+	return rule.Package
+}
+
+// the license groups that can be used in the `allowLicenses` and `denyLicenses` lists
+var licenseGroups = map[string][]string{
+	// the strong and the network copyleft licenses, the derived works must be released under the
+	// same license
+	"copyleft": {"GPL-*", "AGPL-*", "SSPL-*", "EUPL-*", "OSL-*", "RPL-*", "CC-BY-SA-*", "CC-BY-NC-SA-*", "Sleepycat"},
+	// the file-level or library-level copyleft licenses
+	"weak-copyleft": {"LGPL-*", "MPL-*", "EPL-*", "CDDL-*", "CPL-*", "MS-RL"},
+}
+
+// matchLicense checks whether the SPDX license identifier matches any of the patterns, the
+// patterns are case-insensitive and can be a glob pattern (e.g. "GPL-*") or a license group.
+func matchLicense(patterns []string, id string) bool {
+	id = strings.ToLower(id)
+	for _, pattern := range patterns {
+		if group, ok := licenseGroups[strings.ToLower(pattern)]; ok {
+			if matchLicense(group, id) {
+				return true
+			}
+			continue
+		}
+		pattern = strings.ToLower(pattern)
+		if pattern == id {
+			return true
+		}
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyLicense(patterns []string, ids []string) bool {
+	for _, id := range ids {
+		if matchLicense(patterns, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLicenseExpression returns the alternatives of a SPDX license expression, each alternative
+// is the licenses that apply together, e.g. "(MIT OR Apache-2.0) AND BSD-3-Clause" ->
+// [["MIT", "BSD-3-Clause"], ["Apache-2.0", "BSD-3-Clause"]]. The exceptions of the `WITH`
+// operator are ignored.
+func parseLicenseExpression(license string) [][]string {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(license))
+	if len(tokens) == 0 {
+		return nil
+	}
+	p := &licenseParser{tokens: tokens}
+	alternatives := p.parseOr()
+	for p.pos < len(p.tokens) {
+		// the unbalanced parentheses, take the rest as the alternatives
+		p.pos++
+		alternatives = append(alternatives, p.parseOr()...)
+	}
+	ret := make([][]string, 0, len(alternatives))
+	for _, ids := range alternatives {
+		if len(ids) > 0 {
+			ret = append(ret, ids)
+		}
+	}
+	return ret
+}
+
+type licenseParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *licenseParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *licenseParser) parseOr() [][]string {
+	alternatives := p.parseAnd()
+	for strings.EqualFold(p.peek(), "OR") {
+		p.pos++
+		alternatives = append(alternatives, p.parseAnd()...)
+	}
+	return alternatives
+}
+
+func (p *licenseParser) parseAnd() [][]string {
+	alternatives := p.parseAtom()
+	for strings.EqualFold(p.peek(), "AND") {
+		p.pos++
+		right := p.parseAtom()
+		product := make([][]string, 0, len(alternatives)*len(right))
+		for _, a := range alternatives {
+			for _, b := range right {
+				product = append(product, append(append([]string{}, a...), b...))
+			}
+		}
+		alternatives = product
+	}
+	return alternatives
+}
+
+func (p *licenseParser) parseAtom() [][]string {
+	token := p.peek()
+	switch {
+	case token == "":
+		return [][]string{{}}
+	case token == "(":
+		p.pos++
+		alternatives := p.parseOr()
+		if p.peek() == ")" {
+			p.pos++
+		}
+		return alternatives
+	case token == ")" || strings.EqualFold(token, "AND") || strings.EqualFold(token, "OR"):
+		// an operator without the operand
+		return [][]string{{}}
+	}
+	p.pos++
+	if strings.EqualFold(p.peek(), "WITH") {
+		p.pos += 2
+	}
+	return [][]string{{token}}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestCheckPackagePolicy(t *testing.T) {
+	var policy config.PackagePolicy
+	err := json.Unmarshal([]byte(`{
+		"deny": [
+			"reactt",
+			"lodash@<4.17.21",
+			{ "package": "@evil/*", "reason": "known malicious scope" }
+		],
+		"allow": ["react", "react-*", "lodash", "@evil/*", "@types/*"],
+		"allowLicenses": ["MIT", "Apache-2.0"],
+		"denyLicenses": ["GPL-3.0", "copyleft"]
+	}`), &policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		version string
+		license string
+		policy  string
+	}{
+		{"react", "18.2.0", "MIT", ""},
+		{"react-dom", "18.2.0", "mit", ""},
+		{"reactt", "1.0.0", "MIT", "deny"},
+		{"lodash", "4.17.20", "MIT", "deny"},
+		{"lodash", "4.17.21", "MIT", ""},
+		{"@evil/pkg", "1.0.0", "MIT", "deny"},
+		{"vue", "3.0.0", "MIT", "allow"},
+		{"react-foo", "1.0.0", "", "allowLicenses"},
+		{"react-foo", "1.0.0", "UNLICENSED", "allowLicenses"},
+		{"react-foo", "1.0.0", "(GPL-3.0 OR MIT)", ""},
+		{"react-foo", "1.0.0", "GPL-3.0", "denyLicenses"},
+		{"react-foo", "1.0.0", "AGPL-3.0-only", "denyLicenses"},
+		{"react-foo", "1.0.0", "GPL-2.0-only WITH Classpath-exception-2.0", "denyLicenses"},
+		{"react-foo", "1.0.0", "MIT AND GPL-3.0", "denyLicenses"},
+		{"react-foo", "1.0.0", "MIT AND BSD-3-Clause", "allowLicenses"},
+		{"react-foo", "1.0.0", "(MIT OR GPL-3.0) AND Apache-2.0", ""},
+		{"react-foo", "1.0.0", "LGPL-3.0", "allowLicenses"},
+	}
+	for _, c := range cases {
+		v := checkPackagePolicy(&policy, c.name, c.version, c.license, true)
+		if c.policy == "" && v != nil {
+			t.Fatalf("%s@%s (%s) should be allowed: %v", c.name, c.version, c.license, v)
+		}
+		if c.policy != "" && (v == nil || v.Policy != c.policy) {
+			t.Fatalf("%s@%s (%s) should be denied by the %s policy, got %v", c.name, c.version, c.license, c.policy, v)
+		}
+	}
+
+	v := checkPackagePolicy(&policy, "@evil/pkg", "1.0.0", "", false)
+	if v == nil || v.Rule != "@evil/*" || v.Reason != "known malicious scope" {
+		t.Fatalf("unexpected violation: %v", v)
+	}
+	if v.Error() != "package @evil/pkg is denied by the deny policy (@evil/*): known malicious scope" {
+		t.Fatalf("unexpected error message: %s", v.Error())
+	}
+	// the license is not checked for the github packages
+	if v := checkPackagePolicy(&policy, "react-foo", "abcdef1234", "", false); v != nil {
+		t.Fatalf("unexpected violation: %v", v)
+	}
+}
+
+func TestNpmPackageLicense(t *testing.T) {
+	for data, expected := range map[string]string{
+		`{"license": "MIT"}`:                                      "MIT",
+		`{"license": {"type": "ISC"}}`:                            "ISC",
+		`{"licenses": [{"type": "MIT"}, {"type": "Apache-2.0"}]}`: "MIT OR Apache-2.0",
+		`{}`: "",
+	} {
+		var p NpmPackageTemp
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			t.Fatal(err)
+		}
+		if license := p.ToNpmPackage().License; license != expected {
+			t.Fatalf("expected license %q of %s, got %q", expected, data, license)
+		}
+	}
+}
+
+func TestParseLicenseExpression(t *testing.T) {
+	for expr, expected := range map[string]string{
+		"MIT":                                       "MIT",
+		"(MIT OR Apache-2.0)":                       "MIT | Apache-2.0",
+		"(MIT OR Apache-2.0) AND BSD-3-Clause":      "MIT+BSD-3-Clause | Apache-2.0+BSD-3-Clause",
+		"MIT and (GPL-2.0+ or LGPL-3.0)":            "MIT+GPL-2.0+ | MIT+LGPL-3.0",
+		"GPL-2.0-only WITH Classpath-exception-2.0": "GPL-2.0-only",
+		"(MIT OR ":                                  "MIT",
+		"":                                          "",
+	} {
+		alternatives := []string{}
+		for _, ids := range parseLicenseExpression(expr) {
+			alternatives = append(alternatives, strings.Join(ids, "+"))
+		}
+		if ret := strings.Join(alternatives, " | "); ret != expected {
+			t.Fatalf("parseLicenseExpression(%q): expected %q, got %q", expr, expected, ret)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// the max number of the specifiers of a prebuild request
+const maxPrebuildSpecifiers = 1000
+
+// PrebuildInput is the input of the prebuild API and the `prebuildFile` config, e.g.
+// `{"packages": ["react@18", "react-dom@18/client"], "targets": ["es2022", "deno"]}`.
+type PrebuildInput struct {
+	Packages []string `json:"packages"`
+	Targets  []string `json:"targets,omitempty"`
+}
+
+// PrebuildResult is the result of the prebuild API.
+type PrebuildResult struct {
+	Queued []string          `json:"queued"`
+	Built  []string          `json:"built"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+func (input *PrebuildInput) validate() error {
+	if len(input.Packages) == 0 {
+		return errors.New("packages is required")
+	}
+	if len(input.Packages) > maxPrebuildSpecifiers {
+		return fmt.Errorf("too many packages, the max is %d", maxPrebuildSpecifiers)
+	}
+	if len(input.Targets) == 0 {
+		input.Targets = []string{"es2022"}
+	}
+	for _, target := range input.Targets {
+		if !isValidTarget(target) {
+			return fmt.Errorf("invalid target '%s'", target)
+		}
+	}
+	return nil
+}
+
+// prebuild adds the build tasks of the packages to the build queue, the tasks are built in
+// the background.
+func prebuild(input PrebuildInput, cdnOrigin string) (*PrebuildResult, error) {
+	if err := input.validate(); err != nil {
+		return nil, err
+	}
+	result := &PrebuildResult{Queued: []string{}, Built: []string{}}
+	for _, specifier := range input.Packages {
+		pkg, _, err := validatePkgPath("/" + strings.TrimPrefix(strings.TrimSpace(specifier), "/"))
+		if err == nil && pkg.FromEsmsh {
+			err = errors.New("unsupported package")
+		}
+		if err == nil && !cfg.Policy.IsEmpty() {
+			if v := checkPackagePolicy(&cfg.Policy, pkg.Name, pkg.Version, "", false); v != nil {
+				err = v
+			}
+		}
+		if err != nil {
+			if result.Errors == nil {
+				result.Errors = map[string]string{}
+			}
+			result.Errors[specifier] = err.Error()
+			continue
+		}
+		for _, target := range input.Targets {
+			task := &BuildTask{
+				Args: BuildArgs{
+					alias:      map[string]string{},
+					deps:       PkgSlice{},
+					external:   newStringSet(),
+					exports:    newStringSet(),
+					conditions: newStringSet(),
+				},
+				CdnOrigin:    cdnOrigin,
+				BuildVersion: VERSION,
+				Pkg:          pkg,
+				Target:       target,
+			}
+			if _, ok := queryESMBuild(task.ID()); ok {
+				result.Built = append(result.Built, task.ID())
+				continue
+			}
+			task.trigger = &auditTrigger{Trigger: "prebuild"}
+			buildQueue.Add(task, "")
+			result.Queued = append(result.Queued, task.ID())
+		}
+	}
+	return result, nil
+}
+
+// prebuildFromFile prebuilds the packages in the `prebuildFile` config at startup.
+func prebuildFromFile(filename string) {
+	var input PrebuildInput
+	err := utils.ParseJSONFile(filename, &input)
+	if err != nil {
+		log.Component("prebuild").Errorf("prebuild: %v", err)
+		return
+	}
+	result, err := prebuild(input, cfg.CdnOrigin)
+	if err != nil {
+		log.Component("prebuild").Errorf("prebuild: %v", err)
+		return
+	}
+	for specifier, message := range result.Errors {
+		log.Component("prebuild").Warnf("prebuild %s: %s", specifier, message)
+	}
+	log.Component("prebuild").Infof("prebuild: %d queued, %d built", len(result.Queued), len(result.Built))
+}
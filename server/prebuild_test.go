@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestPrebuild(t *testing.T) {
+	dir := t.TempDir()
+	localFS, err := storage.OpenFS("local:" + path.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltDB, err := storage.OpenDB("bolt:" + path.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltDB.Close()
+	defer func(prevFS storage.FileSystem, prevDB storage.DataBase, prevQueue *BuildQueue, prevCfg *config.Config) {
+		fs, db, buildQueue, cfg = prevFS, prevDB, prevQueue, prevCfg
+	}(fs, db, buildQueue, cfg)
+	// the queue without processes keeps the tasks pending
+	fs, db, buildQueue, cfg = localFS, boltDB, newBuildQueue(0), &config.Config{}
+
+	id := fmt.Sprintf("v%d/lodash-es@4.17.21/es2022/lodash-es.mjs", VERSION)
+	fs.WriteFile(path.Join("builds", id), bytes.NewBufferString("export default {}"))
+	db.Put(id, utils.MustEncodeJSON(ESMBuild{HasExportDefault: true}))
+
+	result, err := prebuild(PrebuildInput{
+		Packages: []string{"lodash-es@4.17.21", "nanoid@5.0.4/non-secure", "INVALID NAME"},
+		Targets:  []string{"es2022", "deno"},
+	}, "https://esm.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Built) != 1 || result.Built[0] != id {
+		t.Fatalf("unexpected built modules: %v", result.Built)
+	}
+	if len(result.Queued) != 3 || buildQueue.Len() != 3 {
+		t.Fatalf("unexpected queued modules: %v", result.Queued)
+	}
+	if _, ok := result.Errors["INVALID NAME"]; !ok || len(result.Errors) != 1 {
+		t.Fatalf("unexpected errors: %v", result.Errors)
+	}
+
+	for _, input := range []PrebuildInput{
+		{},
+		{Packages: []string{"lodash-es@4.17.21"}, Targets: []string{"es1999"}},
+	} {
+		if _, err := prebuild(input, "https://esm.sh"); err == nil {
+			t.Fatalf("should fail with the invalid input %+v", input)
+		}
+	}
+}
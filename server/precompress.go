@@ -0,0 +1,31 @@
+package server
+
+import (
+	"bytes"
+
+	"github.com/andybalholm/brotli"
+)
+
+// the brotli quality of the precompressed artifacts, the artifacts are compressed once at build
+// time so the best compression is affordable
+const precompressQuality = brotli.BestCompression
+
+// writePrecompressedVariant writes the brotli-compressed variant (`{savePath}.br`) of the build
+// artifact with the `precompress` config.
+func writePrecompressedVariant(savePath string, data []byte) {
+	// the artifacts are compressed at rest already with the `storageCompression` config
+	if !cfg.Precompress || cfg.StorageCompression != "" || len(data) < 1024 {
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	w := brotli.NewWriterLevel(buf, precompressQuality)
+	if _, err := w.Write(data); err != nil {
+		return
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(data) {
+		return
+	}
+	if _, err := fs.WriteFile(savePath+".br", buf); err != nil {
+		log.Component("storage").Errorf("precompress '%s': %v", savePath, err)
+	}
+}
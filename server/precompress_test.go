@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/rex"
+)
+
+func TestPrecompress(t *testing.T) {
+	localFS, err := storage.OpenFS("local:" + path.Join(t.TempDir(), "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prevFS storage.FileSystem, prevCfg *config.Config) {
+		fs, cfg = prevFS, prevCfg
+	}(fs, cfg)
+	fs, cfg = localFS, &config.Config{Precompress: true}
+
+	savePath := "builds/v135/foo@1.0.0/es2022/foo.mjs"
+	code := []byte(strings.Repeat("export const foo = 'bar';\n", 100))
+	fs.WriteFile(savePath, bytes.NewReader(code))
+	writePrecompressedVariant(savePath, code)
+
+	router := &rex.Router{}
+	router.Use(func(ctx *rex.Context) interface{} {
+		ctx.W.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		return serveStorageFile(ctx, savePath, time.Now().Add(-time.Minute))
+	})
+	for _, acceptEncoding := range []string{"gzip, deflate, br", "gzip"} {
+		req := httptest.NewRequest("GET", "https://esm.sh/foo@1.0.0/es2022/foo.mjs", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var body []byte
+		if acceptEncoding == "gzip" {
+			if rec.Header().Get("Content-Encoding") != "" {
+				t.Fatal("the precompressed variant should not be served")
+			}
+			body = rec.Body.Bytes()
+		} else {
+			if rec.Header().Get("Content-Encoding") != "br" {
+				t.Fatal("the precompressed variant should be served")
+			}
+			body, _ = io.ReadAll(brotli.NewReader(rec.Body))
+		}
+		if !bytes.Equal(body, code) {
+			t.Fatalf("invalid content for %q", acceptEncoding)
+		}
+	}
+}
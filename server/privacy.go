@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// the salt of the hashed client IPs, it's rotated daily and never stored so the hashes can't be
+// linked across the days
+var ipHashSalt struct {
+	lock sync.Mutex
+	day  string
+	salt []byte
+}
+
+func getIPHashSalt(now time.Time) []byte {
+	ipHashSalt.lock.Lock()
+	defer ipHashSalt.lock.Unlock()
+	day := now.UTC().Format("2006-01-02")
+	if ipHashSalt.day != day {
+		salt := make([]byte, 32)
+		rand.Read(salt)
+		ipHashSalt.day = day
+		ipHashSalt.salt = salt
+	}
+	return ipHashSalt.salt
+}
+
+// anonymizeIP anonymizes the client IP by the `logPrivacy` config.
+func anonymizeIP(ip string) string {
+	if cfg == nil || cfg.LogPrivacy.AnonymizeIP == "" || ip == "" {
+		return ip
+	}
+	if cfg.LogPrivacy.AnonymizeIP == "hash" {
+		mac := hmac.New(sha256.New, getIPHashSalt(time.Now()))
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "-"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// anonymizeUserAgent drops the user agent by the `logPrivacy` config, the user agent is only used
+// to resolve the build target.
+func anonymizeUserAgent(ua string) string {
+	if cfg != nil && cfg.LogPrivacy.DropUserAgent {
+		return "-"
+	}
+	return ua
+}
+
+// privacyLogger is the access logger that anonymizes the client IPs and the user agents.
+type privacyLogger struct {
+	rex.Logger
+}
+
+// Printf logs the access record of rex, the arguments are the client IP, the host, the protocol,
+// the method, the request URI, the content length, the referer, the user agent, the status, the
+// written bytes and the duration.
+func (l *privacyLogger) Printf(format string, v ...interface{}) {
+	if len(v) == 11 {
+		if ip, ok := v[0].(string); ok {
+			v[0] = anonymizeIP(ip)
+		}
+		if ua, ok := v[7].(string); ok {
+			v[7] = anonymizeUserAgent(ua)
+		}
+	}
+	l.Logger.Printf(format, v...)
+}
+
+// enforceLogRetention removes the log files that are older than the `retention` days of the
+// `logPrivacy` config, it checks the log directory hourly.
+func enforceLogRetention(dir string, retention int) {
+	for {
+		removeExpiredLogs(dir, time.Now().Add(-time.Duration(retention)*24*time.Hour))
+		time.Sleep(time.Hour)
+	}
+}
+
+func removeExpiredLogs(dir string, before time.Time) (removed int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil || !fi.ModTime().Before(before) {
+			continue
+		}
+		if err = os.Remove(path.Join(dir, entry.Name())); err != nil {
+			log.Warnf("log retention: %v", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Infof("log retention: removed %d log files", removed)
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestLogPrivacy(t *testing.T) {
+	defer func(prev *config.Config) {
+		cfg = prev
+	}(cfg)
+
+	cfg = &config.Config{}
+	if anonymizeIP("203.0.113.7") != "203.0.113.7" || anonymizeUserAgent("Mozilla/5.0") != "Mozilla/5.0" {
+		t.Fatal("the logs should not be anonymized by default")
+	}
+
+	cfg = &config.Config{LogPrivacy: config.LogPrivacy{AnonymizeIP: "truncate", DropUserAgent: true}}
+	for ip, expected := range map[string]string{
+		"203.0.113.7":             "203.0.113.0",
+		"2001:db8:85a3:1:2:3:4:5": "2001:db8:85a3::",
+		"::ffff:203.0.113.7":      "203.0.113.0",
+		"not-an-ip":               "-",
+		"":                        "",
+	} {
+		if v := anonymizeIP(ip); v != expected {
+			t.Fatalf("%s: expected %q, got %q", ip, expected, v)
+		}
+	}
+
+	logger := &testLogger{}
+	access := &privacyLogger{logger}
+	access.Printf(`%s %s %s %s %s %d %s "%s" %d %d %dms`, "203.0.113.7", "esm.sh", "HTTP/1.1", "GET", "/react", 0, "-", "Mozilla/5.0 (Macintosh)", 200, 1024, 12)
+	if len(logger.lines) != 1 || logger.lines[0] != `203.0.113.0 esm.sh HTTP/1.1 GET /react 0 - "-" 200 1024 12ms` {
+		t.Fatalf("unexpected access log: %v", logger.lines)
+	}
+
+	cfg.LogPrivacy.AnonymizeIP = "hash"
+	hashed := anonymizeIP("203.0.113.7")
+	if len(hashed) != 16 || strings.Contains(hashed, "203") || anonymizeIP("203.0.113.7") != hashed || anonymizeIP("203.0.113.8") == hashed {
+		t.Fatalf("unexpected hashed ip %q", hashed)
+	}
+}
+
+func TestRemoveExpiredLogs(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-31 * 24 * time.Hour)
+	for name, modTime := range map[string]time.Time{
+		"access-20240101.log": old,
+		"main-v135.log":       time.Now(),
+		"audit.jsonl":         old,
+	} {
+		filename := path.Join(dir, name)
+		if err := os.WriteFile(filename, []byte("log"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filename, modTime, modTime)
+	}
+	if removed := removeExpiredLogs(dir, time.Now().Add(-30*24*time.Hour)); removed != 1 {
+		t.Fatalf("expected 1 removed, got %d", removed)
+	}
+	if _, err := os.Stat(path.Join(dir, "access-20240101.log")); !os.IsNotExist(err) {
+		t.Fatal("the expired log should be removed")
+	}
+}
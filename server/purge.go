@@ -0,0 +1,338 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+var errPurgeUnsupported = errors.New("the storage does not support purging")
+
+// PurgeQuery matches the packages to purge, either by the package name with an optional
+// version, or by the prefix of `name@version`, e.g. "react@18.2.0", "react" and "@babel/".
+type PurgeQuery struct {
+	Name    string
+	Version string
+	Prefix  string
+}
+
+func (q PurgeQuery) match(pkg string) bool {
+	if pkg == "" {
+		return false
+	}
+	if q.Prefix != "" {
+		return strings.HasPrefix(pkg, q.Prefix)
+	}
+	name, version := splitPkgNameVersion(pkg)
+	return name == q.Name && (q.Version == "" || version == q.Version)
+}
+
+// PurgeResult is the result of the purge API.
+type PurgeResult struct {
+	Packages   []string `json:"packages"`
+	Dependents []string `json:"dependents,omitempty"`
+	Files      int      `json:"files"`
+	Records    int      `json:"records"`
+}
+
+// purgePackages evicts the built modules, the type definitions, the build records and the
+// npm metadata of the matched packages. If `cascade` is true, the builds that import the
+// purged modules are evicted as well.
+func purgePackages(query PurgeQuery, cascade bool) (*PurgeResult, error) {
+	remover, ok := fs.(storage.FileSystemRemover)
+	if !ok {
+		return nil, errPurgeUnsupported
+	}
+	scanner, _ := db.(storage.DataBaseScanner)
+	if cascade && scanner == nil {
+		return nil, errors.New("the database does not support the cascading purge")
+	}
+
+	result := &PurgeResult{Packages: []string{}}
+	purged := map[string]bool{}
+
+	if cfg.StaleIfError > 0 && scanner != nil {
+		// keep the last known good builds in case the rebuilds fail
+		err := scanner.Scan("", func(key string, value []byte) error {
+			if query.match(getBuildIdPackage(key)) {
+				stashStaleBuild(key, value)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := walkPackageDirs(remover, func(dir string, pkg string) error {
+		if query.match(pkg) {
+			n, err := remover.RemoveAll(dir)
+			if err != nil {
+				return err
+			}
+			result.Files += n
+			purged[pkg] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if scanner != nil {
+		ids := []string{}
+		err = scanner.Scan("", func(key string, value []byte) error {
+			if pkg := getBuildIdPackage(key); query.match(pkg) {
+				ids = append(ids, key)
+				purged[pkg] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if db.Delete(id) == nil {
+				result.Records++
+			}
+		}
+		if cascade {
+			err = purgeDependents(remover, scanner, purged, ids, result)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for pkg := range purged {
+		result.Packages = append(result.Packages, pkg)
+		if !strings.HasPrefix(pkg, "gh/") {
+			name, _ := splitPkgNameVersion(pkg)
+			purgeNpmMetadata(name, pkg)
+		}
+		// remove the installed package to make sure it will be re-installed
+		os.RemoveAll(path.Join(cfg.WorkDir, "npm", pkg))
+	}
+	if query.Name != "" && !strings.HasPrefix(query.Name, "gh/") {
+		pkg := ""
+		if query.Version != "" {
+			pkg = query.Name + "@" + query.Version
+		}
+		purgeNpmMetadata(query.Name, pkg)
+	}
+	sort.Strings(result.Packages)
+	collectBlobs()
+	return result, nil
+}
+
+var blobCollectorSignal = make(chan struct{}, 1)
+
+// startBlobCollector starts the collector that removes the unreferenced blobs of the content-addressed
+// storage, the purged or replaced files leave their blobs behind.
+func startBlobCollector() {
+	go func() {
+		for range blobCollectorSignal {
+			removed, err := casFS.CollectGarbage()
+			if err != nil {
+				log.Errorf("storage(cas): failed to collect blobs: %v", err)
+			} else if removed > 0 {
+				log.Infof("storage(cas): %d unreferenced blobs removed", removed)
+			}
+		}
+	}()
+}
+
+// collectBlobs signals the blob collector, the signals are coalesced while a collection is running.
+func collectBlobs() {
+	if casFS == nil {
+		return
+	}
+	select {
+	case blobCollectorSignal <- struct{}{}:
+	default:
+	}
+}
+
+// purgeDependents evicts the builds that import the purged packages recursively.
+func purgeDependents(remover storage.FileSystemRemover, scanner storage.DataBaseScanner, purged map[string]bool, purgedIds []string, result *PurgeResult) error {
+	purgedBuilds := map[string]bool{}
+	for _, id := range purgedIds {
+		purgedBuilds[id] = true
+	}
+	for {
+		dependents := []string{}
+		err := scanner.Scan("", func(key string, value []byte) error {
+			var esm ESMBuild
+			if json.Unmarshal(value, &esm) != nil {
+				return nil
+			}
+			for _, dep := range esm.Deps {
+				if !strings.HasPrefix(dep, "/") {
+					continue
+				}
+				id := strings.TrimPrefix(strings.TrimPrefix(dep, strings.TrimSuffix(cfg.CdnBasePath, "/")), "/")
+				if purgedBuilds[id] || purged[getBuildIdPackage(id)] {
+					dependents = append(dependents, key)
+					stashStaleBuild(key, value)
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(dependents) == 0 {
+			return nil
+		}
+		for _, id := range dependents {
+			savePath := getBuildSavepath(id)
+			for _, name := range []string{savePath, savePath + ".br", savePath + ".map", savePath + ".meta"} {
+				n, err := remover.RemoveAll(name)
+				if err != nil {
+					return err
+				}
+				result.Files += n
+			}
+			if db.Delete(id) == nil {
+				result.Records++
+			}
+			purgedBuilds[id] = true
+			result.Dependents = append(result.Dependents, id)
+		}
+	}
+}
+
+// purgeNpmMetadata deletes the cached npm metadata of the package, the `pkg` is the
+// `name@version` of the package, or an empty string to delete the packument only.
+func purgeNpmMetadata(name string, pkg string) {
+	if cache == nil {
+		return
+	}
+	keys := []string{"npm-packument:" + name}
+	if pkg != "" {
+		keys = append(keys, "npm:"+pkg)
+	}
+	for _, key := range keys {
+		cache.Delete(key)
+		cache.Delete("stale:" + key)
+	}
+}
+
+// walkPackageDirs calls the `fn` with the package directories in the `builds/{v135}/`,
+// `types/{host}/{v135}/` and `types-bundle/{host}/{v135}/` directories.
+func walkPackageDirs(remover storage.FileSystemRemover, fn func(dir string, pkg string) error) error {
+	roots := []string{"builds"}
+	for _, dir := range []string{"types", "types-bundle"} {
+		hosts, err := readSubDirs(remover, dir)
+		if err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			roots = append(roots, path.Join(dir, host))
+		}
+	}
+	for _, root := range roots {
+		versions, err := readSubDirs(remover, root)
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			dir := path.Join(root, v)
+			pkgs, err := readPackageDirs(remover, dir)
+			if err != nil {
+				return err
+			}
+			for _, pkg := range pkgs {
+				if err = fn(path.Join(dir, pkg), pkg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// getBuildIdPackage returns the package of the build id,
+// e.g. "v135/react@18.2.0/es2022/react.mjs" -> "react@18.2.0".
+func getBuildIdPackage(id string) string {
+	segments := strings.Split(id, "/")
+	if len(segments) < 2 {
+		return ""
+	}
+	segments = segments[1:]
+	n := 1
+	if segments[0] == "gh" {
+		n = 3
+	} else if strings.HasPrefix(segments[0], "@") {
+		n = 2
+	}
+	if len(segments) < n || !strings.Contains(segments[n-1], "@") {
+		return ""
+	}
+	return strings.Join(segments[:n], "/")
+}
+
+// readPackageDirs returns the `name@version` directories in the build directory, including the
+// scoped packages and the github packages (`gh/owner/repo@ref`).
+func readPackageDirs(remover storage.FileSystemRemover, dir string) ([]string, error) {
+	names, err := readSubDirs(remover, dir)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []string{}
+	for _, name := range names {
+		depth := 0
+		if name == "gh" {
+			depth = 2
+		} else if strings.HasPrefix(name, "@") {
+			depth = 1
+		} else if strings.Contains(name, "@") {
+			pkgs = append(pkgs, name)
+			continue
+		}
+		prefixes := []string{name}
+		for i := 0; i < depth; i++ {
+			next := []string{}
+			for _, prefix := range prefixes {
+				subNames, err := readSubDirs(remover, path.Join(dir, prefix))
+				if err != nil {
+					return nil, err
+				}
+				for _, subName := range subNames {
+					next = append(next, prefix+"/"+subName)
+				}
+			}
+			prefixes = next
+		}
+		for _, prefix := range prefixes {
+			if strings.Contains(path.Base(prefix), "@") {
+				pkgs = append(pkgs, prefix)
+			}
+		}
+	}
+	return pkgs, nil
+}
+
+// readSubDirs returns the names of the sub-directories, or nil if the directory does not exist.
+func readSubDirs(remover storage.FileSystemRemover, dir string) ([]string, error) {
+	names, err := remover.ReadDir(dir)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	dirs := []string{}
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			dirs = append(dirs, strings.TrimSuffix(name, "/"))
+		}
+	}
+	return dirs, nil
+}
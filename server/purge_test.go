@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestPurgePackages(t *testing.T) {
+	dir := t.TempDir()
+	localFS, err := storage.OpenFS("local:" + path.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltDB, err := storage.OpenDB("bolt:" + path.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltDB.Close()
+	memoryCache, err := storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prevFS storage.FileSystem, prevDB storage.DataBase, prevCache storage.Cache, prevCfg *config.Config) {
+		fs, db, cache, cfg = prevFS, prevDB, prevCache, prevCfg
+	}(fs, db, cache, cfg)
+	fs, db, cache, cfg = localFS, boltDB, memoryCache, &config.Config{WorkDir: dir}
+
+	builds := map[string][]string{
+		"v135/react@18.2.0/es2022/react.mjs":                      nil,
+		"v135/react@18.3.1/es2022/react.mjs":                      nil,
+		"v135/react-dom@18.2.0/es2022/react-dom.mjs":              {"/v135/react@18.2.0/es2022/react.mjs"},
+		"v135/react-dom@18.2.0/es2022/client.js":                  {"/v135/react-dom@18.2.0/es2022/react-dom.mjs"},
+		"v135/@babel/core@7.24.0/es2022/core.mjs":                 nil,
+		"v135/@babel/parser@7.24.0/es2022/parser.mjs":             nil,
+		"v135/gh/microsoft/tslib@2.6.2/es2022/tslib.mjs":          nil,
+		"v135/preact@10.19.0/es2022/preact.mjs":                   nil,
+		"v135/preact@10.19.0/X-ZXJlYWN0/es2022/preact.bundle.mjs": nil,
+	}
+	for id, deps := range builds {
+		fs.WriteFile(path.Join("builds", id), bytes.NewBufferString("export default {}"))
+		db.Put(id, utils.MustEncodeJSON(ESMBuild{Deps: deps}))
+	}
+	fs.WriteFile("types/esm.sh/v135/react@18.2.0/index.d.ts", bytes.NewBufferString("export {}"))
+	fs.WriteFile("types/esm.sh/v135/@types/react@18.2.0/index.d.ts", bytes.NewBufferString("export {}"))
+	cache.Set("npm:react@18.2.0", []byte("{}"), time.Hour)
+	cache.Set("npm-packument:react", []byte("{}"), time.Hour)
+	cache.Set("npm-packument:preact", []byte("{}"), time.Hour)
+
+	expectPurged := func(query PurgeQuery, cascade bool, packages []string, dependents []string) {
+		result, err := purgePackages(query, cascade)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(result.Dependents)
+		if strings.Join(result.Packages, ",") != strings.Join(packages, ",") {
+			t.Fatalf("unexpected purged packages %v, expected %v", result.Packages, packages)
+		}
+		if strings.Join(result.Dependents, ",") != strings.Join(dependents, ",") {
+			t.Fatalf("unexpected purged dependents %v, expected %v", result.Dependents, dependents)
+		}
+	}
+	expectExists := func(name string, exists bool) {
+		_, err := fs.Stat(name)
+		if (err == nil) != exists {
+			t.Fatalf("%s: expected exists=%v, got %v", name, exists, err)
+		}
+	}
+
+	expectPurged(PurgeQuery{Name: "react", Version: "18.2.0"}, true, []string{"react@18.2.0"}, []string{
+		"v135/react-dom@18.2.0/es2022/client.js",
+		"v135/react-dom@18.2.0/es2022/react-dom.mjs",
+	})
+	expectExists("builds/v135/react@18.2.0/es2022/react.mjs", false)
+	expectExists("types/esm.sh/v135/react@18.2.0/index.d.ts", false)
+	expectExists("builds/v135/react-dom@18.2.0/es2022/react-dom.mjs", false)
+	expectExists("builds/v135/react@18.3.1/es2022/react.mjs", true)
+	expectExists("types/esm.sh/v135/@types/react@18.2.0/index.d.ts", true)
+	if _, ok := queryESMBuild("v135/react-dom@18.2.0/es2022/react-dom.mjs"); ok {
+		t.Fatal("the dependent build record should be purged")
+	}
+	for _, key := range []string{"npm:react@18.2.0", "npm-packument:react"} {
+		if _, err := cache.Get(key); err != storage.ErrNotFound {
+			t.Fatalf("the cache %s should be purged", key)
+		}
+	}
+
+	expectPurged(PurgeQuery{Prefix: "@babel/"}, false, []string{"@babel/core@7.24.0", "@babel/parser@7.24.0"}, nil)
+	expectPurged(PurgeQuery{Name: "gh/microsoft/tslib"}, false, []string{"gh/microsoft/tslib@2.6.2"}, nil)
+	expectPurged(PurgeQuery{Name: "preact"}, false, []string{"preact@10.19.0"}, nil)
+	expectExists("builds/v135/preact@10.19.0", false)
+	if _, err := cache.Get("npm-packument:preact"); err != storage.ErrNotFound {
+		t.Fatal("the cache npm-packument:preact should be purged")
+	}
+	expectPurged(PurgeQuery{Name: "vue"}, false, []string{}, nil)
+}
+
+func TestGetBuildIdPackage(t *testing.T) {
+	for id, pkg := range map[string]string{
+		"v135/react@18.2.0/es2022/react.mjs":             "react@18.2.0",
+		"stable/react@18.2.0/es2022/react.mjs":           "react@18.2.0",
+		"v135/@babel/core@7.24.0/es2022/core.mjs":        "@babel/core@7.24.0",
+		"v135/gh/microsoft/tslib@2.6.2/es2022/tslib.mjs": "gh/microsoft/tslib@2.6.2",
+		"v135/node.ns.d.ts":                              "",
+	} {
+		if ret := getBuildIdPackage(id); ret != pkg {
+			t.Fatalf("getBuildIdPackage(%s): expected %s, got %s", id, pkg, ret)
+		}
+	}
+}
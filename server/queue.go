@@ -2,7 +2,10 @@ package server
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
+	"runtime/debug"
 	"sync"
 	"time"
 )
@@ -14,8 +17,14 @@ type BuildQueue struct {
 	tasks        map[string]*queueTask
 	processes    []*queueTask
 	maxProcesses int
+	running      sync.WaitGroup
+	closed       bool
 }
 
+// errServerShuttingDown is the error of the build tasks that are not started before the server
+// shutdown.
+var errServerShuttingDown = errors.New("server is shutting down")
+
 type BuildQueueConsumer struct {
 	IP string           `json:"ip"`
 	C  chan BuildOutput `json:"-"`
@@ -38,22 +47,35 @@ type queueTask struct {
 func (t *queueTask) run() BuildOutput {
 	c := make(chan BuildOutput, 1)
 	go func(c chan BuildOutput) {
-		meta, err := t.Build()
+		defer func() {
+			// the panic value may contain the secrets, log it with the redacted logger instead
+			// of crashing the server with the panic trace
+			if v := recover(); v != nil {
+				t.logger().Errorf("[panic] %v\n%s", v, debug.Stack())
+				c <- BuildOutput{err: fmt.Errorf("build '%s': internal error", t.ID())}
+			}
+		}()
+		meta, err := buildWithLock(t.BuildTask)
 		c <- BuildOutput{meta, err}
 	}(c)
 
+	timeout := time.Duration(cfg.BuildLimits.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+
 	var output BuildOutput
 	select {
 	case output = <-c:
 		if output.err == nil {
-			log.Infof("build '%s' done in %v", t.ID(), time.Since(t.startedAt))
+			t.logger().Infof("build done in %v", time.Since(t.startedAt))
 		} else {
-			log.Errorf("build '%s': %v", t.ID(), output.err)
+			t.logger().Errorf("build failed: %v", output.err)
 		}
-	case <-time.After(10 * time.Minute):
-		log.Errorf("build '%s': timeout(%v)", t.ID(), time.Since(t.startedAt))
+	case <-time.After(timeout):
+		t.logger().Errorf("build timeout(%v)", time.Since(t.startedAt))
 		output = BuildOutput{
-			err: fmt.Errorf("build '%s': timeout(%v)", t.ID(), time.Since(t.startedAt)),
+			err: &BuildLimitError{Limit: "timeout", Message: fmt.Sprintf("build '%s' is not finished in %v", t.ID(), time.Since(t.startedAt))},
 		}
 	}
 
@@ -79,8 +101,14 @@ func (q *BuildQueue) Len() int {
 
 // Add adds a new build task.
 func (q *BuildQueue) Add(task *BuildTask, consumerIp string) *BuildQueueConsumer {
-	c := &BuildQueueConsumer{consumerIp, make(chan BuildOutput, 1)}
+	// the consumers are listed in the `/status.json`
+	c := &BuildQueueConsumer{anonymizeIP(consumerIp), make(chan BuildOutput, 1)}
 	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		c.C <- BuildOutput{err: errServerShuttingDown}
+		return c
+	}
 	t, ok := q.tasks[task.ID()]
 	if ok && consumerIp != "" {
 		t.consumers = append(t.consumers, c)
@@ -91,6 +119,13 @@ func (q *BuildQueue) Add(task *BuildTask, consumerIp string) *BuildQueueConsumer
 		return c
 	}
 
+	// fail fast if the task failed recently
+	if f, ok := getBuildFailure(task.ID()); ok {
+		task.logger().Debugf("failed %d times, retry after %ds", f.Attempts, f.RetryAfter())
+		c.C <- BuildOutput{err: f}
+		return c
+	}
+
 	task.stage = "pending"
 	t = &queueTask{
 		BuildTask: task,
@@ -131,7 +166,7 @@ func (q *BuildQueue) RemoveConsumer(task *BuildTask, c *BuildQueueConsumer) {
 func (q *BuildQueue) next() {
 	var nextTask *queueTask
 	q.lock.Lock()
-	if len(q.processes) < q.maxProcesses {
+	if !q.closed && len(q.processes) < q.maxProcesses {
 		for el := q.list.Front(); el != nil; el = el.Next() {
 			t, ok := el.Value.(*queueTask)
 			if ok && !t.inProcess {
@@ -147,8 +182,13 @@ func (q *BuildQueue) next() {
 	}
 
 	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return
+	}
 	nextTask.inProcess = true
 	q.processes = append(q.processes, nextTask)
+	q.running.Add(1)
 	q.lock.Unlock()
 
 	go q.wait(nextTask)
@@ -158,6 +198,16 @@ func (q *BuildQueue) wait(t *queueTask) {
 	t.startedAt = time.Now()
 
 	output := t.run()
+	recordBuildAudit(t, output)
+	if output.err != nil {
+		buildDuration.Observe(time.Since(t.startedAt).Seconds(), "failure")
+		recordBuildFailure(t.ID(), output.err)
+		recordRecentFailure(t, output.err)
+	} else {
+		buildDuration.Observe(time.Since(t.startedAt).Seconds(), "success")
+		clearBuildFailure(t.ID())
+		dropStaleBuild(t.ID())
+	}
 
 	q.lock.Lock()
 	a := make([]*queueTask, len(q.processes))
@@ -179,4 +229,50 @@ func (q *BuildQueue) wait(t *queueTask) {
 	for _, c := range t.consumers {
 		c.C <- output
 	}
+	q.running.Done()
+}
+
+// Close stops the queue starting new tasks, the pending tasks are dropped and their consumers
+// get the `errServerShuttingDown` error. The tasks in process are not interrupted.
+func (q *BuildQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	for el := q.list.Front(); el != nil; {
+		next := el.Next()
+		t, ok := el.Value.(*queueTask)
+		if ok && !t.inProcess {
+			q.list.Remove(el)
+			delete(q.tasks, t.ID())
+			for _, c := range t.consumers {
+				c.C <- BuildOutput{err: errServerShuttingDown}
+			}
+		}
+		el = next
+	}
+}
+
+// Processing returns the number of the tasks in process.
+func (q *BuildQueue) Processing() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return len(q.processes)
+}
+
+// Wait waits for the tasks in process to finish, it returns the error of the context if it's done
+// before.
+func (q *BuildQueue) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+// rateLimiter is a set of token buckets by key.
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitRule is the limiters of all the requests and the build-triggering requests, a nil
+// limiter means no limit.
+type rateLimitRule struct {
+	requests *rateLimiter
+	builds   *rateLimiter
+}
+
+var (
+	ipRateLimit    rateLimitRule
+	tokenRateLimit rateLimitRule
+
+	rateLimitedRequests = newCounterVec("esm_rate_limited_requests_total", "The number of the requests rejected by the rate limiter.", "bucket", "kind")
+)
+
+func newRateLimiter(b config.TokenBucket) *rateLimiter {
+	if b.Rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: b.Rate, burst: float64(b.Burst), buckets: map[string]*tokenBucket{}}
+}
+
+// initRateLimit creates the rate limiters of the config.
+func initRateLimit(c config.RateLimit) {
+	ipRateLimit = rateLimitRule{newRateLimiter(c.IP.Requests), newRateLimiter(c.IP.Builds)}
+	tokenRateLimit = rateLimitRule{newRateLimiter(c.Token.Requests), newRateLimiter(c.Token.Builds)}
+}
+
+// take takes a token of the bucket of the key, it returns the duration to wait for the next token
+// if the bucket is empty.
+func (l *rateLimiter) take(key string) (ok bool, retryAfter time.Duration) {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep removes the full buckets, they are the same as the new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// getRateLimitKey returns the limiters of the request, and the key of the bucket: the API key of
+// the authorized request, or the client IP.
+func getRateLimitKey(ctx *rex.Context) (rule rateLimitRule, bucket string, key string) {
+	if token := getAPIKey(ctx); token != "" {
+		return tokenRateLimit, "token", token
+	}
+	return ipRateLimit, "ip", getClientIP(ctx)
+}
+
+// rateLimit returns a handle that rejects the requests exceeding the rate limit with 429.
+func rateLimit() rex.Handle {
+	return func(ctx *rex.Context) interface{} {
+		if isAdminRequest(ctx) {
+			return nil
+		}
+		rule, bucket, key := getRateLimitKey(ctx)
+		return limitRate(ctx, rule.requests, bucket, key, "requests")
+	}
+}
+
+// checkColdBuild checks the request that triggers a new build with the cold build protection and
+// the rate limit, it returns the response to reject the request, otherwise nil.
+func checkColdBuild(ctx *rex.Context) interface{} {
+	if res := checkBuildTrigger(ctx); res != nil {
+		return res
+	}
+	return checkBuildRateLimit(ctx)
+}
+
+// checkBuildTrigger returns a response to reject the request that triggers a new build if it
+// doesn't have the opt-in header of the `coldBuild` config or an API key, otherwise nil.
+func checkBuildTrigger(ctx *rex.Context) interface{} {
+	c := cfg.ColdBuild
+	if c.Header == "" || isAdminRequest(ctx) || getAPIKey(ctx) != "" {
+		return nil
+	}
+	if v := ctx.R.Header.Get(c.Header); v != "" && (c.Value == "" || subtle.ConstantTimeCompare([]byte(v), []byte(c.Value)) == 1) {
+		return nil
+	}
+	ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	return throwError(ctx, c.Status, errBuildNotAllowed, "the module is not built yet, and the request is not allowed to trigger a build")
+}
+
+// checkBuildRateLimit takes a token of the builds bucket of the request that triggers a build,
+// it returns a 429 response if the bucket is empty, otherwise nil.
+func checkBuildRateLimit(ctx *rex.Context) interface{} {
+	if isAdminRequest(ctx) {
+		return nil
+	}
+	rule, bucket, key := getRateLimitKey(ctx)
+	return limitRate(ctx, rule.builds, bucket, key, "builds")
+}
+
+func limitRate(ctx *rex.Context, l *rateLimiter, bucket string, key string, kind string) interface{} {
+	if l == nil {
+		return nil
+	}
+	ok, retryAfter := l.take(key)
+	if ok {
+		return nil
+	}
+	rateLimitedRequests.Inc(bucket, kind)
+	header := ctx.W.Header()
+	header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return throwError(ctx, http.StatusTooManyRequests, errRateLimited, "Too Many Requests")
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(config.TokenBucket{Rate: 10, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("a"); !ok {
+			t.Fatalf("the token %d should be taken", i)
+		}
+	}
+	ok, retryAfter := l.take("a")
+	if ok || retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Fatalf("the bucket should be empty: %v %v", ok, retryAfter)
+	}
+	if ok, _ := l.take("b"); !ok {
+		t.Fatal("the buckets of the keys should be separated")
+	}
+	time.Sleep(retryAfter)
+	if ok, _ := l.take("a"); !ok {
+		t.Fatal("the bucket should be refilled")
+	}
+	if newRateLimiter(config.TokenBucket{}) != nil {
+		t.Fatal("the zero rate means no limit")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	defer func(prevCfg *config.Config, ip rateLimitRule, token rateLimitRule) {
+		cfg, ipRateLimit, tokenRateLimit = prevCfg, ip, token
+	}(cfg, ipRateLimit, tokenRateLimit)
+	cfg = &config.Config{AuthSecret: "secret"}
+	initRateLimit(config.RateLimit{
+		IP:    config.RateLimitRule{Requests: config.TokenBucket{Rate: 0.01, Burst: 3}, Builds: config.TokenBucket{Rate: 0.01, Burst: 1}},
+		Token: config.RateLimitRule{Requests: config.TokenBucket{Rate: 0.01, Burst: 10}},
+	})
+
+	router := &rex.Router{}
+	router.Use(rateLimit(), func(ctx *rex.Context) interface{} {
+		if ctx.Form.Has("build") {
+			if res := checkBuildRateLimit(ctx); res != nil {
+				return res
+			}
+		}
+		return "ok"
+	})
+	request := func(url string, ip string, auth string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		req.RemoteAddr = ip + ":1234"
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("https://esm.sh/react?build", "10.0.0.1", ""); rec.Code != 200 {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	// the builds bucket is empty
+	rec := request("https://esm.sh/react-dom?build", "10.0.0.1", "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "100" {
+		t.Fatalf("unexpected response: %d %v", rec.Code, rec.Header())
+	}
+	// the cached hits take the requests bucket only
+	if rec := request("https://esm.sh/react", "10.0.0.1", ""); rec.Code != 200 {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if rec := request("https://esm.sh/react", "10.0.0.1", ""); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if rec := request("https://esm.sh/react", "10.0.0.2", ""); rec.Code != 200 {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	// the authorized requests use the token buckets
+	for i := 0; i < 10; i++ {
+		if rec := request("https://esm.sh/react?build", "10.0.0.1", "secret"); rec.Code != 200 {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+	if rec := request("https://esm.sh/react", "10.0.0.1", "secret"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	// an invalid token does not bypass the ip limit
+	if rec := request("https://esm.sh/react", "10.0.0.1", "invalid"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if n := rateLimitedRequests.Get("ip", "builds"); n == 0 {
+		t.Fatal("the rate limited requests should be counted")
+	}
+	buf := bytes.NewBuffer(nil)
+	writeMetrics(buf)
+	if !strings.Contains(buf.String(), `esm_rate_limited_requests_total{bucket="token",kind="requests"} `) {
+		t.Fatalf("unexpected metrics:\n%s", buf.String())
+	}
+}
+
+func TestColdBuild(t *testing.T) {
+	defer func(prevCfg *config.Config, ip rateLimitRule, token rateLimitRule) {
+		cfg, ipRateLimit, tokenRateLimit = prevCfg, ip, token
+	}(cfg, ipRateLimit, tokenRateLimit)
+	cfg = &config.Config{AuthSecret: "secret", ColdBuild: config.ColdBuild{Header: "X-Esm-Build", Value: "yes", Status: 202}}
+	initRateLimit(config.RateLimit{})
+
+	router := &rex.Router{}
+	router.Use(func(ctx *rex.Context) interface{} {
+		if ctx.Form.Has("build") {
+			if res := checkColdBuild(ctx); res != nil {
+				return res
+			}
+		}
+		return "ok"
+	})
+	request := func(url string, header string, value string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the built modules are served to all the requests
+	if rec := request("https://esm.sh/react", "", ""); rec.Code != 200 {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	rec := request("https://esm.sh/react?build", "", "")
+	if rec.Code != 202 || rec.Header().Get("X-Esm-Error-Code") != errBuildNotAllowed {
+		t.Fatalf("unexpected response: %d %v", rec.Code, rec.Header())
+	}
+	if rec := request("https://esm.sh/react?build", "X-Esm-Build", "no"); rec.Code != 202 {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if rec := request("https://esm.sh/react?build", "X-Esm-Build", "yes"); rec.Code != 200 {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if rec := request("https://esm.sh/react?build", "Authorization", "Bearer secret"); rec.Code != 200 {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+}
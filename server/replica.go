@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"github.com/ije/rex"
+)
+
+var (
+	builderProxy     *httputil.ReverseProxy
+	builderProxyOnce sync.Once
+)
+
+// forwardBuild handles the request that requires a build in the read-only mode, the request is
+// proxied to the builder (the `builderOrigin` config) if it's set, otherwise it's rejected.
+func forwardBuild(ctx *rex.Context) interface{} {
+	header := ctx.W.Header()
+	if cfg.BuilderOrigin == "" {
+		header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+		header.Set("Retry-After", "60")
+		return throwError(ctx, http.StatusServiceUnavailable, errReadOnly, "the server is read-only, the module is not built yet")
+	}
+	builderProxyOnce.Do(func() {
+		builderProxy = newBuilderProxy(cfg.BuilderOrigin)
+	})
+	// the builder responds with its own headers
+	for key := range header {
+		header.Del(key)
+	}
+	// the builder generates the import urls with the origin of the replica
+	if ctx.R.Header.Get("X-Real-Origin") == "" {
+		cdnOrigin := cfg.CdnOrigin
+		if cdnOrigin == "" {
+			proto := "http"
+			if ctx.R.TLS != nil {
+				proto = "https"
+			}
+			cdnOrigin = fmt.Sprintf("%s://%s", proto, ctx.R.Host)
+		}
+		ctx.R.Header.Set("X-Real-Origin", cdnOrigin)
+	}
+	// the builder continues the trace of the request
+	if span := getRequestSpan(ctx.R); span != nil {
+		ctx.R.Header.Set("traceparent", span.Traceparent())
+	}
+	log.Component("replica").Debugf("forward build %s to %s", ctx.R.URL.Path, cfg.BuilderOrigin)
+	return builderProxy
+}
+
+func newBuilderProxy(builderOrigin string) *httputil.ReverseProxy {
+	target, err := url.Parse(builderOrigin)
+	if err != nil {
+		// the `builderOrigin` is validated when loading the config
+		panic(fmt.Sprintf("invalid builder origin %q", builderOrigin))
+	}
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.Host = target.Host
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Component("replica").Errorf("forward build %s: %v", r.URL.Path, err)
+			w.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, "failed to connect to the builder")
+		},
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBuilderProxy(t *testing.T) {
+	builder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		io.WriteString(w, r.Host+r.URL.RequestURI()+" "+r.Header.Get("X-Real-Origin"))
+	}))
+	defer builder.Close()
+
+	proxy := newBuilderProxy(builder.URL)
+	req := httptest.NewRequest("GET", "https://esm.sh/react@18.2.0?target=es2022", nil)
+	req.Header.Set("X-Real-Origin", "https://esm.sh")
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != builder.Listener.Addr().String()+"/react@18.2.0?target=es2022 https://esm.sh" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// the builder is down
+	builder.Close()
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "https://esm.sh/react@18.2.0", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+}
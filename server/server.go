@@ -4,7 +4,6 @@ import (
 	"embed"
 	"flag"
 	"fmt"
-	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -17,7 +16,6 @@ import (
 	"github.com/esm-dev/esm.sh/server/config"
 	"github.com/esm-dev/esm.sh/server/storage"
 
-	logx "github.com/ije/gox/log"
 	"github.com/ije/rex"
 )
 
@@ -26,8 +24,11 @@ var (
 	cache        storage.Cache
 	db           storage.DataBase
 	fs           storage.FileSystem
+	locker       storage.Locker
+	storageQuota *storage.QuotaFS
+	casFS        *storage.ContentAddressedFS
 	buildQueue   *BuildQueue
-	log          *logx.Logger
+	log          *structLogger
 	embedFS      EmbedFS
 	fetchLocks   sync.Map
 	installLocks sync.Map
@@ -75,12 +76,36 @@ func Serve(efs EmbedFS) {
 		embedFS = efs
 	}
 
-	log, err = logx.New(fmt.Sprintf("file:%s?buffer=32k", path.Join(cfg.LogDir, fmt.Sprintf("main-v%d.log", VERSION))))
+	// redact the secrets of the config in the logs and the error responses
+	initRedaction(cfg)
+
+	mainLogger, accessLogger, err := openLoggers(cfg)
 	if err != nil {
 		fmt.Printf("initiate logger: %v\n", err)
 		os.Exit(1)
 	}
-	log.SetLevelByName(cfg.LogLevel)
+	log = mainLogger
+
+	err = checkTargetClamp(cfg.MinTarget, cfg.MaxTarget)
+	if err != nil {
+		log.Fatalf("check config: %v", err)
+	}
+	err = checkDenoTargets(cfg.DenoTargets)
+	if err != nil {
+		log.Fatalf("check config: %v", err)
+	}
+	err = checkUAParsers(cfg.UAParsers)
+	if err != nil {
+		log.Fatalf("check config: %v", err)
+	}
+	err = checkTypesOverrides(cfg.TypesOverrides)
+	if err != nil {
+		log.Fatalf("check config: %v", err)
+	}
+	err = checkTypesHeader(cfg.TypesHeader)
+	if err != nil {
+		log.Fatalf("check config: %v", err)
+	}
 
 	nodeInstallDir := os.Getenv("NODE_INSTALL_DIR")
 	if nodeInstallDir == "" {
@@ -107,24 +132,88 @@ func Serve(efs EmbedFS) {
 	if err != nil {
 		log.Fatalf("init storage(fs,%s): %v", cfg.Storage, err)
 	}
+	if v := cfg.StorageChecksum.Verify; v != "" {
+		// detect the corrupted files of the underlying storage, e.g. the bit-rot of the local disks
+		sampleRate := 1.0
+		if v == "sampled" {
+			sampleRate = cfg.StorageChecksum.SampleRate
+		}
+		fs = storage.NewChecksumFS(fs, []string{"builds/", "types/", "types-bundle/", "blobs/", "stale/"}, sampleRate)
+	}
+	if !cfg.StorageQuota.IsEmpty() {
+		// evict the built modules, the type definitions and the package tarballs by the quota
+		tiers := make([]storage.QuotaTier, len(cfg.StorageQuota.Tiers))
+		for i, tier := range cfg.StorageQuota.Tiers {
+			tiers[i] = storage.QuotaTier{MinHits: tier.MinHits, TTL: time.Duration(tier.TTL) * time.Second}
+		}
+		storageQuota, err = storage.NewQuotaFS(fs, storage.QuotaOptions{
+			MaxSize:    cfg.StorageQuota.MaxSize,
+			MaxObjects: cfg.StorageQuota.MaxObjects,
+			Eviction:   cfg.StorageQuota.Eviction,
+			TTL:        time.Duration(cfg.StorageQuota.TTL) * time.Second,
+			Tiers:      tiers,
+			Interval:   time.Duration(cfg.StorageQuota.Interval) * time.Second,
+			Prefixes:   []string{"builds/", "types/", "types-bundle/", "tarballs/", "blobs/", "stale/"},
+		})
+		if err != nil {
+			log.Fatalf("init storage(quota): %v", err)
+		}
+		storageQuota.Start()
+		fs = storageQuota
+	}
+	if cfg.StorageDedup {
+		// share the storage of the identical build outputs
+		casFS = storage.NewContentAddressedFS(fs, []string{"builds/", "types/"}, 1024)
+		fs = casFS
+		startBlobCollector()
+		// collect the blobs that are left by the previous runs
+		collectBlobs()
+	}
+	if cfg.StorageCompression != "" {
+		// compress the built modules and the type definitions at rest, the compressed files are
+		// served to the clients that accept brotli directly
+		fs = storage.NewCompressedFS(fs, []string{"builds/", "types/", "types-bundle/"}, 1024, 0)
+	}
+	if cfg.HotCacheSize > 0 {
+		// serve the popular modules from the memory
+		hotCache = storage.NewHotCacheFS(fs, cfg.HotCacheSize, cfg.HotCacheSize/8)
+		fs = hotCache
+	}
 
 	db, err = storage.OpenDB(cfg.Database)
 	if err != nil {
 		log.Fatalf("init storage(db,%s): %v", cfg.Database, err)
 	}
 
-	buildQueue = newBuildQueue(int(cfg.BuildConcurrency))
-
-	var accessLogger *logx.Logger
-	if cfg.LogDir == "" {
-		accessLogger = &logx.Logger{}
-	} else {
-		accessLogger, err = logx.New(fmt.Sprintf("file:%s?buffer=32k&fileDateFormat=20060102", path.Join(cfg.LogDir, "access.log")))
+	if cfg.Locker != "" {
+		// de-duplicate the builds across the server replicas
+		locker, err = storage.OpenLocker(cfg.Locker)
 		if err != nil {
-			log.Fatalf("initiate access logger: %v", err)
+			log.Fatalf("init storage(locker,%s): %v", cfg.Locker, err)
 		}
 	}
-	accessLogger.SetQuite(true) // quite in terminal
+
+	buildQueue = newBuildQueue(int(cfg.BuildConcurrency))
+	initRateLimit(cfg.RateLimit)
+	if err = initSigningKey(cfg.SigningKey); err != nil {
+		log.Fatalf("init signing key: %v", err)
+	}
+
+	err = initAuditLog(cfg.AuditLog)
+	if err != nil {
+		log.Fatalf("init audit log: %v", err)
+	}
+
+	initTracing(cfg.Tracing)
+
+	if cfg.PrebuildFile != "" && !cfg.ReadOnly {
+		// warm up the packages in background
+		go prebuildFromFile(cfg.PrebuildFile)
+	}
+
+	if cfg.LogPrivacy.Retention > 0 && cfg.LogDir != "" {
+		go enforceLogRetention(cfg.LogDir, cfg.LogPrivacy.Retention)
+	}
 
 	// start node services process
 	go func() {
@@ -139,37 +228,29 @@ func Serve(efs EmbedFS) {
 
 	go restorePurgeTimers(path.Join(cfg.WorkDir, "npm"))
 
+	// add the ETag to the responses and reply 304 to the conditional requests
+	esmHandle := conditional(esmHandler())
+	if cfg.CoalesceRequests {
+		// only one of the identical requests looks up the storage or builds the module
+		esmHandle = coalesce(esmHandle, time.Duration(cfg.CoalesceTimeout)*time.Second)
+	}
+	router := &rex.Router{}
 	if !cfg.NoCompress {
-		rex.Use(rex.Compression())
+		router.Use(compression())
 	}
-	rex.Use(
+	router.Use(
 		rex.ErrorLogger(log),
-		rex.AccessLogger(accessLogger),
+		rex.AccessLogger(&privacyLogger{accessLogger}),
 		rex.Header("Server", "esm.sh"),
-		rex.Cors(rex.CORS{
-			AllowedOrigins: []string{"*"},
-			AllowedMethods: []string{
-				http.MethodGet,
-				http.MethodPost,
-			},
-			ExposedHeaders:   []string{"X-TypeScript-Types"},
-			AllowCredentials: false,
-		}),
-		auth(cfg.AuthSecret),
+		corsHandler(cfg.Cors),
+		auth(),
+		rateLimit(),
 		apiHandler(),
-		esmHandler(),
+		esmHandle,
 	)
 
-	C := rex.Serve(rex.ServerConfig{
-		Port: uint16(cfg.Port),
-		TLS: rex.TLSConfig{
-			Port: uint16(cfg.TlsPort),
-			AutoTLS: rex.AutoTLSConfig{
-				AcceptTOS: cfg.TlsPort > 0 && !isDev,
-				CacheDir:  path.Join(cfg.WorkDir, "autotls"),
-			},
-		},
-	})
+	handler := clientIPHandler(headersHandler(router, cfg.Headers), newClientIPResolver(cfg.TrustedProxies, cfg.ClientIPHeader))
+	servers, C := listen(healthProbes(trackRequests(instrumentRequests(traceRequests(handler)))), isDev)
 
 	if isDev {
 		log.Debugf("Server is ready on http://localhost:%d", cfg.Port)
@@ -186,14 +267,19 @@ func Serve(efs EmbedFS) {
 		log.Error(err)
 	}
 
+	// drain the requests and the builds in process
+	shutdown(servers, time.Duration(cfg.ShutdownTimeout)*time.Second)
+
 	// release resources
 	kill(nsPidFile)
 	db.Close()
-	log.FlushBuffer()
-	accessLogger.FlushBuffer()
+	closeAuditLog()
+	closeTracing()
+	log.Close()
+	accessLogger.Close()
 }
 
 func init() {
 	embedFS = &embed.FS{}
-	log = &logx.Logger{}
+	log = newLogger("text", "debug", nil, []logSink{&consoleLogSink{w: os.Stdout}})
 }
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -33,21 +34,252 @@ type BuildInput struct {
 
 func apiHandler() rex.Handle {
 	return func(ctx *rex.Context) interface{} {
+		if ctx.R.Method == "DELETE" && ctx.Path.String() == apiPathPrefix+"purge" {
+			if cfg.AdminSecret == "" {
+				return throwError(ctx, 404, errNotFound, "the purge API is disabled")
+			}
+			if !isAdminRequest(ctx) {
+				return throwError(ctx, 401, errUnauthorized, "Unauthorized")
+			}
+			query, err := parsePurgeQuery(ctx)
+			if err != nil {
+				return throwError(ctx, 400, errBadRequest, err.Error())
+			}
+			result, err := purgePackages(query, ctx.Form.Has("cascade"))
+			if err != nil {
+				if err == errPurgeUnsupported {
+					return throwError(ctx, 501, errNotSupported, err.Error())
+				}
+				log.Errorf("purge: %v", err)
+				return throwError(ctx, 500, errInternal, "failed to purge")
+			}
+			log.Infof("purge: %d packages, %d dependents, %d files, %d records", len(result.Packages), len(result.Dependents), result.Files, result.Records)
+			ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return result
+		}
+
+		if ctx.Path.String() == apiPathPrefix+"api-keys" && cfg.AdminSecret != "" {
+			if !isAdminRequest(ctx) {
+				return throwError(ctx, 401, errUnauthorized, "Unauthorized")
+			}
+			ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			switch ctx.R.Method {
+			case "GET":
+				keys, err := listAPIKeys()
+				if err != nil {
+					return throwError(ctx, 501, errNotSupported, err.Error())
+				}
+				return keys
+			case "POST":
+				var ttl time.Duration
+				if v := ctx.Form.Value("ttl"); v != "" {
+					seconds, err := strconv.Atoi(v)
+					if err != nil || seconds < 0 {
+						return throwError(ctx, 400, errBadRequest, "invalid ttl")
+					}
+					ttl = time.Duration(seconds) * time.Second
+				}
+				scopes, err := parseAPIKeyScopes(ctx.Form.Value("scopes"))
+				if err != nil {
+					return throwError(ctx, 400, errBadRequest, err.Error())
+				}
+				key, rec, err := createAPIKey(ctx.Form.Value("name"), ttl, scopes)
+				if err != nil {
+					return throwError(ctx, 400, errBadRequest, "failed to create api key: "+err.Error())
+				}
+				log.Infof("api key %s (%s) created", rec.ID, rec.Name)
+				return map[string]interface{}{
+					"id":        rec.ID,
+					"name":      rec.Name,
+					"key":       key,
+					"expiresAt": rec.ExpiresAt,
+					"scopes":    rec.Scopes,
+				}
+			case "DELETE":
+				id := ctx.Form.Value("id")
+				if err := revokeAPIKey(id); err != nil {
+					return throwError(ctx, 404, errNotFound, err.Error())
+				}
+				log.Infof("api key %s revoked", id)
+				return map[string]interface{}{"id": id}
+			}
+			return throwError(ctx, 405, errMethodNotAllowed, "Method Not Allowed")
+		}
+
+		if ctx.Path.String() == apiPathPrefix+"token" && ctx.R.Method == "GET" && isAuthRequired() {
+			// sign a short-lived token with the API key of the `Authorization` header
+			rec := verifyAPIKey(strings.TrimPrefix(ctx.R.Header.Get("Authorization"), "Bearer "))
+			if rec == nil {
+				return throwError(ctx, 401, errUnauthorized, "Unauthorized")
+			}
+			ttl := 3600
+			if v := ctx.Form.Value("ttl"); v != "" {
+				var err error
+				ttl, err = strconv.Atoi(v)
+				if err != nil || ttl <= 0 || ttl > 30*24*3600 {
+					return throwError(ctx, 400, errBadRequest, "invalid ttl")
+				}
+			}
+			expiresAt := time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+			if rec.ExpiresAt > 0 && rec.ExpiresAt < expiresAt {
+				expiresAt = rec.ExpiresAt
+			}
+			ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return map[string]interface{}{
+				"token":     signAPIToken(rec, expiresAt),
+				"expiresAt": expiresAt,
+			}
+		}
+
+		// `GET /-/status/PKG@VERSION/SUBPATH?target=...` returns the build status of the module, it
+		// doesn't trigger the build
+		if (ctx.R.Method == "GET" || ctx.R.Method == "HEAD") && strings.HasPrefix(ctx.Path.String(), apiPathPrefix+"status/") {
+			pathname := strings.TrimPrefix(ctx.Path.String(), apiPathPrefix+"status")
+			if pkg, _, err := validatePkgPath(pathname); err == nil {
+				if res := checkAPIKeyScope(ctx, pkg.Name); res != nil {
+					return res
+				}
+			}
+			status, err := getBuildStatus(pathname, ctx.Form.Value("target"), ctx.Form.Has("dev"), ctx.Form.Has("bundle") || ctx.Form.Has("bundle-deps"))
+			if err != nil {
+				if strings.HasPrefix(err.Error(), "invalid target") {
+					return throwError(ctx, 400, errBadRequest, err.Error())
+				}
+				return throwResolveError(ctx, err)
+			}
+			ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return status
+		}
+
+		if ctx.Path.String() == apiPathPrefix+"snapshot" && (ctx.R.Method == "GET" || ctx.R.Method == "POST") && cfg.AdminSecret != "" {
+			if !isAdminRequest(ctx) {
+				return throwError(ctx, 401, errUnauthorized, "Unauthorized")
+			}
+			if ctx.R.Method == "POST" {
+				defer ctx.R.Body.Close()
+				result, err := importSnapshot(ctx.R.Body)
+				if err != nil {
+					return throwError(ctx, 400, errBadRequest, "failed to import snapshot: "+err.Error())
+				}
+				log.Infof("snapshot: imported %d packages, %d files, %d records", len(result.Packages), result.Files, result.Records)
+				ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+				return result
+			}
+			query, err := parsePurgeQuery(ctx)
+			if err != nil {
+				return throwError(ctx, 400, errBadRequest, err.Error())
+			}
+			if _, ok := fs.(storage.FileSystemRemover); !ok {
+				return throwError(ctx, 501, errNotSupported, errPurgeUnsupported.Error())
+			}
+			if _, ok := db.(storage.DataBaseScanner); !ok {
+				return throwError(ctx, 501, errNotSupported, "the database does not support the snapshot")
+			}
+			// stream the snapshot since it may be large
+			r, w := io.Pipe()
+			go func() {
+				result, err := exportSnapshot(w, query)
+				if err != nil {
+					log.Errorf("snapshot: %v", err)
+					w.CloseWithError(err)
+					return
+				}
+				log.Infof("snapshot: exported %d packages, %d files, %d records", len(result.Packages), result.Files, result.Records)
+				w.Close()
+			}()
+			header := ctx.W.Header()
+			header.Set("Content-Type", "application/gzip")
+			header.Set("Content-Disposition", `attachment; filename="esm-snapshot.tar.gz"`)
+			header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return r
+		}
+
 		if ctx.R.Method == "POST" || ctx.R.Method == "PUT" {
 			switch ctx.Path.String() {
+			case apiPathPrefix + "lock":
+				if !isAdminRequest(ctx) && getAPIKey(ctx) == "" {
+					return throwError(ctx, 401, errUnauthorized, "Unauthorized")
+				}
+				if res := checkBuildRateLimit(ctx); res != nil {
+					return res
+				}
+				defer ctx.R.Body.Close()
+				data, err := io.ReadAll(io.LimitReader(ctx.R.Body, 8*1024*1024))
+				if err != nil {
+					return throwError(ctx, 400, errBadRequest, "failed to read lockfile: "+err.Error())
+				}
+				versions, err := parseLockfile(data)
+				if err != nil {
+					return throwError(ctx, 400, errBadRequest, err.Error())
+				}
+				token, err := saveLockfile(versions)
+				if err != nil {
+					return throwError(ctx, 500, errInternal, "failed to save lockfile")
+				}
+				ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+				return map[string]interface{}{
+					"token":    token,
+					"packages": len(versions),
+				}
+			case apiPathPrefix + "prebuild":
+				if cfg.AdminSecret == "" {
+					return throwError(ctx, 404, errNotFound, "the prebuild API is disabled")
+				}
+				if !isAdminRequest(ctx) {
+					return throwError(ctx, 401, errUnauthorized, "Unauthorized")
+				}
+				if cfg.ReadOnly {
+					return forwardBuild(ctx)
+				}
+				var input PrebuildInput
+				defer ctx.R.Body.Close()
+				err := json.NewDecoder(io.LimitReader(ctx.R.Body, 1024*1024)).Decode(&input)
+				if err != nil {
+					return throwError(ctx, 400, errBadRequest, "failed to parse input: "+err.Error())
+				}
+				for _, specifier := range input.Packages {
+					if pkg, _, err := validatePkgPath("/" + strings.TrimPrefix(strings.TrimSpace(specifier), "/")); err == nil {
+						if res := checkAPIKeyScope(ctx, pkg.Name); res != nil {
+							return res
+						}
+					}
+				}
+				cdnOrigin := ctx.R.Header.Get("X-Real-Origin")
+				if cdnOrigin == "" {
+					cdnOrigin = cfg.CdnOrigin
+				}
+				if cdnOrigin == "" {
+					proto := "http"
+					if ctx.R.TLS != nil {
+						proto = "https"
+					}
+					cdnOrigin = fmt.Sprintf("%s://%s", proto, ctx.R.Host)
+				}
+				result, err := prebuild(input, cdnOrigin)
+				if err != nil {
+					return throwError(ctx, 400, errBadRequest, err.Error())
+				}
+				ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+				return result
 			case "/build":
+				if res := checkColdBuild(ctx); res != nil {
+					return res
+				}
+				if cfg.ReadOnly {
+					return forwardBuild(ctx)
+				}
 				var input BuildInput
 				defer ctx.R.Body.Close()
 				switch ct := ctx.R.Header.Get("Content-Type"); ct {
 				case "application/json":
 					err := json.NewDecoder(ctx.R.Body).Decode(&input)
 					if err != nil {
-						return rex.Err(400, "failed to parse input config: "+err.Error())
+						return throwError(ctx, 400, errBadRequest, "failed to parse input config: "+err.Error())
 					}
 				case "application/javascript", "text/javascript", "application/typescript", "text/typescript":
 					code, err := io.ReadAll(ctx.R.Body)
 					if err != nil {
-						return rex.Err(400, "failed to read code: "+err.Error())
+						return throwError(ctx, 400, errBadRequest, "failed to read code: "+err.Error())
 					}
 					input.Code = string(code)
 					if strings.Contains(ct, "javascript") {
@@ -56,10 +288,10 @@ func apiHandler() rex.Handle {
 						input.Loader = "tsx"
 					}
 				default:
-					return rex.Err(400, "invalid content type")
+					return throwError(ctx, 400, errBadRequest, "invalid content type")
 				}
 				if input.Code == "" {
-					return rex.Err(400, "code is required")
+					return throwError(ctx, 400, errBadRequest, "code is required")
 				}
 				if input.Deps == nil {
 					input.Deps = map[string]string{}
@@ -117,14 +349,20 @@ func apiHandler() rex.Handle {
 					},
 				})
 				if len(ret.Errors) > 0 {
-					return rex.Err(400, "failed to validate code: "+ret.Errors[0].Text)
+					return throwError(ctx, 400, errBadRequest, "failed to validate code: "+ret.Errors[0].Text)
 				}
 				if len(ret.OutputFiles) == 0 {
-					return rex.Err(400, "failed to validate code: no output files")
+					return throwError(ctx, 400, errBadRequest, "failed to validate code: no output files")
 				}
 				code := ret.OutputFiles[0].Contents
 				if len(code) == 0 {
-					return rex.Err(400, "code is empty")
+					return throwError(ctx, 400, errBadRequest, "code is empty")
+				}
+				// the deps include the imports of the code that are added by the resolver
+				for name := range input.Deps {
+					if res := checkAPIKeyScope(ctx, name); res != nil {
+						return res
+					}
 				}
 				h := sha1.New()
 				h.Write(code)
@@ -148,7 +386,7 @@ func apiHandler() rex.Handle {
 				key := "publish-" + id
 				record, err := db.Get(key)
 				if err != nil {
-					return rex.Err(500, "internal server error")
+					return throwError(ctx, 500, errInternal, "internal server error")
 				}
 				if record == nil {
 					_, err = fs.WriteFile(path.Join("publish", id, "index.mjs"), bytes.NewReader(code))
@@ -180,7 +418,7 @@ func apiHandler() rex.Handle {
 					}
 				}
 				if err != nil {
-					return rex.Err(500, "failed to save code")
+					return throwError(ctx, 500, errInternal, "failed to save code")
 				}
 				cdnOrigin := ctx.R.Header.Get("X-Real-Origin")
 				if cdnOrigin == "" {
@@ -201,7 +439,7 @@ func apiHandler() rex.Handle {
 					"bundleUrl": fmt.Sprintf("%s/~%s?bundle", cdnOrigin, id),
 				}
 			default:
-				return rex.Err(404, "not found")
+				return throwError(ctx, 404, errNotFound, "not found")
 			}
 		}
 		return nil
@@ -218,7 +456,7 @@ func esmHandler() rex.Handle {
 
 		// ban malicious requests
 		if strings.HasPrefix(pathname, ".") || strings.HasSuffix(pathname, ".php") {
-			return rex.Status(404, "not found")
+			return throwError(ctx, 404, errNotFound, "not found")
 		}
 
 		cdnOrigin := ctx.R.Header.Get("X-Real-Origin")
@@ -343,17 +581,104 @@ func esmHandler() rex.Handle {
 				return err
 			}
 
-			header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
-			return map[string]interface{}{
+			status := map[string]interface{}{
 				"buildQueue":  q[:i],
 				"purgeTimers": n,
+				"uaCache":     uaTargetCache.Stats(),
+				"chCache":     clientHintsTargetCache.Stats(),
 				"ns":          string(out),
 				"version":     CTX_BUILD_VERSION,
 				"uptime":      time.Since(startTime).String(),
 			}
+			if storageQuota != nil {
+				status["storageQuota"] = storageQuota.Stats()
+			}
+			header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return status
+
+		case apiPathPrefix + "admin":
+			if cfg.AdminSecret == "" {
+				break
+			}
+			// the page fetches the data from `/-/admin.json` with the admin secret
+			html, err := embedFS.ReadFile("server/embed/admin.html")
+			if err != nil {
+				return err
+			}
+			html = bytes.ReplaceAll(html, []byte("{basePath}"), []byte(cfg.CdnBasePath))
+			header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			header.Set("X-Frame-Options", "DENY")
+			return rex.Content("admin.html", startTime, bytes.NewReader(html))
+
+		case apiPathPrefix + "admin.json":
+			if cfg.AdminSecret == "" {
+				break
+			}
+			if !isAdminRequest(ctx) {
+				return throwError(ctx, 401, errUnauthorized, "Unauthorized")
+			}
+			header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return getAdminStatus(startTime)
+
+		case "/.well-known/esm-signing-key":
+			if signingKey == nil {
+				return throwError(ctx, 404, errNotFound, "the signing is disabled")
+			}
+			header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60))
+			return getSigningKeyInfo()
+
+		case apiPathPrefix + "metrics":
+			if cfg.AdminSecret == "" {
+				break
+			}
+			if !isAdminRequest(ctx) {
+				return throwError(ctx, 401, errUnauthorized, "Unauthorized")
+			}
+			buf := bytes.NewBuffer(nil)
+			writeMetrics(buf)
+			header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return buf.String()
+
+		case "/compat.json":
+			header.Set("Cache-Control", "public, max-age=3600")
+			return getCompatData()
 
 		case "/esma-target":
-			return getBuildTargetByUA(userAgent)
+			ua := userAgent
+			target := ""
+			if v := ctx.Form.Value("ua"); v != "" {
+				// don't cache the UAs of the query, anyone can fill the cache with them
+				ua = v
+				target = clampBuildTarget(resolveBuildTargetByUA(ua))
+			} else {
+				target = getBuildTargetByUA(ua)
+			}
+			if !ctx.Form.Has("json") && !strings.Contains(ctx.R.Header.Get("Accept"), "application/json") {
+				return target
+			}
+			info := map[string]interface{}{
+				"target": target,
+				"ua":     ua,
+			}
+			unsupportedFeatures := []string{}
+			if engine, ok := getBrowserEngine(ua); ok {
+				name, version := getBrowserInfo(ua)
+				info["engine"] = map[string]string{
+					"name":    name,
+					"version": version,
+				}
+				unsupportedFeatures = getFeatureNames(getUnsupportedEngineFeatures(engine))
+			} else if engine, ok := getDenoEngine(ua); ok {
+				info["engine"] = map[string]string{
+					"name":    "Deno",
+					"version": strings.TrimPrefix(ua, "Deno/"),
+				}
+				unsupportedFeatures = getFeatureNames(getUnsupportedEngineFeatures(engine))
+			}
+			info["unsupportedFeatures"] = unsupportedFeatures
+			header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return info
 
 		case "/error.js":
 			switch ctx.Form.Value("type") {
@@ -392,7 +717,7 @@ func esmHandler() rex.Handle {
 			}
 
 		case "/favicon.ico":
-			return rex.Status(404, "not found")
+			return throwError(ctx, 404, errNotFound, "not found")
 		}
 
 		// serve embed assets
@@ -408,11 +733,37 @@ func esmHandler() rex.Handle {
 			}
 		}
 
+		// `?bundle-deps` is an alias of `?bundle`, redirect to the canonical url to share the build and the CDN cache
+		if ctx.Form.Has("bundle-deps") {
+			url := fmt.Sprintf("%s%s?%s", cdnOrigin, ctx.R.URL.Path, getCanonicalBundleQuery(ctx.R.URL.RawQuery))
+			return rex.Redirect(url, http.StatusMovedPermanently)
+		}
+
 		// strip loc suffix
 		if strings.ContainsRune(pathname, ':') {
 			pathname = regexpLocPath.ReplaceAllString(pathname, "$1")
 		}
 
+		// `/types-resolve/PKG@VERSION/SUBPATH` API returns the declaration url of the module in JSON
+		typesResolve := false
+		if strings.HasPrefix(pathname, "/types-resolve/") {
+			pathname = strings.TrimPrefix(pathname, "/types-resolve")
+			typesResolve = true
+		}
+
+		// `/integrity/PKG@VERSION/SUBPATH` API is an alias of the `?integrity` query that returns the
+		// SRI manifest of the module graph, the query is added for the redirects
+		if strings.HasPrefix(pathname, "/integrity/") {
+			pathname = strings.TrimPrefix(pathname, "/integrity")
+			if ctx.R.URL.RawQuery != "" {
+				ctx.R.URL.RawQuery = "integrity&" + ctx.R.URL.RawQuery
+			} else {
+				ctx.R.URL.RawQuery = "integrity"
+			}
+			ctx.R.Form = nil
+		}
+		isIntegrity := ctx.Form.Has("integrity")
+
 		var hasBuildVerPrefix bool
 		var hasStablePrefix bool
 		var outdatedBuildVer string
@@ -423,6 +774,8 @@ func esmHandler() rex.Handle {
 			pathname = strings.TrimPrefix(pathname, "/stable")
 			hasBuildVerPrefix = true
 			hasStablePrefix = true
+		} else if typesResolve {
+			// no build version prefix for the `/types-resolve` API
 		} else if strings.HasPrefix(pathname, buildBasePath+"/") || pathname == buildBasePath {
 			a := strings.Split(pathname, "/")
 			pathname = "/" + strings.Join(a[2:], "/")
@@ -435,12 +788,31 @@ func esmHandler() rex.Handle {
 			outdatedBuildVer = a[1]
 		}
 
-		// determine build target by `?target` query or `User-Agent` header
+		// determine build target by `?target` query, `X-Esm-Target` header, client hints or `User-Agent` header
+		targetSpan := startSpan(getRequestSpan(ctx.R), "resolve target")
 		target := strings.ToLower(ctx.Form.Value("target"))
-		targetFromUA := targets[target] == 0
-		if targetFromUA {
-			target = getBuildTargetByUA(userAgent)
+		targetSource := "query"
+		var varyHeaders []string
+		if !isValidTarget(target) {
+			if v := strings.ToLower(ctx.R.Header.Get("X-Esm-Target")); isValidTarget(v) {
+				target = v
+				targetSource = "header"
+				varyHeaders = []string{"X-Esm-Target"}
+			} else {
+				target = getBuildTargetByClientHints(ctx.R.Header.Get("Sec-CH-UA-Full-Version-List"), ctx.R.Header.Get("Sec-CH-UA"))
+				targetSource = "client-hints"
+				if target == "" {
+					target = getBuildTargetByUA(userAgent)
+					targetSource = "user-agent"
+				}
+				varyHeaders = []string{"User-Agent", "Sec-CH-UA", "Sec-CH-UA-Full-Version-List", "X-Esm-Target"}
+				// ask chromium based browsers to send the full version list for the subsequent requests
+				header.Set("Accept-CH", "Sec-CH-UA-Full-Version-List")
+			}
 		}
+		targetSpan.SetAttr("esm.target", target)
+		targetSpan.SetAttr("esm.target.source", targetSource)
+		targetSpan.End(nil)
 
 		if pathname == "/build" {
 			if !hasBuildVerPrefix && !ctx.Form.Has("pin") {
@@ -455,7 +827,7 @@ func esmHandler() rex.Handle {
 			if target == "deno" || target == "denonext" {
 				header.Set("Content-Type", "application/typescript; charset=utf-8")
 			} else {
-				code, err := minify(string(data), targets[target], api.LoaderTS)
+				code, err := minify(string(data), target, api.LoaderTS)
 				if err != nil {
 					return throwErrorJS(ctx, fmt.Errorf("transform error: %v", err))
 				}
@@ -463,8 +835,8 @@ func esmHandler() rex.Handle {
 				header.Set("Content-Type", "application/javascript; charset=utf-8")
 			}
 			header.Set("Cache-Control", "public, max-age=31536000, immutable")
-			if targetFromUA {
-				header.Add("Vary", "User-Agent")
+			for _, h := range varyHeaders {
+				header.Add("Vary", h)
 			}
 			return bytes.ReplaceAll(data, []byte("$ORIGIN"), []byte(cdnOrigin))
 		}
@@ -498,14 +870,14 @@ func esmHandler() rex.Handle {
 			if strings.HasSuffix(pathname, ".js") {
 				data, err := embedFS.ReadFile("server/embed/polyfills" + pathname)
 				if err == nil {
-					code, err := minify(string(data), targets[target], api.LoaderJS)
+					code, err := minify(string(data), target, api.LoaderJS)
 					if err != nil {
 						return throwErrorJS(ctx, fmt.Errorf("transform error: %v", err))
 					}
 					header.Set("Content-Type", "application/javascript; charset=utf-8")
 					header.Set("Cache-Control", "public, max-age=31536000, immutable")
-					if targetFromUA {
-						header.Add("Vary", "User-Agent")
+					for _, h := range varyHeaders {
+						header.Add("Vary", h)
 					}
 					return rex.Content(pathname, startTime, bytes.NewReader(code))
 				}
@@ -520,13 +892,18 @@ func esmHandler() rex.Handle {
 			}
 		}
 
+		// use the npm compatibility registry of JSR for `/jsr/@scope/pkg` path
+		if p, ok := toJSRNpmPath(pathname); ok {
+			pathname = p
+		}
+
 		// ban malicious requests by banList
 		// trim the leading `/` in pathname to get the package name
 		// e.g. /@ORG/PKG -> @ORG/PKG
 		packageFullName := pathname[1:]
 		pkgBanned := cfg.BanList.IsPackageBanned(packageFullName)
 		if pkgBanned {
-			return rex.Status(403, "forbidden")
+			return throwError(ctx, 403, errForbidden, "forbidden")
 		}
 
 		external := newStringSet()
@@ -539,22 +916,86 @@ func esmHandler() rex.Handle {
 			pathname = "/gh/" + pathname[5:]
 		}
 
+		// check `?tag` and `?prerelease` query to resolve the version
+		resolveOptions := PkgResolveOptions{Tag: cfg.NpmDefaultTag, Prerelease: cfg.NpmPrerelease}
+		if tag := ctx.Form.Value("tag"); tag != "" {
+			if !validatePackageName(tag) {
+				return throwError(ctx, 400, errInvalidQuery, "Invalid tag query")
+			}
+			resolveOptions.Tag = tag
+		}
+		if ctx.Form.Has("prerelease") {
+			resolveOptions.Prerelease = ctx.Form.Value("prerelease") != "false"
+		}
+
 		// get package info
-		reqPkg, extraQuery, err := validatePkgPath(pathname)
+		resolveSpan := startSpan(getRequestSpan(ctx.R), "resolve package")
+		reqPkg, extraQuery, err := validatePkgPathWithOptions(pathname, resolveOptions)
+		if err == nil {
+			resolveSpan.SetAttr("esm.package", reqPkg.String())
+		}
+		resolveSpan.End(err)
 		if err != nil {
-			status := 500
-			message := err.Error()
-			if message == "invalid path" {
-				status = 400
-			} else if strings.HasSuffix(message, "not found") {
-				status = 404
-			}
-			return rex.Status(status, message)
+			return throwResolveError(ctx, err)
 		}
 
 		if reqPkg.Name == "apps" {
 			// resvered package name
-			return rex.Status(404, "not found")
+			return throwError(ctx, 404, errNotFound, "not found")
+		}
+
+		// check the package against the scopes of the API key, for both the modules and the types
+		if res := checkAPIKeyScope(ctx, reqPkg.Name); res != nil {
+			return res
+		}
+
+		hotPackages.Inc(reqPkg.Name)
+
+		// check the package against the `policy` config
+		if !cfg.Policy.IsEmpty() && !reqPkg.FromEsmsh {
+			var license string
+			checkLicense := (len(cfg.Policy.AllowLicenses) > 0 || len(cfg.Policy.DenyLicenses) > 0) && !reqPkg.FromGithub
+			var info *NpmPackage
+			if checkLicense || (cfg.Policy.DenyInstallScripts && !reqPkg.FromGithub) {
+				p, err := fetchPackageInfo(reqPkg.Name, reqPkg.Version)
+				if err != nil {
+					return throwResolveError(ctx, err)
+				}
+				info = &p
+				license = info.License
+			}
+			v := checkPackagePolicy(&cfg.Policy, reqPkg.Name, reqPkg.Version, license, checkLicense)
+			if v == nil && info != nil {
+				v = checkInstallScriptsPolicy(info)
+			}
+			if v != nil {
+				return sendError(ctx, &httpError{Status: 403, Code: errPolicyDenied, Message: v.Error(), Pkg: reqPkg.String(), Policy: v})
+			}
+		}
+
+		// check the package version against the security advisories
+		if cfg.Advisories.Action != "" && !reqPkg.FromEsmsh && !reqPkg.FromGithub {
+			advisories, v := checkAdvisories(reqPkg.Name, reqPkg.Version)
+			if v != nil {
+				return sendError(ctx, &httpError{Status: 403, Code: errPolicyDenied, Message: v.Error(), Pkg: reqPkg.String(), Policy: v})
+			}
+			if len(advisories) > 0 && cfg.Advisories.Action == "warn" {
+				ctx.W.Header().Set("X-Esm-Advisories", toHeaderValue(advisoriesString(advisories)))
+			}
+		}
+
+		// surface the deprecation message and the license of the resolved version, the pinned urls read
+		// them from the build meta instead to avoid the registry lookup
+		versionResolved := !strings.HasPrefix(pathname, fmt.Sprintf("/%s@%s", reqPkg.Name, reqPkg.Version))
+		if versionResolved && !reqPkg.FromEsmsh && !reqPkg.FromGithub {
+			if info, _, err := getPackageInfo("", reqPkg.Name, reqPkg.Version); err == nil {
+				if info.Deprecated != "" {
+					ctx.W.Header().Set("X-Esm-Deprecated", toHeaderValue(info.Deprecated))
+				}
+				if info.License != "" {
+					ctx.W.Header().Set("X-Esm-License", toHeaderValue(info.License))
+				}
+			}
 		}
 
 		// fix url related `import.meta.url`
@@ -562,9 +1003,9 @@ func esmHandler() rex.Handle {
 			extname := path.Ext(reqPkg.Subpath)
 			dir := path.Join(cfg.WorkDir, "npm", reqPkg.Name+"@"+reqPkg.Version)
 			if !dirExists(dir) {
-				err := installPackage(dir, reqPkg)
+				err := installPackage(dir, reqPkg, getRequestSpan(ctx.R))
 				if err != nil {
-					return rex.Status(500, err.Error())
+					return throwPkgError(ctx, reqPkg, 500, errInstallFailed, err.Error())
 				}
 			}
 			pkgRoot := path.Join(dir, "node_modules", reqPkg.Name)
@@ -572,7 +1013,7 @@ func esmHandler() rex.Handle {
 				return strings.HasSuffix(fp, extname)
 			})
 			if err != nil {
-				return rex.Status(500, err.Error())
+				return throwError(ctx, 500, errInternal, err.Error())
 			}
 			var file string
 			if l := len(files); l == 1 {
@@ -595,7 +1036,7 @@ func esmHandler() rex.Handle {
 				}
 			}
 			if file == "" {
-				return rex.Status(404, "File not found")
+				return throwPkgError(ctx, reqPkg, 404, errFileNotFound, "File not found")
 			}
 			url := fmt.Sprintf("%s%s/%s@%s/%s", cdnOrigin, cfg.CdnBasePath, reqPkg.Name, reqPkg.Version, file)
 			return rex.Redirect(url, http.StatusMovedPermanently)
@@ -607,7 +1048,7 @@ func esmHandler() rex.Handle {
 			if reqPkg.Submodule == "" {
 				info, _, err := getPackageInfo("", reqPkg.Name, reqPkg.Version)
 				if err != nil {
-					return rex.Status(500, err.Error())
+					return throwResolveError(ctx, err)
 				}
 				types := "index.d.ts"
 				if info.Types != "" {
@@ -644,6 +1085,10 @@ func esmHandler() rex.Handle {
 			ghPrefix = "/gh"
 		}
 
+		// the `?no-redirect` query serves the resolved module directly instead of redirecting to the
+		// url with full package version, the url is sent in the `Content-Location` header
+		noRedirect := ctx.Form.Has("no-redirect")
+
 		// redirect to the url with full package version
 		if !hasBuildVerPrefix && !reqPkg.FromEsmsh && !strings.HasPrefix(pathname, fmt.Sprintf("%s/%s@%s", ghPrefix, reqPkg.Name, reqPkg.Version)) {
 			bvPrefix := ""
@@ -657,20 +1102,31 @@ func esmHandler() rex.Handle {
 					bvPrefix = fmt.Sprintf("/v%d", CTX_BUILD_VERSION)
 				}
 			}
+			if typesResolve {
+				bvPrefix = "/types-resolve"
+			}
 			if external.Has("*") {
 				eaSign = "*"
 			}
 			if reqPkg.Subpath != "" {
 				subPath = "/" + reqPkg.Subpath
 			}
-			if ctx.R.URL.RawQuery != "" {
+			var url string
+			if rawQuery := getRedirectQuery(ctx, noRedirect); rawQuery != "" {
 				if extraQuery != "" {
-					query = "&" + ctx.R.URL.RawQuery
-					return rex.Redirect(fmt.Sprintf("%s%s%s%s/%s%s@%s%s%s", cdnOrigin, cfg.CdnBasePath, bvPrefix, ghPrefix, eaSign, reqPkg.Name, reqPkg.Version, query, subPath), http.StatusFound)
+					query = "&" + rawQuery
+					url = fmt.Sprintf("%s%s%s%s/%s%s@%s%s%s", cdnOrigin, cfg.CdnBasePath, bvPrefix, ghPrefix, eaSign, reqPkg.Name, reqPkg.Version, query, subPath)
+				} else {
+					query = "?" + rawQuery
 				}
-				query = "?" + ctx.R.URL.RawQuery
 			}
-			return rex.Redirect(fmt.Sprintf("%s%s%s%s/%s%s@%s%s%s", cdnOrigin, cfg.CdnBasePath, bvPrefix, ghPrefix, eaSign, reqPkg.Name, reqPkg.Version, subPath, query), http.StatusFound)
+			if url == "" {
+				url = fmt.Sprintf("%s%s%s%s/%s%s@%s%s%s", cdnOrigin, cfg.CdnBasePath, bvPrefix, ghPrefix, eaSign, reqPkg.Name, reqPkg.Version, subPath, query)
+			}
+			if !noRedirect {
+				return rex.Redirect(url, http.StatusFound)
+			}
+			defer setNoRedirectHeaders(header, url)
 		}
 
 		// redirect to the url with full package version with build version prefix
@@ -690,10 +1146,14 @@ func esmHandler() rex.Handle {
 			if reqPkg.Subpath != "" {
 				subPath = "/" + reqPkg.Subpath
 			}
-			if ctx.R.URL.RawQuery != "" {
-				query = "?" + ctx.R.URL.RawQuery
+			if rawQuery := getRedirectQuery(ctx, noRedirect); rawQuery != "" {
+				query = "?" + rawQuery
 			}
-			return rex.Redirect(fmt.Sprintf("%s%s%s/%s%s%s", cdnOrigin, cfg.CdnBasePath, bvPrefix, reqPkg.VersionName(), subPath, query), http.StatusFound)
+			url := fmt.Sprintf("%s%s%s/%s%s%s", cdnOrigin, cfg.CdnBasePath, bvPrefix, reqPkg.VersionName(), subPath, query)
+			if !noRedirect {
+				return rex.Redirect(url, http.StatusFound)
+			}
+			defer setNoRedirectHeaders(header, url)
 		}
 
 		// support `https://esm.sh/react?dev&target=es2020/jsx-runtime` pattern for jsx transformer
@@ -714,8 +1174,30 @@ func esmHandler() rex.Handle {
 			reqPkg.Submodule = utils.CleanPath(v)[1:]
 		}
 
+		// `?no-transform` (or `?raw`) query serves the published files of the package byte-for-byte
+		noTransform := (ctx.Form.Has("no-transform") || ctx.Form.Has("raw")) && !hasBuildVerPrefix && !reqPkg.FromGithub && !typesResolve
+		if noTransform && reqPkg.Subpath == "" {
+			info, _, err := getPackageInfo("", reqPkg.Name, reqPkg.Version)
+			if err != nil {
+				return throwResolveError(ctx, err)
+			}
+			entry := info.Module
+			if entry == "" {
+				entry = info.Main
+			}
+			if entry == "" {
+				entry = "index.js"
+			} else if path.Ext(entry) == "" {
+				entry += ".js"
+			}
+			url := fmt.Sprintf("%s%s/%s/%s?no-transform", cdnOrigin, cfg.CdnBasePath, reqPkg.VersionName(), utils.CleanPath(entry)[1:])
+			return rex.Redirect(url, http.StatusFound)
+		}
+
 		var reqType string
-		if reqPkg.Subpath != "" {
+		if noTransform {
+			reqType = "raw"
+		} else if reqPkg.Subpath != "" {
 			ext := path.Ext(reqPkg.Subpath)
 			switch ext {
 			case ".mjs", ".js", ".jsx", ".ts", ".mts", ".tsx":
@@ -740,7 +1222,7 @@ func esmHandler() rex.Handle {
 				} else {
 					reqType = "raw"
 				}
-			case ".css", ".map":
+			case ".css", ".map", ".sig":
 				if hasBuildVerPrefix && hasTargetSegment(reqPkg.Subpath) {
 					reqType = "builds"
 				} else {
@@ -753,6 +1235,11 @@ func esmHandler() rex.Handle {
 			}
 		}
 
+		// the `/types-resolve` API only resolves modules
+		if typesResolve && reqType != "" {
+			return throwError(ctx, 400, errBadRequest, "types-resolve: not a module")
+		}
+
 		// serve raw dist or npm dist files like CSS/map etc..
 		if reqType == "raw" {
 			installDir := fmt.Sprintf("npm/%s", reqPkg.VersionName())
@@ -760,7 +1247,7 @@ func esmHandler() rex.Handle {
 			fi, err := os.Lstat(savePath)
 			if err != nil {
 				if os.IsExist(err) {
-					return rex.Status(500, err.Error())
+					return throwError(ctx, 500, errInternal, err.Error())
 				}
 				task := &BuildTask{
 					CdnOrigin: cdnOrigin,
@@ -774,39 +1261,57 @@ func esmHandler() rex.Handle {
 					},
 					Target: "raw",
 				}
-				c := buildQueue.Add(task, ctx.RemoteIP())
+				if res := checkColdBuild(ctx); res != nil {
+					return res
+				}
+				if cfg.ReadOnly {
+					return forwardBuild(ctx)
+				}
+				task.trigger = getAuditTrigger(ctx, "request")
+				task.parentSpan = getRequestSpan(ctx.R)
+				c := buildQueue.Add(task, getClientIP(ctx))
 				select {
 				case output := <-c.C:
 					if output.err != nil {
-						return rex.Status(500, "Fail to install package: "+output.err.Error())
+						return throwBuildError(ctx, reqPkg, errInstallFailed, fmt.Errorf("Fail to install package: %w", output.err))
 					}
 					fi, err = os.Lstat(savePath)
 					if err != nil {
 						if os.IsExist(err) {
-							return rex.Status(500, err.Error())
+							return throwError(ctx, 500, errInternal, err.Error())
 						}
-						return rex.Status(404, "File Not Found")
+						return throwPkgError(ctx, reqPkg, 404, errFileNotFound, "File Not Found")
 					}
 				case <-time.After(10 * time.Minute):
 					buildQueue.RemoveConsumer(task, c)
 					header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
-					return rex.Status(http.StatusRequestTimeout, "timeout, we are downloading package hardly, please try again later!")
+					return throwPkgError(ctx, reqPkg, http.StatusRequestTimeout, errBuildTimeout, "timeout, we are downloading package hardly, please try again later!")
 				}
 			}
 
+			if fi.IsDir() {
+				return throwPkgError(ctx, reqPkg, 404, errFileNotFound, "File Not Found")
+			}
 			content, err := os.Open(savePath)
 			if err != nil {
 				if os.IsExist(err) {
-					return rex.Status(500, err.Error())
+					return throwError(ctx, 500, errInternal, err.Error())
 				}
-				return rex.Status(404, "File Not Found")
+				return throwPkgError(ctx, reqPkg, 404, errFileNotFound, "File Not Found")
+			}
+			switch path.Ext(savePath) {
+			case ".js", ".mjs", ".cjs", ".jsx":
+				header.Set("Content-Type", "application/javascript; charset=utf-8")
+			case ".ts", ".mts", ".cts", ".tsx":
+				header.Set("Content-Type", "application/typescript; charset=utf-8")
 			}
 			header.Set("Cache-Control", "public, max-age=31536000, immutable")
+			header.Set("ETag", getFileETag(savePath, fi.ModTime(), ""))
 			return rex.Content(savePath, fi.ModTime(), content) // auto closed
 		}
 
-		// serve build files
-		if hasBuildVerPrefix && (reqType == "builds" || reqType == "types") {
+		// serve build files, the `?bundle` and `?esm` types are transformed in the "build and return dts" step
+		if hasBuildVerPrefix && (reqType == "builds" || (reqType == "types" && !ctx.Form.Has("bundle") && !ctx.Form.Has("esm"))) {
 			var savePath string
 			if outdatedBuildVer != "" {
 				savePath = path.Join(reqType, outdatedBuildVer, pathname)
@@ -818,21 +1323,34 @@ func esmHandler() rex.Handle {
 			if reqType == "types" {
 				savePath = path.Join("types", getTypesRoot(cdnOrigin), strings.TrimPrefix(savePath, "types/"))
 			}
+			// the detached signature of the build file
+			if reqType == "builds" && signingKey != nil && strings.HasSuffix(savePath, ".sig") {
+				fi, err := fs.Stat(strings.TrimSuffix(savePath, ".sig"))
+				if err != nil {
+					if err == storage.ErrNotFound {
+						return throwPkgError(ctx, reqPkg, 404, errFileNotFound, "Not found")
+					}
+					return throwError(ctx, 500, errInternal, err.Error())
+				}
+				signature, err := getFileSignature(strings.TrimSuffix(savePath, ".sig"), fi.ModTime())
+				if err != nil {
+					return throwError(ctx, 500, errInternal, err.Error())
+				}
+				header.Set("Content-Type", "text/plain; charset=utf-8")
+				header.Set("Cache-Control", "public, max-age=31536000, immutable")
+				return signature
+			}
 			fi, err := fs.Stat(savePath)
 			if err != nil {
 				if err == storage.ErrNotFound && strings.HasSuffix(pathname, ".map") {
-					return rex.Status(404, "Not found")
+					return throwPkgError(ctx, reqPkg, 404, errFileNotFound, "Not found")
 				}
 				if err != storage.ErrNotFound {
-					return rex.Status(500, err.Error())
+					return throwError(ctx, 500, errInternal, err.Error())
 				}
 			}
 
 			if err == nil {
-				r, err := fs.OpenFile(savePath)
-				if err != nil {
-					return rex.Status(500, err.Error())
-				}
 				if reqType == "types" {
 					header.Set("Content-Type", "application/typescript; charset=utf-8")
 				} else if endsWith(pathname, ".js", ".mjs", ".jsx", ".ts", ".mts", ".tsx") {
@@ -842,16 +1360,43 @@ func esmHandler() rex.Handle {
 				}
 				header.Set("Cache-Control", "public, max-age=31536000, immutable")
 				if ctx.Form.Has("worker") && reqType == "builds" {
+					header.Set("Content-Type", "application/javascript; charset=utf-8")
+					if workerMode := ctx.Form.Value("worker"); workerMode == "url" {
+						return getWorkerFactory(workerMode, nil)
+					}
+					r, err := fs.OpenFile(savePath)
+					if err != nil {
+						return throwError(ctx, 500, errInternal, err.Error())
+					}
 					defer r.Close()
 					buf, err := io.ReadAll(r)
 					if err != nil {
-						return rex.Status(500, err.Error())
+						return throwError(ctx, 500, errInternal, err.Error())
 					}
 					code := bytes.TrimSuffix(buf, []byte(fmt.Sprintf(`//# sourceMappingURL=%s.map`, path.Base(savePath))))
-					header.Set("Content-Type", "application/javascript; charset=utf-8")
-					return fmt.Sprintf(`export default function workerFactory(inject) { const blob = new Blob([%s, typeof inject === "string" ? "\n// inject\n" + inject : ""], { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module" })}`, utils.MustEncodeJSON(string(code)))
+					return getWorkerFactory("", code)
 				}
-				return rex.Content(savePath, fi.ModTime(), r) // auto closed
+				if isIntegrity && reqType == "builds" {
+					id := strings.TrimPrefix(savePath, "builds/")
+					if hasStablePrefix {
+						id = "stable" + pathname
+					}
+					header.Set("Content-Type", "application/json; charset=utf-8")
+					return serveIntegrityManifest(ctx, cdnOrigin, id)
+				}
+				if cfg.ModulePreload && reqType == "builds" && endsWith(pathname, ".mjs", ".js") {
+					id := strings.TrimPrefix(savePath, "builds/")
+					if hasStablePrefix {
+						id = "stable" + pathname
+					}
+					if esm, ok := queryESMBuild(id); ok {
+						setModulePreloadLinks(header, esm.Deps)
+					}
+				}
+				if reqType == "builds" && endsWith(pathname, ".mjs", ".js", ".css") {
+					setArtifactHeaders(header, savePath, fi.ModTime())
+				}
+				return serveStorageFile(ctx, savePath, fi.ModTime())
 			}
 		}
 
@@ -871,6 +1416,19 @@ func esmHandler() rex.Handle {
 			}
 		}
 
+		// check `?define` query, e.g. `?define=process.env.NODE_ENV:production,__DEV__:false`
+		define := map[string]string{}
+		if ctx.Form.Has("define") {
+			for _, p := range strings.Split(ctx.Form.Value("define"), ",") {
+				key, value := utils.SplitByFirstByte(strings.TrimSpace(p), ':')
+				key = strings.TrimSpace(key)
+				value = strings.TrimSpace(value)
+				if regexpJSMemberPath.MatchString(key) && value != "" {
+					define[key] = toDefineValue(value)
+				}
+			}
+		}
+
 		// check `?deps` query
 		deps := PkgSlice{}
 		if ctx.Form.Has("deps") {
@@ -882,7 +1440,7 @@ func esmHandler() rex.Handle {
 						if strings.HasSuffix(err.Error(), "not found") {
 							continue
 						}
-						return rex.Status(400, fmt.Sprintf("Invalid deps query: %v not found", p))
+						return throwError(ctx, 400, errInvalidQuery, fmt.Sprintf("Invalid deps query: %v not found", p))
 					}
 					if reqPkg.Name == "react-dom" && m.Name == "react" {
 						// the `react` version always matches `react-dom` version
@@ -907,6 +1465,83 @@ func esmHandler() rex.Handle {
 			}
 		}
 
+		// check `?jsx` queries
+		jsx := ctx.Form.Value("jsx")
+		jsxImportSource := ""
+		jsxFactory := ""
+		jsxFragment := ""
+		switch jsx {
+		case "automatic":
+			if v := ctx.Form.Value("jsx-import-source"); v != "" {
+				if !validatePackageName(v) {
+					return throwError(ctx, 400, errInvalidQuery, fmt.Sprintf("Invalid jsx-import-source query: %s", v))
+				}
+				jsxImportSource = v
+			}
+		case "classic":
+			if v := ctx.Form.Value("jsx-factory"); v != "" {
+				if !regexpJSMemberPath.MatchString(v) {
+					return throwError(ctx, 400, errInvalidQuery, fmt.Sprintf("Invalid jsx-factory query: %s", v))
+				}
+				jsxFactory = v
+			}
+			if v := ctx.Form.Value("jsx-fragment"); v != "" {
+				if !regexpJSMemberPath.MatchString(v) {
+					return throwError(ctx, 400, errInvalidQuery, fmt.Sprintf("Invalid jsx-fragment query: %s", v))
+				}
+				jsxFragment = v
+			}
+		case "":
+		default:
+			return throwError(ctx, 400, errInvalidQuery, fmt.Sprintf("Invalid jsx query: %s", jsx))
+		}
+
+		// check `?format=iife` or `?standalone` query, e.g. `?format=iife&global-name=MyLib`
+		globalName := ""
+		if ctx.Form.Value("format") == "iife" || ctx.Form.Has("standalone") {
+			globalName = ctx.Form.Value("global-name")
+			if globalName == "" {
+				globalName = toGlobalName(reqPkg.Name)
+			}
+			if !regexpJSMemberPath.MatchString(globalName) {
+				return throwError(ctx, 400, errInvalidQuery, fmt.Sprintf("Invalid global-name query: %s", globalName))
+			}
+		}
+
+		// check `?banner` query, only the banners in the `banners` config are allowed
+		banner := ctx.Form.Value("banner")
+		if banner != "" {
+			if _, ok := cfg.Banners[banner]; !ok {
+				return throwError(ctx, 400, errInvalidQuery, fmt.Sprintf("Invalid banner query: %s", banner))
+			}
+		}
+
+		// check `?lock` (or `?deps-lock`) query, the token of the lockfile uploaded by `POST /-/lock`
+		lock := ctx.Form.Value("lock")
+		if lock == "" {
+			lock = ctx.Form.Value("deps-lock")
+		}
+		if lock != "" {
+			if _, err := getLockfile(lock); err != nil {
+				return throwError(ctx, 400, errInvalidQuery, fmt.Sprintf("Invalid lock query: %s", lock))
+			}
+		}
+
+		// check `?ts` query or the `TypeScript/x.y` token of the UA, to select the `typesVersions` of package.json
+		tsVersion := ""
+		if v := ctx.Form.Value("ts"); v != "" {
+			var ok bool
+			tsVersion, ok = toTSVersion(v)
+			if !ok {
+				return throwError(ctx, 400, errInvalidQuery, fmt.Sprintf("Invalid ts query: %s", v))
+			}
+		} else if m := regexpTSVersionUA.FindStringSubmatch(userAgent); m != nil {
+			tsVersion, _ = toTSVersion(m[1])
+			if !includes(varyHeaders, "User-Agent") {
+				varyHeaders = append(varyHeaders, "User-Agent")
+			}
+		}
+
 		// check `?conditions` query
 		conditions := newStringSet()
 		if ctx.Form.Has("conditions") {
@@ -959,13 +1594,27 @@ func esmHandler() rex.Handle {
 		}
 
 		isPkgCss := ctx.Form.Has("css")
+		injectCss := ctx.Form.Has("inject-css")
 		isBundle := ctx.Form.Has("bundle") && !stableBuild[reqPkg.Name]
 		isDev := ctx.Form.Has("dev")
 		isPined := ctx.Form.Has("pin") || hasBuildVerPrefix || stableBuild[reqPkg.Name]
 		isWorker := ctx.Form.Has("worker")
-		noCheck := ctx.Form.Has("no-check") || ctx.Form.Has("no-dts")
+		// `?worker=url` creates the worker from the module url instead of a blob url for the strict CSPs
+		workerMode := ctx.Form.Value("worker")
+		noCheck := ctx.Form.Has("no-check") || ctx.Form.Has("no-dts") || cfg.NoDts
+		// `?dts-reference` query attaches the types by a `/// <reference types>` directive instead of the header
+		dtsReference := ctx.Form.Has("dts-reference")
+		// `?bundle-types` and `?dts-esm` queries are passed to the types url as `?bundle` and `?esm`
+		dtsQuery := []string{}
+		if ctx.Form.Has("bundle-types") {
+			dtsQuery = append(dtsQuery, "bundle")
+		}
+		if ctx.Form.Has("dts-esm") {
+			dtsQuery = append(dtsQuery, "esm")
+		}
 		ignoreRequire := ctx.Form.Has("ignore-require") || reqPkg.Name == "@unocss/preset-icons"
 		keepNames := ctx.Form.Has("keep-names")
+		noMinifyIdents := ctx.Form.Has("no-minify-identifiers")
 		ignoreAnnotations := ctx.Form.Has("ignore-annotations")
 
 		// force react/jsx-dev-runtime and react-refresh into `dev` mode
@@ -976,12 +1625,22 @@ func esmHandler() rex.Handle {
 		buildArgs := BuildArgs{
 			alias:             alias,
 			conditions:        conditions,
+			define:            define,
 			denoStdVersion:    dsv,
 			deps:              deps,
 			external:          external,
 			ignoreAnnotations: ignoreAnnotations,
 			ignoreRequire:     ignoreRequire,
 			keepNames:         keepNames,
+			noMinifyIdents:    noMinifyIdents,
+			jsx:               jsx,
+			jsxImportSource:   jsxImportSource,
+			jsxFactory:        jsxFactory,
+			jsxFragment:       jsxFragment,
+			globalName:        globalName,
+			banner:            banner,
+			tsVersion:         tsVersion,
+			lock:              lock,
 			exports:           exports,
 		}
 
@@ -1018,7 +1677,7 @@ func esmHandler() rex.Handle {
 			a := strings.Split(reqPkg.Submodule, "/")
 			if len(a) > 0 {
 				maybeTarget := a[0]
-				if _, ok := targets[maybeTarget]; ok {
+				if isValidTarget(maybeTarget) {
 					submodule := strings.Join(a[1:], "/")
 					pkgName := strings.TrimSuffix(path.Base(reqPkg.Name), ".js")
 					if strings.HasSuffix(submodule, ".css") {
@@ -1106,32 +1765,72 @@ func esmHandler() rex.Handle {
 					Pkg:          reqPkg,
 					Target:       "types",
 				}
-				c := buildQueue.Add(task, ctx.RemoteIP())
+				if res := checkColdBuild(ctx); res != nil {
+					return res
+				}
+				if cfg.ReadOnly {
+					return forwardBuild(ctx)
+				}
+				task.trigger = getAuditTrigger(ctx, "request")
+				task.parentSpan = getRequestSpan(ctx.R)
+				c := buildQueue.Add(task, getClientIP(ctx))
 				select {
 				case output := <-c.C:
 					if output.err != nil {
-						return rex.Status(500, "types: "+output.err.Error())
+						return throwBuildError(ctx, reqPkg, errBuildFailed, fmt.Errorf("types: %w", output.err))
 					}
 				case <-time.After(10 * time.Minute):
 					buildQueue.RemoveConsumer(task, c)
 					header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
-					return rex.Status(http.StatusRequestTimeout, "timeout, we are transforming the types hardly, please try again later!")
+					return throwPkgError(ctx, reqPkg, http.StatusRequestTimeout, errBuildTimeout, "timeout, we are transforming the types hardly, please try again later!")
 				}
 			}
 			savePath, fi, err := findDts()
 			if err != nil {
 				if err == storage.ErrNotFound {
-					return rex.Status(404, "Types not found")
+					return throwPkgError(ctx, reqPkg, 404, errTypesNotFound, "Types not found")
+				}
+				return throwError(ctx, 500, errInternal, err.Error())
+			}
+			// roll up the local declaration files into a single file with `?bundle` query,
+			// and rewrite the CJS constructs of the declarations with `?esm` query
+			if ctx.Form.Has("bundle") || ctx.Form.Has("esm") {
+				var data []byte
+				if ctx.Form.Has("bundle") {
+					dtsUrl := fmt.Sprintf("%s%s%s", cdnOrigin, cfg.CdnBasePath, pathname)
+					if strings.HasSuffix(dtsUrl, "~.d.ts") {
+						dtsUrl = strings.TrimSuffix(dtsUrl, "~.d.ts")
+						if strings.HasSuffix(savePath, path.Base(dtsUrl)+"/index.d.ts") {
+							dtsUrl += "/index.d.ts"
+						} else {
+							dtsUrl += ".d.ts"
+						}
+					}
+					data, err = bundleDTS(savePath, dtsUrl)
+				} else {
+					var r io.ReadCloser
+					r, err = fs.OpenFile(savePath)
+					if err == nil {
+						data, err = io.ReadAll(r)
+						r.Close()
+					}
 				}
-				return rex.Status(500, err.Error())
-			}
-			r, err := fs.OpenFile(savePath)
-			if err != nil {
-				return rex.Status(500, err.Error())
+				if err != nil {
+					return throwPkgError(ctx, reqPkg, 500, errInternal, "types: "+err.Error())
+				}
+				if ctx.Form.Has("esm") {
+					data, err = toESMDeclaration(data, cdnOrigin+cfg.CdnBasePath)
+					if err != nil {
+						return throwPkgError(ctx, reqPkg, 500, errInternal, "types: "+err.Error())
+					}
+				}
+				header.Set("Content-Type", "application/typescript; charset=utf-8")
+				header.Set("Cache-Control", "public, max-age=31536000, immutable")
+				return data
 			}
 			header.Set("Content-Type", "application/typescript; charset=utf-8")
 			header.Set("Cache-Control", "public, max-age=31536000, immutable")
-			return rex.Content(savePath, fi.ModTime(), r) // auto closed
+			return serveStorageFile(ctx, savePath, fi.ModTime())
 		}
 
 		task := &BuildTask{
@@ -1141,12 +1840,15 @@ func esmHandler() rex.Handle {
 			Pkg:          reqPkg,
 			Target:       target,
 			Dev:          isDev,
-			Bundle:       isBundle || isWorker,
+			Bundle:       isBundle || isWorker || buildArgs.globalName != "",
 		}
 
 		buildId := task.ID()
 		esm, hasBuild := queryESMBuild(buildId)
+		recordCacheLookup("builds", hasBuild)
+		targetRequests.Inc(target, targetSource)
 		fallback := false
+		stale := false
 
 		if !hasBuild {
 			if !isBarePath && !isPined {
@@ -1166,9 +1868,19 @@ func esmHandler() rex.Handle {
 			// if the previous build exists and is not pin/bare mode, then build current module in backgound,
 			// or wait the current build task for 60 seconds
 			if esm != nil {
-				buildQueue.Add(task, "")
+				if !cfg.ReadOnly {
+					task.trigger = getAuditTrigger(ctx, "revalidate")
+					task.parentSpan = getRequestSpan(ctx.R)
+					buildQueue.Add(task, "")
+				}
+			} else if res := checkColdBuild(ctx); res != nil {
+				return res
+			} else if cfg.ReadOnly {
+				return forwardBuild(ctx)
 			} else {
-				c := buildQueue.Add(task, ctx.RemoteIP())
+				task.trigger = getAuditTrigger(ctx, "request")
+				task.parentSpan = getRequestSpan(ctx.R)
+				c := buildQueue.Add(task, getClientIP(ctx))
 				select {
 				case output := <-c.C:
 					if output.err != nil {
@@ -1181,19 +1893,64 @@ func esmHandler() rex.Handle {
 								return rex.Redirect(url, http.StatusMovedPermanently)
 							}
 							header.Set("Cache-Control", "public, max-age=31536000, immutable")
-							return rex.Status(404, "Module not found")
+							return throwPkgError(ctx, reqPkg, 404, errModuleNotFound, "Module not found")
+						}
+						// serve the last known good build if the rebuild fails
+						staleEsm, ok := loadStaleBuild(task.ID())
+						if !ok {
+							return throwBuildError(ctx, reqPkg, errBuildFailed, output.err)
 						}
-						return throwErrorJS(ctx, output.err)
+						log.Warnf("serve the stale build '%s': %v", task.ID(), output.err)
+						header.Set("Warning", `111 - "Revalidation Failed"`)
+						esm = staleEsm
+						fallback = true
+						stale = true
+					} else {
+						esm = output.meta
 					}
-					esm = output.meta
 				case <-time.After(10 * time.Minute):
 					buildQueue.RemoveConsumer(task, c)
 					header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
-					return rex.Status(http.StatusRequestTimeout, "timeout, we are building the package hardly, please try again later!")
+					return throwPkgError(ctx, reqPkg, http.StatusRequestTimeout, errBuildTimeout, "timeout, we are building the package hardly, please try again later!")
 				}
 			}
 		}
 
+		// the deprecation message and the license of the pinned urls and the github packages are known after the build
+		if esm.Deprecated != "" && header.Get("X-Esm-Deprecated") == "" {
+			header.Set("X-Esm-Deprecated", toHeaderValue(esm.Deprecated))
+		}
+		if esm.License != "" && header.Get("X-Esm-License") == "" {
+			header.Set("X-Esm-License", toHeaderValue(esm.License))
+		}
+
+		// return the declaration url that is attached to the module by the types header,
+		// `null` if the module has no types
+		if typesResolve {
+			var dtsUrl interface{}
+			if esm.Dts != "" && !noCheck {
+				url := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, strings.TrimPrefix(esm.Dts, "/"))
+				if len(dtsQuery) > 0 {
+					url += "?" + strings.Join(dtsQuery, "&")
+				}
+				dtsUrl = url
+			}
+			if fallback {
+				header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			} else if isPined {
+				header.Set("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", 24*3600)) // cache for 24 hours
+			}
+			for _, h := range varyHeaders {
+				header.Add("Vary", h)
+			}
+			return map[string]interface{}{
+				"specifier": reqPkg.String(),
+				"types":     dtsUrl,
+			}
+		}
+
 		// should redirect to `*.d.ts` file
 		if esm.TypesOnly {
 			dtsUrl := fmt.Sprintf(
@@ -1202,7 +1959,17 @@ func esmHandler() rex.Handle {
 				cfg.CdnBasePath,
 				strings.TrimPrefix(esm.Dts, "/"),
 			)
-			header.Set("X-TypeScript-Types", dtsUrl)
+			if len(dtsQuery) > 0 {
+				dtsUrl += "?" + strings.Join(dtsQuery, "&")
+			}
+			body := "export default null;\n"
+			if !noCheck {
+				if dtsReference {
+					body = fmt.Sprintf("/// <reference types=\"%s\" />\n%s", dtsUrl, body)
+				} else {
+					header.Set(getTypesHeader(), dtsUrl)
+				}
+			}
 			header.Set("Content-Type", "application/javascript; charset=utf-8")
 			if fallback {
 				header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
@@ -1216,13 +1983,26 @@ func esmHandler() rex.Handle {
 			if ctx.R.Method == http.MethodHead {
 				return []byte{}
 			}
-			return []byte("export default null;\n")
+			return []byte(body)
+		}
+
+		// the `?integrity` query returns the SRI manifest of the module graph
+		if isIntegrity {
+			if isPined && !fallback && !stale {
+				header.Set("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60))
+			}
+			for _, h := range varyHeaders {
+				header.Add("Vary", h)
+			}
+			return serveIntegrityManifest(ctx, cdnOrigin, buildId)
 		}
 
 		// redirect to package css from `?css`
 		if isPkgCss && reqPkg.Submodule == "" {
 			if !esm.PackageCSS {
-				return rex.Status(404, "Package CSS not found")
+				return throwPkgError(ctx, reqPkg, 404, errFileNotFound, "Package CSS not found")
 			}
 			url := fmt.Sprintf("%s%s/%s.css", cdnOrigin, cfg.CdnBasePath, strings.TrimSuffix(buildId, path.Ext(buildId)))
 			code := 302
@@ -1232,8 +2012,39 @@ func esmHandler() rex.Handle {
 			return rex.Redirect(url, code)
 		}
 
+		// serve the standalone build as a classic script
+		if buildArgs.globalName != "" && !isBarePath {
+			savePath := task.getSavepath()
+			if stale {
+				savePath = staleBuildPrefix + savePath
+			}
+			fi, err := fs.Stat(savePath)
+			if err != nil {
+				if err == storage.ErrNotFound {
+					return throwPkgError(ctx, reqPkg, 404, errFileNotFound, "File not found")
+				}
+				return throwError(ctx, 500, errInternal, err.Error())
+			}
+			if stale {
+				header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			} else if isPined {
+				header.Set("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", 24*3600)) // cache for 24 hours
+			}
+			for _, h := range varyHeaders {
+				header.Add("Vary", h)
+			}
+			header.Set("Content-Type", "application/javascript; charset=utf-8")
+			setArtifactHeaders(header, savePath, fi.ModTime())
+			return serveStorageFile(ctx, savePath, fi.ModTime())
+		}
+
 		if isBarePath {
 			savePath := task.getSavepath()
+			if stale {
+				savePath = staleBuildPrefix + savePath
+			}
 			if strings.HasSuffix(reqPkg.Subpath, ".css") {
 				base, _ := utils.SplitByLastByte(savePath, '.')
 				savePath = base + ".css"
@@ -1241,38 +2052,65 @@ func esmHandler() rex.Handle {
 			fi, err := fs.Stat(savePath)
 			if err != nil {
 				if err == storage.ErrNotFound {
-					return rex.Status(404, "File not found")
+					return throwPkgError(ctx, reqPkg, 404, errFileNotFound, "File not found")
 				}
-				return rex.Status(500, err.Error())
+				return throwError(ctx, 500, errInternal, err.Error())
 			}
-			f, err := fs.OpenFile(savePath)
-			if err != nil {
-				return rex.Status(500, err.Error())
+			if stale {
+				header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			} else {
+				header.Set("Cache-Control", "public, max-age=31536000, immutable")
 			}
-			header.Set("Cache-Control", "public, max-age=31536000, immutable")
 			if isWorker && endsWith(savePath, ".mjs", ".js") {
+				header.Set("Content-Type", "application/javascript; charset=utf-8")
+				if workerMode == "url" {
+					return getWorkerFactory(workerMode, nil)
+				}
+				f, err := fs.OpenFile(savePath)
+				if err != nil {
+					return throwError(ctx, 500, errInternal, err.Error())
+				}
 				buf, err := io.ReadAll(f)
 				f.Close()
 				if err != nil {
-					return rex.Status(500, err.Error())
+					return throwError(ctx, 500, errInternal, err.Error())
 				}
 				code := bytes.TrimSuffix(buf, []byte(fmt.Sprintf(`//# sourceMappingURL=%s.map`, path.Base(savePath))))
-				header.Set("Content-Type", "application/javascript; charset=utf-8")
-				return fmt.Sprintf(`export default function workerFactory(inject) { const blob = new Blob([%s, typeof inject === "string" ? "\n// inject\n" + inject : ""], { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module" })}`, utils.MustEncodeJSON(string(code)))
+				return getWorkerFactory("", code)
 			}
 			if endsWith(savePath, ".mjs", ".js") {
 				header.Set("Content-Type", "application/javascript; charset=utf-8")
+				setModulePreloadLinks(header, esm.Deps)
 			}
-			return rex.Content(savePath, fi.ModTime(), f) // auto closed
+			setArtifactHeaders(header, savePath, fi.ModTime())
+			return serveStorageFile(ctx, savePath, fi.ModTime())
 		}
 
 		buf := bytes.NewBuffer(nil)
 		fmt.Fprintf(buf, `/* esm.sh - %v */%s`, reqPkg, EOL)
 
+		if esm.Dts != "" && !noCheck && !isWorker {
+			dtsUrl := fmt.Sprintf("%s%s%s", cdnOrigin, cfg.CdnBasePath, esm.Dts)
+			if len(dtsQuery) > 0 {
+				dtsUrl += "?" + strings.Join(dtsQuery, "&")
+			}
+			if dtsReference {
+				fmt.Fprintf(buf, `/// <reference types="%s" />%s`, dtsUrl, EOL)
+			} else {
+				header.Set(getTypesHeader(), dtsUrl)
+			}
+		}
+
 		if isWorker {
-			fmt.Fprintf(buf, `export { default } from "%s/%s?worker";`, cfg.CdnBasePath, buildId)
+			if workerMode == "url" {
+				fmt.Fprintf(buf, `export { default } from "%s/%s?worker=url";`, cfg.CdnBasePath, buildId)
+			} else {
+				fmt.Fprintf(buf, `export { default } from "%s/%s?worker";`, cfg.CdnBasePath, buildId)
+			}
 		} else {
-			if len(esm.Deps) > 0 {
+			// the side-effect imports of the deps defeat tree-shaking in the downstream bundlers,
+			// skip them if the package declares `sideEffects: false`
+			if len(esm.Deps) > 0 && !esm.SideEffectsFree {
 				// TODO: lookup deps of deps?
 				for _, dep := range esm.Deps {
 					if strings.HasPrefix(dep, "/") && cfg.CdnBasePath != "" {
@@ -1282,6 +2120,7 @@ func esmHandler() rex.Handle {
 				}
 			}
 			header.Set("X-Esm-Id", buildId)
+			setModulePreloadLinks(header, append([]string{"/" + buildId}, esm.Deps...))
 			fmt.Fprintf(buf, `export * from "%s/%s";%s`, cfg.CdnBasePath, buildId, EOL)
 			if (esm.FromCJS || esm.HasExportDefault) && (exports.Len() == 0 || exports.Has("default")) {
 				fmt.Fprintf(buf, `export { default } from "%s/%s";%s`, cfg.CdnBasePath, buildId, EOL)
@@ -1290,12 +2129,19 @@ func esmHandler() rex.Handle {
 				fmt.Fprintf(buf, `import __cjs_exports$ from "%s/%s";%s`, cfg.CdnBasePath, buildId, EOL)
 				fmt.Fprintf(buf, `export const { %s } = __cjs_exports$;%s`, strings.Join(exports.Values(), ", "), EOL)
 			}
+			// load the extracted package css by a `<link>` element with `?inject-css` query
+			if injectCss && esm.PackageCSS {
+				cssUrl := fmt.Sprintf("%s%s/%s.css", cdnOrigin, cfg.CdnBasePath, strings.TrimSuffix(buildId, path.Ext(buildId)))
+				// the origin comes from the request headers, it's encoded as a JS string and escaped in the selector
+				fmt.Fprintf(
+					buf,
+					`if(typeof document!=="undefined"){const h=%s;if(!document.querySelector('link[href="'+CSS.escape(h)+'"]')){const l=document.createElement("link");l.rel="stylesheet";l.href=h;document.head.appendChild(l)}}%s`,
+					utils.MustEncodeJSON(cssUrl),
+					EOL,
+				)
+			}
 		}
 
-		if esm.Dts != "" && !noCheck && !isWorker {
-			dtsUrl := fmt.Sprintf("%s%s%s", cdnOrigin, cfg.CdnBasePath, esm.Dts)
-			header.Set("X-TypeScript-Types", dtsUrl)
-		}
 		if fallback {
 			header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
 		} else {
@@ -1305,11 +2151,15 @@ func esmHandler() rex.Handle {
 				header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", 24*3600)) // cache for 24 hours
 			}
 		}
-		if targetFromUA {
-			header.Add("Vary", "User-Agent")
+		for _, h := range varyHeaders {
+			header.Add("Vary", h)
 		}
 		header.Set("Content-Length", strconv.Itoa(buf.Len()))
 		header.Set("Content-Type", "application/javascript; charset=utf-8")
+		header.Set("X-Esm-Integrity", getIntegrity(buf.Bytes()))
+		if signingKey != nil {
+			header.Set("X-Esm-Signature", signData(buf.Bytes()))
+		}
 		if ctx.R.Method == http.MethodHead {
 			return []byte{}
 		}
@@ -1317,19 +2167,187 @@ func esmHandler() rex.Handle {
 	}
 }
 
-func auth(secret string) rex.Handle {
+// auth returns a handle that requires an API key (the `authSecret`, the `apiKeys` or the keys
+// created by the admin API) for all requests if the auth is enabled.
+func auth() rex.Handle {
 	return func(ctx *rex.Context) interface{} {
-		if secret != "" && ctx.R.Header.Get("Authorization") != "Bearer "+secret {
-			return rex.Status(401, "Unauthorized")
+		// the admin dashboard page has no data, it's authorized by the admin secret of `/-/admin.json`
+		if ctx.Path.String() == apiPathPrefix+"admin" && ctx.R.Method == "GET" {
+			return nil
+		}
+		if isAuthRequired() && !isAdminRequest(ctx) && getAPIKey(ctx) == "" {
+			ctx.W.Header().Set("WWW-Authenticate", "Bearer")
+			return throwError(ctx, 401, errUnauthorized, "Unauthorized")
 		}
 		return nil
 	}
 }
 
+// compression returns a handle that enables the response compression, except for the range
+// requests since the byte ranges refer to the uncompressed content.
+func compression() rex.Handle {
+	handle := rex.Compression()
+	return func(ctx *rex.Context) interface{} {
+		if ctx.R.Header.Get("Range") != "" {
+			return nil
+		}
+		return handle(ctx)
+	}
+}
+
+// isAdminRequest checks whether the request is authorized with the `adminSecret` config.
+func isAdminRequest(ctx *rex.Context) bool {
+	if cfg.AdminSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(ctx.R.Header.Get("Authorization")), []byte("Bearer "+cfg.AdminSecret)) == 1
+}
+
+// getClientIP returns the IP of the client that is resolved by the `clientIPHandler`.
+func getClientIP(ctx *rex.Context) string {
+	if ip := ctx.R.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	return ctx.RemoteIP()
+}
+
+// serveStorageFile serves the file in the storage, the brotli-compressed file (or the precompressed
+// variant) is served as it is if the client accepts brotli, otherwise the file is decompressed (and
+// may be re-compressed by the compression middleware).
+func serveStorageFile(ctx *rex.Context, savePath string, modTime time.Time) interface{} {
+	// the encoded variants don't support the range requests
+	isRange := ctx.R.Header.Get("Range") != ""
+	if cfg.Precompress && cfg.StorageCompression == "" {
+		header := ctx.W.Header()
+		header.Add("Vary", "Accept-Encoding")
+		// serve the precompressed variant if it's not outdated
+		if !isRange && acceptsEncoding(ctx.R.Header.Get("Accept-Encoding"), "br") {
+			if fi, err := fs.Stat(savePath + ".br"); err == nil && !fi.ModTime().Before(modTime) {
+				etag := getFileETag(savePath, modTime, "br")
+				header.Set("ETag", etag)
+				header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+				if isNotModified(ctx.R, etag, modTime) {
+					return notModified()
+				}
+				r, err := fs.OpenFile(savePath + ".br")
+				if err == nil {
+					header.Set("Content-Encoding", "br")
+					return r // auto closed
+				}
+				if isCorruptedArtifact(err) {
+					// fallback to the original file
+					discardCorruptedArtifact(savePath + ".br")
+				}
+			}
+		}
+	}
+	encoder, ok := fs.(storage.FileSystemEncoder)
+	if ok {
+		ctx.W.Header().Add("Vary", "Accept-Encoding")
+	}
+	if ok && !isRange && acceptsEncoding(ctx.R.Header.Get("Accept-Encoding"), "br") {
+		r, encoding, err := encoder.OpenEncodedFile(savePath)
+		if err != nil {
+			if isCorruptedArtifact(err) {
+				return serveCorruptedArtifact(ctx, savePath)
+			}
+			return throwError(ctx, 500, errInternal, err.Error())
+		}
+		if encoding == "br" {
+			header := ctx.W.Header()
+			etag := getFileETag(savePath, modTime, "br")
+			header.Set("ETag", etag)
+			header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+			if isNotModified(ctx.R, etag, modTime) {
+				r.Close()
+				return notModified()
+			}
+			header.Set("Content-Encoding", "br")
+			return r // auto closed
+		}
+		ctx.W.Header().Set("ETag", getFileETag(savePath, modTime, ""))
+		return rex.Content(savePath, modTime, r) // auto closed
+	}
+	// the conditional requests are handled by the `http.ServeContent` with the ETag header
+	ctx.W.Header().Set("ETag", getFileETag(savePath, modTime, ""))
+	r, err := fs.OpenFile(savePath)
+	if err != nil {
+		if isCorruptedArtifact(err) {
+			ctx.W.Header().Del("ETag")
+			return serveCorruptedArtifact(ctx, savePath)
+		}
+		return throwError(ctx, 500, errInternal, err.Error())
+	}
+	return rex.Content(savePath, modTime, r) // auto closed
+}
+
+// serveIntegrityManifest returns the SRI manifest of the build and its dependencies.
+func serveIntegrityManifest(ctx *rex.Context, cdnOrigin string, buildId string) interface{} {
+	manifest, err := getIntegrityManifest(cdnOrigin, buildId)
+	if err != nil {
+		return throwError(ctx, 500, errInternal, err.Error())
+	}
+	ctx.W.Header().Set("X-Esm-Id", buildId)
+	return map[string]interface{}{"integrity": manifest}
+}
+
+// acceptsEncoding checks whether the `Accept-Encoding` header accepts the encoding.
+func acceptsEncoding(acceptEncoding string, encoding string) bool {
+	for _, p := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(p, ";")
+		if strings.EqualFold(strings.TrimSpace(name), encoding) {
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// the max number of the `modulepreload` links of a module
+const maxModulePreloadLinks = 16
+
+// setModulePreloadLinks adds the `Link: <...>; rel="modulepreload"` header for the modules with
+// the `modulePreload` config, so the browsers can fetch the dependencies before parsing the module.
+func setModulePreloadLinks(header http.Header, modules []string) {
+	if !cfg.ModulePreload {
+		return
+	}
+	links := make([]string, 0, len(modules))
+	for _, url := range modules {
+		if len(links) >= maxModulePreloadLinks {
+			break
+		}
+		if strings.HasPrefix(url, "/") {
+			url = cfg.CdnBasePath + url
+		} else if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+			continue
+		}
+		links = append(links, fmt.Sprintf(`<%s>; rel="modulepreload"`, url))
+	}
+	if len(links) > 0 {
+		header.Add("Link", strings.Join(links, ", "))
+	}
+}
+
+// parsePurgeQuery parses the `pkg` or `prefix` query of the admin APIs.
+func parsePurgeQuery(ctx *rex.Context) (query PurgeQuery, err error) {
+	if pkg := ctx.Form.Value("pkg"); pkg != "" {
+		query.Name, query.Version = splitPkgNameVersion(pkg)
+		if !strings.HasPrefix(query.Name, "gh/") && !validatePackageName(query.Name) {
+			err = errors.New("invalid package name")
+		}
+		return
+	}
+	query.Prefix = ctx.Form.Value("prefix")
+	if query.Prefix == "" {
+		err = errors.New("missing `pkg` or `prefix` query")
+	}
+	return
+}
+
 func hasTargetSegment(path string) bool {
 	parts := strings.Split(path, "/")
 	for _, part := range parts {
-		if targets[part] > 0 {
+		if isValidTarget(part) {
 			return true
 		}
 	}
@@ -1342,15 +2360,88 @@ func throwErrorJS(ctx *rex.Context, err error) interface{} {
 	fmt.Fprintf(
 		buf,
 		`throw new Error("[esm.sh] " + %s);%s`,
-		strings.TrimSpace(string(utils.MustEncodeJSON(err.Error()))),
+		strings.TrimSpace(string(utils.MustEncodeJSON(redact(err.Error())))),
 		"\n",
 	)
 	fmt.Fprintf(buf, "export default null;\n")
 	ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
 	ctx.W.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	setBuildFailureHeaders(ctx.W.Header(), err)
 	return rex.Status(500, buf)
 }
 
+// getRedirectQuery returns the raw query of the redirect url, the `no-redirect` query is removed
+// from the url that is sent in the `Content-Location` header.
+func getRedirectQuery(ctx *rex.Context, noRedirect bool) string {
+	rawQuery := ctx.R.URL.RawQuery
+	if !noRedirect {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	kept := make([]string, 0, len(params))
+	for _, p := range params {
+		if name, _, _ := strings.Cut(p, "="); name != "no-redirect" && p != "" {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// getCanonicalBundleQuery returns the raw query with the `bundle-deps` alias replaced by `bundle`.
+func getCanonicalBundleQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	kept := make([]string, 0, len(params))
+	hasBundle := false
+	for _, p := range params {
+		name, _, _ := strings.Cut(p, "=")
+		if name == "bundle" || name == "bundle-deps" {
+			if !hasBundle {
+				kept = append(kept, "bundle")
+				hasBundle = true
+			}
+			continue
+		}
+		if p != "" {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// setNoRedirectHeaders sets the `Content-Location` header to the url with full package version,
+// and the response of the version range is not cached as immutable.
+func setNoRedirectHeaders(header http.Header, url string) {
+	header.Set("Content-Location", url)
+	if strings.Contains(header.Get("Cache-Control"), "immutable") {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60))
+	}
+}
+
+// setBuildFailureHeaders sets the `Retry-After` header if the build failed recently, the error
+// response can be cached until the build is retried.
+func setBuildFailureHeaders(header http.Header, err error) {
+	if f, ok := err.(*BuildFailure); ok {
+		header.Set("Retry-After", strconv.Itoa(f.RetryAfter()))
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", f.RetryAfter()))
+	}
+}
+
+// getTypesHeader returns the header to attach the type definitions, default is `X-TypeScript-Types`.
+func getTypesHeader() string {
+	if cfg.TypesHeader != "" {
+		return cfg.TypesHeader
+	}
+	return "X-TypeScript-Types"
+}
+
+// checkTypesHeader checks the `typesHeader` config.
+func checkTypesHeader(name string) error {
+	if name != "" && name != "X-TypeScript-Types" && name != "X-Deno-Types" {
+		return fmt.Errorf("invalid types header '%s'", name)
+	}
+	return nil
+}
+
 func getTypesRoot(cdnOrigin string) string {
 	url, err := url.Parse(cdnOrigin)
 	if err != nil {
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/rex"
+)
+
+func TestSetModulePreloadLinks(t *testing.T) {
+	defer func(prevCfg *config.Config) {
+		cfg = prevCfg
+	}(cfg)
+	cfg = &config.Config{ModulePreload: true, CdnBasePath: "/cdn"}
+
+	header := http.Header{}
+	setModulePreloadLinks(header, []string{"/v135/react@18.2.0/es2022/react.mjs", "https://deno.land/std/path/mod.ts", "node:fs"})
+	if link := header.Get("Link"); link != `</cdn/v135/react@18.2.0/es2022/react.mjs>; rel="modulepreload", <https://deno.land/std/path/mod.ts>; rel="modulepreload"` {
+		t.Fatalf("unexpected link header: %s", link)
+	}
+
+	// the links are limited
+	deps := make([]string, maxModulePreloadLinks+10)
+	for i := range deps {
+		deps[i] = fmt.Sprintf("/v135/dep-%d@1.0.0/es2022/dep-%d.mjs", i, i)
+	}
+	header = http.Header{}
+	setModulePreloadLinks(header, deps)
+	if n := len(strings.Split(header.Get("Link"), ", ")); n != maxModulePreloadLinks {
+		t.Fatalf("expected %d links, got %d", maxModulePreloadLinks, n)
+	}
+
+	cfg.ModulePreload = false
+	header = http.Header{}
+	setModulePreloadLinks(header, deps)
+	if header.Get("Link") != "" {
+		t.Fatal("the links should not be added")
+	}
+}
+
+func TestServeStorageFileRange(t *testing.T) {
+	localFS, err := storage.OpenFS("local:" + path.Join(t.TempDir(), "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prevFS storage.FileSystem, prevCfg *config.Config) {
+		fs, cfg = prevFS, prevCfg
+	}(fs, cfg)
+	fs, cfg = storage.NewCompressedFS(localFS, []string{"builds/"}, 0, 5), &config.Config{StorageCompression: "br"}
+
+	savePath := "builds/v135/foo@1.0.0/es2022/foo.mjs.map"
+	data := []byte(strings.Repeat("0123456789", 1000))
+	fs.WriteFile(savePath, bytes.NewReader(data))
+
+	router := &rex.Router{}
+	router.Use(compression(), func(ctx *rex.Context) interface{} {
+		return serveStorageFile(ctx, savePath, time.Now().Add(-time.Minute))
+	})
+	req := httptest.NewRequest("GET", "https://esm.sh/v135/foo@1.0.0/es2022/foo.mjs.map", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	req.Header.Set("Range", "bytes=100-109")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	h := rec.Header()
+	if rec.Code != http.StatusPartialContent || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "bytes 100-109/10000" || h.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("unexpected response: %d %v", rec.Code, h)
+	}
+	if rec.Body.String() != "0123456789" {
+		t.Fatalf("unexpected body: %q", rec.Body.String())
+	}
+
+	// the full response is sent brotli-compressed as it is
+	req.Header.Del("Range")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("unexpected response: %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestNoRedirect(t *testing.T) {
+	var contentLocation string
+	router := &rex.Router{}
+	router.Use(func(ctx *rex.Context) interface{} {
+		header := ctx.W.Header()
+		func() {
+			defer setNoRedirectHeaders(header, "https://esm.sh/react@18.2.0?"+getRedirectQuery(ctx, true))
+			header.Set("Cache-Control", "public, max-age=31536000, immutable")
+		}()
+		contentLocation = header.Get("Content-Location")
+		return "ok"
+	})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "https://esm.sh/react@^18?dev&no-redirect&target=es2022", nil))
+	if contentLocation != "https://esm.sh/react@18.2.0?dev&target=es2022" {
+		t.Fatalf("unexpected Content-Location: %s", contentLocation)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=600" {
+		t.Fatalf("unexpected Cache-Control: %s", cc)
+	}
+}
+
+func TestBundleDepsRedirect(t *testing.T) {
+	defer func(prevCfg *config.Config) {
+		cfg = prevCfg
+	}(cfg)
+	cfg = &config.Config{CdnOrigin: "https://esm.sh"}
+
+	tests := map[string]string{
+		"bundle-deps":                   "bundle",
+		"dev&bundle-deps&target=es2022": "dev&bundle&target=es2022",
+		"bundle&bundle-deps":            "bundle",
+	}
+	for query, expected := range tests {
+		if q := getCanonicalBundleQuery(query); q != expected {
+			t.Fatalf("unexpected canonical query of '%s': %s", query, q)
+		}
+	}
+
+	router := &rex.Router{}
+	router.Use(esmHandler())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "https://esm.sh/lodash-es@4.17.21?bundle-deps&dev", nil))
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://esm.sh/lodash-es@4.17.21?bundle&dev" {
+		t.Fatalf("unexpected response: %d %v", rec.Code, rec.Header())
+	}
+}
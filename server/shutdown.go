@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	shuttingDown   int32
+	activeRequests int64
+)
+
+// isShuttingDown returns true if the server is draining the requests and the builds.
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// trackRequests returns a handler that counts the in-flight requests for the shutdown progress.
+func trackRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&activeRequests, 1)
+		defer atomic.AddInt64(&activeRequests, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// shutdown stops the servers accepting new connections, drains the in-flight requests, and waits
+// for the builds in process to finish and store their artifacts. The pending builds are dropped.
+// The connections and the builds that are not done in the timeout are aborted.
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	atomic.StoreInt32(&shuttingDown, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Infof("Shutting down: %d requests and %d builds in process", atomic.LoadInt64(&activeRequests), buildQueue.Processing())
+	buildQueue.Close()
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, s := range servers {
+			wg.Add(1)
+			go func(s *http.Server) {
+				defer wg.Done()
+				s.Shutdown(ctx)
+			}(s)
+		}
+		wg.Wait()
+		buildQueue.Wait(ctx)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			if ctx.Err() == nil {
+				log.Info("Server is shut down")
+				return
+			}
+		case <-ticker.C:
+			log.Infof("Shutting down: waiting for %d requests and %d builds", atomic.LoadInt64(&activeRequests), buildQueue.Processing())
+			continue
+		case <-ctx.Done():
+		}
+		log.Warnf("Shutdown timeout(%v): %d requests and %d builds are aborted", timeout, atomic.LoadInt64(&activeRequests), buildQueue.Processing())
+		for _, s := range servers {
+			s.Close()
+		}
+		return
+	}
+}
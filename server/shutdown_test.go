@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBuildQueueClose(t *testing.T) {
+	q := newBuildQueue(1)
+	pending := &queueTask{BuildTask: &BuildTask{id: "v135/foo@1.0.0/es2022/foo.mjs"}, consumers: []*BuildQueueConsumer{{"127.0.0.1", make(chan BuildOutput, 1)}}}
+	pending.el = q.list.PushBack(pending)
+	q.tasks[pending.ID()] = pending
+	q.running.Add(1)
+
+	q.Close()
+	if q.Len() != 0 {
+		t.Fatal("the pending task should be dropped")
+	}
+	if output := <-pending.consumers[0].C; output.err != errServerShuttingDown {
+		t.Fatalf("unexpected output: %v", output.err)
+	}
+	if output := <-q.Add(&BuildTask{}, "127.0.0.1").C; output.err != errServerShuttingDown {
+		t.Fatalf("unexpected output: %v", output.err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if q.Wait(ctx) == nil {
+		t.Fatal("the task in process should be waited")
+	}
+	q.running.Done()
+	if err := q.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defer func(prev *BuildQueue) {
+		buildQueue = prev
+		shuttingDown = 0
+	}(buildQueue)
+	buildQueue = newBuildQueue(1)
+
+	started := make(chan struct{})
+	ts := httptest.NewServer(trackRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})))
+	defer ts.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		res, err := http.Get(ts.URL)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode != 200 {
+				err = http.ErrAbortHandler
+			}
+		}
+		errc <- err
+	}()
+	<-started
+	shutdown([]*http.Server{ts.Config}, 5*time.Second)
+	if !isShuttingDown() {
+		t.Fatal("the server should be shutting down")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("the in-flight request should be drained: %v", err)
+	}
+}
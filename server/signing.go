@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// signingKey is the Ed25519 key to sign the build artifacts, nil means signing is disabled.
+var signingKey ed25519.PrivateKey
+
+// initSigningKey decodes the base64 encoded seed (or the private key) of the `signingKey` config.
+func initSigningKey(key string) error {
+	if key == "" {
+		signingKey = nil
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return err
+	}
+	switch len(data) {
+	case ed25519.SeedSize:
+		signingKey = ed25519.NewKeyFromSeed(data)
+	case ed25519.PrivateKeySize:
+		signingKey = ed25519.PrivateKey(data)
+	default:
+		return fmt.Errorf("invalid key size %d", len(data))
+	}
+	return nil
+}
+
+// getSigningKeyID returns the id of the signing key, the first 16 hex digits of the sha256 hash of
+// the public key.
+func getSigningKeyID() string {
+	sum := sha256.Sum256(signingKey.Public().(ed25519.PublicKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// signData returns the base64 encoded Ed25519 signature of the data.
+func signData(data []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, data))
+}
+
+// getFileSignature returns the base64 encoded Ed25519 signature of the file in the storage, the
+// signatures are cached by the path and the modtime of the file.
+func getFileSignature(savePath string, modTime time.Time) (string, error) {
+	cacheKey := fmt.Sprintf("signature:%s@%d", savePath, modTime.UnixNano())
+	if data, err := cache.Get(cacheKey); err == nil && len(data) > 0 {
+		return string(data), nil
+	}
+	r, err := fs.OpenFile(savePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	signature := signData(data)
+	cache.Set(cacheKey, []byte(signature), 24*time.Hour)
+	return signature, nil
+}
+
+// setArtifactHeaders sets the `X-Esm-Integrity` header with the SRI hash of the build file, and
+// the `X-Esm-Signature` header with the detached signature if the signing is enabled.
+func setArtifactHeaders(header http.Header, savePath string, modTime time.Time) {
+	if integrity, err := getFileIntegrity(savePath, modTime); err == nil {
+		header.Set("X-Esm-Integrity", integrity)
+	}
+	if signingKey != nil {
+		if signature, err := getFileSignature(savePath, modTime); err == nil {
+			header.Set("X-Esm-Signature", signature)
+		}
+	}
+}
+
+// getSigningKeyInfo returns the public key of the signing key for the
+// `/.well-known/esm-signing-key` endpoint.
+func getSigningKeyInfo() map[string]interface{} {
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	der, _ := x509.MarshalPKIXPublicKey(publicKey)
+	return map[string]interface{}{
+		"algorithm": "Ed25519",
+		"keyId":     getSigningKeyID(),
+		"publicKey": base64.StdEncoding.EncodeToString(publicKey),
+		"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestSigning(t *testing.T) {
+	localFS, err := storage.OpenFS("local:" + path.Join(t.TempDir(), "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryCache, err := storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prevFS storage.FileSystem, prevCache storage.Cache, prevKey ed25519.PrivateKey) {
+		fs, cache, signingKey = prevFS, prevCache, prevKey
+	}(fs, cache, signingKey)
+	fs, cache = localFS, memoryCache
+
+	if err := initSigningKey(base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+		t.Fatal("the invalid key should be rejected")
+	}
+	if err := initSigningKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, ed25519.SeedSize))); err != nil {
+		t.Fatal(err)
+	}
+
+	savePath := "builds/v135/foo@1.0.0/es2022/foo.mjs"
+	data := []byte("export default 'foo'")
+	fs.WriteFile(savePath, bytes.NewReader(data))
+	signature, err := getFileSignature(savePath, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(signature)
+	info := getSigningKeyInfo()
+	publicKey, _ := base64.StdEncoding.DecodeString(info["publicKey"].(string))
+	if !ed25519.Verify(publicKey, data, sig) {
+		t.Fatal("the signature should be verified by the published key")
+	}
+	if info["keyId"] != getSigningKeyID() || len(getSigningKeyID()) != 16 {
+		t.Fatalf("unexpected key id: %v", info["keyId"])
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+// the max size of a file in a snapshot
+const maxSnapshotFileSize = 64 * 1024 * 1024
+
+// SnapshotResult is the result of exporting or importing a snapshot.
+type SnapshotResult struct {
+	Packages []string `json:"packages"`
+	Files    int      `json:"files"`
+	Records  int      `json:"records"`
+}
+
+// exportSnapshot writes the built modules, the type definitions and the build records of the
+// matched packages to `w` as a gzipped tarball. The files are stored as `files/{path}` and the
+// build records are stored as `records/{id}`.
+func exportSnapshot(w io.Writer, query PurgeQuery) (*SnapshotResult, error) {
+	remover, ok := fs.(storage.FileSystemRemover)
+	if !ok {
+		return nil, errPurgeUnsupported
+	}
+	scanner, ok := db.(storage.DataBaseScanner)
+	if !ok {
+		return nil, errors.New("the database does not support the snapshot")
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	result := &SnapshotResult{Packages: []string{}}
+	exported := map[string]bool{}
+
+	err := walkPackageDirs(remover, func(dir string, pkg string) error {
+		if !query.match(pkg) {
+			return nil
+		}
+		exported[pkg] = true
+		return walkFiles(remover, dir, func(name string) error {
+			stat, err := fs.Stat(name)
+			if err != nil {
+				if err == storage.ErrNotFound {
+					return nil
+				}
+				return err
+			}
+			f, err := fs.OpenFile(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			err = tw.WriteHeader(&tar.Header{
+				Name:    "files/" + name,
+				Mode:    0644,
+				Size:    stat.Size(),
+				ModTime: stat.ModTime(),
+			})
+			if err != nil {
+				return err
+			}
+			if _, err = io.CopyN(tw, f, stat.Size()); err != nil {
+				return err
+			}
+			result.Files++
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err = scanner.Scan("", func(key string, value []byte) error {
+		pkg := getBuildIdPackage(key)
+		if !query.match(pkg) {
+			return nil
+		}
+		exported[pkg] = true
+		err := tw.WriteHeader(&tar.Header{
+			Name:    "records/" + key,
+			Mode:    0644,
+			Size:    int64(len(value)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = tw.Write(value); err != nil {
+			return err
+		}
+		result.Records++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gw.Close(); err != nil {
+		return nil, err
+	}
+	for pkg := range exported {
+		result.Packages = append(result.Packages, pkg)
+	}
+	sort.Strings(result.Packages)
+	return result, nil
+}
+
+// importSnapshot reads a snapshot created by `exportSnapshot` and writes the files and the build
+// records to the storage, the existing files and records are overwritten.
+func importSnapshot(r io.Reader) (*SnapshotResult, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	result := &SnapshotResult{Packages: []string{}}
+	imported := map[string]bool{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Size > maxSnapshotFileSize {
+			return nil, errors.New("file too large: " + header.Name)
+		}
+		kind, name, _ := strings.Cut(header.Name, "/")
+		if !isSafeSnapshotPath(name) {
+			return nil, errors.New("invalid file name: " + header.Name)
+		}
+		switch kind {
+		case "files":
+			if !strings.HasPrefix(name, "builds/") && !strings.HasPrefix(name, "types/") && !strings.HasPrefix(name, "types-bundle/") {
+				return nil, errors.New("invalid file name: " + header.Name)
+			}
+			if _, err = fs.WriteFile(name, io.LimitReader(tr, header.Size)); err != nil {
+				return nil, err
+			}
+			result.Files++
+			if pkg := getBuildIdPackage(strings.TrimPrefix(name, "builds/")); pkg != "" && strings.HasPrefix(name, "builds/") {
+				imported[pkg] = true
+			}
+		case "records":
+			pkg := getBuildIdPackage(name)
+			if pkg == "" {
+				return nil, errors.New("invalid build id: " + name)
+			}
+			value, err := io.ReadAll(io.LimitReader(tr, header.Size))
+			if err != nil {
+				return nil, err
+			}
+			if err = db.Put(name, value); err != nil {
+				return nil, err
+			}
+			imported[pkg] = true
+			result.Records++
+		default:
+			return nil, errors.New("invalid file name: " + header.Name)
+		}
+	}
+	for pkg := range imported {
+		result.Packages = append(result.Packages, pkg)
+	}
+	sort.Strings(result.Packages)
+	// the imported files may replace the pointers of the content-addressed storage
+	collectBlobs()
+	return result, nil
+}
+
+// walkFiles calls the `fn` with the files in the directory recursively.
+func walkFiles(remover storage.FileSystemRemover, dir string, fn func(name string) error) error {
+	names, err := remover.ReadDir(dir)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			err = walkFiles(remover, path.Join(dir, name), fn)
+		} else {
+			err = fn(path.Join(dir, name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSafeSnapshotPath(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || path.Clean(name) != name {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestSnapshot(t *testing.T) {
+	openStorage := func(dir string) (storage.FileSystem, storage.DataBase) {
+		localFS, err := storage.OpenFS("local:" + path.Join(dir, "storage"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		boltDB, err := storage.OpenDB("bolt:" + path.Join(dir, "esm.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return localFS, boltDB
+	}
+	srcFS, srcDB := openStorage(t.TempDir())
+	defer srcDB.Close()
+	dstFS, dstDB := openStorage(t.TempDir())
+	defer dstDB.Close()
+	defer func(prevFS storage.FileSystem, prevDB storage.DataBase, prevCfg *config.Config) {
+		fs, db, cfg = prevFS, prevDB, prevCfg
+	}(fs, db, cfg)
+	fs, db, cfg = srcFS, srcDB, &config.Config{}
+
+	for _, id := range []string{
+		"v135/react@18.2.0/es2022/react.mjs",
+		"v135/react-dom@18.2.0/es2022/client.js",
+		"v135/preact@10.19.0/es2022/preact.mjs",
+	} {
+		fs.WriteFile(path.Join("builds", id), bytes.NewBufferString("export default {}"))
+		db.Put(id, utils.MustEncodeJSON(ESMBuild{HasExportDefault: true}))
+	}
+	fs.WriteFile("types/esm.sh/v135/react@18.2.0/index.d.ts", bytes.NewBufferString("export {}"))
+
+	buf := bytes.NewBuffer(nil)
+	result, err := exportSnapshot(buf, PurgeQuery{Prefix: "react"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(result.Packages, ",") != "react-dom@18.2.0,react@18.2.0" || result.Files != 3 || result.Records != 2 {
+		t.Fatalf("unexpected export result: %+v", result)
+	}
+
+	fs, db = dstFS, dstDB
+	result, err = importSnapshot(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 3 || result.Records != 2 {
+		t.Fatalf("unexpected import result: %+v", result)
+	}
+	if esm, ok := queryESMBuild("v135/react@18.2.0/es2022/react.mjs"); !ok || !esm.HasExportDefault {
+		t.Fatal("the build record should be imported")
+	}
+	if _, err = fs.Stat("types/esm.sh/v135/react@18.2.0/index.d.ts"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("builds/v135/preact@10.19.0/es2022/preact.mjs"); err != storage.ErrNotFound {
+		t.Fatal("preact should not be imported")
+	}
+
+	// reject the unsafe paths
+	for _, name := range []string{"files/../esm.db", "files/publish/foo.mjs", "records/../foo", "etc/passwd"} {
+		buf := bytes.NewBuffer(nil)
+		gw := gzip.NewWriter(buf)
+		tw := tar.NewWriter(gw)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 2})
+		io.WriteString(tw, "{}")
+		tw.Close()
+		gw.Close()
+		if _, err = importSnapshot(buf); err == nil {
+			t.Fatalf("should reject the file '%s'", name)
+		}
+	}
+}
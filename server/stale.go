@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+// the prefix of the last known good builds in the storage
+const staleBuildPrefix = "stale/"
+
+// stashStaleBuild keeps a copy of the build as the last known good artifact before it's purged,
+// the copy is served if the rebuild fails in the `staleIfError` duration.
+func stashStaleBuild(id string, record []byte) {
+	if cache == nil || cfg.StaleIfError <= 0 {
+		return
+	}
+	var esm ESMBuild
+	if json.Unmarshal(record, &esm) != nil || esm.TypesOnly {
+		return
+	}
+	savePath := getBuildSavepath(id)
+	f, err := fs.OpenFile(savePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err = fs.WriteFile(staleBuildPrefix+savePath, f); err != nil {
+		log.Component("storage").Errorf("stash stale build '%s': %v", id, err)
+		return
+	}
+	cache.Set("stale-build:"+id, record, time.Duration(cfg.StaleIfError)*time.Second)
+}
+
+// loadStaleBuild returns the last known good build that is stashed by `stashStaleBuild`.
+func loadStaleBuild(id string) (*ESMBuild, bool) {
+	if cache == nil || cfg.StaleIfError <= 0 {
+		return nil, false
+	}
+	data, err := cache.Get("stale-build:" + id)
+	if err != nil {
+		return nil, false
+	}
+	var esm ESMBuild
+	if json.Unmarshal(data, &esm) != nil {
+		return nil, false
+	}
+	if _, err = fs.Stat(staleBuildPrefix + getBuildSavepath(id)); err != nil {
+		return nil, false
+	}
+	return &esm, true
+}
+
+// dropStaleBuild removes the stashed build after the rebuild succeeds.
+func dropStaleBuild(id string) {
+	if cache == nil || cfg.StaleIfError <= 0 {
+		return
+	}
+	if ok, _ := cache.Has("stale-build:" + id); !ok {
+		return
+	}
+	cache.Delete("stale-build:" + id)
+	if remover, ok := fs.(storage.FileSystemRemover); ok {
+		remover.RemoveAll(staleBuildPrefix + getBuildSavepath(id))
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"path"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestStaleBuild(t *testing.T) {
+	dir := t.TempDir()
+	localFS, err := storage.OpenFS("local:" + path.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltDB, err := storage.OpenDB("bolt:" + path.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltDB.Close()
+	memoryCache, err := storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prevFS storage.FileSystem, prevDB storage.DataBase, prevCache storage.Cache, prevCfg *config.Config) {
+		fs, db, cache, cfg = prevFS, prevDB, prevCache, prevCfg
+	}(fs, db, cache, cfg)
+	fs, db, cache, cfg = localFS, boltDB, memoryCache, &config.Config{WorkDir: dir, StaleIfError: 3600}
+
+	id := "v135/lodash-es@4.17.21/es2022/lodash-es.mjs"
+	fs.WriteFile(path.Join("builds", id), bytes.NewBufferString("export default {}"))
+	db.Put(id, utils.MustEncodeJSON(ESMBuild{HasExportDefault: true}))
+
+	if _, err = purgePackages(PurgeQuery{Name: "lodash-es"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := queryESMBuild(id); ok {
+		t.Fatal("the build should be purged")
+	}
+	esm, ok := loadStaleBuild(id)
+	if !ok || !esm.HasExportDefault {
+		t.Fatal("the purged build should be stashed")
+	}
+	if _, err = fs.Stat(staleBuildPrefix + path.Join("builds", id)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stashed build is removed after the rebuild succeeds
+	dropStaleBuild(id)
+	if _, ok = loadStaleBuild(id); ok {
+		t.Fatal("the stale build should be removed")
+	}
+	if _, err = fs.Stat(staleBuildPrefix + path.Join("builds", id)); err != storage.ErrNotFound {
+		t.Fatal("the stale file should be removed")
+	}
+}
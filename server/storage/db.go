@@ -15,6 +15,13 @@ type DataBase interface {
 	Close() error
 }
 
+// DataBaseScanner is implemented by the databases that support iterating the records.
+type DataBaseScanner interface {
+	// Scan calls the `fn` function for each record whose key has the prefix, the value is only
+	// valid during the call.
+	Scan(prefix string, fn func(key string, value []byte) error) error
+}
+
 type DBDriver interface {
 	Open(config string, options url.Values) (conn DataBase, err error)
 }
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"net/url"
 
 	bolt "go.etcd.io/bbolt"
@@ -49,6 +50,19 @@ func (i *boltDB) Delete(key string) error {
 	})
 }
 
+func (i *boltDB) Scan(prefix string, fn func(key string, value []byte) error) error {
+	return i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(defaultBucket).Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (i *boltDB) Close() error {
 	return i.db.Close()
 }
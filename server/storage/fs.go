@@ -16,6 +16,16 @@ type FileSystem interface {
 	WriteFile(path string, r io.Reader) (written int64, err error)
 }
 
+// FileSystemRemover is implemented by the file systems that support listing and removing the
+// files, it's required by the purge API.
+type FileSystemRemover interface {
+	// ReadDir returns the names of the entries in the directory, the names of the sub-directories
+	// end with a slash.
+	ReadDir(dir string) (names []string, err error)
+	// RemoveAll removes the file or the directory with all the files it contains.
+	RemoveAll(path string) (removed int, err error)
+}
+
 type FileStat interface {
 	Size() int64
 	ModTime() time.Time
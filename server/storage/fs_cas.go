@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the pointer file of a content-addressed blob: "\x00cas:" + sha256 hex + ":" + size in 16 hex digits
+const (
+	casPointerMagic = "\x00cas:"
+	casPointerSize  = len(casPointerMagic) + 64 + 1 + 16
+)
+
+// ContentAddressedFS stores the files as the blobs keyed by the sha256 hash of the content, the
+// files with identical content share one blob. The file path is a small pointer file that refers
+// to the blob, the files smaller than `minSize` and the files outside of the `prefixes` are
+// stored as they are.
+type ContentAddressedFS struct {
+	fs       FileSystem
+	prefixes []string
+	minSize  int64
+	gcLock   sync.Mutex
+	// the blobs that are referenced by the writes during the garbage collection
+	gcRefs map[string]struct{}
+}
+
+type casFileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+func (fi *casFileStat) Size() int64 {
+	return fi.size
+}
+
+func (fi *casFileStat) ModTime() time.Time {
+	return fi.modTime
+}
+
+// NewContentAddressedFS returns a file system that de-duplicates the files under the `prefixes`.
+func NewContentAddressedFS(fs FileSystem, prefixes []string, minSize int64) *ContentAddressedFS {
+	if minSize < int64(casPointerSize) {
+		minSize = int64(casPointerSize)
+	}
+	return &ContentAddressedFS{fs: fs, prefixes: prefixes, minSize: minSize}
+}
+
+func (fs *ContentAddressedFS) Stat(name string) (FileStat, error) {
+	stat, err := fs.fs.Stat(name)
+	if err != nil || stat.Size() != int64(casPointerSize) {
+		return stat, err
+	}
+	hash, size, ok := fs.readPointer(name)
+	if !ok {
+		return stat, nil
+	}
+	// the blob may be evicted
+	if _, err = fs.fs.Stat(getCASBlobPath(hash)); err != nil {
+		return nil, err
+	}
+	return &casFileStat{size: size, modTime: stat.ModTime()}, nil
+}
+
+func (fs *ContentAddressedFS) OpenFile(name string) (io.ReadSeekCloser, error) {
+	f, err := fs.fs.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pointer := make([]byte, casPointerSize+1)
+	n, err := io.ReadFull(f, pointer)
+	if n != casPointerSize || !bytes.HasPrefix(pointer, []byte(casPointerMagic)) {
+		// not a pointer file
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	f.Close()
+	hash, _, err := parseCASPointer(pointer[:n])
+	if err != nil {
+		return nil, err
+	}
+	return fs.fs.OpenFile(getCASBlobPath(hash))
+}
+
+func (fs *ContentAddressedFS) WriteFile(name string, r io.Reader) (int64, error) {
+	if !fs.isAddressed(name) {
+		return fs.fs.WriteFile(name, r)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(data)) < fs.minSize {
+		return fs.fs.WriteFile(name, bytes.NewReader(data))
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	blobPath := getCASBlobPath(hash)
+	fs.gcLock.Lock()
+	if fs.gcRefs != nil {
+		fs.gcRefs[hash] = struct{}{}
+	}
+	fs.gcLock.Unlock()
+	if _, err = fs.fs.Stat(blobPath); err == ErrNotFound {
+		_, err = fs.fs.WriteFile(blobPath, bytes.NewReader(data))
+	}
+	if err != nil {
+		return 0, err
+	}
+	pointer := fmt.Sprintf("%s%s:%016x", casPointerMagic, hash, len(data))
+	if _, err = fs.fs.WriteFile(name, strings.NewReader(pointer)); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+func (fs *ContentAddressedFS) ReadDir(dir string) ([]string, error) {
+	remover, ok := fs.fs.(FileSystemRemover)
+	if !ok {
+		return nil, errors.New("file system does not support listing files")
+	}
+	return remover.ReadDir(dir)
+}
+
+// RemoveAll removes the pointer files, the blobs are kept since they may be shared by other files,
+// use `CollectGarbage` to remove the unreferenced blobs.
+func (fs *ContentAddressedFS) RemoveAll(name string) (int, error) {
+	remover, ok := fs.fs.(FileSystemRemover)
+	if !ok {
+		return 0, errors.New("file system does not support removing files")
+	}
+	return remover.RemoveAll(name)
+}
+
+// CollectGarbage removes the blobs that are not referenced by any pointer file (mark and sweep),
+// the blobs that are written during the collection are kept.
+func (fs *ContentAddressedFS) CollectGarbage() (removed int, err error) {
+	remover, ok := fs.fs.(FileSystemRemover)
+	if !ok {
+		return 0, errors.New("file system does not support removing files")
+	}
+
+	fs.gcLock.Lock()
+	fs.gcRefs = map[string]struct{}{}
+	fs.gcLock.Unlock()
+	defer func() {
+		fs.gcLock.Lock()
+		fs.gcRefs = nil
+		fs.gcLock.Unlock()
+	}()
+
+	// mark the blobs that are referenced by the pointer files
+	marked := map[string]struct{}{}
+	for _, prefix := range fs.prefixes {
+		err = walkFiles(remover, prefix, func(name string) {
+			if stat, err := fs.fs.Stat(name); err == nil && stat.Size() == int64(casPointerSize) {
+				if hash, _, ok := fs.readPointer(name); ok {
+					marked[hash] = struct{}{}
+				}
+			}
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	// sweep the unreferenced blobs
+	var blobs []string
+	err = walkFiles(remover, "blobs/sha256/", func(name string) {
+		blobs = append(blobs, name)
+	})
+	if err != nil {
+		return
+	}
+	for _, name := range blobs {
+		hash := path.Base(name)
+		if _, ok := marked[hash]; ok {
+			continue
+		}
+		fs.gcLock.Lock()
+		if _, ok := fs.gcRefs[hash]; !ok {
+			var n int
+			n, err = remover.RemoveAll(name)
+			removed += n
+		}
+		fs.gcLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (fs *ContentAddressedFS) isAddressed(name string) bool {
+	for _, prefix := range fs.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *ContentAddressedFS) readPointer(name string) (hash string, size int64, ok bool) {
+	f, err := fs.fs.OpenFile(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	pointer := make([]byte, casPointerSize)
+	if _, err = io.ReadFull(f, pointer); err != nil {
+		return
+	}
+	hash, size, err = parseCASPointer(pointer)
+	return hash, size, err == nil
+}
+
+func parseCASPointer(pointer []byte) (hash string, size int64, err error) {
+	s := string(pointer)
+	if len(s) != casPointerSize || !strings.HasPrefix(s, casPointerMagic) {
+		return "", 0, errors.New("cas: invalid pointer")
+	}
+	hash, sizeHex, ok := strings.Cut(strings.TrimPrefix(s, casPointerMagic), ":")
+	if !ok || len(hash) != 64 {
+		return "", 0, errors.New("cas: invalid pointer")
+	}
+	size, err = strconv.ParseInt(sizeHex, 16, 64)
+	return
+}
+
+// walkFiles calls the `fn` with the path of every file in the directory recursively.
+func walkFiles(remover FileSystemRemover, dir string, fn func(name string)) error {
+	names, err := remover.ReadDir(dir)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			if err = walkFiles(remover, dir+name, fn); err != nil {
+				return err
+			}
+		} else {
+			fn(dir + name)
+		}
+	}
+	return nil
+}
+
+// getCASBlobPath returns the path of the blob, e.g. "blobs/sha256/ab/abcdef...".
+func getCASBlobPath(hash string) string {
+	return path.Join("blobs", "sha256", hash[:2], hash)
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentAddressedFS(t *testing.T) {
+	root := t.TempDir()
+	localFS, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewContentAddressedFS(localFS, []string{"builds/"}, 128)
+
+	content := bytes.Repeat([]byte("export const foo = 'bar';\n"), 20)
+	for _, name := range []string{"builds/v135/foo@1.0.0/es2021/foo.mjs", "builds/v135/foo@1.0.0/es2022/foo.mjs"} {
+		n, err := fs.WriteFile(name, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(content)) {
+			t.Fatalf("invalid written(%d), should be %d", n, len(content))
+		}
+	}
+
+	// the identical files share one blob
+	blobs, _ := filepath.Glob(filepath.Join(root, "blobs", "sha256", "*", "*"))
+	if len(blobs) != 1 {
+		t.Fatalf("expected 1 blob, got %d", len(blobs))
+	}
+	fi, err := localFS.Stat("builds/v135/foo@1.0.0/es2021/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(casPointerSize) {
+		t.Fatalf("the file should be a pointer, got %d bytes", fi.Size())
+	}
+
+	fi, err = fs.Stat("builds/v135/foo@1.0.0/es2022/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Fatalf("invalid size(%d), should be %d", fi.Size(), len(content))
+	}
+	f, err := fs.OpenFile("builds/v135/foo@1.0.0/es2022/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(data, content) {
+		t.Fatalf("unexpected content: %s", string(data))
+	}
+
+	// the small files and the files outside of the prefixes are stored as they are
+	for _, name := range []string{"builds/v135/foo@1.0.0/es2022/bar.mjs", "publish/foo.mjs"} {
+		data := content
+		if name == "builds/v135/foo@1.0.0/es2022/bar.mjs" {
+			data = []byte("export default 1")
+		}
+		fs.WriteFile(name, bytes.NewReader(data))
+		fi, err := localFS.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(data)) {
+			t.Fatalf("%s should not be a pointer", name)
+		}
+		f, err := fs.OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret, _ := io.ReadAll(f)
+		f.Close()
+		if !bytes.Equal(ret, data) {
+			t.Fatalf("unexpected content of %s: %s", name, string(ret))
+		}
+	}
+}
+
+func TestContentAddressedFSCollectGarbage(t *testing.T) {
+	root := t.TempDir()
+	localFS, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewContentAddressedFS(localFS, []string{"builds/"}, 128)
+
+	shared := bytes.Repeat([]byte("export const foo = 'bar';\n"), 20)
+	fs.WriteFile("builds/v135/foo@1.0.0/es2021/foo.mjs", bytes.NewReader(shared))
+	fs.WriteFile("builds/v135/foo@1.0.0/es2022/foo.mjs", bytes.NewReader(shared))
+	fs.WriteFile("builds/v135/bar@1.0.0/es2022/bar.mjs", bytes.NewReader(bytes.Repeat([]byte("export const bar = 'foo';\n"), 20)))
+	countBlobs := func() int {
+		blobs, _ := filepath.Glob(filepath.Join(root, "blobs", "sha256", "*", "*"))
+		return len(blobs)
+	}
+	if n := countBlobs(); n != 2 {
+		t.Fatalf("expected 2 blobs, got %d", n)
+	}
+
+	// the shared blob is kept while one of the files refers to it
+	fs.RemoveAll("builds/v135/foo@1.0.0/es2021/")
+	fs.RemoveAll("builds/v135/bar@1.0.0/")
+	removed, err := fs.CollectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || countBlobs() != 1 {
+		t.Fatalf("expected 1 removed blob and 1 kept blob, got %d removed and %d kept", removed, countBlobs())
+	}
+	f, err := fs.OpenFile("builds/v135/foo@1.0.0/es2022/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fs.RemoveAll("builds/v135/foo@1.0.0/")
+	if removed, err = fs.CollectGarbage(); err != nil || removed != 1 || countBlobs() != 0 {
+		t.Fatalf("expected the last blob to be removed, got %d removed, %v", removed, err)
+	}
+}
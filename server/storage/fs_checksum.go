@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+)
+
+// the suffix of the checksum files
+const checksumSuffix = ".sha256"
+
+// ErrChecksumMismatch is returned by the `ChecksumFS` when the content of a file doesn't match
+// its checksum, e.g. the file is corrupted by the bit-rot of the disk.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumFS stores the sha256 checksum of the files under the `prefixes` alongside the files
+// (`{name}.sha256`), and verifies the content when the files are opened. The files are verified
+// at the `sampleRate` (0-1, 1 means always), and the files without a checksum (e.g. written
+// before the checksums are enabled) are not verified.
+type ChecksumFS struct {
+	fs         FileSystem
+	prefixes   []string
+	sampleRate float64
+}
+
+// NewChecksumFS returns a file system that verifies the checksums of the files under the `prefixes`.
+func NewChecksumFS(fs FileSystem, prefixes []string, sampleRate float64) *ChecksumFS {
+	return &ChecksumFS{fs: fs, prefixes: prefixes, sampleRate: sampleRate}
+}
+
+func (fs *ChecksumFS) Stat(name string) (FileStat, error) {
+	return fs.fs.Stat(name)
+}
+
+func (fs *ChecksumFS) OpenFile(name string) (io.ReadSeekCloser, error) {
+	if !fs.isChecked(name) || (fs.sampleRate < 1 && rand.Float64() >= fs.sampleRate) {
+		return fs.fs.OpenFile(name)
+	}
+	f, err := fs.fs.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := fs.readChecksum(name)
+	if err != nil {
+		if err == ErrNotFound {
+			return &bytesReadSeekCloser{bytes.NewReader(data)}, nil
+		}
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != checksum {
+		return nil, fmt.Errorf("%s: %w", name, ErrChecksumMismatch)
+	}
+	return &bytesReadSeekCloser{bytes.NewReader(data)}, nil
+}
+
+func (fs *ChecksumFS) WriteFile(name string, r io.Reader) (int64, error) {
+	if !fs.isChecked(name) {
+		return fs.fs.WriteFile(name, r)
+	}
+	h := sha256.New()
+	n, err := fs.fs.WriteFile(name, io.TeeReader(r, h))
+	if err != nil {
+		return n, err
+	}
+	if _, err = fs.fs.WriteFile(name+checksumSuffix, strings.NewReader(hex.EncodeToString(h.Sum(nil)))); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ReadDir lists the files in the directory, the checksum files are omitted.
+func (fs *ChecksumFS) ReadDir(dir string) ([]string, error) {
+	remover, ok := fs.fs.(FileSystemRemover)
+	if !ok {
+		return nil, errors.New("file system does not support listing files")
+	}
+	names, err := remover.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := names[:0]
+	for _, name := range names {
+		if !strings.HasSuffix(name, checksumSuffix) {
+			ret = append(ret, name)
+		}
+	}
+	return ret, nil
+}
+
+// RemoveAll removes the file with its checksum, or the directory with all the files it contains.
+func (fs *ChecksumFS) RemoveAll(name string) (int, error) {
+	remover, ok := fs.fs.(FileSystemRemover)
+	if !ok {
+		return 0, errors.New("file system does not support removing files")
+	}
+	n, err := remover.RemoveAll(name)
+	if err != nil {
+		return n, err
+	}
+	if fs.isChecked(name) {
+		if _, err := fs.fs.Stat(name + checksumSuffix); err == nil {
+			remover.RemoveAll(name + checksumSuffix)
+		}
+	}
+	return n, nil
+}
+
+func (fs *ChecksumFS) isChecked(name string) bool {
+	if strings.HasSuffix(name, checksumSuffix) {
+		return false
+	}
+	for _, prefix := range fs.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *ChecksumFS) readChecksum(name string) (string, error) {
+	f, err := fs.fs.OpenFile(name + checksumSuffix)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, 128))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumFS(t *testing.T) {
+	root := t.TempDir()
+	localFS, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewChecksumFS(localFS, []string{"builds/"}, 1)
+
+	content := []byte("export const foo = 'bar';\n")
+	name := "builds/v135/foo@1.0.0/es2022/foo.mjs"
+	if _, err = fs.WriteFile(name, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(root, name+".sha256")); err != nil {
+		t.Fatal("the checksum file should be written")
+	}
+	f, err := fs.OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(data, content) {
+		t.Fatal("invalid content")
+	}
+
+	// the files outside of the prefixes have no checksums
+	if _, err = fs.WriteFile("tarballs/foo-1.0.0.tgz", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "tarballs/foo-1.0.0.tgz.sha256")); !os.IsNotExist(err) {
+		t.Fatal("the checksum file should not be written")
+	}
+
+	// the checksum files are omitted in the listing
+	names, err := fs.ReadDir("builds/v135/foo@1.0.0/es2022")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "foo.mjs" {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	// corrupt the file
+	if err = os.WriteFile(filepath.Join(root, name), []byte("export const foo = 'baz';\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.OpenFile(name); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	// the file is not verified if it's not sampled
+	if f, err = NewChecksumFS(localFS, []string{"builds/"}, 0).OpenFile(name); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// the file without a checksum is not verified
+	if _, err = localFS.WriteFile("builds/legacy.mjs", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = fs.OpenFile("builds/legacy.mjs"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// the checksum file is removed with the file
+	if _, err = fs.RemoveAll(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(root, name+".sha256")); !os.IsNotExist(err) {
+		t.Fatal("the checksum file should be removed")
+	}
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// the header of a compressed file: "\x00br:" + original size in 16 hex digits
+const (
+	compressedMagic      = "\x00br:"
+	compressedHeaderSize = len(compressedMagic) + 16
+)
+
+// FileSystemEncoder is implemented by the file systems that store the files encoded, the
+// encoded content can be served to the clients directly without decoding.
+type FileSystemEncoder interface {
+	// OpenEncodedFile returns the encoded content of the file and the encoding (e.g. "br"),
+	// the encoding is empty if the file is not encoded.
+	OpenEncodedFile(name string) (r io.ReadSeekCloser, encoding string, err error)
+}
+
+// CompressedFS stores the files under the `prefixes` brotli-compressed, the files are decompressed
+// when they are opened. The files smaller than `minSize` and the files that are not compressible
+// are stored as they are.
+type CompressedFS struct {
+	fs       FileSystem
+	prefixes []string
+	minSize  int64
+	quality  int
+}
+
+type compressedFileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+func (fi *compressedFileStat) Size() int64 {
+	return fi.size
+}
+
+func (fi *compressedFileStat) ModTime() time.Time {
+	return fi.modTime
+}
+
+// NewCompressedFS returns a file system that compresses the files under the `prefixes` with the
+// brotli `quality` (0-11).
+func NewCompressedFS(fs FileSystem, prefixes []string, minSize int64, quality int) *CompressedFS {
+	if quality < brotli.BestSpeed || quality > brotli.BestCompression {
+		quality = brotli.DefaultCompression
+	}
+	return &CompressedFS{fs: fs, prefixes: prefixes, minSize: minSize, quality: quality}
+}
+
+func (fs *CompressedFS) Stat(name string) (FileStat, error) {
+	stat, err := fs.fs.Stat(name)
+	if err != nil || !fs.isCompressible(name) || stat.Size() < int64(compressedHeaderSize) {
+		return stat, err
+	}
+	f, err := fs.fs.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, ok := readCompressedHeader(f)
+	if !ok {
+		return stat, nil
+	}
+	return &compressedFileStat{size: size, modTime: stat.ModTime()}, nil
+}
+
+func (fs *CompressedFS) OpenFile(name string) (io.ReadSeekCloser, error) {
+	r, encoding, err := fs.OpenEncodedFile(name)
+	if err != nil || encoding == "" {
+		return r, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(brotli.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	return &bytesReadSeekCloser{bytes.NewReader(data)}, nil
+}
+
+func (fs *CompressedFS) OpenEncodedFile(name string) (io.ReadSeekCloser, string, error) {
+	f, err := fs.fs.OpenFile(name)
+	if err != nil || !fs.isCompressible(name) {
+		return f, "", err
+	}
+	if _, ok := readCompressedHeader(f); ok {
+		// the reader is positioned at the compressed content
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		return &bytesReadSeekCloser{bytes.NewReader(data)}, "br", nil
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return f, "", nil
+}
+
+func (fs *CompressedFS) WriteFile(name string, r io.Reader) (int64, error) {
+	if !fs.isCompressible(name) {
+		return fs.fs.WriteFile(name, r)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(data)) < fs.minSize {
+		return fs.fs.WriteFile(name, bytes.NewReader(data))
+	}
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "%s%016x", compressedMagic, len(data))
+	w := brotli.NewWriterLevel(buf, fs.quality)
+	if _, err = w.Write(data); err != nil {
+		return 0, err
+	}
+	if err = w.Close(); err != nil {
+		return 0, err
+	}
+	if buf.Len() >= len(data) {
+		// not compressible
+		return fs.fs.WriteFile(name, bytes.NewReader(data))
+	}
+	if _, err = fs.fs.WriteFile(name, buf); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+func (fs *CompressedFS) ReadDir(dir string) ([]string, error) {
+	remover, ok := fs.fs.(FileSystemRemover)
+	if !ok {
+		return nil, errors.New("file system does not support listing files")
+	}
+	return remover.ReadDir(dir)
+}
+
+func (fs *CompressedFS) RemoveAll(name string) (int, error) {
+	remover, ok := fs.fs.(FileSystemRemover)
+	if !ok {
+		return 0, errors.New("file system does not support removing files")
+	}
+	return remover.RemoveAll(name)
+}
+
+func (fs *CompressedFS) isCompressible(name string) bool {
+	for _, prefix := range fs.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readCompressedHeader reads the header of a compressed file and returns the original size.
+func readCompressedHeader(r io.Reader) (size int64, ok bool) {
+	header := make([]byte, compressedHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, []byte(compressedMagic)) {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(string(header[len(compressedMagic):]), 16, 64)
+	return size, err == nil
+}
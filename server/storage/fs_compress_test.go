@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressedFS(t *testing.T) {
+	root := t.TempDir()
+	localFS, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewCompressedFS(localFS, []string{"builds/"}, 128, 0)
+
+	content := bytes.Repeat([]byte("export const foo = 'bar';\n"), 100)
+	name := "builds/v135/foo@1.0.0/es2022/foo.mjs"
+	n, err := fs.WriteFile(name, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(content)) {
+		t.Fatalf("invalid written(%d), should be %d", n, len(content))
+	}
+	raw, _ := os.ReadFile(filepath.Join(root, name))
+	if len(raw) >= len(content) {
+		t.Fatalf("the file should be compressed, got %d bytes", len(raw))
+	}
+	stat, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(content)) {
+		t.Fatalf("invalid size(%d), should be %d", stat.Size(), len(content))
+	}
+	f, err := fs.OpenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(data, content) {
+		t.Fatal("invalid content")
+	}
+
+	// the encoded content is brotli
+	r, encoding, err := fs.OpenEncodedFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "br" {
+		t.Fatalf("invalid encoding %q", encoding)
+	}
+	data, _ = io.ReadAll(brotli.NewReader(r))
+	r.Close()
+	if !bytes.Equal(data, content) {
+		t.Fatal("invalid encoded content")
+	}
+
+	// the small files, the incompressible files and the files outside of the prefixes are stored as they are
+	random := make([]byte, 1024)
+	rand.Read(random)
+	for name, content := range map[string][]byte{
+		"builds/v135/foo@1.0.0/es2022/small.mjs":  []byte("export {}"),
+		"builds/v135/foo@1.0.0/es2022/random.bin": random,
+		"publish/foo.mjs":                         content,
+	} {
+		if _, err = fs.WriteFile(name, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := os.ReadFile(filepath.Join(root, name))
+		if !bytes.Equal(raw, content) {
+			t.Fatalf("%s should not be compressed", name)
+		}
+		r, encoding, err := fs.OpenEncodedFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if encoding != "" {
+			t.Fatalf("%s: invalid encoding %q", name, encoding)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HotCacheFS is a bounded in-memory LRU cache in front of a file system, the popular files are
+// served from the memory without touching the disk or the object storage.
+type HotCacheFS struct {
+	fs            FileSystem
+	maxSize       int64
+	maxObjectSize int64
+	lock          sync.Mutex
+	size          int64
+	lru           *list.List
+	entries       map[string]*list.Element
+	hits          int64
+	misses        int64
+}
+
+type hotCacheEntry struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func (e *hotCacheEntry) Size() int64 {
+	return int64(len(e.data))
+}
+
+func (e *hotCacheEntry) ModTime() time.Time {
+	return e.modTime
+}
+
+// NewHotCacheFS returns a file system that caches the files smaller than the `maxObjectSize` in
+// the memory, the least recently used files are evicted when the total size exceeds the `maxSize`.
+func NewHotCacheFS(fs FileSystem, maxSize int64, maxObjectSize int64) *HotCacheFS {
+	if maxObjectSize <= 0 || maxObjectSize > maxSize {
+		maxObjectSize = maxSize
+	}
+	return &HotCacheFS{
+		fs:            fs,
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+		lru:           list.New(),
+		entries:       map[string]*list.Element{},
+	}
+}
+
+func (fs *HotCacheFS) Stat(name string) (FileStat, error) {
+	if entry, ok := fs.get(name); ok {
+		return entry, nil
+	}
+	return fs.fs.Stat(name)
+}
+
+func (fs *HotCacheFS) OpenFile(name string) (io.ReadSeekCloser, error) {
+	if entry, ok := fs.get(name); ok {
+		return &bytesReadSeekCloser{bytes.NewReader(entry.data)}, nil
+	}
+	stat, err := fs.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.OpenFile(name)
+	if err != nil || stat.Size() > fs.maxObjectSize {
+		return f, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	fs.set(&hotCacheEntry{name: name, data: data, modTime: stat.ModTime()})
+	return &bytesReadSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// OpenEncodedFile opens the encoded file of the underlying file system, the encoded files are
+// not cached in the memory.
+func (fs *HotCacheFS) OpenEncodedFile(name string) (io.ReadSeekCloser, string, error) {
+	encoder, ok := fs.fs.(FileSystemEncoder)
+	if !ok {
+		f, err := fs.OpenFile(name)
+		return f, "", err
+	}
+	return encoder.OpenEncodedFile(name)
+}
+
+func (fs *HotCacheFS) WriteFile(name string, r io.Reader) (int64, error) {
+	fs.Remove(name)
+	return fs.fs.WriteFile(name, r)
+}
+
+// Remove evicts the file from the memory cache.
+func (fs *HotCacheFS) Remove(name string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if el, ok := fs.entries[name]; ok {
+		fs.removeElement(el)
+	}
+}
+
+func (fs *HotCacheFS) ReadDir(dir string) ([]string, error) {
+	remover, ok := fs.fs.(FileSystemRemover)
+	if !ok {
+		return nil, errors.New("file system does not support listing files")
+	}
+	return remover.ReadDir(dir)
+}
+
+func (fs *HotCacheFS) RemoveAll(name string) (int, error) {
+	remover, ok := fs.fs.(FileSystemRemover)
+	if !ok {
+		return 0, errors.New("file system does not support removing files")
+	}
+	fs.lock.Lock()
+	for key, el := range fs.entries {
+		if key == name || strings.HasPrefix(key, strings.TrimSuffix(name, "/")+"/") {
+			fs.removeElement(el)
+		}
+	}
+	fs.lock.Unlock()
+	return remover.RemoveAll(name)
+}
+
+// Stats returns the total size of the cached files, and the hits and misses of the cache.
+func (fs *HotCacheFS) Stats() (size int64, hits int64, misses int64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.size, fs.hits, fs.misses
+}
+
+func (fs *HotCacheFS) get(name string) (*hotCacheEntry, bool) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	el, ok := fs.entries[name]
+	if !ok {
+		fs.misses++
+		return nil, false
+	}
+	fs.hits++
+	fs.lru.MoveToFront(el)
+	return el.Value.(*hotCacheEntry), true
+}
+
+func (fs *HotCacheFS) set(entry *hotCacheEntry) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if el, ok := fs.entries[entry.name]; ok {
+		fs.removeElement(el)
+	}
+	fs.entries[entry.name] = fs.lru.PushFront(entry)
+	fs.size += entry.Size()
+	for fs.size > fs.maxSize {
+		fs.removeElement(fs.lru.Back())
+	}
+}
+
+func (fs *HotCacheFS) removeElement(el *list.Element) {
+	entry := fs.lru.Remove(el).(*hotCacheEntry)
+	delete(fs.entries, entry.name)
+	fs.size -= entry.Size()
+}
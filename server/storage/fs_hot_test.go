@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestHotCacheFS(t *testing.T) {
+	localFS, err := OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewHotCacheFS(localFS, 10, 6)
+
+	for name, content := range map[string]string{"a.mjs": "aaaa", "b.mjs": "bbbb", "c.mjs": "cccc", "large.mjs": "large file"} {
+		if _, err := fs.WriteFile(name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		f, err := fs.OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		return string(data)
+	}
+
+	read("a.mjs")
+	read("b.mjs")
+	read("a.mjs")
+	if size, hits, misses := fs.Stats(); size != 8 || hits != 1 || misses != 2 {
+		t.Fatalf("unexpected stats: size=%d hits=%d misses=%d", size, hits, misses)
+	}
+
+	// `b.mjs` is the least recently used
+	read("c.mjs")
+	if _, ok := fs.entries["b.mjs"]; ok {
+		t.Fatal("b.mjs should be evicted")
+	}
+	if _, ok := fs.entries["a.mjs"]; !ok {
+		t.Fatal("a.mjs should be cached")
+	}
+
+	// the files larger than the max object size are not cached
+	if read("large.mjs") != "large file" {
+		t.Fatal("unexpected content of large.mjs")
+	}
+	if _, ok := fs.entries["large.mjs"]; ok {
+		t.Fatal("large.mjs should not be cached")
+	}
+
+	// writing the file evicts the stale cache
+	fs.WriteFile("a.mjs", bytes.NewBufferString("AAAA"))
+	if read("a.mjs") != "AAAA" {
+		t.Fatal("should read the updated content")
+	}
+	fi, err := fs.Stat("a.mjs")
+	if err != nil || fi.Size() != 4 {
+		t.Fatalf("unexpected stat: %v", err)
+	}
+	if size, _, _ := fs.Stats(); size > 10 {
+		t.Fatalf("the cache size %d exceeds the max size", size)
+	}
+}
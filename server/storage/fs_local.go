@@ -1,31 +1,73 @@
 package storage
 
 import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// the prefix of the temporary files, the files are renamed to the target path after written
+	localTempPrefix = ".tmp-"
+	// the directory of the shards in the root
+	localShardsDir = "_shards"
+	// the number of the leading path segments that decide the shard of a file,
+	// e.g. "builds/v135/react@18.2.0"
+	localShardDepth = 3
 )
 
 type localFSDriver struct{}
 
+// Open opens the local file system, the options are:
+//   - shard: "true" to spread the files across 256 shard directories by the hash of the leading
+//     path segments, the existing files that are not sharded are still readable.
+//   - fsync: "none" (default), "file" to sync the file before renaming it to the target path, or
+//     "full" to sync the parent directory after renaming as well.
 func (driver *localFSDriver) Open(root string, options url.Values) (FileSystem, error) {
 	root = filepath.Clean(root)
 	err := ensureDir(root)
 	if err != nil {
 		return nil, err
 	}
-	return &localFSLayer{root}, nil
+	fsync := options.Get("fsync")
+	switch fsync {
+	case "":
+		fsync = "none"
+	case "none", "file", "full":
+	default:
+		return nil, fmt.Errorf("invalid fsync option '%s'", fsync)
+	}
+	fs := &localFSLayer{root: root, shard: options.Get("shard") == "true", fsync: fsync}
+	// remove the temporary files left by the interrupted writes
+	go fs.removeTempFiles(time.Now().Add(-10 * time.Minute))
+	return fs, nil
 }
 
 type localFSLayer struct {
-	root string
+	root  string
+	shard bool
+	fsync string
 }
 
 func (fs *localFSLayer) Stat(name string) (FileStat, error) {
-	fullPath := path.Join(fs.root, name)
-	fi, err := os.Lstat(fullPath)
+	var fi os.FileInfo
+	var err error
+	for _, fullPath := range fs.lookupPaths(name) {
+		fi, err = os.Lstat(fullPath)
+		if err == nil || !os.IsNotExist(err) {
+			break
+		}
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, ErrNotFound
@@ -36,31 +78,186 @@ func (fs *localFSLayer) Stat(name string) (FileStat, error) {
 }
 
 func (fs *localFSLayer) OpenFile(name string) (file io.ReadSeekCloser, err error) {
-	fullPath := path.Join(fs.root, name)
-	file, err = os.Open(fullPath)
-	if err != nil && os.IsNotExist(err) {
-		err = ErrNotFound
+	var f *os.File
+	for _, fullPath := range fs.lookupPaths(name) {
+		f, err = os.Open(fullPath)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
 	}
-	return
+	return nil, ErrNotFound
 }
 
+// WriteFile writes the content to a temporary file and renames it to the target path, so a
+// crash never leaves a partial file.
 func (fs *localFSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
-	fullPath := path.Join(fs.root, name)
-	err = ensureDir(path.Dir(fullPath))
+	fullPath := fs.getPath(name)
+	dir := path.Dir(fullPath)
+	err = ensureDir(dir)
 	if err != nil {
 		return
 	}
 
-	file, err := os.Create(fullPath)
+	suffix := make([]byte, 8)
+	readRand(suffix)
+	tmpPath := path.Join(dir, localTempPrefix+hex.EncodeToString(suffix)+"-"+path.Base(fullPath))
+	file, err := os.Create(tmpPath)
 	if err != nil {
 		return
 	}
-	defer file.Close()
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+		}
+	}()
 
 	written, err = io.Copy(file, content)
+	if err != nil {
+		return
+	}
+	if fs.fsync != "none" {
+		if err = file.Sync(); err != nil {
+			return
+		}
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmpPath, fullPath); err != nil {
+		return
+	}
+	if fs.fsync == "full" {
+		err = syncDir(dir)
+	}
+	return
+}
+
+func (fs *localFSLayer) ReadDir(dir string) ([]string, error) {
+	found := false
+	set := map[string]struct{}{}
+	for _, fullPath := range fs.dirPaths(dir) {
+		entries, err := os.ReadDir(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		found = true
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, localTempPrefix) || (fullPath == fs.root && name == localShardsDir) {
+				continue
+			}
+			if entry.IsDir() {
+				name += "/"
+			}
+			set[name] = struct{}{}
+		}
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fs *localFSLayer) RemoveAll(name string) (removed int, err error) {
+	for _, fullPath := range fs.dirPaths(name) {
+		err = filepath.Walk(fullPath, func(_ string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				removed++
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		err = os.RemoveAll(fullPath)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
+// getPath returns the path of the file on the disk.
+func (fs *localFSLayer) getPath(name string) string {
+	if !fs.shard {
+		return path.Join(fs.root, name)
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	key := name
+	if segments := strings.SplitN(name, "/", localShardDepth+1); len(segments) > localShardDepth {
+		key = strings.Join(segments[:localShardDepth], "/")
+	}
+	sum := sha1.Sum([]byte(key))
+	return path.Join(fs.root, localShardsDir, hex.EncodeToString(sum[:1]), name)
+}
+
+// lookupPaths returns the paths to look up the file, the files written before the sharding is
+// enabled are stored in the root.
+func (fs *localFSLayer) lookupPaths(name string) []string {
+	if !fs.shard {
+		return []string{path.Join(fs.root, name)}
+	}
+	return []string{fs.getPath(name), path.Join(fs.root, name)}
+}
+
+// dirPaths returns the paths of the directory in all the shards, the directory with the leading
+// path segments is stored in one shard.
+func (fs *localFSLayer) dirPaths(dir string) []string {
+	paths := []string{path.Join(fs.root, dir)}
+	if fs.shard {
+		if len(strings.Split(strings.Trim(path.Clean("/"+dir), "/"), "/")) >= localShardDepth {
+			return append(paths, fs.getPath(dir))
+		}
+		for i := 0; i < 256; i++ {
+			paths = append(paths, path.Join(fs.root, localShardsDir, fmt.Sprintf("%02x", i), dir))
+		}
+	}
+	return paths
+}
+
+// removeTempFiles removes the temporary files that are created before the `before` time.
+func (fs *localFSLayer) removeTempFiles(before time.Time) {
+	filepath.Walk(fs.root, func(filename string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && strings.HasPrefix(fi.Name(), localTempPrefix) && fi.ModTime().Before(before) {
+			os.Remove(filename)
+		}
+		return nil
+	})
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil && errors.Is(err, os.ErrInvalid) {
+		// some platforms do not support syncing directories
+		return nil
+	}
+	return err
+}
+
+func readRand(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// fallback to the time-based name
+		copy(b, fmt.Sprintf("%016x", time.Now().UnixNano()))
+	}
+}
+
 func ensureDir(dir string) (err error) {
 	_, err = os.Lstat(dir)
 	if err != nil && os.IsNotExist(err) {
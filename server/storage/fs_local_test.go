@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -66,3 +67,56 @@ func TestLocalFS(t *testing.T) {
 		t.Fatalf("File should be not existent")
 	}
 }
+
+func TestLocalFSShard(t *testing.T) {
+	root := t.TempDir()
+	// the files written before the sharding is enabled
+	legacyFS, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyFS.WriteFile("builds/v135/foo@1.0.0/es2022/foo.mjs", bytes.NewBufferString("export default 'foo'"))
+
+	fs, err := OpenFS("local:" + root + "?shard=true&fsync=full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"builds/v135/bar@1.0.0/es2022/bar.mjs", "builds/v135/baz@1.0.0/es2022/baz.mjs"} {
+		if _, err = fs.WriteFile(name, bytes.NewBufferString("export default {}")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should be stored in a shard", name)
+		}
+		if _, err = fs.Stat(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := fs.OpenFile("builds/v135/foo@1.0.0/es2022/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// the directories are merged across the shards, and the temporary files are ignored
+	os.WriteFile(filepath.Join(root, "builds", "v135", localTempPrefix+"partial"), []byte("export"), 0644)
+	names, err := fs.(FileSystemRemover).ReadDir("builds/v135")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "bar@1.0.0/,baz@1.0.0/,foo@1.0.0/" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+
+	n, err := fs.(FileSystemRemover).RemoveAll("builds/v135/bar@1.0.0")
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 removed file, got %d (%v)", n, err)
+	}
+	if _, err = fs.Stat("builds/v135/bar@1.0.0/es2022/bar.mjs"); err != ErrNotFound {
+		t.Fatal("the file should be removed")
+	}
+
+	if _, err = OpenFS("local:" + root + "?fsync=always"); err == nil {
+		t.Fatal("should fail with the invalid fsync option")
+	}
+}
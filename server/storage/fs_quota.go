@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaOptions is the options of the QuotaFS.
+type QuotaOptions struct {
+	// MaxSize is the max total size of the evictable files in bytes, 0 means no limit.
+	MaxSize int64
+	// MaxObjects is the max number of the evictable files, 0 means no limit.
+	MaxObjects int
+	// Eviction is the eviction policy when the quota is exceeded, one of "lru" (least recently
+	// used), "lfu" (least frequently used) and "ttl" (like "lru" but the TTL is required),
+	// default is "lru".
+	Eviction string
+	// TTL evicts the files that are not accessed in the duration, 0 means no TTL.
+	TTL time.Duration
+	// Tiers are the TTLs by the access count, a file uses the TTL of the tier with the highest
+	// `MinHits` it reaches, or the `TTL` if it reaches no tier.
+	Tiers []QuotaTier
+	// Interval is the interval of the janitor, default is 10 minutes.
+	Interval time.Duration
+	// Prefixes are the prefixes of the evictable files.
+	Prefixes []string
+}
+
+// QuotaTier is a retention tier of the QuotaFS, the files accessed at least `MinHits` times are
+// evicted if they are not accessed in the `TTL`, 0 means no TTL.
+type QuotaTier struct {
+	MinHits int64
+	TTL     time.Duration
+}
+
+// QuotaStats is the stats of the QuotaFS.
+type QuotaStats struct {
+	Size         int64     `json:"size"`
+	Objects      int       `json:"objects"`
+	Evictions    int64     `json:"evictions"`
+	EvictedBytes int64     `json:"evictedBytes"`
+	LastRun      time.Time `json:"lastRun,omitempty"`
+}
+
+type quotaEntry struct {
+	name       string
+	size       int64
+	accessedAt time.Time
+	hits       int64
+}
+
+// QuotaFS limits the total size and the number of the evictable files of a file system, a
+// background janitor evicts the files by the eviction policy when the quota is exceeded.
+type QuotaFS struct {
+	fs      FileSystem
+	remover FileSystemRemover
+	options QuotaOptions
+	lock    sync.Mutex
+	entries map[string]*quotaEntry
+	stats   QuotaStats
+	stop    chan struct{}
+}
+
+// NewQuotaFS returns a file system with the quota, the file system must support listing and
+// removing files.
+func NewQuotaFS(fs FileSystem, options QuotaOptions) (*QuotaFS, error) {
+	remover, ok := fs.(FileSystemRemover)
+	if !ok {
+		return nil, errors.New("file system does not support removing files")
+	}
+	switch options.Eviction {
+	case "":
+		options.Eviction = "lru"
+	case "lru", "lfu":
+	case "ttl":
+		if options.TTL <= 0 && len(options.Tiers) == 0 {
+			return nil, errors.New("the ttl eviction requires a ttl")
+		}
+	default:
+		return nil, errors.New("invalid eviction policy '" + options.Eviction + "'")
+	}
+	if options.Interval <= 0 {
+		options.Interval = 10 * time.Minute
+	}
+	tiers := make([]QuotaTier, len(options.Tiers))
+	copy(tiers, options.Tiers)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinHits < tiers[j].MinHits })
+	options.Tiers = tiers
+	return &QuotaFS{
+		fs:      fs,
+		remover: remover,
+		options: options,
+		entries: map[string]*quotaEntry{},
+	}, nil
+}
+
+func (fs *QuotaFS) Stat(name string) (FileStat, error) {
+	return fs.fs.Stat(name)
+}
+
+func (fs *QuotaFS) OpenFile(name string) (io.ReadSeekCloser, error) {
+	f, err := fs.fs.OpenFile(name)
+	if err == nil {
+		fs.lock.Lock()
+		if entry, ok := fs.entries[name]; ok {
+			entry.accessedAt = time.Now()
+			entry.hits++
+		}
+		fs.lock.Unlock()
+	}
+	return f, err
+}
+
+func (fs *QuotaFS) WriteFile(name string, r io.Reader) (int64, error) {
+	n, err := fs.fs.WriteFile(name, r)
+	if err == nil && fs.isEvictable(name) {
+		fs.add(&quotaEntry{name: name, size: n, accessedAt: time.Now()})
+	}
+	return n, err
+}
+
+func (fs *QuotaFS) ReadDir(dir string) ([]string, error) {
+	return fs.remover.ReadDir(dir)
+}
+
+func (fs *QuotaFS) RemoveAll(name string) (int, error) {
+	fs.lock.Lock()
+	for key, entry := range fs.entries {
+		if key == name || strings.HasPrefix(key, strings.TrimSuffix(name, "/")+"/") {
+			fs.remove(entry)
+		}
+	}
+	fs.lock.Unlock()
+	return fs.remover.RemoveAll(name)
+}
+
+// Stats returns the stats of the quota.
+func (fs *QuotaFS) Stats() QuotaStats {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.stats
+}
+
+// Start scans the existing files and starts the janitor.
+func (fs *QuotaFS) Start() {
+	fs.stop = make(chan struct{})
+	go func() {
+		for _, prefix := range fs.options.Prefixes {
+			fs.scan(strings.TrimSuffix(prefix, "/"))
+		}
+		ticker := time.NewTicker(fs.options.Interval)
+		defer ticker.Stop()
+		for {
+			fs.Evict()
+			select {
+			case <-fs.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the janitor.
+func (fs *QuotaFS) Stop() {
+	if fs.stop != nil {
+		close(fs.stop)
+	}
+}
+
+// Evict evicts the files that exceed the quota or the TTL, returns the number of the evicted files.
+func (fs *QuotaFS) Evict() int {
+	now := time.Now()
+	fs.lock.Lock()
+	entries := make([]quotaEntry, 0, len(fs.entries))
+	for _, entry := range fs.entries {
+		entries = append(entries, *entry)
+	}
+	fs.lock.Unlock()
+
+	if fs.options.Eviction == "lfu" {
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].hits != entries[j].hits {
+				return entries[i].hits < entries[j].hits
+			}
+			return entries[i].accessedAt.Before(entries[j].accessedAt)
+		})
+	} else {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].accessedAt.Before(entries[j].accessedAt)
+		})
+	}
+
+	// evict the files until the usage is under 90% of the quota to avoid evicting on every run
+	maxSize := fs.options.MaxSize * 9 / 10
+	maxObjects := fs.options.MaxObjects * 9 / 10
+	evicted := 0
+	for _, entry := range entries {
+		fs.lock.Lock()
+		size, objects := fs.stats.Size, fs.stats.Objects
+		fs.lock.Unlock()
+		ttl := fs.getTTL(entry.hits)
+		expired := ttl > 0 && now.Sub(entry.accessedAt) > ttl
+		overQuota := (fs.options.MaxSize > 0 && size > maxSize) || (fs.options.MaxObjects > 0 && objects > maxObjects)
+		if !expired && !overQuota {
+			if fs.options.TTL <= 0 && len(fs.options.Tiers) == 0 {
+				// the entries are sorted, no more files to evict
+				break
+			}
+			continue
+		}
+		if _, err := fs.remover.RemoveAll(entry.name); err != nil {
+			continue
+		}
+		fs.lock.Lock()
+		if current, ok := fs.entries[entry.name]; ok {
+			fs.remove(current)
+			fs.stats.Evictions++
+			fs.stats.EvictedBytes += current.size
+			evicted++
+		}
+		fs.lock.Unlock()
+	}
+
+	fs.lock.Lock()
+	fs.stats.LastRun = now
+	fs.lock.Unlock()
+	return evicted
+}
+
+// getTTL returns the TTL of a file by the access count.
+func (fs *QuotaFS) getTTL(hits int64) time.Duration {
+	ttl := fs.options.TTL
+	for _, tier := range fs.options.Tiers {
+		if hits < tier.MinHits {
+			break
+		}
+		ttl = tier.TTL
+	}
+	return ttl
+}
+
+func (fs *QuotaFS) scan(dir string) {
+	names, err := fs.remover.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			fs.scan(path.Join(dir, name))
+			continue
+		}
+		filename := path.Join(dir, name)
+		stat, err := fs.fs.Stat(filename)
+		if err != nil {
+			continue
+		}
+		fs.lock.Lock()
+		_, ok := fs.entries[filename]
+		fs.lock.Unlock()
+		if !ok {
+			fs.add(&quotaEntry{name: filename, size: stat.Size(), accessedAt: stat.ModTime()})
+		}
+	}
+}
+
+func (fs *QuotaFS) isEvictable(name string) bool {
+	for _, prefix := range fs.options.Prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *QuotaFS) add(entry *quotaEntry) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if prev, ok := fs.entries[entry.name]; ok {
+		entry.hits = prev.hits
+		fs.remove(prev)
+	}
+	fs.entries[entry.name] = entry
+	fs.stats.Size += entry.size
+	fs.stats.Objects++
+}
+
+func (fs *QuotaFS) remove(entry *quotaEntry) {
+	delete(fs.entries, entry.name)
+	fs.stats.Size -= entry.size
+	fs.stats.Objects--
+}
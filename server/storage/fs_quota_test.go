@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQuotaFS(t *testing.T) {
+	localFS, err := OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the existing files are scanned at startup
+	localFS.WriteFile("builds/v135/old@1.0.0/es2022/old.mjs", bytes.NewBufferString("0123456789"))
+	localFS.WriteFile("publish/foo.mjs", bytes.NewBufferString("0123456789"))
+
+	fs, err := NewQuotaFS(localFS, QuotaOptions{MaxSize: 100, Prefixes: []string{"builds/"}, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Start()
+	defer fs.Stop()
+	for i := 0; i < 100; i++ {
+		if !fs.Stats().LastRun.IsZero() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := fs.Stats(); stats.Objects != 1 || stats.Size != 10 {
+		t.Fatalf("unexpected stats after scanning: %+v", stats)
+	}
+
+	for i := 0; i < 10; i++ {
+		fs.WriteFile(fmt.Sprintf("builds/v135/foo@1.0.%d/es2022/foo.mjs", i), bytes.NewBufferString("0123456789"))
+		time.Sleep(time.Millisecond)
+	}
+	// access the first build
+	f, err := fs.OpenFile("builds/v135/foo@1.0.0/es2022/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// evict the files until the usage is under 90% of the quota
+	if n := fs.Evict(); n != 2 {
+		t.Fatalf("expected 2 evicted files, got %d", n)
+	}
+	stats := fs.Stats()
+	if stats.Size != 90 || stats.Objects != 9 || stats.Evictions != 2 || stats.EvictedBytes != 20 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	// the least recently used files are evicted
+	for name, exists := range map[string]bool{
+		"builds/v135/old@1.0.0/es2022/old.mjs": false,
+		"builds/v135/foo@1.0.0/es2022/foo.mjs": true,
+		"builds/v135/foo@1.0.1/es2022/foo.mjs": false,
+		"builds/v135/foo@1.0.2/es2022/foo.mjs": true,
+		"publish/foo.mjs":                      true,
+	} {
+		if _, err := fs.Stat(name); (err == nil) != exists {
+			t.Fatalf("%s: expected exists=%v, got %v", name, exists, err)
+		}
+	}
+
+	if _, err = NewQuotaFS(localFS, QuotaOptions{Eviction: "ttl"}); err == nil {
+		t.Fatal("the ttl eviction should require a ttl")
+	}
+}
+
+func TestQuotaFSEviction(t *testing.T) {
+	localFS, err := OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the least frequently used files are evicted
+	fs, _ := NewQuotaFS(localFS, QuotaOptions{MaxObjects: 3, Eviction: "lfu", Prefixes: []string{"builds/"}})
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("builds/%d.mjs", i)
+		fs.WriteFile(name, bytes.NewBufferString("export {}"))
+		for j := 0; j < 4-i; j++ {
+			f, _ := fs.OpenFile(name)
+			f.Close()
+		}
+	}
+	if n := fs.Evict(); n != 2 {
+		t.Fatalf("expected 2 evicted files, got %d", n)
+	}
+	for i, exists := range []bool{true, true, false, false} {
+		if _, err := fs.Stat(fmt.Sprintf("builds/%d.mjs", i)); (err == nil) != exists {
+			t.Fatalf("builds/%d.mjs: expected exists=%v, got %v", i, exists, err)
+		}
+	}
+
+	// the files that are not accessed in the ttl are evicted
+	fs, _ = NewQuotaFS(localFS, QuotaOptions{Eviction: "ttl", TTL: 50 * time.Millisecond, Prefixes: []string{"types/"}})
+	fs.WriteFile("types/a.d.ts", bytes.NewBufferString("export {}"))
+	time.Sleep(100 * time.Millisecond)
+	fs.WriteFile("types/b.d.ts", bytes.NewBufferString("export {}"))
+	if n := fs.Evict(); n != 1 {
+		t.Fatalf("expected 1 evicted file, got %d", n)
+	}
+	if _, err := fs.Stat("types/a.d.ts"); err != ErrNotFound {
+		t.Fatal("types/a.d.ts should be evicted")
+	}
+
+	// the popular files are kept longer by the tiers
+	fs, _ = NewQuotaFS(localFS, QuotaOptions{
+		Eviction: "ttl",
+		TTL:      50 * time.Millisecond,
+		Tiers:    []QuotaTier{{MinHits: 10, TTL: 0}, {MinHits: 3, TTL: time.Hour}},
+		Prefixes: []string{"tiers/"},
+	})
+	for i, hits := range []int{0, 2, 3, 10} {
+		name := fmt.Sprintf("tiers/%d.mjs", i)
+		fs.WriteFile(name, bytes.NewBufferString("export {}"))
+		for j := 0; j < hits; j++ {
+			f, _ := fs.OpenFile(name)
+			f.Close()
+		}
+	}
+	// the files have been idle for 2 hours
+	fs.lock.Lock()
+	for _, entry := range fs.entries {
+		entry.accessedAt = entry.accessedAt.Add(-2 * time.Hour)
+	}
+	fs.lock.Unlock()
+	if n := fs.Evict(); n != 3 {
+		t.Fatalf("expected 3 evicted files, got %d", n)
+	}
+	if _, err := fs.Stat("tiers/3.mjs"); err != nil {
+		t.Fatal("tiers/3.mjs should be kept")
+	}
+}
@@ -0,0 +1,547 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the minimum part size of the multipart upload of S3
+	s3MinPartSize     = 5 * 1024 * 1024
+	s3DefaultPartSize = 16 * 1024 * 1024
+)
+
+// s3FSDriver is the driver of the S3 compatible object storages, e.g. AWS S3, Cloudflare R2,
+// Google Cloud Storage (with the interoperability API) and MinIO.
+//
+//	s3:bucket/prefix?endpoint=https://s3.us-east-1.amazonaws.com&region=us-east-1&accessKeyId=xxx&secretAccessKey=xxx
+//
+// The credentials fall back to the `AWS_ACCESS_KEY_ID`, `AWS_SECRET_ACCESS_KEY` and `AWS_SESSION_TOKEN`
+// environment variables. The `cacheDir` option enables the read-through cache on the local disk, and
+// the objects larger than the `partSize` option (default is 16MB) are uploaded in multiple parts.
+type s3FSDriver struct{}
+
+func (driver *s3FSDriver) Open(root string, options url.Values) (FileSystem, error) {
+	bucket, prefix := root, ""
+	if i := strings.IndexByte(root, '/'); i >= 0 {
+		bucket, prefix = root[:i], strings.Trim(root[i+1:], "/")
+	}
+	if bucket == "" {
+		return nil, errors.New("s3: missing bucket")
+	}
+	region := options.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := strings.TrimRight(options.Get("endpoint"), "/")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("s3: invalid endpoint '%s'", endpoint)
+	}
+	fs := &s3FSLayer{
+		endpoint:        endpoint,
+		bucket:          bucket,
+		prefix:          prefix,
+		region:          region,
+		accessKeyID:     options.Get("accessKeyId"),
+		secretAccessKey: options.Get("secretAccessKey"),
+		sessionToken:    options.Get("sessionToken"),
+		partSize:        s3DefaultPartSize,
+		client:          &http.Client{Timeout: 5 * time.Minute},
+	}
+	if fs.accessKeyID == "" {
+		fs.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		fs.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		fs.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if fs.accessKeyID == "" || fs.secretAccessKey == "" {
+		return nil, errors.New("s3: missing credentials")
+	}
+	if v := options.Get("partSize"); v != "" {
+		size, err := parseBytesValue(v)
+		if err != nil || size < s3MinPartSize {
+			return nil, fmt.Errorf("s3: invalid part size '%s', the minimum is 5MB", v)
+		}
+		fs.partSize = size
+	}
+	if dir := options.Get("cacheDir"); dir != "" {
+		fs.cacheDir = filepath.Clean(dir)
+		if err := ensureDir(fs.cacheDir); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+type s3FSLayer struct {
+	endpoint        string
+	bucket          string
+	prefix          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	partSize        int64
+	cacheDir        string
+	client          *http.Client
+}
+
+type s3FileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+func (fi *s3FileStat) Size() int64 {
+	return fi.size
+}
+
+func (fi *s3FileStat) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fs *s3FSLayer) Stat(name string) (FileStat, error) {
+	res, err := fs.request("HEAD", name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &s3FileStat{size: res.ContentLength, modTime: modTime}, nil
+}
+
+func (fs *s3FSLayer) OpenFile(name string) (io.ReadSeekCloser, error) {
+	var cachePath string
+	if fs.cacheDir != "" {
+		cachePath = filepath.Join(fs.cacheDir, filepath.FromSlash(path.Clean("/"+name)))
+		if f, err := os.Open(cachePath); err == nil {
+			return f, nil
+		}
+	}
+	res, err := fs.request("GET", name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if cachePath != "" {
+		err = writeCacheFile(cachePath, res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(cachePath)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &bytesReadSeekCloser{bytes.NewReader(data)}, nil
+}
+
+func (fs *s3FSLayer) WriteFile(name string, r io.Reader) (written int64, err error) {
+	// read the first part to check whether the multipart upload is needed
+	buf := make([]byte, fs.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return
+	}
+	if int64(n) < fs.partSize {
+		var res *http.Response
+		res, err = fs.request("PUT", name, nil, buf[:n])
+		if err != nil {
+			return
+		}
+		res.Body.Close()
+		written = int64(n)
+	} else {
+		written, err = fs.multipartUpload(name, buf, r)
+		if err != nil {
+			return
+		}
+	}
+	if fs.cacheDir != "" {
+		// the stale cache is removed, it will be downloaded again when it's opened
+		os.Remove(filepath.Join(fs.cacheDir, filepath.FromSlash(path.Clean("/"+name))))
+	}
+	return written, nil
+}
+
+func (fs *s3FSLayer) multipartUpload(name string, firstPart []byte, r io.Reader) (written int64, err error) {
+	res, err := fs.request("POST", name, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&initiate)
+	res.Body.Close()
+	if err != nil {
+		return
+	}
+	if initiate.UploadID == "" {
+		return 0, errors.New("s3: missing upload id")
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+	defer func() {
+		if err != nil {
+			// abort the upload to release the uploaded parts
+			if res, e := fs.request("DELETE", name, url.Values{"uploadId": {initiate.UploadID}}, nil); e == nil {
+				res.Body.Close()
+			}
+		}
+	}()
+
+	part := firstPart
+	for partNumber := 1; len(part) > 0; partNumber++ {
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {initiate.UploadID}}
+		res, err = fs.request("PUT", name, query, part)
+		if err != nil {
+			return
+		}
+		res.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: partNumber, ETag: res.Header.Get("ETag")})
+		written += int64(len(part))
+		if int64(len(part)) < fs.partSize {
+			break
+		}
+		buf := make([]byte, fs.partSize)
+		n, e := io.ReadFull(r, buf)
+		if e != nil && e != io.ErrUnexpectedEOF && e != io.EOF {
+			err = e
+			return
+		}
+		part = buf[:n]
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return
+	}
+	res, err = fs.request("POST", name, url.Values{"uploadId": {initiate.UploadID}}, body)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	// the complete request may fail with a 200 status code
+	data, err := io.ReadAll(res.Body)
+	if err == nil && bytes.Contains(data, []byte("<Error>")) {
+		err = fmt.Errorf("s3: complete multipart upload of %s failed: %s", name, string(data))
+	}
+	return
+}
+
+func (fs *s3FSLayer) ReadDir(dir string) ([]string, error) {
+	prefix := s3ListPrefix(fs.prefix, dir)
+	names := []string{}
+	err := fs.listObjects(prefix, "/", func(key string, isDir bool) error {
+		name := strings.TrimPrefix(key, prefix)
+		if name != "" && name != "/" {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (fs *s3FSLayer) RemoveAll(name string) (removed int, err error) {
+	key := strings.TrimPrefix(path.Clean("/"+fs.prefix+"/"+name), "/")
+	keys := []string{}
+	if _, err = fs.Stat(name); err == nil {
+		keys = append(keys, key)
+	} else if err != ErrNotFound {
+		return
+	}
+	err = fs.listObjects(key+"/", "", func(key string, isDir bool) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		var res *http.Response
+		res, err = fs.do("DELETE", "/"+key, nil, nil)
+		if err != nil {
+			return
+		}
+		res.Body.Close()
+		removed++
+	}
+	if fs.cacheDir != "" {
+		os.RemoveAll(filepath.Join(fs.cacheDir, filepath.FromSlash(path.Clean("/"+name))))
+	}
+	return
+}
+
+// listObjects lists the objects with the ListObjectsV2 API, the common prefixes are passed to
+// the callback function as directories if the `delimiter` is not empty.
+func (fs *s3FSLayer) listObjects(prefix string, delimiter string, fn func(key string, isDir bool) error) error {
+	var result struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+		CommonPrefixes []struct {
+			Prefix string `xml:"Prefix"`
+		} `xml:"CommonPrefixes"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	for {
+		res, err := fs.do("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		result.Contents = nil
+		result.CommonPrefixes = nil
+		result.IsTruncated = false
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, p := range result.CommonPrefixes {
+			if err := fn(p.Prefix, true); err != nil {
+				return err
+			}
+		}
+		for _, c := range result.Contents {
+			if err := fn(c.Key, false); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (fs *s3FSLayer) request(method string, name string, query url.Values, body []byte) (res *http.Response, err error) {
+	return fs.do(method, path.Clean("/"+fs.prefix+"/"+name), query, body)
+}
+
+// do sends the request to the bucket, the `key` is the object key with the leading slash, or
+// an empty string for the bucket requests.
+func (fs *s3FSLayer) do(method string, key string, query url.Values, body []byte) (res *http.Response, err error) {
+	u := fs.endpoint + s3EscapePath("/"+fs.bucket+key)
+	if len(query) > 0 {
+		u += "?" + s3CanonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	if body == nil {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if fs.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", fs.sessionToken)
+	}
+	signS3Request(req, payloadHash, fs.accessKeyID, fs.secretAccessKey, fs.region, "s3", time.Now())
+	res, err = fs.client.Do(req)
+	if err != nil {
+		return
+	}
+	if res.StatusCode == 404 {
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	if res.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s %s", method, key, res.Status, string(data))
+	}
+	return
+}
+
+// signS3Request signs the request with the AWS Signature Version 4, the `Host` header and the
+// `X-Amz-*` headers are signed.
+func signS3Request(req *http.Request, payloadHash string, accessKeyID string, secretAccessKey string, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		if k := strings.ToLower(key); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := bytes.NewBuffer(nil)
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath escapes the path with the URI encoding of AWS, the `/` is kept.
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(key)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3ListPrefix returns the prefix of the keys in the directory.
+func s3ListPrefix(prefix string, dir string) string {
+	p := strings.Trim(path.Clean("/"+prefix+"/"+dir), "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+func s3Escape(s string) string {
+	buf := strings.Builder{}
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func writeCacheFile(filename string, r io.Reader) (err error) {
+	err = ensureDir(filepath.Dir(filename))
+	if err != nil {
+		return
+	}
+	tmp := filename + ".tmp" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	return os.Rename(tmp, filename)
+}
+
+// parseBytesValue parses the size value, e.g. "1024", "8KB", "16MB", "1GB".
+func parseBytesValue(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for suffix, v := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, suffix))
+			unit = v
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * unit, nil
+}
+
+type bytesReadSeekCloser struct {
+	*bytes.Reader
+}
+
+func (r *bytesReadSeekCloser) Close() error {
+	return nil
+}
+
+func init() {
+	RegisterFileSystem("s3", &s3FSDriver{})
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignS3Request(t *testing.T) {
+	// the `get-vanilla` case of the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	now, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	sum := sha256.Sum256(nil)
+	signS3Request(req, hex.EncodeToString(sum[:]), "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Fatalf("unexpected authorization header:\n%s\nexpected:\n%s", auth, expected)
+	}
+}
+
+func TestS3FS(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	uploads := map[string]map[string][]byte{}
+	getRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+			w.WriteHeader(403)
+			return
+		}
+		key := r.URL.Path
+		query := r.URL.Query()
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.Method == "POST" && query.Has("uploads"):
+			uploads["upload-1"] = map[string][]byte{}
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == "PUT" && query.Has("uploadId"):
+			uploads[query.Get("uploadId")][query.Get("partNumber")] = body
+			w.Header().Set("ETag", `"etag-`+query.Get("partNumber")+`"`)
+		case r.Method == "POST" && query.Has("uploadId"):
+			parts := uploads[query.Get("uploadId")]
+			numbers := []string{}
+			for n := range parts {
+				numbers = append(numbers, n)
+			}
+			sort.Strings(numbers)
+			data := []byte{}
+			for _, n := range numbers {
+				data = append(data, parts[n]...)
+			}
+			objects[key] = data
+			fmt.Fprint(w, `<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`)
+		case r.Method == "GET" && query.Get("list-type") == "2":
+			prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+			keys := []string{}
+			for k := range objects {
+				keys = append(keys, strings.TrimPrefix(k, "/esm/"))
+			}
+			sort.Strings(keys)
+			fmt.Fprint(w, `<ListBucketResult>`)
+			seen := map[string]bool{}
+			for _, k := range keys {
+				if !strings.HasPrefix(k, prefix) {
+					continue
+				}
+				if i := strings.Index(k[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+					if p := k[:len(prefix)+i+1]; !seen[p] {
+						seen[p] = true
+						fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, p)
+					}
+				} else {
+					fmt.Fprintf(w, `<Contents><Key>%s</Key></Contents>`, k)
+				}
+			}
+			fmt.Fprint(w, `</ListBucketResult>`)
+		case r.Method == "DELETE":
+			delete(objects, key)
+			w.WriteHeader(204)
+		case r.Method == "PUT":
+			objects[key] = body
+		case r.Method == "GET" || r.Method == "HEAD":
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			if r.Method == "GET" {
+				getRequests++
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Write(data)
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	fs, err := OpenFS(fmt.Sprintf("s3:esm/builds?endpoint=%s&accessKeyId=test-key&secretAccessKey=test-secret&partSize=5MB&cacheDir=%s", server.URL, cacheDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := fs.WriteFile("v135/react@18.2.0/es2022/react.mjs", bytes.NewBufferString("export default {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 17 || string(objects["/esm/builds/v135/react@18.2.0/es2022/react.mjs"]) != "export default {}" {
+		t.Fatalf("unexpected object: %d %v", n, objects)
+	}
+
+	fi, err := fs.Stat("v135/react@18.2.0/es2022/react.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 17 {
+		t.Fatalf("invalid size(%d), should be 17", fi.Size())
+	}
+
+	// the read-through cache
+	for i := 0; i < 2; i++ {
+		f, err := fs.OpenFile("v135/react@18.2.0/es2022/react.mjs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(f)
+		f.Close()
+		if string(data) != "export default {}" {
+			t.Fatalf("unexpected content: %s", string(data))
+		}
+	}
+	if getRequests != 1 {
+		t.Fatalf("expected 1 GET request, got %d", getRequests)
+	}
+
+	// multipart upload
+	large := bytes.Repeat([]byte("0123456789"), 1024*1024+1)
+	n, err = fs.WriteFile("large.tgz", bytes.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(large)) || !bytes.Equal(objects["/esm/builds/large.tgz"], large) || len(uploads["upload-1"]) != 3 {
+		t.Fatalf("unexpected multipart upload: %d bytes in %d parts", n, len(uploads["upload-1"]))
+	}
+
+	if _, err = fs.Stat("not-found.mjs"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err = fs.OpenFile("not-found.mjs"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// list and remove the files
+	fs.WriteFile("v135/react@18.2.0/es2022/jsx-runtime.js", bytes.NewBufferString("export {}"))
+	fs.WriteFile("v135/react-dom@18.2.0/es2022/react-dom.mjs", bytes.NewBufferString("export {}"))
+	remover := fs.(FileSystemRemover)
+	names, err := remover.ReadDir("v135")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "react-dom@18.2.0/,react@18.2.0/" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+	removed, err := remover.RemoveAll("v135/react@18.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 removed files, got %d", removed)
+	}
+	if _, err = fs.Stat("v135/react@18.2.0/es2022/react.mjs"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err = fs.Stat("v135/react-dom@18.2.0/es2022/react-dom.mjs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = OpenFS("s3:esm?endpoint=" + server.URL + "&accessKeyId=test-key&secretAccessKey=test-secret&partSize=1MB"); err == nil {
+		t.Fatal("should fail with the part size less than 5MB")
+	}
+}
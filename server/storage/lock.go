@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+// Locker is a lock service shared by the server replicas, the locks are identified by the
+// `key` and owned by the `owner`, and they expire after the `ttl` unless refreshed.
+type Locker interface {
+	// Lock acquires the lock, returns false if the lock is held by another owner.
+	Lock(key string, owner string, ttl time.Duration) (bool, error)
+	// Refresh extends the ttl of the lock, returns false if the lock is not held by the owner.
+	Refresh(key string, owner string, ttl time.Duration) (bool, error)
+	// Unlock releases the lock if it's held by the owner.
+	Unlock(key string, owner string) error
+	Close() error
+}
+
+type LockerDriver interface {
+	Open(addr string, options url.Values) (locker Locker, err error)
+}
+
+var lockerDrivers sync.Map
+
+func OpenLocker(lockerUrl string) (Locker, error) {
+	name, addr := utils.SplitByFirstByte(lockerUrl, ':')
+	driver, ok := lockerDrivers.Load(name)
+	if ok {
+		root, options, err := parseConfigUrl(addr)
+		if err == nil {
+			return driver.(LockerDriver).Open(root, options)
+		}
+	}
+	return nil, fmt.Errorf("unregistered locker '%s'", name)
+}
+
+func RegisterLocker(name string, driver LockerDriver) error {
+	_, ok := lockerDrivers.Load(name)
+	if ok {
+		return fmt.Errorf("locker driver '%s' has been registered", name)
+	}
+
+	lockerDrivers.Store(name, driver)
+	return nil
+}
+
+// mLocker is the in-memory locker for a single server and the tests.
+type mLocker struct {
+	lock  sync.Mutex
+	locks map[string]mValue
+}
+
+func (ml *mLocker) Lock(key string, owner string, ttl time.Duration) (bool, error) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	if v, ok := ml.locks[key]; ok && !v.isExpired() && string(v.data) != owner {
+		return false, nil
+	}
+	ml.locks[key] = mValue{[]byte(owner), time.Now().Add(ttl).UnixNano()}
+	return true, nil
+}
+
+func (ml *mLocker) Refresh(key string, owner string, ttl time.Duration) (bool, error) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	if v, ok := ml.locks[key]; !ok || v.isExpired() || string(v.data) != owner {
+		return false, nil
+	}
+	ml.locks[key] = mValue{[]byte(owner), time.Now().Add(ttl).UnixNano()}
+	return true, nil
+}
+
+func (ml *mLocker) Unlock(key string, owner string) error {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	if v, ok := ml.locks[key]; ok && string(v.data) == owner {
+		delete(ml.locks, key)
+	}
+	return nil
+}
+
+func (ml *mLocker) Close() error {
+	return nil
+}
+
+type mLockerDriver struct{}
+
+func (driver *mLockerDriver) Open(addr string, options url.Values) (Locker, error) {
+	return &mLocker{locks: map[string]mValue{}}, nil
+}
+
+func init() {
+	RegisterLocker("memory", &mLockerDriver{})
+}
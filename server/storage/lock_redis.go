@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisUnlockScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	redisRefreshScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// redisLockerDriver is the driver of the locker backed by Redis, the locks are the keys set with
+// `SET key owner NX PX ttl` and released by the owner only.
+//
+//	redis:127.0.0.1:6379?password=xxx&db=0&prefix=esm:lock:
+//
+// The password falls back to the `REDIS_PASSWORD` environment variable.
+type redisLockerDriver struct{}
+
+func (driver *redisLockerDriver) Open(addr string, options url.Values) (Locker, error) {
+	if addr == "" {
+		addr = "127.0.0.1:6379"
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("redis: invalid address '%s'", addr)
+	}
+	r := &redisLocker{
+		addr:     addr,
+		username: options.Get("username"),
+		password: options.Get("password"),
+		prefix:   "esm:lock:",
+		timeout:  5 * time.Second,
+	}
+	if r.password == "" {
+		r.password = os.Getenv("REDIS_PASSWORD")
+	}
+	if options.Has("prefix") {
+		r.prefix = options.Get("prefix")
+	}
+	if v := options.Get("db"); v != "" {
+		db, err := strconv.Atoi(v)
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("redis: invalid db '%s'", v)
+		}
+		r.db = db
+	}
+	timeout, err := parseDurationValue(options.Get("timeout"), r.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("redis: invalid timeout '%s'", options.Get("timeout"))
+	}
+	r.timeout = timeout
+	// check the connection
+	if _, err = r.do("PING"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type redisLocker struct {
+	addr     string
+	username string
+	password string
+	db       int
+	prefix   string
+	timeout  time.Duration
+	lock     sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+func (r *redisLocker) Lock(key string, owner string, ttl time.Duration) (bool, error) {
+	ret, err := r.do("SET", r.prefix+key, owner, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return ret == "OK", nil
+}
+
+func (r *redisLocker) Refresh(key string, owner string, ttl time.Duration) (bool, error) {
+	ret, err := r.do("EVAL", redisRefreshScript, "1", r.prefix+key, owner, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return ret == int64(1), nil
+}
+
+func (r *redisLocker) Unlock(key string, owner string) error {
+	_, err := r.do("EVAL", redisUnlockScript, "1", r.prefix+key, owner)
+	return err
+}
+
+func (r *redisLocker) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.conn != nil {
+		err := r.conn.Close()
+		r.conn = nil
+		return err
+	}
+	return nil
+}
+
+// do sends the command and reads the reply, the connection is re-dialed after an I/O error.
+func (r *redisLocker) do(args ...string) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.conn == nil {
+		if err := r.dial(); err != nil {
+			return nil, err
+		}
+	}
+	ret, err := r.roundTrip(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			r.conn.Close()
+			r.conn = nil
+		}
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *redisLocker) dial() error {
+	conn, err := net.DialTimeout("tcp", r.addr, r.timeout)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err = r.roundTrip(args...); err != nil {
+			conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	if r.db > 0 {
+		if _, err = r.roundTrip("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisLocker) roundTrip(args ...string) (interface{}, error) {
+	r.conn.SetDeadline(time.Now().Add(r.timeout))
+	buf := strings.Builder{}
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(r.conn, buf.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(r.reader)
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readRedisReply reads a reply of the RESP protocol, the simple strings and the bulk strings
+// are returned as strings, the integers as int64, and the nil replies as nil.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: invalid reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply '%s'", line)
+}
+
+func init() {
+	RegisterLocker("redis", &redisLockerDriver{})
+}
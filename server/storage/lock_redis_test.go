@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedisLocker(t *testing.T) {
+	var mu sync.Mutex
+	keys := map[string]string{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				authed := false
+				for {
+					reply, err := readRedisReply(r)
+					if err != nil {
+						return
+					}
+					args := []string{}
+					for _, v := range reply.([]interface{}) {
+						args = append(args, v.(string))
+					}
+					mu.Lock()
+					switch {
+					case args[0] == "AUTH":
+						authed = args[1] == "secret"
+						fmt.Fprint(conn, "+OK\r\n")
+					case !authed:
+						fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+					case args[0] == "PING":
+						fmt.Fprint(conn, "+PONG\r\n")
+					case args[0] == "SELECT":
+						fmt.Fprint(conn, "+OK\r\n")
+					case args[0] == "SET":
+						if _, ok := keys[args[1]]; ok {
+							fmt.Fprint(conn, "$-1\r\n")
+						} else {
+							keys[args[1]] = args[2]
+							fmt.Fprint(conn, "+OK\r\n")
+						}
+					case args[0] == "EVAL":
+						n := 0
+						if keys[args[3]] == args[4] {
+							n = 1
+							if strings.Contains(args[1], `"del"`) {
+								delete(keys, args[3])
+							}
+						}
+						fmt.Fprintf(conn, ":%d\r\n", n)
+					default:
+						fmt.Fprint(conn, "-ERR unknown command\r\n")
+					}
+					mu.Unlock()
+				}
+			}(conn)
+		}
+	}()
+
+	if _, err = OpenLocker("redis:" + ln.Addr().String() + "?password=wrong"); err == nil {
+		t.Fatal("should fail with the wrong password")
+	}
+	locker, err := OpenLocker("redis:" + ln.Addr().String() + "?password=secret&db=1&prefix=test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Close()
+
+	ok, err := locker.Lock("build:foo", "owner-1", 30*time.Second)
+	if err != nil || !ok {
+		t.Fatalf("should acquire the lock: %v", err)
+	}
+	if keys["test:build:foo"] != "owner-1" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if ok, _ = locker.Lock("build:foo", "owner-2", 30*time.Second); ok {
+		t.Fatal("the lock is held by owner-1")
+	}
+	if ok, _ = locker.Refresh("build:foo", "owner-2", 30*time.Second); ok {
+		t.Fatal("owner-2 should not refresh the lock")
+	}
+	if ok, _ = locker.Refresh("build:foo", "owner-1", 30*time.Second); !ok {
+		t.Fatal("owner-1 should refresh the lock")
+	}
+	// the lock is released by the owner only
+	locker.Unlock("build:foo", "owner-2")
+	if keys["test:build:foo"] != "owner-1" {
+		t.Fatal("owner-2 should not release the lock")
+	}
+	locker.Unlock("build:foo", "owner-1")
+	if ok, _ = locker.Lock("build:foo", "owner-2", 30*time.Second); !ok {
+		t.Fatal("owner-2 should acquire the released lock")
+	}
+
+	// reconnect after the connection is closed
+	locker.(*redisLocker).conn.Close()
+	if _, err = locker.Lock("build:bar", "owner-1", time.Second); err == nil {
+		t.Fatal("should fail with the closed connection")
+	}
+	if ok, err = locker.Lock("build:bar", "owner-1", time.Second); err != nil || !ok {
+		t.Fatalf("should reconnect: %v", err)
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("+OK\r\n:42\r\n$5\r\nhello\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n-ERR oops\r\n"))
+	for _, expected := range []interface{}{"OK", int64(42), "hello", nil} {
+		v, err := readRedisReply(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != expected {
+			t.Fatalf("expected %v, got %v", expected, v)
+		}
+	}
+	v, err := readRedisReply(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := v.([]interface{}); len(a) != 2 || a[0] != "a" || a[1] != int64(1) {
+		t.Fatalf("unexpected array reply: %v", v)
+	}
+	if _, err = readRedisReply(r); err == nil || err.Error() != "redis: ERR oops" {
+		t.Fatalf("expected the error reply, got %v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type devFS struct {
@@ -82,6 +83,90 @@ func (s *stringSet) Values() []string {
 	return a
 }
 
+// A LRU cache for string values with hit/miss statistics
+type lruCache struct {
+	hits     uint64 // keep 64-bit aligned for atomic operations
+	misses   uint64
+	lock     sync.Mutex
+	capacity int
+	list     *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value string
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		list:     list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+// Get returns the value of the given key and marks the key as recently used.
+func (c *lruCache) Get(key string) (string, bool) {
+	c.lock.Lock()
+	var value string
+	el, ok := c.items[key]
+	if ok {
+		c.list.MoveToFront(el)
+		value = el.Value.(*lruEntry).value
+	}
+	c.lock.Unlock()
+
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return "", false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return value, true
+}
+
+// Set sets the value of the given key, the least recently used key will be evicted if the cache is full.
+func (c *lruCache) Set(key string, value string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry).value = value
+		c.list.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.list.PushFront(&lruEntry{key, value})
+	if c.list.Len() > c.capacity {
+		el := c.list.Back()
+		c.list.Remove(el)
+		delete(c.items, el.Value.(*lruEntry).key)
+	}
+}
+
+// Len returns the number of the cached keys.
+func (c *lruCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.list.Len()
+}
+
+// Stats returns the hit/miss statistics of the cache.
+func (c *lruCache) Stats() map[string]interface{} {
+	hits := atomic.LoadUint64(&c.hits)
+	misses := atomic.LoadUint64(&c.misses)
+	hitRate := 0.0
+	if total := hits + misses; total > 0 {
+		hitRate = float64(hits) / float64(total)
+	}
+	return map[string]interface{}{
+		"size":    c.Len(),
+		"hits":    hits,
+		"misses":  misses,
+		"hitRate": hitRate,
+	}
+}
+
 type StringOrMap struct {
 	Str string
 	Map map[string]interface{}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	if v, ok := c.Get("a"); !ok || v != "1" {
+		t.Fatalf("invalid value('%s') of 'a', should be '1'", v)
+	}
+	// 'b' is the least recently used key
+	c.Set("c", "3")
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("'b' should be evicted")
+	}
+	if c.Len() != 2 {
+		t.Fatalf("invalid cache size(%d), should be 2", c.Len())
+	}
+	stats := c.Stats()
+	if stats["hits"] != uint64(1) || stats["misses"] != uint64(1) {
+		t.Fatalf("invalid stats %v", stats)
+	}
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the size of the range requests to download a large tarball
+	tarballChunkSize = 4 * 1024 * 1024
+	// the max attempts to fetch a tarball (or a chunk of it)
+	tarballMaxAttempts = 5
+)
+
+var errTarballTooLarge = errors.New("tarball too large")
+
+// fetchPackageTarball downloads the tarball of the package to the work directory and verifies
+// its integrity, returns the path of the tarball file.
+func fetchPackageTarball(pkg Pkg) (tarballPath string, err error) {
+	info, err := fetchPackageInfo(pkg.Name, pkg.Version)
+	if err != nil {
+		return
+	}
+	if info.Dist.Tarball == "" {
+		return "", fmt.Errorf("npm: tarball of %s not found", pkg.VersionName())
+	}
+	tarballPath = path.Join(cfg.WorkDir, "npm", ".tarballs", pkg.Name+"@"+info.Version+".tgz")
+	integrity := getDistIntegrity(info.Dist)
+	// the concurrent installs of the package share the `.part` files of the download
+	lock := getFetchLock("tarball:" + tarballPath)
+	lock.Lock()
+	defer lock.Unlock()
+	if fileExists(tarballPath) && verifyTarballIntegrity(tarballPath, integrity) == nil {
+		return
+	}
+	// the tarball may be downloaded by another server instance that shares the storage
+	savePath := path.Join("tarballs", pkg.Name+"@"+info.Version+".tgz")
+	if r, e := fs.OpenFile(savePath); e == nil {
+		e = writeTarballFile(tarballPath, r)
+		r.Close()
+		if e == nil && verifyTarballIntegrity(tarballPath, integrity) == nil {
+			return
+		}
+	}
+	client := httpClient
+	header := http.Header{}
+	// only send the credentials to the host of the registry
+	registry := getNpmRegistry(pkg.Name)
+	if u, e := url.Parse(registry.Registry); e == nil && strings.HasPrefix(info.Dist.Tarball, u.Scheme+"://"+u.Host+"/") {
+		setNpmRegistryAuth(header, registry)
+		// the timeout of the registry is for the metadata requests
+		registry.Timeout = 0
+		client, err = getNpmRegistryClient(registry)
+		if err != nil {
+			return
+		}
+	}
+	err = downloadTarball(client, info.Dist.Tarball, tarballPath, header)
+	if err != nil {
+		return
+	}
+	err = verifyTarballIntegrity(tarballPath, integrity)
+	if err != nil {
+		os.Remove(tarballPath)
+		return
+	}
+	if f, e := os.Open(tarballPath); e == nil {
+		_, e = fs.WriteFile(savePath, f)
+		f.Close()
+		if e != nil {
+			log.Component("npm").Warnf("storage: save tarball %s: %v", savePath, e)
+		}
+	}
+	return
+}
+
+func writeTarballFile(filename string, r io.Reader) (err error) {
+	ensureDir(path.Dir(filename))
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		os.Remove(filename)
+	}
+	return
+}
+
+// downloadTarball downloads the tarball to the savePath. The tarball is fetched in chunks with
+// parallel range requests if the server supports it, each chunk is saved in a `.part` file, so
+// a failed chunk resumes from the last received byte, even after the server restarts.
+func downloadTarball(client *http.Client, url string, savePath string, header http.Header) (err error) {
+	size, ranged, err := probeTarball(client, url, header)
+	if err != nil {
+		return
+	}
+	if size > cfg.NpmTarballMaxSize {
+		return fmt.Errorf("%w: %s is %d bytes", errTarballTooLarge, url, size)
+	}
+	ensureDir(path.Dir(savePath))
+
+	chunks := 1
+	if ranged && size > tarballChunkSize {
+		chunks = int((size + tarballChunkSize - 1) / tarballChunkSize)
+	}
+	concurrency := cfg.NpmTarballConcurrency
+	if concurrency > chunks {
+		concurrency = chunks
+	}
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	queue := make(chan int, chunks)
+	for i := 0; i < chunks; i++ {
+		queue <- i
+	}
+	close(queue)
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				start := int64(i) * tarballChunkSize
+				end := start + tarballChunkSize - 1
+				if chunks == 1 {
+					end = size - 1
+				} else if end >= size {
+					end = size - 1
+				}
+				e := fetchTarballChunk(client, url, header, fmt.Sprintf("%s.part%d", savePath, i), start, end, ranged)
+				if e != nil {
+					errOnce.Do(func() { err = e })
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		return
+	}
+
+	// join the chunks
+	tmpPath := savePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return
+	}
+	for i := 0; i < chunks; i++ {
+		var part *os.File
+		part, err = os.Open(fmt.Sprintf("%s.part%d", savePath, i))
+		if err == nil {
+			_, err = io.Copy(f, part)
+			part.Close()
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+	for i := 0; i < chunks; i++ {
+		os.Remove(fmt.Sprintf("%s.part%d", savePath, i))
+	}
+	return os.Rename(tmpPath, savePath)
+}
+
+// probeTarball requests the first byte of the tarball to check the size and whether the server
+// supports range requests.
+func probeTarball(client *http.Client, url string, header http.Header) (size int64, ranged bool, err error) {
+	for attempt := 0; attempt < tarballMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(tarballBackoff(attempt))
+		}
+		var req *http.Request
+		req, err = http.NewRequest("GET", url, nil)
+		if err != nil {
+			return
+		}
+		copyHeader(req.Header, header)
+		req.Header.Set("Range", "bytes=0-0")
+		var res *http.Response
+		res, err = client.Do(req)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		switch {
+		case res.StatusCode == 206:
+			// Content-Range: bytes 0-0/1234
+			_, total, _ := strings.Cut(res.Header.Get("Content-Range"), "/")
+			size, err = strconv.ParseInt(total, 10, 64)
+			if err == nil {
+				return size, true, nil
+			}
+			// the total size is unknown
+			return -1, false, nil
+		case res.StatusCode == 200:
+			return res.ContentLength, false, nil
+		case res.StatusCode >= 500 || res.StatusCode == 429:
+			err = fmt.Errorf("fetch %s: %s", url, res.Status)
+		default:
+			return 0, false, fmt.Errorf("fetch %s: %s", url, res.Status)
+		}
+	}
+	return
+}
+
+// fetchTarballChunk fetches the bytes of the `start-end` range to the partPath, the request is
+// retried with backoff and resumes from the size of the part file. The whole tarball is fetched
+// if the server doesn't support range requests.
+func fetchTarballChunk(client *http.Client, url string, header http.Header, partPath string, start int64, end int64, ranged bool) (err error) {
+	for attempt := 0; attempt < tarballMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(tarballBackoff(attempt))
+		}
+		var offset int64
+		if ranged {
+			if fi, e := os.Stat(partPath); e == nil {
+				offset = fi.Size()
+			}
+			if offset == end-start+1 {
+				return nil
+			}
+			// the part file is broken
+			if offset > end-start+1 {
+				os.Remove(partPath)
+				offset = 0
+			}
+		}
+		var done bool
+		done, err = fetchTarballRange(client, url, header, partPath, start+offset, end, ranged)
+		if done {
+			return
+		}
+	}
+	return
+}
+
+func fetchTarballRange(client *http.Client, url string, header http.Header, partPath string, start int64, end int64, ranged bool) (done bool, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return true, err
+	}
+	copyHeader(req.Header, header)
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if ranged {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if (ranged && res.StatusCode != 206) || (!ranged && res.StatusCode != 200) {
+		err = fmt.Errorf("fetch %s: %s", url, res.Status)
+		return res.StatusCode < 500 && res.StatusCode != 429, err
+	}
+	f, err := os.OpenFile(partPath, flag, 0644)
+	if err != nil {
+		return true, err
+	}
+	defer f.Close()
+	// the server may not send the `Content-Length` header without range requests
+	n, err := io.Copy(f, io.LimitReader(res.Body, cfg.NpmTarballMaxSize+1))
+	if err != nil {
+		return false, err
+	}
+	if !ranged && n > cfg.NpmTarballMaxSize {
+		return true, fmt.Errorf("%w: %s", errTarballTooLarge, url)
+	}
+	return true, nil
+}
+
+// tarballBackoff returns the delay before the next attempt: 500ms, 1s, 2s, 4s...
+func tarballBackoff(attempt int) time.Duration {
+	return time.Duration(250<<attempt) * time.Millisecond
+}
+
+func copyHeader(dst http.Header, src http.Header) {
+	for key, values := range src {
+		dst[key] = values
+	}
+}
+
+// verifyTarballIntegrity checks the tarball with the subresource integrity, e.g. `sha512-...`.
+func verifyTarballIntegrity(filename string, integrity string) (err error) {
+	if integrity == "" {
+		return nil
+	}
+	algorithm, digest, _ := strings.Cut(integrity, "-")
+	var h hash.Hash
+	switch algorithm {
+	case "sha512":
+		h = sha512.New()
+	case "sha1":
+		h = sha1.New()
+	default:
+		// unsupported algorithm
+		return nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return
+	}
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != digest {
+		return fmt.Errorf("integrity of %s mismatched", path.Base(filename))
+	}
+	return nil
+}
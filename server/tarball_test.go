@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestDownloadTarball(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{NpmTarballMaxSize: 16 * 1024 * 1024, NpmTarballConcurrency: 2}
+
+	data := make([]byte, tarballChunkSize*2+1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	sum := sha512.Sum512(data)
+	integrity := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	var flakyRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flaky.tgz" {
+			atomic.AddInt32(&flakyRequests, 1)
+		}
+		if r.URL.Path == "/flaky.tgz" && r.Header.Get("Range") == "bytes=0-"+strconv.Itoa(tarballChunkSize-1) {
+			// drop the connection after sending a part of the first chunk
+			w.Header().Set("Content-Range", "bytes 0-"+strconv.Itoa(tarballChunkSize-1)+"/"+strconv.Itoa(len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(tarballChunkSize))
+			w.WriteHeader(206)
+			w.Write(data[:1024])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		if r.URL.Path == "/no-range.tgz" {
+			w.Write(data)
+			return
+		}
+		http.ServeContent(w, r, "pkg.tgz", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	for _, name := range []string{"pkg.tgz", "flaky.tgz", "no-range.tgz"} {
+		savePath := path.Join(dir, name)
+		err := downloadTarball(httpClient, ts.URL+"/"+name, savePath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = verifyTarballIntegrity(savePath, integrity); err != nil {
+			t.Fatal(name, err)
+		}
+		if name == "flaky.tgz" && atomic.LoadInt32(&flakyRequests) < 5 {
+			t.Fatal("the broken chunk should be retried")
+		}
+		if fileExists(savePath + ".part0") {
+			t.Fatal("the part files should be removed")
+		}
+	}
+
+	// resume the chunk from the part file
+	savePath := path.Join(dir, "resume.tgz")
+	os.WriteFile(savePath+".part0", data[:100], 0644)
+	if err := downloadTarball(httpClient, ts.URL+"/resume.tgz", savePath, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyTarballIntegrity(savePath, integrity); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.NpmTarballMaxSize = 1024
+	for _, name := range []string{"large.tgz", "no-range.tgz"} {
+		err := downloadTarball(httpClient, ts.URL+"/"+name, path.Join(dir, "large", name), nil)
+		if !errors.Is(err, errTarballTooLarge) {
+			t.Fatalf("%s: should fail with errTarballTooLarge, got %v", name, err)
+		}
+	}
+
+	if err := verifyTarballIntegrity(path.Join(dir, "pkg.tgz"), "sha512-invalid"); err == nil {
+		t.Fatal("should fail on the mismatched integrity")
+	}
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+// the kinds of the spans of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// the max number of the spans that are exported in a batch
+const traceBatchSize = 512
+
+// traceSpan is a span of the OpenTelemetry traces. The methods of a nil span are no-op, so the
+// callers don't need to check whether the tracing is enabled. The spans of the traces that are
+// not sampled are still created to propagate the trace context, but they are not exported.
+type traceSpan struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []traceAttr
+	err      string
+}
+
+type traceAttr struct {
+	key   string
+	value interface{}
+}
+
+// startTrace starts the root span of the trace, the trace context is continued from the
+// `traceparent` header (https://www.w3.org/TR/trace-context/) if it's valid. It returns nil if
+// the tracing is not enabled.
+func startTrace(name string, traceparent string) *traceSpan {
+	if tracer == nil {
+		return nil
+	}
+	span := &traceSpan{name: name, kind: spanKindInternal, start: time.Now()}
+	if traceID, parentID, sampled, ok := parseTraceparent(traceparent); ok {
+		span.traceID = traceID
+		span.parentID = parentID
+		span.sampled = sampled
+	} else {
+		rand.Read(span.traceID[:])
+		span.sampled = tracer.sampleRate >= 1 || mrand.Float64() < tracer.sampleRate
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// startSpan starts a child span of the parent, it returns nil if the parent is nil.
+func startSpan(parent *traceSpan, name string) *traceSpan {
+	if parent == nil {
+		return nil
+	}
+	span := &traceSpan{
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		sampled:  parent.sampled,
+		name:     name,
+		kind:     spanKindInternal,
+		start:    time.Now(),
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// SetAttr sets an attribute of the span, the value is a string, an integer, a float or a bool.
+func (s *traceSpan) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, traceAttr{key, value})
+}
+
+// End ends the span with the error, and exports it if the trace is sampled.
+func (s *traceSpan) End(err error) {
+	if s == nil || !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = redact(err.Error())
+	}
+	if s.sampled && tracer != nil {
+		tracer.add(s)
+	}
+}
+
+// Traceparent returns the `traceparent` header of the span to propagate the trace context.
+func (s *traceSpan) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+// parseTraceparent parses the `traceparent` header in the format of
+// "{version}-{trace-id}-{parent-id}-{trace-flags}".
+func parseTraceparent(v string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	a := strings.Split(strings.TrimSpace(v), "-")
+	if len(a) < 4 || len(a[0]) != 2 || a[0] == "ff" || len(a[1]) != 32 || len(a[2]) != 16 || len(a[3]) != 2 {
+		return
+	}
+	// the future versions may append the fields, but the version 00 has 4 fields only
+	if a[0] == "00" && len(a) != 4 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(a[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(a[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+	flags, err := hex.DecodeString(a[3])
+	if err != nil {
+		return
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+type traceSpanKey struct{}
+
+// getRequestSpan returns the span of the request, or nil if the tracing is not enabled.
+func getRequestSpan(r *http.Request) *traceSpan {
+	span, _ := r.Context().Value(traceSpanKey{}).(*traceSpan)
+	return span
+}
+
+// traceRequests starts a span for each request, the span is stored in the context of the request.
+func traceRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		pathname := strings.TrimPrefix(r.URL.Path, cfg.CdnBasePath)
+		if !strings.HasPrefix(pathname, "/") {
+			pathname = "/" + pathname
+		}
+		span := startTrace(r.Method+" "+getMetricsRoute(pathname), r.Header.Get("traceparent"))
+		span.kind = spanKindServer
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", redact(r.URL.Path))
+		span.SetAttr("user_agent.original", anonymizeUserAgent(r.UserAgent()))
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				status = 200
+			}
+			span.SetAttr("http.response.status_code", status)
+			if status >= 500 {
+				span.End(fmt.Errorf("%d %s", status, http.StatusText(status)))
+			} else {
+				span.End(nil)
+			}
+		}()
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), traceSpanKey{}, span)))
+	})
+}
+
+// traceExporter exports the spans to the OTLP/HTTP endpoint in batches.
+type traceExporter struct {
+	lock        sync.RWMutex
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	sampleRate  float64
+	queue       chan *traceSpan
+	done        chan struct{}
+	closed      bool
+}
+
+// the exporter of the `tracing` config, it's nil if the tracing is not enabled
+var tracer *traceExporter
+
+// initTracing starts the exporter of the `tracing` config.
+func initTracing(c config.Tracing) {
+	if c.Endpoint == "" {
+		return
+	}
+	tracer = &traceExporter{
+		endpoint:    c.Endpoint,
+		headers:     c.Headers,
+		serviceName: c.ServiceName,
+		sampleRate:  c.SampleRate,
+		queue:       make(chan *traceSpan, 4*traceBatchSize),
+		done:        make(chan struct{}),
+	}
+	go tracer.run()
+}
+
+// closeTracing exports the pending spans, at most 5 seconds.
+func closeTracing() {
+	e := tracer
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.lock.Unlock()
+	select {
+	case <-e.done:
+	case <-time.After(5 * time.Second):
+		log.Component("tracing").Warnf("tracing: %d spans are not exported", len(e.queue))
+	}
+}
+
+func (e *traceExporter) add(span *traceSpan) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- span:
+	default:
+		// drop the span instead of blocking the requests if the collector is slow
+	}
+}
+
+func (e *traceExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	batch := make([]*traceSpan, 0, traceBatchSize)
+	for {
+		select {
+		case span, ok := <-e.queue:
+			if !ok {
+				e.export(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= traceBatchSize {
+				e.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (e *traceExporter) export(spans []*traceSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(e.encode(spans)))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	res, err := withClientTimeout(httpClient, 10*time.Second).Do(req)
+	if err != nil {
+		log.Component("tracing").Warnf("tracing: failed to export %d spans: %v", len(spans), err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		log.Component("tracing").Warnf("tracing: failed to export %d spans: the collector responds %d", len(spans), res.StatusCode)
+	}
+}
+
+// encode encodes the spans in the OTLP/JSON format, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+func (e *traceExporter) encode(spans []*traceSpan) []byte {
+	list := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        encodeTraceAttrs(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.err}
+		}
+		list[i] = span
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": encodeTraceAttrs([]traceAttr{{"service.name", e.serviceName}, {"service.version", strconv.Itoa(VERSION)}}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "esm.sh"},
+						"spans": list,
+					},
+				},
+			},
+		},
+	})
+	return data
+}
+
+func encodeTraceAttrs(attrs []traceAttr) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]interface{}
+		switch v := a.value.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		list = append(list, map[string]interface{}{"key": a.key, "value": value})
+	}
+	return list
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parentID, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || !sampled {
+		t.Fatal("the traceparent should be valid and sampled")
+	}
+	if got := (&traceSpan{traceID: traceID, spanID: parentID}).Traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00" {
+		t.Fatalf("unexpected traceparent %q", got)
+	}
+	if _, _, sampled, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); !ok || sampled {
+		t.Fatal("the traceparent should be valid and not sampled")
+	}
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if _, _, _, ok := parseTraceparent(v); ok {
+			t.Fatalf("the traceparent %q should be invalid", v)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	defer func(prevCfg *config.Config, prevTracer *traceExporter) {
+		cfg = prevCfg
+		tracer = prevTracer
+	}(cfg, tracer)
+	cfg = &config.Config{CdnBasePath: ""}
+
+	posted := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer collector-token" {
+			w.WriteHeader(401)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		posted <- body
+	}))
+	defer collector.Close()
+
+	initTracing(config.Tracing{
+		Endpoint:    collector.URL + "/v1/traces",
+		Headers:     map[string]string{"Authorization": "Bearer collector-token"},
+		ServiceName: "esm.sh",
+		SampleRate:  1,
+	})
+
+	handler := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := startSpan(getRequestSpan(r), "resolve package")
+		span.SetAttr("esm.package", "react@18.3.1")
+		span.End(nil)
+		w.WriteHeader(404)
+	}))
+	req := httptest.NewRequest("GET", "/react@18", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the trace of the request that is not sampled upstream is not exported
+	req = httptest.NewRequest("GET", "/vue@3", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	closeTracing()
+
+	var body struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string `json:"key"`
+					Value struct {
+						StringValue string `json:"stringValue"`
+					} `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceId      string `json:"traceId"`
+					SpanId       string `json:"spanId"`
+					ParentSpanId string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Kind         int    `json:"kind"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	select {
+	case data := <-posted:
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("the spans are not exported")
+	}
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected resource spans: %+v", body)
+	}
+	if attr := body.ResourceSpans[0].Resource.Attributes[0]; attr.Key != "service.name" || attr.Value.StringValue != "esm.sh" {
+		t.Fatalf("unexpected resource attribute: %+v", attr)
+	}
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if server.Name != "GET module" || server.Kind != spanKindServer || server.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanId != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected server span: %+v", server)
+	}
+	if child.Name != "resolve package" || child.TraceId != server.TraceId || child.ParentSpanId != server.SpanId {
+		t.Fatalf("unexpected child span: %+v", child)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mssola/useragent"
+)
+
+// UAParser parses the browser name and version from the `User-Agent` header.
+type UAParser interface {
+	Parse(ua string) (name string, version string)
+}
+
+var uaParsers sync.Map
+
+// the default parser chain, the later parsers are used when the former ones fail to
+// recognize a browser. can be overridden by the `uaParsers` config.
+var defaultUAParsers = []string{"useragent", "tokens"}
+
+func init() {
+	RegisterUAParser("useragent", &mssolaUAParser{})
+	RegisterUAParser("tokens", &tokensUAParser{})
+}
+
+// RegisterUAParser registers a UA parser that can be used in the `uaParsers` config.
+func RegisterUAParser(name string, parser UAParser) error {
+	_, ok := uaParsers.Load(name)
+	if ok {
+		return fmt.Errorf("ua parser '%s' has been registered", name)
+	}
+
+	uaParsers.Store(name, parser)
+	return nil
+}
+
+// checkUAParsers checks the `uaParsers` config.
+func checkUAParsers(names []string) error {
+	for _, name := range names {
+		if _, ok := uaParsers.Load(name); !ok {
+			return fmt.Errorf("unknown ua parser '%s'", name)
+		}
+	}
+	return nil
+}
+
+// parseUA parses the UA by the parser chain, returns the result of the first parser
+// that recognizes a known browser, or the first non-empty result.
+func parseUA(ua string) (name string, version string) {
+	names := defaultUAParsers
+	if cfg != nil && len(cfg.UAParsers) > 0 {
+		names = cfg.UAParsers
+	}
+	for _, parserName := range names {
+		parser, ok := uaParsers.Load(parserName)
+		if !ok {
+			continue
+		}
+		n, v := parser.(UAParser).Parse(ua)
+		if n == "" || v == "" {
+			continue
+		}
+		if _, ok := browsers[strings.ToLower(n)]; ok {
+			return n, v
+		}
+		if name == "" {
+			name, version = n, v
+		}
+	}
+	return
+}
+
+// mssolaUAParser is the UA parser based on https://github.com/mssola/useragent
+type mssolaUAParser struct{}
+
+func (p *mssolaUAParser) Parse(ua string) (name string, version string) {
+	name, version = useragent.New(ua).Browser()
+	if name == "HeadlessChrome" {
+		return "Chrome", version
+	}
+	if name == "Safari" && strings.Contains(ua, "iPhone;") {
+		return "iOS", version
+	}
+	// Chrome and Firefox on iOS use the WebKit of the system
+	if strings.Contains(ua, "CriOS/") || strings.Contains(ua, "FxiOS/") {
+		if m := regexpIOSVersion.FindStringSubmatch(ua); m != nil {
+			return "iOS", m[1] + "." + m[2]
+		}
+	}
+	return
+}
+
+// tokensUAParser recognizes browsers by the product tokens of the UA, e.g. `Firefox/115.0`,
+// it's a fallback of the UAs that the other parsers don't understand.
+type tokensUAParser struct{}
+
+var uaProductTokens = []struct {
+	name   string
+	regexp *regexp.Regexp
+}{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/(\d+(?:\.\d+)?)`)},
+	{"Opera", regexp.MustCompile(`OPR/(\d+(?:\.\d+)?)`)},
+	{"Firefox", regexp.MustCompile(`Firefox/(\d+(?:\.\d+)?)`)},
+	{"Chrome", regexp.MustCompile(`Chrom(?:e|ium)/(\d+(?:\.\d+)?)`)},
+	{"Safari", regexp.MustCompile(`Version/(\d+(?:\.\d+)?).*Safari/`)},
+}
+
+var regexpIOSVersion = regexp.MustCompile(`(?:iPhone|iPad|iPod).+OS (\d+)_(\d+)`)
+
+func (p *tokensUAParser) Parse(ua string) (name string, version string) {
+	// all browsers on iOS use the WebKit of the system
+	if m := regexpIOSVersion.FindStringSubmatch(ua); m != nil {
+		return "iOS", m[1] + "." + m[2]
+	}
+	for _, token := range uaProductTokens {
+		if m := token.regexp.FindStringSubmatch(ua); m != nil {
+			return token.name, m[1]
+		}
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+type testUAParser struct{}
+
+func (p *testUAParser) Parse(ua string) (name string, version string) {
+	if ua == "TestBrowser" {
+		return "Chrome", "100"
+	}
+	return
+}
+
+func TestUAParserChain(t *testing.T) {
+	tests := []struct {
+		ua      string
+		name    string
+		version string
+	}{
+		{
+			ua:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0",
+			name:    "Edge",
+			version: "120.0.0.0",
+		},
+		{
+			ua:      "Mozilla/5.0 (iPhone; CPU iPhone OS 16_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/112.0.5615.46 Mobile/15E148 Safari/604.1",
+			name:    "iOS",
+			version: "16.4",
+		},
+		{
+			ua:      "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0",
+			name:    "Firefox",
+			version: "115.0",
+		},
+	}
+	for _, tt := range tests {
+		name, version := parseUA(tt.ua)
+		if name != tt.name || version != tt.version {
+			t.Fatalf("invalid browser info(%s %s) of '%s', should be '%s %s'", name, version, tt.ua, tt.name, tt.version)
+		}
+	}
+
+	name, version := (&tokensUAParser{}).Parse("Mozilla/5.0 (X11; Linux x86_64) Chromium/96.0.4664.45")
+	if name != "Chrome" || version != "96.0" {
+		t.Fatalf("invalid browser info(%s %s), should be 'Chrome 96.0'", name, version)
+	}
+
+	if RegisterUAParser("useragent", &testUAParser{}) == nil {
+		t.Fatal("ua parser 'useragent' should be registered")
+	}
+	RegisterUAParser("test", &testUAParser{})
+	if checkUAParsers([]string{"test", "useragent"}) != nil {
+		t.Fatal("ua parsers should be valid")
+	}
+	if checkUAParsers([]string{"uap-go"}) == nil {
+		t.Fatal("ua parser 'uap-go' should be invalid")
+	}
+
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{UAParsers: []string{"test", "useragent"}}
+	name, version = parseUA("TestBrowser")
+	if name != "Chrome" || version != "100" {
+		t.Fatalf("invalid browser info(%s %s), should be 'Chrome 100'", name, version)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/Masterminds/semver/v3"
+	esbuildConfig "github.com/ije/esbuild-internal/config"
 	"github.com/ije/esbuild-internal/js_ast"
 	"github.com/ije/esbuild-internal/js_parser"
 	"github.com/ije/esbuild-internal/logger"
@@ -29,7 +30,12 @@ var (
 	regexpBuildVersionPath = regexp.MustCompile(`^/v\d+(/|$)`)
 	regexpCliPath          = regexp.MustCompile(`^/v\d+\/?$`)
 	regexpLocPath          = regexp.MustCompile(`(\.js):\d+:\d+$`)
+	regexpVersionNumber    = regexp.MustCompile(`\d+(\.\d+)*`)
+	regexpTSVersion        = regexp.MustCompile(`^(\d+)(?:\.(\d+))?(?:\.\d+)?$`)
+	regexpTSVersionUA      = regexp.MustCompile(`\bTypeScript/(\d+(?:\.\d+){0,2})\b`)
 	regexpJSIdent          = regexp.MustCompile(`^[a-zA-Z_$][\w$]*$`)
+	regexpJSMemberPath     = regexp.MustCompile(`^[a-zA-Z_$][\w$]*(\.[a-zA-Z_$][\w$]*)*$`)
+	regexpJSONLiteral      = regexp.MustCompile(`^(true|false|null|undefined|-?\d+(\.\d+)?|"[^"]*")$`)
 	regexpGlobalIdent      = regexp.MustCompile(`__[a-zA-Z]+\$`)
 )
 
@@ -62,6 +68,16 @@ func isRemoteSpecifier(importPath string) bool {
 	return strings.HasPrefix(importPath, "https://") || strings.HasPrefix(importPath, "http://")
 }
 
+// toHeaderValue converts the text to a single line header value.
+func toHeaderValue(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s))
+}
+
 // isLocalSpecifier returns true if the import path is a local path.
 func isLocalSpecifier(importPath string) bool {
 	return strings.HasPrefix(importPath, "file://") || strings.HasPrefix(importPath, "/") || strings.HasPrefix(importPath, "./") || strings.HasPrefix(importPath, "../") || importPath == "." || importPath == ".."
@@ -232,6 +248,13 @@ func validateJS(filename string) (isESM bool, namedExports []string, err error)
 	if err != nil {
 		return
 	}
+	parserOptions := js_parser.Options{}
+	if isTSFile(filename) {
+		parserOptions = js_parser.OptionsFromConfig(&esbuildConfig.Options{
+			TS:  esbuildConfig.TSOptions{Parse: true},
+			JSX: esbuildConfig.JSXOptions{Parse: strings.HasSuffix(filename, ".tsx")},
+		})
+	}
 	log := logger.NewDeferLog(logger.DeferLogNoVerboseOrDebug, nil)
 	ast, pass := js_parser.Parse(log, logger.Source{
 		Index:          0,
@@ -239,7 +262,7 @@ func validateJS(filename string) (isESM bool, namedExports []string, err error)
 		PrettyPath:     "<stdin>",
 		Contents:       string(data),
 		IdentifierName: "stdin",
-	}, js_parser.Options{})
+	}, parserOptions)
 	if !pass {
 		err = errors.New("invalid syntax, require javascript/typescript")
 		return
@@ -254,6 +277,33 @@ func validateJS(filename string) (isESM bool, namedExports []string, err error)
 	return
 }
 
+// toGlobalName converts the package name to a global variable name, e.g. `@scope/foo-bar` -> `fooBar`.
+func toGlobalName(pkgName string) string {
+	name := path.Base(pkgName)
+	buf := strings.Builder{}
+	upper := false
+	for _, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == '$' || (c >= '0' && c <= '9' && buf.Len() > 0) {
+			if upper && c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			buf.WriteRune(c)
+			upper = false
+		} else {
+			upper = buf.Len() > 0
+		}
+	}
+	if buf.Len() == 0 {
+		return "_"
+	}
+	return buf.String()
+}
+
+// isTSFile returns true if the file is a typescript source file but not a declaration file.
+func isTSFile(filename string) bool {
+	return endsWith(filename, ".ts", ".mts", ".tsx") && !endsWith(filename, ".d.ts", ".d.mts")
+}
+
 var purgeDelay = 24 * time.Hour
 
 func toPurge(pkg string, destDir string) {
@@ -324,3 +374,15 @@ func concatBytes(a, b []byte) []byte {
 func jsDataUrl(code string) string {
 	return fmt.Sprintf("data:text/javascript;base64,%s", base64.StdEncoding.EncodeToString([]byte(code)))
 }
+
+// toTSVersion normalizes the typescript version to `major.minor`, e.g. `5` -> `5.0`, `5.3.2` -> `5.3`
+func toTSVersion(v string) (string, bool) {
+	m := regexpTSVersion.FindStringSubmatch(v)
+	if m == nil {
+		return "", false
+	}
+	if m[2] == "" {
+		return m[1] + ".0", true
+	}
+	return m[1] + "." + m[2], true
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/ije/gox/utils"
+)
+
+// getWorkerFactory returns the module that exports the factory function of the web worker. By
+// default the worker is created from a blob URL of the module code, so a code snippet can be
+// injected. With the "url" mode, the module worker is created from the URL of the module itself,
+// which is allowed by the strict CSPs without the `blob:` source, but no code can be injected.
+func getWorkerFactory(mode string, code []byte) string {
+	if mode == "url" {
+		return `export default function workerFactory(inject) { if (typeof inject === "string") throw new Error("workerFactory: the code injection is not supported with ?worker=url"); const url = new URL(import.meta.url); url.search = ""; return new Worker(url, { type: "module" })}`
+	}
+	return fmt.Sprintf(`export default function workerFactory(inject) { const blob = new Blob([%s, typeof inject === "string" ? "\n// inject\n" + inject : ""], { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module" })}`, utils.MustEncodeJSON(string(code)))
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWorkerFactory(t *testing.T) {
+	code := getWorkerFactory("", []byte(`self.postMessage("hello")`))
+	if !strings.Contains(code, `new Blob(["self.postMessage(\"hello\")"`) || !strings.Contains(code, "URL.createObjectURL(blob)") {
+		t.Fatalf("unexpected worker factory: %s", code)
+	}
+
+	code = getWorkerFactory("url", nil)
+	if strings.Contains(code, "Blob") || strings.Contains(code, "createObjectURL") {
+		t.Fatalf("the url mode should not use the blob url: %s", code)
+	}
+	if !strings.Contains(code, "new URL(import.meta.url)") || !strings.Contains(code, `url.search = ""`) {
+		t.Fatalf("unexpected worker factory: %s", code)
+	}
+}
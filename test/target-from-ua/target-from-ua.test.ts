@@ -22,3 +22,16 @@ Deno.test("build target from UA", async () => {
     "es2021",
   );
 });
+
+Deno.test("build target info from UA", async () => {
+  const ua =
+    "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.3 Safari/605.1.15";
+  const res = await fetch(
+    `http://localhost:8080/esma-target?json&ua=${encodeURIComponent(ua)}`,
+  );
+  const info = await res.json();
+  assertEquals(info.target, "es2021");
+  assertEquals(info.ua, ua);
+  assertEquals(info.engine, { name: "Safari", version: "16.3" });
+  assertEquals(Array.isArray(info.unsupportedFeatures), true);
+});
@@ -1,7 +1,18 @@
-import { assertEquals } from "https://deno.land/std@0.180.0/testing/asserts.ts";
+import { assert, assertEquals } from "https://deno.land/std@0.180.0/testing/asserts.ts";
 
 import * as tslib from "http://localhost:8080/tslib?exports=__await,__spread";
 
 Deno.test("tree-shaking", () => {
   assertEquals(Object.keys(tslib), ["__await", "__spread"]);
 });
+
+Deno.test("tree-shaking: the members not in the `?exports` are shaken out", async () => {
+  const code = await fetch(
+    "http://localhost:8080/lodash-es@4.17.21?exports=debounce&target=es2022",
+  ).then((res) => res.text());
+  const [, buildPath] = code.match(/export \* from "(\/.+)";/)!;
+  const bundle = await fetch(`http://localhost:8080${buildPath}`).then((res) => res.text());
+  assert(bundle.includes("maxWait"));
+  // a constant of the `_Hash` module of lodash that `debounce` does not depend on
+  assert(!bundle.includes("__lodash_hash_undefined__"));
+});